@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// startAdmin start the admin HTTP API when admin_listen is configured
+func (s *Forwarder) startAdmin() error {
+	if s.config.AdminListen == "" {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/status", s.authorize(capStatus, s.handleStatus))
+	mux.HandleFunc("GET /api/clients", s.authorize(capStatus, s.handleClients))
+	mux.HandleFunc("GET /api/schedule", s.authorize(capStatus, s.handleSchedule))
+	mux.HandleFunc("GET /api/ports", s.authorize(capStatus, s.handlePorts))
+	mux.HandleFunc("GET /api/values", s.authorize(capRead, s.handleValues))
+	mux.HandleFunc("GET /api/derived", s.authorize(capRead, s.handleDerivedValues))
+	mux.HandleFunc("GET /api/tags", s.authorize(capRead, s.handleTags))
+	mux.HandleFunc("PUT /api/tags/{slave_id}/{name}", s.authorize(capWrite, s.handleTagWrite))
+	mux.HandleFunc("GET /api/snapshot", s.authorize(capRead, s.handleSnapshotExport))
+	mux.HandleFunc("POST /api/snapshot", s.authorize(capWrite, s.handleSnapshotImport))
+	mux.HandleFunc("POST /api/cache/invalidate", s.authorize(capWrite, s.handleCacheInvalidate))
+	mux.HandleFunc("POST /api/slaves/{slave_id}/restart", s.authorize(capConfig, s.handleRestart))
+	mux.HandleFunc("GET /metrics", s.authorize(capStatus, s.handleMetrics))
+
+	l, err := net.Listen("tcp", s.config.AdminListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on admin address %s: %v", s.config.AdminListen, err)
+	}
+	s.admin = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          s.logger.stdLogger(LevelWarn),
+	}
+	if s.config.AdminClientCAFile != "" {
+		pool, err := loadCertPool(s.config.AdminClientCAFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		// client certificates are optional, tokens and users still work
+		s.admin.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	if s.config.AdminAuditFile != "" {
+		audit, err := openCapture(s.config.AdminAuditFile)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		s.adminAudit = audit
+	}
+	useTLS := s.config.AdminCertFile != ""
+	if useTLS {
+		s.logger.Infof("admin API listening on %s (TLS)", l.Addr())
+	} else {
+		s.logger.Infof("admin API listening on %s", l.Addr())
+	}
+	if s.config.AdminAuth == nil {
+		if addr, ok := l.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() {
+			s.logger.Warnf("admin API on %s requires no authentication, configure admin_auth", l.Addr())
+		}
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		var err error
+		if useTLS {
+			err = s.admin.ServeTLS(l, s.config.AdminCertFile, s.config.AdminKeyFile)
+		} else {
+			err = s.admin.Serve(l)
+		}
+		if s.adminAudit != nil {
+			s.adminAudit.close()
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("admin API stopped: %v", err)
+			s.fail(fmt.Errorf("admin API: %v", err))
+			s.cancel()
+		}
+	}()
+	return nil
+}
+
+// handleStatus GET /api/status, per slave connection status
+func (s *Forwarder) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.status())
+}
+
+// handleClients GET /api/clients, per upstream client traffic statistics
+func (s *Forwarder) handleClients(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.upstreams.snapshot())
+}
+
+// writeJSON write v as JSON response
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
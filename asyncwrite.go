@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// asyncWriter writes acknowledged upstream and waiting for the slave
+type asyncWriter struct {
+	queue        chan asyncWrite
+	audit        *captureFile  // result of every write, nil to only log failures
+	flushTimeout time.Duration // time limit for writing the queue on shutdown
+}
+
+// asyncWrite acknowledged write request
+type asyncWrite struct {
+	frame  mbserver.Framer
+	client string
+	acked  time.Time
+}
+
+// asyncWriteEntry result of one acknowledged write in the audit file
+type asyncWriteEntry struct {
+	Time     string  `json:"time"` // time of the acknowledgement
+	Slave    byte    `json:"slave"`
+	Client   string  `json:"client"`
+	Function uint8   `json:"function"`
+	Address  int     `json:"address"`
+	Quantity int     `json:"quantity"`
+	Data     string  `json:"data"`          // request data, hex
+	Delay    float64 `json:"delay_seconds"` // time from the acknowledgement to the result
+	Result   string  `json:"result"`        // "ok", the exception of the slave or "dropped"
+}
+
+// queueWrite acknowledge a write to a slave with async_writes and queue it
+// for the slave, false when the request is to be forwarded synchronously
+func (s *Forwarder) queueWrite(frame mbserver.Framer, slaveID byte, clientName string) ([]byte, *mbserver.Exception, bool) {
+	switch frame.GetFunction() {
+	case 5, 6, 15, 16:
+	default:
+		return nil, nil, false
+	}
+	s.clientsMux.RLock()
+	client := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	data := frame.GetData()
+	if client == nil || client.async == nil || len(data) < 4 {
+		return nil, nil, false
+	}
+
+	select {
+	case client.async.queue <- asyncWrite{frame: frame.Copy(), client: clientName, acked: s.clock.Now()}:
+	default:
+		s.logger.Warnf("async write queue of slave %d is full, write from %s rejected", slaveID, clientName)
+		return nil, &mbserver.SlaveDeviceBusy, true
+	}
+	// the response of every queued function echoes the address and the
+	// value or quantity
+	return append([]byte(nil), data[:4]...), &mbserver.Success, true
+}
+
+// startAsyncWriters start writing the queued writes of the slaves with
+// async_writes, one at a time in the order they were acknowledged
+func (s *Forwarder) startAsyncWriters() {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	for slaveID, client := range s.clients {
+		if client.async == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				select {
+				case w := <-client.async.queue:
+					s.asyncWrite(slaveID, client.async, w)
+				case <-s.ctx.Done():
+					s.flushAsyncWrites(slaveID, client.async)
+					return
+				}
+			}
+		}()
+	}
+}
+
+// flushAsyncWrites write the acknowledged writes still queued on shutdown
+// until flush_timeout has passed, the rest are dropped; a write in progress
+// always completes
+func (s *Forwarder) flushAsyncWrites(slaveID byte, a *asyncWriter) {
+	deadline := s.clock.Now().Add(a.flushTimeout)
+	dropped := 0
+	for {
+		select {
+		case w := <-a.queue:
+			if !s.clock.Now().Before(deadline) {
+				dropped++
+				s.asyncDrop(slaveID, a, w)
+				continue
+			}
+			s.asyncWrite(slaveID, a, w)
+		default:
+			if dropped > 0 {
+				s.logger.Warnf("%d acknowledged writes to slave %d dropped on shutdown, not written within %s", dropped, slaveID, a.flushTimeout)
+			}
+			return
+		}
+	}
+}
+
+// asyncWrite forward one acknowledged write to the slave and record the result
+func (s *Forwarder) asyncWrite(slaveID byte, a *asyncWriter, w asyncWrite) {
+	result := "ok"
+	function := w.frame.GetFunction()
+	// the request already passed the checks of handle when it was queued
+	if _, exception := s.handlers[function](w.frame); exception != &mbserver.Success {
+		result = exceptionName(*exception)
+	}
+
+	_, address, quantity, _ := pduRange(append([]byte{function}, w.frame.GetData()...))
+	if result != "ok" {
+		s.logger.Errorf("acknowledged write from %s failed on slave %d (function %d, addr %d, count %d): %s",
+			w.client, slaveID, function, address, quantity, result)
+	}
+	s.auditAsyncWrite(slaveID, a, w, result)
+}
+
+// asyncDrop record an acknowledged write that is never forwarded to the slave
+func (s *Forwarder) asyncDrop(slaveID byte, a *asyncWriter, w asyncWrite) {
+	function := w.frame.GetFunction()
+	_, address, quantity, _ := pduRange(append([]byte{function}, w.frame.GetData()...))
+	s.logger.Errorf("acknowledged write from %s dropped for slave %d (function %d, addr %d, count %d, data %x)",
+		w.client, slaveID, function, address, quantity, w.frame.GetData())
+	s.auditAsyncWrite(slaveID, a, w, "dropped")
+}
+
+// auditAsyncWrite append the result of an acknowledged write to audit_file
+func (s *Forwarder) auditAsyncWrite(slaveID byte, a *asyncWriter, w asyncWrite, result string) {
+	if a.audit == nil {
+		return
+	}
+	function := w.frame.GetFunction()
+	_, address, quantity, _ := pduRange(append([]byte{function}, w.frame.GetData()...))
+	msg, err := json.Marshal(asyncWriteEntry{
+		Time:     w.acked.UTC().Format(time.RFC3339Nano),
+		Slave:    slaveID,
+		Client:   w.client,
+		Function: function,
+		Address:  address,
+		Quantity: quantity,
+		Data:     hex.EncodeToString(w.frame.GetData()),
+		Delay:    s.clock.Now().Sub(w.acked).Seconds(),
+		Result:   result,
+	})
+	if err != nil {
+		return
+	}
+	if err := a.audit.write(msg); err != nil {
+		s.logger.Errorf("async write audit: %v", err)
+	}
+}
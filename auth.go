@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// admin API capabilities
+const (
+	capStatus = "status" // connection status, client statistics and metrics
+	capRead   = "read"   // register values and snapshot export
+	capWrite  = "write"  // register writes, e.g. snapshot import
+	capConfig = "config" // configuration and lifecycle changes
+)
+
+// adminCapabilities valid capabilities of custom roles
+var adminCapabilities = map[string]bool{capStatus: true, capRead: true, capWrite: true, capConfig: true}
+
+// builtinRoles capabilities of the built-in roles
+var builtinRoles = map[string][]string{
+	"viewer":   {capStatus, capRead},
+	"operator": {capStatus, capRead, capWrite},
+	"admin":    {capStatus, capRead, capWrite, capConfig},
+}
+
+// adminIdentity authenticated caller of the admin API
+type adminIdentity struct {
+	name string // e.g. "token:grafana", "user:ops" or "cert:scada-01"
+	role string
+}
+
+// adminIdentityKey request context key of the authenticated *adminIdentity
+type adminIdentityKey struct{}
+
+// adminClient return the client name of requests made through the admin API
+// on behalf of r: the authenticated identity, "admin" without admin_auth
+func adminClient(r *http.Request) string {
+	if id, ok := r.Context().Value(adminIdentityKey{}).(*adminIdentity); ok {
+		return id.name
+	}
+	return "admin"
+}
+
+// adminAuditEntry one admin API request in the audit log
+type adminAuditEntry struct {
+	Time       string `json:"time"`
+	Remote     string `json:"remote"`
+	Identity   string `json:"identity,omitempty"`
+	Role       string `json:"role,omitempty"`
+	Method     string `json:"method"`
+	Path       string `json:"path"`
+	Capability string `json:"capability"`
+	Status     int    `json:"status"`
+}
+
+// statusWriter response writer remembering the status code
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+// WriteHeader record and send the status code
+func (w *statusWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write send body data, the status defaults to 200
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// authorize wrap handler to require a role with capability when admin_auth
+// is configured, every request is recorded in the audit log
+func (s *Forwarder) authorize(capability string, handler http.HandlerFunc) http.HandlerFunc {
+	auth := s.config.AdminAuth
+	return func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		var id *adminIdentity
+		defer func() { s.audit(r, id, capability, sw.status) }()
+
+		if auth == nil {
+			handler(sw, r)
+			return
+		}
+		id = authIdentity(auth, r)
+		if id == nil {
+			if len(auth.Users) > 0 {
+				sw.Header().Set("WWW-Authenticate", `Basic realm="mb-forwarder"`)
+			} else {
+				sw.Header().Set("WWW-Authenticate", "Bearer")
+			}
+			writeJSON(sw, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+			return
+		}
+		if !roleAllows(auth, id.role, capability) {
+			s.logger.Warnf("admin API %s %s denied to %s from %s, role %s lacks %s", r.Method, r.URL.Path, id.name, r.RemoteAddr, id.role, capability)
+			writeJSON(sw, http.StatusForbidden, map[string]string{"error": capability + " access required"})
+			return
+		}
+		if capability == capWrite || capability == capConfig {
+			s.logger.Infof("admin API %s %s by %s (%s) from %s", r.Method, r.URL.Path, id.name, id.role, r.RemoteAddr)
+		}
+		handler(sw, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, id)))
+	}
+}
+
+// authIdentity return the identity proven by r: a bearer token, a basic auth
+// user or a verified client certificate; nil if none matches
+func authIdentity(auth *AdminAuthConfig, r *http.Request) *adminIdentity {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		for _, t := range auth.Tokens {
+			if secureEqual(token, t.Token) {
+				return &adminIdentity{name: "token:" + t.Name, role: t.Role}
+			}
+		}
+		return nil
+	}
+	if username, password, ok := r.BasicAuth(); ok {
+		for _, u := range auth.Users {
+			if secureEqual(username, u.Username) && secureEqual(password, u.Password) {
+				return &adminIdentity{name: "user:" + u.Username, role: u.Role}
+			}
+		}
+		return nil
+	}
+	// only certificates verified against admin_client_ca_file have chains
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		for _, c := range auth.Certs {
+			if cn == c.CommonName {
+				return &adminIdentity{name: "cert:" + cn, role: c.Role}
+			}
+		}
+	}
+	return nil
+}
+
+// roleAllows report whether role has capability
+func roleAllows(auth *AdminAuthConfig, role, capability string) bool {
+	caps, ok := builtinRoles[role]
+	if !ok {
+		caps = auth.Roles[role]
+	}
+	return slices.Contains(caps, capability)
+}
+
+// audit record an admin API request in admin_audit_file, id is nil for
+// unauthenticated requests
+func (s *Forwarder) audit(r *http.Request, id *adminIdentity, capability string, status int) {
+	if s.adminAudit == nil {
+		return
+	}
+	entry := adminAuditEntry{
+		Time:       s.clock.Now().UTC().Format(time.RFC3339Nano),
+		Remote:     r.RemoteAddr,
+		Method:     r.Method,
+		Path:       r.URL.RequestURI(),
+		Capability: capability,
+		Status:     status,
+	}
+	if id != nil {
+		entry.Identity = id.name
+		entry.Role = id.role
+	}
+	msg, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	if err := s.adminAudit.write(msg); err != nil {
+		s.logger.Errorf("admin API audit: %v", err)
+	}
+}
+
+// secureEqual compare secrets in constant time
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
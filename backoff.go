@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"time"
+)
+
+// backoff delays between reconnect attempts of one slave
+type backoff struct {
+	strategy string
+	min, max time.Duration
+	attempt  int
+	fib      [2]time.Duration // last two fibonacci delays
+}
+
+func newBackoff(c *BackoffConfig) *backoff {
+	b := &backoff{
+		strategy: c.Strategy,
+		min:      time.Duration(c.Min) * time.Millisecond,
+		max:      time.Duration(c.Max) * time.Millisecond,
+	}
+	b.reset()
+	return b
+}
+
+// next return the delay before the next attempt after a failed one
+func (b *backoff) next() time.Duration {
+	var d time.Duration
+	switch b.strategy {
+	case "constant":
+		d = b.min
+	case "exponential", "exponential_jitter":
+		d = b.min
+		for i := 0; i < b.attempt && d < b.max; i++ {
+			d *= 2
+		}
+		d = min(d, b.max)
+		if b.strategy == "exponential_jitter" {
+			// full jitter between min and the exponential delay, so that
+			// slaves of a shared gateway spread out their attempts
+			d = b.min + rand.N(d-b.min+1)
+		}
+	case "fibonacci":
+		d = b.fib[1]
+		b.fib = [2]time.Duration{b.fib[1], min(b.fib[0]+b.fib[1], b.max)}
+	}
+	b.attempt++
+	return min(d, b.max)
+}
+
+// reset start over after a successful attempt
+func (b *backoff) reset() {
+	b.attempt = 0
+	b.fib = [2]time.Duration{0, b.min}
+}
+
+// backoffDialer dialer refusing to dial again until the backoff delay after
+// a failed dial has passed, requests in between fail immediately with the
+// last dial error instead of hammering the slave
+type backoffDialer struct {
+	Dialer
+	clock Clock
+
+	mu      sync.Mutex
+	backoff *backoff
+	retryAt time.Time
+	lastErr error
+}
+
+// DialContext dial address unless the backoff delay has not passed yet
+func (d *backoffDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	d.mu.Lock()
+	if wait := d.retryAt.Sub(d.clock.Now()); wait > 0 {
+		err := d.lastErr
+		d.mu.Unlock()
+		return nil, fmt.Errorf("%w (next attempt in %s)", err, wait.Round(time.Millisecond))
+	}
+	d.mu.Unlock()
+
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err != nil {
+		d.lastErr = err
+		d.retryAt = d.clock.Now().Add(d.backoff.next())
+		return nil, err
+	}
+	d.backoff.reset()
+	d.retryAt = time.Time{}
+	return conn, nil
+}
+
+// retryIn return the time until the next dial is allowed
+func (d *backoffDialer) retryIn() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return max(d.retryAt.Sub(d.clock.Now()), 0)
+}
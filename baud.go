@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// defaultBaudCandidates line settings tried by baud rate detection when none
+// are configured, the common rates with the Modbus default even parity first
+var defaultBaudCandidates = func() []LineSettings {
+	var candidates []LineSettings
+	for _, baudRate := range []int{9600, 19200, 38400, 115200, 57600, 4800, 2400, 1200} {
+		for _, parity := range []string{"E", "N"} {
+			candidates = append(candidates, LineSettings{BaudRate: baudRate, Parity: parity})
+		}
+	}
+	return candidates
+}()
+
+// baudDetector probe of the line settings of an RTU slave
+type baudDetector struct {
+	slaveID  byte
+	function uint8 // read function of the probe
+	address  uint16
+	timeout  time.Duration // response timeout of each candidate
+
+	candidates []LineSettings
+	logf       func(format string, v ...any)
+}
+
+// detect try the candidate line settings in order until the slave answers a
+// probe, caller must hold the mutex; the line stays open with the settings
+// found, which are kept for reconnects
+func (t *rtuTransport) detect() error {
+	d := t.detector
+	data := binary.BigEndian.AppendUint16(nil, d.address)
+	data = binary.BigEndian.AppendUint16(data, 1)
+	probe := (&mbserver.RTUFrame{Address: d.slaveID, Function: d.function, Data: data}).Bytes()
+
+	for _, candidate := range d.candidates {
+		config := t.config
+		config.BaudRate, config.Parity, config.Timeout = candidate.BaudRate, candidate.Parity, d.timeout
+		port, err := t.open(config)
+		if err != nil {
+			return err
+		}
+		t.port = port
+		saved := t.config
+		t.config = config
+		response, err := t.send(probe)
+		t.config = saved
+		if err == nil && validProbeResponse(response, d.slaveID, d.function) {
+			t.config.BaudRate, t.config.Parity = candidate.BaudRate, candidate.Parity
+			t.detector = nil
+			d.logf("detected line settings of slave %d: %d baud, parity %s", d.slaveID, candidate.BaudRate, candidate.Parity)
+			return nil
+		}
+		t.close()
+	}
+	return fmt.Errorf("baud rate detection: no candidate line settings got a valid response from slave %d", d.slaveID)
+}
+
+// validProbeResponse report whether response is a frame of the slave to the
+// probe with a valid CRC, exceptions included
+func validProbeResponse(response []byte, slaveID byte, function uint8) bool {
+	frame, err := mbserver.NewRTUFrame(response)
+	return err == nil && frame.Address == slaveID && frame.Function&0x7F == function
+}
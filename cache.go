@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// cacheKey identifies a cached block by function code and start address
+type cacheKey struct {
+	function uint8
+	address  uint16
+}
+
+type cacheBlock struct {
+	data    []byte
+	expires time.Time
+}
+
+// readCache short lived cache of read-ahead blocks
+type readCache struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	blocks map[cacheKey]cacheBlock
+}
+
+func newReadCache(ttl time.Duration) *readCache {
+	return &readCache{ttl: ttl, blocks: make(map[cacheKey]cacheBlock)}
+}
+
+// get return the block data if present and not expired
+func (c *readCache) get(key cacheKey, now time.Time) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	block, ok := c.blocks[key]
+	if !ok || !now.Before(block.expires) {
+		return nil, false
+	}
+	return block.data, true
+}
+
+// put store block data, dropping expired blocks
+func (c *readCache) put(key cacheKey, data []byte, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for k, block := range c.blocks {
+		if !now.Before(block.expires) {
+			delete(c.blocks, k)
+		}
+	}
+	c.blocks[key] = cacheBlock{data: data, expires: now.Add(c.ttl)}
+}
+
+// size return the number of blocks not expired at now, c may be nil
+func (c *readCache) size(now time.Time) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, block := range c.blocks {
+		if now.Before(block.expires) {
+			n++
+		}
+	}
+	return n
+}
+
+// invalidate drop the cached blocks of function overlapping quantity items
+// at address, function 0 for every function and quantity 0 for every
+// address; return the number of blocks dropped
+func (c *readCache) invalidate(function uint8, address, quantity int) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dropped := 0
+	for key, block := range c.blocks {
+		size := len(block.data) / 2
+		if key.function == 1 || key.function == 2 {
+			size = len(block.data) * 8
+		}
+		if (function == 0 || key.function == function) && overlaps(int(key.address), size, address, quantity) {
+			delete(c.blocks, key)
+			dropped++
+		}
+	}
+	return dropped
+}
+
+// overlaps report whether the range of size items at start overlaps quantity
+// items at address, quantity 0 for every address
+func overlaps(start, size, address, quantity int) bool {
+	return quantity == 0 || (start < address+quantity && address < start+size)
+}
+
+// maskRegister apply a mask write to register address of the big endian
+// registers data starting at start, if it holds the register
+func maskRegister(data []byte, start, address int, andMask, orMask uint16) {
+	offset := (address - start) * 2
+	if offset < 0 || offset+1 >= len(data) {
+		return
+	}
+	value := binary.BigEndian.Uint16(data[offset:])
+	binary.BigEndian.PutUint16(data[offset:], value&andMask|orMask&^andMask)
+}
+
+// readAhead answer a small read from a cached block of the configured size,
+// reading the whole block from the slave on a miss. ok is false when the read
+// does not fit in one block or the slave rejected the wider read, the caller
+// then reads directly.
+func (s *Forwarder) readAhead(client *modbusClient, slaveID byte, function uint8, address, quantity int) (results []byte, ok bool, err error) {
+	block := min(client.readAhead, client.readLimit(function))
+	start := address / block * block
+	if address+quantity > start+block {
+		return nil, false, nil
+	}
+	count := min(block, 0x10000-start)
+
+	key := cacheKey{function: function, address: uint16(start)}
+	data, hit := client.cache.get(key, s.clock.Now())
+	if !hit {
+		data, err = s.readOnce(client, slaveID, function, start, count)
+		if err != nil {
+			if _, rejected := err.(*modbus.ModbusError); rejected {
+				s.logger.Debugf("read-ahead of slave %d (function %d, addr %d, count %d) rejected, reading directly: %v", slaveID, function, start, count, err)
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		client.cache.put(key, data, s.clock.Now())
+	}
+
+	results, ok = extractRange(function, data, address-start, quantity)
+	return results, ok, nil
+}
+
+// extractRange copy quantity items at offset out of block data, data holds
+// packed bits for the bit functions and big endian registers otherwise
+func extractRange(function uint8, data []byte, offset, quantity int) ([]byte, bool) {
+	if function == 1 || function == 2 {
+		if len(data)*8 < offset+quantity {
+			return nil, false
+		}
+		results := make([]byte, (quantity+7)/8)
+		copyBits(results, 0, data, offset, quantity)
+		return results, true
+	}
+	if len(data) < (offset+quantity)*2 {
+		return nil, false
+	}
+	return append([]byte(nil), data[offset*2:(offset+quantity)*2]...), true
+}
+
+// mergeRange copy the overlapping part of quantity written items at address
+// into block data starting at start
+func mergeRange(function uint8, block []byte, start, address, quantity int, data []byte) {
+	bits := function == 1 || function == 2
+	size := len(block) / 2
+	if bits {
+		size = len(block) * 8
+	}
+	from, to := max(address, start), min(address+quantity, start+size)
+	if from >= to {
+		return
+	}
+	if bits {
+		copyBits(block, from-start, data, from-address, to-from)
+	} else {
+		copy(block[(from-start)*2:(to-start)*2], data[(from-address)*2:])
+	}
+}
+
+// copyBits copy count bits of packed (LSB first) coil data from src at
+// srcOffset to dst at dstOffset
+func copyBits(dst []byte, dstOffset int, src []byte, srcOffset, count int) {
+	for i := 0; i < count; i++ {
+		s, d := srcOffset+i, dstOffset+i
+		if src[s/8]&(1<<(s%8)) != 0 {
+			dst[d/8] |= 1 << (d % 8)
+		} else {
+			dst[d/8] &^= 1 << (d % 8)
+		}
+	}
+}
+
+// handleCacheInvalidate POST /api/cache/invalidate[?slave_id=N][&type=&address=&quantity=|&tag=name],
+// drop cached read-ahead blocks and static ranges so the next read reaches
+// the slave
+func (s *Forwarder) handleCacheInvalidate(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	filter, err := parseRangeFilter(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	slaveID := -1 // every slave
+	if q.Has("slave_id") {
+		id, err := strconv.Atoi(q.Get("slave_id"))
+		if _, ok := s.config.Servers[byte(id)]; err != nil || id < 0 || id > 255 || !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown slave %q", q.Get("slave_id"))})
+			return
+		}
+		slaveID = id
+	}
+	if name := q.Get("tag"); name != "" {
+		if slaveID < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "tag requires slave_id"})
+			return
+		}
+		tag, ok := s.config.Servers[byte(slaveID)].tag(name)
+		if !ok {
+			writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown tag %s of slave %d", name, slaveID)})
+			return
+		}
+		filter = rangeFilter{typ: tag.Type, address: tag.Address, quantity: tag.registers()}
+	}
+
+	result := struct {
+		Blocks       int `json:"blocks"`        // read-ahead blocks dropped
+		StaticRanges int `json:"static_ranges"` // static ranges dropped
+	}{}
+	function := pollFunctions[filter.typ] // 0 for every type
+	s.clientsMux.RLock()
+	for id, client := range s.clients {
+		if slaveID < 0 || int(id) == slaveID {
+			result.Blocks += client.cache.invalidate(function, filter.address, filter.quantity)
+			result.StaticRanges += client.static.invalidate(function, filter.address, filter.quantity)
+		}
+	}
+	s.clientsMux.RUnlock()
+
+	s.logger.Infof("cache invalidated through the admin API: %d read-ahead blocks, %d static ranges", result.Blocks, result.StaticRanges)
+	writeJSON(w, http.StatusOK, result)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// transaction request and response decoded by a sniffer or tap
+type transaction struct {
+	Source    string   `json:"source"`
+	Time      string   `json:"time"`
+	Unit      uint8    `json:"unit"`
+	Function  uint8    `json:"function"`
+	Address   *int     `json:"address,omitempty"`
+	Quantity  *int     `json:"quantity,omitempty"`
+	Values    []uint16 `json:"values,omitempty"`    // registers or bits read or written
+	Request   string   `json:"request"`             // request PDU, hex
+	Response  string   `json:"response,omitempty"`  // response PDU, hex
+	Exception string   `json:"exception,omitempty"` // exception of the response
+	Error     string   `json:"error,omitempty"`     // "no response" when the slave didn't answer
+	Duration  float64  `json:"duration_ms,omitempty"`
+}
+
+// txObserver destination of the transactions decoded by a sniffer or tap
+type txObserver struct {
+	kind      string // "sniffer" or "tap"
+	name      string
+	mqttTopic string       // empty to not publish
+	capture   *captureFile // nil to not record
+}
+
+// captureFile JSON lines file recording decoded transactions, one per line
+type captureFile struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+// openCapture open path for appending transactions
+func openCapture(path string) (*captureFile, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	return &captureFile{file: file}, nil
+}
+
+// write append one JSON encoded transaction
+func (c *captureFile) write(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.file.Write(append(msg, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %v", c.file.Name(), err)
+	}
+	return nil
+}
+
+// close close the file
+func (c *captureFile) close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.file.Close()
+}
+
+// emitTransaction decode a transaction and stream it to the log, MQTT,
+// WebSocket subscribers and the capture file
+func (s *Forwarder) emitTransaction(o *txObserver, request, response *mbserver.RTUFrame, duration time.Duration) {
+	ev := transaction{
+		Source:   o.name,
+		Time:     s.clock.Now().Add(-duration).UTC().Format(time.RFC3339Nano), // time of the request
+		Unit:     request.Address,
+		Function: request.Function,
+		Request:  hex.EncodeToString(append([]byte{request.Function}, request.Data...)),
+	}
+	decodeRequest(&ev, request)
+
+	var summary string
+	switch {
+	case response == nil && request.Address == 0:
+		summary = "broadcast"
+	case response == nil:
+		ev.Error = "no response"
+		summary = ev.Error
+	default:
+		ev.Response = hex.EncodeToString(append([]byte{response.Function}, response.Data...))
+		ev.Duration = float64(duration.Microseconds()) / 1000
+		if response.Function&0x80 != 0 && len(response.Data) > 0 {
+			ev.Exception = exceptionName(mbserver.Exception(response.Data[0]))
+			summary = "exception " + ev.Exception
+		} else {
+			decodeResponse(&ev, response)
+			summary = "ok"
+		}
+		summary += fmt.Sprintf(" (%v)", duration.Round(time.Microsecond))
+	}
+
+	var target string
+	if ev.Address != nil {
+		target = fmt.Sprintf(", addr %d, count %d", *ev.Address, *ev.Quantity)
+	}
+	var values string
+	if len(ev.Values) > 0 {
+		values = fmt.Sprintf(" %v", ev.Values)
+	}
+	s.logger.Infof("%s %s: slave %d function %d%s%s: %s", o.kind, o.name, ev.Unit, ev.Function, target, values, summary)
+
+	msg, _ := json.Marshal(ev)
+	if s.sniffs != nil {
+		s.sniffs.publish(msg)
+	}
+	if o.mqttTopic != "" && s.mqtt != nil && s.mqtt.IsConnectionOpen() {
+		s.mqtt.Publish(o.mqttTopic, byte(s.config.MQTT.QoS), false, msg)
+	}
+	if o.capture != nil {
+		if err := o.capture.write(msg); err != nil {
+			s.logger.Warnf("%s %s: %v", o.kind, o.name, err)
+		}
+	}
+}
+
+// decodeRequest decode address, quantity and written values of a request
+func decodeRequest(ev *transaction, request *mbserver.RTUFrame) {
+	data := request.Data
+	if len(data) < 4 {
+		return
+	}
+	address, quantity := int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:]))
+	switch request.Function {
+	case 1, 2, 3, 4:
+	case 5:
+		ev.Values, quantity = []uint16{boolValue(quantity == 0xFF00)}, 1
+	case 6:
+		ev.Values, quantity = []uint16{uint16(quantity)}, 1
+	case 15:
+		if len(data) > 5 {
+			ev.Values = unpackBits(data[5:], quantity)
+		}
+	case 16:
+		if len(data) > 5 {
+			ev.Values = unpackRegisters(data[5:])
+		}
+	default:
+		return
+	}
+	ev.Address, ev.Quantity = &address, &quantity
+}
+
+// decodeResponse decode the values returned by a read
+func decodeResponse(ev *transaction, response *mbserver.RTUFrame) {
+	if len(response.Data) < 1 || ev.Quantity == nil {
+		return
+	}
+	switch response.Function {
+	case 1, 2:
+		ev.Values = unpackBits(response.Data[1:], *ev.Quantity)
+	case 3, 4:
+		ev.Values = unpackRegisters(response.Data[1:])
+	}
+}
+
+func unpackBits(data []byte, quantity int) []uint16 {
+	values := make([]uint16, 0, quantity)
+	for i := 0; i < quantity && i/8 < len(data); i++ {
+		values = append(values, uint16(data[i/8]>>(i%8)&1))
+	}
+	return values
+}
+
+func unpackRegisters(data []byte) []uint16 {
+	values := make([]uint16, len(data)/2)
+	for i := range values {
+		values[i] = binary.BigEndian.Uint16(data[2*i:])
+	}
+	return values
+}
+
+func boolValue(b bool) uint16 {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// upstreamStats traffic counters of one upstream client address
+type upstreamStats struct {
+	connections atomic.Uint64 // accepted connections
+	active      atomic.Int64  // currently open connections
+	rejected    atomic.Uint64 // connections rejected by max_connections_per_client
+	evicted     atomic.Uint64 // connections closed by max_connections_per_client
+	requests    atomic.Uint64
+	errors      atomic.Uint64 // exception responses
+	duplicates  atomic.Uint64 // retransmissions answered from the original response
+	malformed   malformedFrames
+	bytesIn     atomic.Uint64
+	bytesOut    atomic.Uint64
+	lastSeen    atomic.Int64 // unix nanoseconds
+}
+
+// upstreamClients upstream client statistics by client address
+type upstreamClients struct {
+	mu    sync.Mutex
+	stats map[string]*upstreamStats
+}
+
+// get return the statistics of addr, creating them on first use
+func (c *upstreamClients) get(addr string) *upstreamStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.stats == nil {
+		c.stats = make(map[string]*upstreamStats)
+	}
+	stats, ok := c.stats[addr]
+	if !ok {
+		stats = &upstreamStats{}
+		c.stats[addr] = stats
+	}
+	return stats
+}
+
+// clientAddr return the address upstream statistics are grouped by, the
+// IP without port for TCP clients
+func clientAddr(addr net.Addr) string {
+	if addr == nil {
+		return "unknown"
+	}
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP.String()
+	}
+	if host, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return host
+	}
+	if addr.Network() == "unix" {
+		return "unix"
+	}
+	return addr.String()
+}
+
+// upstreamStatus traffic statistics of one upstream client
+type upstreamStatus struct {
+	Addr        string          `json:"addr"`
+	Connections uint64          `json:"connections"`
+	Active      int64           `json:"active_connections"`
+	Rejected    uint64          `json:"rejected_connections"`
+	Evicted     uint64          `json:"evicted_connections"`
+	Requests    uint64          `json:"requests"`
+	Errors      uint64          `json:"errors"`
+	ErrorRate   float64         `json:"error_rate"`
+	Duplicates  uint64          `json:"duplicates"`
+	Malformed   malformedStatus `json:"malformed"` // malformed requests by kind
+	BytesIn     uint64          `json:"bytes_in"`
+	BytesOut    uint64          `json:"bytes_out"`
+	LastSeen    *time.Time      `json:"last_seen,omitempty"`
+}
+
+// snapshot return statistics of all upstream clients sorted by address
+func (c *upstreamClients) snapshot() []upstreamStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clients := make([]upstreamStatus, 0, len(c.stats))
+	for addr, stats := range c.stats {
+		client := upstreamStatus{
+			Addr:        addr,
+			Connections: stats.connections.Load(),
+			Active:      stats.active.Load(),
+			Rejected:    stats.rejected.Load(),
+			Evicted:     stats.evicted.Load(),
+			Requests:    stats.requests.Load(),
+			Errors:      stats.errors.Load(),
+			Duplicates:  stats.duplicates.Load(),
+			Malformed:   stats.malformed.snapshot(),
+			BytesIn:     stats.bytesIn.Load(),
+			BytesOut:    stats.bytesOut.Load(),
+		}
+		if client.Requests > 0 {
+			client.ErrorRate = float64(client.Errors) / float64(client.Requests)
+		}
+		if lastSeen := stats.lastSeen.Load(); lastSeen != 0 {
+			t := time.Unix(0, lastSeen)
+			client.LastSeen = &t
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Addr < clients[j].Addr })
+	return clients
+}
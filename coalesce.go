@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// writeCoalescer hold single register writes for a short window so rapid
+// successive writes to the same register reach the slave as one write of
+// the final value
+type writeCoalescer struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	pending map[uint16]uint16 // address -> latest value
+}
+
+func newWriteCoalescer(window time.Duration) *writeCoalescer {
+	return &writeCoalescer{window: window, pending: make(map[uint16]uint16)}
+}
+
+// coalesceWrite queue a single register write, the latest value is written
+// to the slave when the window opened by the first queued write has passed
+func (s *Forwarder) coalesceWrite(client *modbusClient, slaveID byte, address, value uint16) {
+	c := client.coalescer
+	c.mu.Lock()
+	_, queued := c.pending[address]
+	c.pending[address] = value
+	c.mu.Unlock()
+	if queued {
+		s.logger.Debugf("coalesced write to slave %d register %d, value %d", slaveID, address, value)
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		select {
+		case <-s.clock.After(c.window):
+		case <-s.ctx.Done():
+			// flush before shutting down
+		}
+
+		c.mu.Lock()
+		value := c.pending[address]
+		delete(c.pending, address)
+		c.mu.Unlock()
+
+		if err := s.writeRegister(client, slaveID, address, value); err != nil {
+			s.logger.Errorf("failed to write coalesced single register (slave %d, addr %d, value %d): %v", slaveID, address, value, err)
+			return
+		}
+		s.logger.Infof("write single register success (slave %d, addr %d, value %d)", slaveID, address, value)
+	}()
+}
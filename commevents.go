@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/goburrow/modbus"
+	"github.com/tbrandon/mbserver"
+)
+
+// communication event bytes of the event log, see MODBUS Application
+// Protocol Specification, Get Comm Event Log
+const (
+	commEventSent          = 0x40 // response sent
+	commEventReadException = 0x01 // with an exception 1-3
+	commEventAbort         = 0x02 // with a slave device failure exception
+	commEventBusy          = 0x04 // with a busy exception
+	commEventReceived      = 0x80 // request received
+	commEventCommError     = 0x02 // with a communication error
+)
+
+// maxCommEvents events kept in the event log
+const maxCommEvents = 64
+
+// commEventLog last transactions of the forwarder with a slave, one event
+// per transaction
+type commEventLog struct {
+	mu     sync.Mutex
+	events [maxCommEvents]byte
+	next   int // index of the next event
+	count  int // events kept
+}
+
+// commEvent event of a transaction: a sent event, with the exception of the
+// slave if any, or a communication error when the slave did not answer
+// with a valid response
+func commEvent(err error) byte {
+	if err == nil {
+		return commEventSent
+	}
+	var modbusErr *modbus.ModbusError
+	if !errors.As(err, &modbusErr) {
+		return commEventReceived | commEventCommError
+	}
+	switch mbserver.Exception(modbusErr.ExceptionCode) {
+	case mbserver.IllegalFunction, mbserver.IllegalDataAddress, mbserver.IllegalDataValue:
+		return commEventSent | commEventReadException
+	case mbserver.SlaveDeviceFailure:
+		return commEventSent | commEventAbort
+	case mbserver.AcknowledgeSlave, mbserver.SlaveDeviceBusy:
+		return commEventSent | commEventBusy
+	}
+	return commEventSent
+}
+
+func (l *commEventLog) add(event byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events[l.next] = event
+	l.next = (l.next + 1) % maxCommEvents
+	l.count = min(l.count+1, maxCommEvents)
+}
+
+// snapshot the events, the most recent first
+func (l *commEventLog) snapshot() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	events := make([]byte, l.count)
+	for i := range events {
+		events[i] = l.events[(l.next-1-i+maxCommEvents)%maxCommEvents]
+	}
+	return events
+}
+
+// commStatus status word, successful transaction and transaction counts of
+// a slave, the status is busy while a transaction is queued or in progress
+func (c *modbusClient) commStatus() (status, events, messages uint16) {
+	if c.queued.Load() > 0 {
+		status = 0xFFFF
+	}
+	requests := c.requests.Load()
+	return status, uint16(requests - c.failures.Load()), uint16(requests)
+}
+
+// commEventCounter answer get comm event counter, function code 11, with
+// the successful transactions of the forwarder with the slave; the request
+// is not forwarded
+func (s *Forwarder) commEventCounter(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	slaveID := getSlaveID(frame)
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+	status, events, _ := client.commStatus()
+	return []byte{byte(status >> 8), byte(status), byte(events >> 8), byte(events)}, &mbserver.Success
+}
+
+// commEventLog answer get comm event log, function code 12, with the
+// counters and the last transactions of the forwarder with the slave; the
+// request is not forwarded
+func (s *Forwarder) commEventLog(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	slaveID := getSlaveID(frame)
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+	status, events, messages := client.commStatus()
+	log := client.events.snapshot()
+	data := []byte{byte(6 + len(log)), byte(status >> 8), byte(status), byte(events >> 8), byte(events), byte(messages >> 8), byte(messages)}
+	return append(data, log...), &mbserver.Success
+}
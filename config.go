@@ -2,7 +2,14 @@ package main
 
 import (
 	"fmt"
+	"net"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -10,21 +17,500 @@ import (
 var C Config
 
 type Config struct {
-	ListenPort int             `yaml:"listen_port"`
-	Servers    map[byte]Server `yaml:"servers"` // SlaveID -> Server
-	// LogLevel   string         `yaml:"log_level"`
+	Version    int       `yaml:"version"` // config schema version, 1 when not set
+	ListenPort int       `yaml:"listen_port"`
+	Servers    ServerMap `yaml:"servers"`   // SlaveID -> Server
+	LogLevel   string    `yaml:"log_level"` // "error", "warn", "info", "debug" or "trace"
+	DumpFile   string    `yaml:"dump_file"` // state dump file, empty to dump to log
+
+	LogSampleRate int `yaml:"log_sample_rate"` // log 1-in-N successful reads, 0 to not log them
+
+	MaxConnectionsPerClient int    `yaml:"max_connections_per_client"` // simultaneous upstream connections per client IP, 0 for no limit
+	ConnectionLimitPolicy   string `yaml:"connection_limit_policy"`    // "reject" new connections or "close_oldest"
+
+	DuplicateWindow int `yaml:"duplicate_window"` // answer retransmitted requests within this time(milliseconds) from the original response, 0 to disable
+
+	FairScheduling *FairScheduling `yaml:"fair_scheduling"` // share the slaves round-robin between the upstream clients, nil for first-come-first-served
+
+	ListenUnix         string      `yaml:"listen_unix"`      // unix domain socket path, empty to disable
+	ListenUnixModeText string      `yaml:"listen_unix_mode"` // unix socket file mode, e.g. "0660"
+	ListenUnixMode     os.FileMode `yaml:"-"`
+
+	Listen []ListenAddress `yaml:"listen"` // addresses the Modbus TCP listener binds, empty for 0.0.0.0:listen_port
+
+	ListenSocketOptions *SocketOptions `yaml:"listen_socket_options"` // TCP tuning of the upstream connections, nil for the defaults
+
+	TLS *TLSConfig `yaml:"tls"` // Modbus/TCP over TLS listener, nil to disable
+
+	Tenants []TenantConfig `yaml:"tenants"` // customers with their own listener, slaves, permissions and limits
+
+	WSListen string `yaml:"ws_listen"` // MBAP over WebSocket listen address, e.g. "0.0.0.0:8502", empty to disable
+	WSPath   string `yaml:"ws_path"`   // WebSocket endpoint path, default "/modbus"
+	// origins of the web pages allowed to connect, e.g. "https://hmi.example.com",
+	// "*" for any; empty for the same origin only
+	WSAllowedOrigins []string `yaml:"ws_allowed_origins"`
+	WSUnits          UnitMap  `yaml:"ws_units"`           // upstream unit ID -> server of WebSocket connections, empty for the default routing
+	WSReadOnly       bool     `yaml:"ws_read_only"`       // reject write function codes on WebSocket connections
+	WSAuth           bool     `yaml:"ws_auth"`            // require admin_auth credentials, roles without "write" are read only
+	WSValuesPath     string   `yaml:"ws_values_path"`     // WebSocket path on ws_listen streaming the tag values with their quality, default "/values"
+	WSValuesInterval int      `yaml:"ws_values_interval"` // tag value event interval(milliseconds), default 5000
+
+	AdminListen   string           `yaml:"admin_listen"`    // admin HTTP API address, e.g. "127.0.0.1:8080", empty to disable
+	AdminAuth     *AdminAuthConfig `yaml:"admin_auth"`      // admin API credentials, nil to not require any
+	AdminCertFile string           `yaml:"admin_cert_file"` // admin API TLS certificate, PEM, empty for plain HTTP
+	AdminKeyFile  string           `yaml:"admin_key_file"`  // admin API TLS private key, PEM
+	// CA verifying admin API client certificates, PEM, empty to not accept any
+	AdminClientCAFile string `yaml:"admin_client_ca_file"`
+	AdminAuditFile    string `yaml:"admin_audit_file"` // JSON lines log of the admin API requests, empty to disable
+
+	MQTT *MQTTConfig `yaml:"mqtt"` // MQTT command topics, nil to disable
+
+	Hooks []HookConfig `yaml:"hooks"` // commands and webhooks run on connection, listener and write events
+
+	Sniffers  []SnifferConfig `yaml:"sniffers"`   // passive serial bus analyzers
+	Taps      []TapConfig     `yaml:"taps"`       // transparent proxies recording the transactions of a master and a device
+	SniffPath string          `yaml:"sniff_path"` // WebSocket path on ws_listen streaming the transactions of sniffers and taps, default "/sniff"
+
+	Unit0   UnitPolicy `yaml:"unit_0"`   // handling of unit ID 0, default reject
+	Unit255 UnitPolicy `yaml:"unit_255"` // handling of unit ID 255, default reject
+
+	UnroutedUnit string `yaml:"unrouted_unit"` // response to unknown unit IDs: "gateway_path_unavailable", "slave_device_failure" or "silent"
+
+	Keepalive *KeepaliveConfig `yaml:"keepalive"` // keepalives of the masters answered by the forwarder, nil to forward them
+
+	DiagnosticUnit    int      `yaml:"diagnostic_unit"`    // unit ID answered by the forwarder with its own health registers, 0 to disable
+	DiagnosticControl []string `yaml:"diagnostic_control"` // upstream client IPs allowed to write the diagnostic unit control coils and registers
+
+	DerivedUnit      int               `yaml:"derived_unit"`      // unit ID answering the derived registers, 0 to disable
+	DerivedRegisters []DerivedRegister `yaml:"derived_registers"` // virtual registers computed from polled registers
+
+	StartupPolicy  string `yaml:"startup_policy"`  // "fail_fast" or "degrade"
+	StartupTimeout int    `yaml:"startup_timeout"` // time budget(seconds) for connecting all slaves, 0 for no limit
+
+	MonitorInterval int    `yaml:"monitor_interval"` // connection check interval(seconds), default 30
+	ProbeType       string `yaml:"probe_type"`       // "holding", "input", "coils", "discrete" or "none"
+	ProbeAddress    *int   `yaml:"probe_address"`    // probe start address, default 1
+	ProbeQuantity   int    `yaml:"probe_quantity"`   // probe quantity, default 1
+
+	Health HealthConfig `yaml:"health"` // health scoring of the slaves
+
+	ReconnectBackoff *BackoffConfig `yaml:"reconnect_backoff"` // delays between reconnect attempts of TCP, WebSocket and remote serial slaves, nil to redial on every request
+}
+
+// HealthConfig health score of the slaves: the moving average of the
+// transaction success rate, lowered when the latency exceeds the target
+type HealthConfig struct {
+	Alpha         float64 `yaml:"alpha"`          // weight of the latest transaction in the moving averages, 0-1, default 0.1
+	LatencyTarget int     `yaml:"latency_target"` // latency(milliseconds) above which the score drops, default 1000
+	DownBelow     float64 `yaml:"down_below"`     // a failed probe marks the slave down only with the score below, 0 (default) for any failed probe
+	UpAbove       float64 `yaml:"up_above"`       // a success marks a down slave up only with the score at least, default down_below
+}
+
+// FairScheduling round-robin turns of the upstream clients on each slave
+type FairScheduling struct {
+	Weights map[string]int `yaml:"weights"` // client IP -> turns in a row, default 1
+	Classes []QoSClass     `yaml:"classes"` // QoS classes sharing the turns by weight, unlisted clients are in class "default"
+}
+
+// QoSClass upstream clients sharing the turns of their class
+type QoSClass struct {
+	Name    string   `yaml:"name"`
+	Weight  int      `yaml:"weight"`  // turns in a row of the class, default 1
+	Clients []string `yaml:"clients"` // client IPs, CIDR networks, "mqtt", "admin" or admin API identities
+}
+
+// BackoffConfig reconnect backoff strategy
+type BackoffConfig struct {
+	Strategy string `yaml:"strategy"` // "constant", "exponential", "exponential_jitter" (default) or "fibonacci"
+	Min      int    `yaml:"min"`      // first delay(milliseconds), default 1000
+	Max      int    `yaml:"max"`      // maximum delay(milliseconds), default 60000
+}
+
+// DerivedRegister virtual register computed from the polled registers of
+// one or more slaves
+type DerivedRegister struct {
+	Name    string  `yaml:"name"`
+	Address int     `yaml:"address"` // holding and input register of derived_unit
+	Expr    string  `yaml:"expr"`    // e.g. "holding(1, 100) + holding(2, 100) + holding(3, 100)"
+	Scale   float64 `yaml:"scale"`   // factor applied to the result, default 1
+
+	Compiled *derivedExpr `yaml:"-"`
+}
+
+// KeepaliveConfig keepalives answered by the forwarder without reaching
+// the slaves
+type KeepaliveConfig struct {
+	Loopback    bool   `yaml:"loopback"`     // answer FC 8 return query data (sub-function 0) of every unit
+	EmptyFrames string `yaml:"empty_frames"` // MBAP frames without PDU: "echo" (default), "ignore" or "close"
+}
+
+// AdminAuthConfig admin API credentials, each assigned a role
+type AdminAuthConfig struct {
+	Tokens []AdminToken `yaml:"tokens"` // bearer tokens
+	Users  []AdminUser  `yaml:"users"`  // basic auth users
+	Certs  []AdminCert  `yaml:"certs"`  // client certificates, require admin_client_ca_file
+	// additional roles by name, each a list of capabilities: "status",
+	// "read", "write" and "config"
+	Roles map[string][]string `yaml:"roles"`
+}
+
+// AdminToken bearer token of the admin API
+type AdminToken struct {
+	Name  string `yaml:"name"`  // name recorded in the audit log
+	Token string `yaml:"token"` // at least 16 characters
+	Role  string `yaml:"role"`  // "viewer" (default), "operator", "admin" or a custom role
+}
+
+// AdminUser basic auth user of the admin API
+type AdminUser struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	Role     string `yaml:"role"` // "viewer" (default), "operator", "admin" or a custom role
+}
+
+// AdminCert client certificate of the admin API, matched by subject common name
+type AdminCert struct {
+	CommonName string `yaml:"common_name"`
+	Role       string `yaml:"role"` // "viewer" (default), "operator", "admin" or a custom role
+}
+
+// ListenAddress address the Modbus TCP listener binds, with the routing
+// and permissions of its connections
+type ListenAddress struct {
+	Address  string  `yaml:"address"`   // host and port, e.g. "10.0.0.5:502", "[fd00::5]:502" or "[::]:502"
+	Units    UnitMap `yaml:"units"`     // upstream unit ID -> server, empty for the default routing
+	ReadOnly bool    `yaml:"read_only"` // reject write function codes
+}
+
+// UnmarshalYAML decode a listen address, a plain string is the address with
+// the default routing
+func (a *ListenAddress) UnmarshalYAML(unmarshal func(any) error) error {
+	var address string
+	if err := unmarshal(&address); err == nil {
+		*a = ListenAddress{Address: address}
+		return nil
+	}
+	type plain ListenAddress
+	return unmarshal((*plain)(a))
+}
+
+// TLSConfig Modbus/TCP over TLS listener
+type TLSConfig struct {
+	ListenPort     int          `yaml:"listen_port"`     // default 802
+	CertFile       string       `yaml:"cert_file"`       // server certificate, PEM
+	KeyFile        string       `yaml:"key_file"`        // server private key, PEM
+	ClientCAFile   string       `yaml:"client_ca_file"`  // CA verifying client certificates, empty to not require them
+	RequireProfile bool         `yaml:"require_profile"` // close connections whose server name matches no profile
+	Profiles       []TLSProfile `yaml:"profiles"`
+}
+
+// TLSProfile routing and permissions selected by the SNI server name the client presents
+type TLSProfile struct {
+	ServerName string  `yaml:"server_name"`
+	Units      UnitMap `yaml:"units"`     // upstream unit ID -> server, empty for the default routing
+	ReadOnly   bool    `yaml:"read_only"` // reject write function codes
+	CertFile   string  `yaml:"cert_file"` // certificate presented for this server name, default the listener certificate
+	KeyFile    string  `yaml:"key_file"`
+}
+
+// TenantConfig customer served on its own listener port, with its own
+// slaves, permissions and limits
+type TenantConfig struct {
+	Name           string  `yaml:"name"`             // tenant label of the metrics
+	ListenPort     int     `yaml:"listen_port"`      // Modbus TCP port of the tenant
+	Units          UnitMap `yaml:"units"`            // upstream unit ID -> server, the only servers the tenant reaches
+	ReadOnly       bool    `yaml:"read_only"`        // reject write function codes
+	MaxConnections int     `yaml:"max_connections"`  // simultaneous connections, 0 for no limit
+	MaxRequestRate int     `yaml:"max_request_rate"` // requests per second, 0 for no limit
+	RequestBurst   int     `yaml:"request_burst"`    // requests allowed at once above the rate, default max_request_rate
+}
+
+// MQTTConfig MQTT broker connection and command topics writing tags
+type MQTTConfig struct {
+	Broker        string `yaml:"broker"` // broker URL, e.g. "tcp://127.0.0.1:1883"
+	ClientID      string `yaml:"client_id"`
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`
+	CommandTopic  string `yaml:"command_topic"`  // topic pattern with {slave} and {tag} placeholders, default "mbf/{slave}/{tag}/set"
+	ResponseTopic string `yaml:"response_topic"` // topic pattern the write results are published to, default "mbf/{slave}/{tag}/result"
+	QoS           int    `yaml:"qos"`            // 0, 1 or 2
+
+	StateTopic        string `yaml:"state_topic"`        // topic pattern tag values are published to, default "mbf/{slave}/{tag}/state"
+	StateInterval     int    `yaml:"state_interval"`     // tag value publish interval(milliseconds), 0 to not publish values
+	AvailabilityTopic string `yaml:"availability_topic"` // topic pattern "online" or "offline" of the tag values is published to, default "mbf/{slave}/{tag}/availability"
+	StateFormat       string `yaml:"state_format"`       // "value" (default) for the bare value, "json" for the value with its quality and timestamp
+
+	Discovery       bool   `yaml:"discovery"`        // publish Home Assistant discovery messages for the tags
+	DiscoveryPrefix string `yaml:"discovery_prefix"` // Home Assistant discovery prefix, default "homeassistant"
+}
+
+// HookConfig external command or webhook run on forwarder events, with the
+// event details as environment variables and JSON
+type HookConfig struct {
+	Name    string   `yaml:"name"`    // hook name in the log, default the command or URL
+	Events  []string `yaml:"events"`  // events the hook runs on, empty for all
+	Command []string `yaml:"command"` // program and arguments, run with MBF_* environment variables and the event JSON on stdin
+	URL     string   `yaml:"url"`     // webhook the event JSON is POSTed to
+	Timeout int      `yaml:"timeout"` // time limit of one run(seconds), default 10
+}
+
+// SnifferConfig serial port listened on without transmitting, decoding the
+// RTU traffic of other masters and slaves
+type SnifferConfig struct {
+	Name      string `yaml:"name"`
+	Addr      string `yaml:"addr"`       // serial device name
+	BaudRate  int    `yaml:"baud_rate"`  // default 9600
+	DataBits  int    `yaml:"data_bits"`  // default 8
+	StopBits  int    `yaml:"stop_bits"`  // default 1
+	Parity    string `yaml:"parity"`     // default "N"
+	MQTTTopic string `yaml:"mqtt_topic"` // topic the decoded transactions are published to, empty to not publish
+}
+
+// TapConfig transparent Modbus TCP proxy between an existing master and a
+// single device, forwarding bytes unchanged while recording the transactions
+type TapConfig struct {
+	Name        string `yaml:"name"`
+	Listen      string `yaml:"listen"`       // address the master connects to, e.g. "0.0.0.0:5020"
+	Backend     string `yaml:"backend"`      // device address, e.g. "192.168.1.10:502"
+	CaptureFile string `yaml:"capture_file"` // JSON lines file the transactions are appended to, empty to not record
+	MQTTTopic   string `yaml:"mqtt_topic"`   // topic the transactions are published to, empty to not publish
+}
+
+// UnitPolicy handling of the special unit IDs 0 and 255
+type UnitPolicy struct {
+	Policy string `yaml:"policy"` // "reject", "broadcast" or "forward"
+	Target int    `yaml:"target"` // slave ID requests are forwarded to, default the only server
 }
 
 type Server struct {
-	ConnType string `yaml:"conn_type"` // "tcp" or "rtu"
-	SlaveID  int    `yaml:"slave_id"`
-	Addr     string `yaml:"addr"`      // TCP IP or RTU COMADDR
+	ConnType string `yaml:"conn_type"` // "tcp", "rtu" or "ws"
+	SlaveID  int    `yaml:"slave_id"`  // ignored, the unit ID is the key of the server; removed in version 2
+	Addr     string `yaml:"addr"`      // TCP IP, RTU COMADDR or WebSocket URL
 	Port     int    `yaml:"port"`      // TCP Port
 	BaudRate int    `yaml:"baud_rate"` // RTU Baud Rate
 	DataBits int    `yaml:"data_bits"` // RTU Data Bits
 	StopBits int    `yaml:"stop_bits"` // RTU Stop Bits
 	Parity   string `yaml:"parity"`    // RTU Parity
-	Timeout  int    `yaml:"timeout"`   // Timeout(seconds)
+	// RTU serial driver: "local" (default) for a serial port of this host,
+	// "rfc2217" or "tcp" for a remote serial port at addr host:port
+	SerialDriver string `yaml:"serial_driver"`
+	// local RTU serial port found by the serial number of its USB adapter
+	// instead of addr, resolved on every open
+	USBSerial string `yaml:"usb_serial"`
+	// RTU timing for slow slaves
+	InterCharTimeout int `yaml:"inter_char_timeout"` // max silence within a response(milliseconds), 0 (default) for none
+	TurnaroundDelay  int `yaml:"turnaround_delay"`   // min silence between a response and the next request(milliseconds), 0 (default) for none
+	// line settings probed on first connect instead of baud_rate and parity,
+	// nil disabled
+	BaudDetect *BaudDetect `yaml:"baud_detect"`
+	Timeout    int         `yaml:"timeout"` // Timeout(seconds)
+	// response timeouts of address ranges overriding timeout, e.g. for a
+	// range whose writes trigger a slow EEPROM write on the device
+	TimeoutRules []TimeoutRule `yaml:"timeout_rules"`
+	Aliases      []int         `yaml:"aliases"` // additional upstream unit IDs reaching this server
+
+	// function code filter, enforced before any downstream request
+	AllowedFunctionCodes []int `yaml:"allowed_function_codes"` // only these function codes are forwarded, empty for all
+	DeniedFunctionCodes  []int `yaml:"denied_function_codes"`  // these function codes are rejected
+	// forward the function codes the forwarder has no handler for, e.g.
+	// vendor specific ones, byte for byte instead of rejecting them
+	RawPassthrough bool `yaml:"raw_passthrough"`
+
+	HiddenRanges []AddressRange `yaml:"hidden_ranges"` // ranges upstream reads are not allowed to touch
+	StaticRanges []AddressRange `yaml:"static_ranges"` // ranges read from the slave once and cached, e.g. nameplate data
+	WriteLimits  []WriteLimit   `yaml:"write_limits"`  // write rate limits of registers or coils
+
+	WriteSchedule *WriteSchedule `yaml:"write_schedule"` // times writes are allowed, nil for any time
+	WriteRules    []WriteRule    `yaml:"write_rules"`    // allowed values of holding registers
+	Tags          []Tag          `yaml:"tags"`           // named points, e.g. for MQTT command topics
+
+	// request size limits, default to the Modbus specification maximum
+	MaxReadRegisters  int `yaml:"max_read_registers"`  // FC 3/4 quantity, max 125
+	MaxReadBits       int `yaml:"max_read_bits"`       // FC 1/2 quantity, max 2000
+	MaxWriteRegisters int `yaml:"max_write_registers"` // FC 16 quantity, max 123
+
+	SplitReads bool `yaml:"split_reads"` // split reads larger than the limits instead of rejecting them
+
+	// read-ahead merging of small reads
+	ReadAheadBlock int `yaml:"read_ahead_block"` // block size(registers or bits), 0 disabled
+	ReadAheadTTL   int `yaml:"read_ahead_ttl"`   // block lifetime(milliseconds), default 1000
+
+	WriteCoalesceWindow int `yaml:"write_coalesce_window"` // single register write hold time(milliseconds), 0 disabled
+
+	AsyncWrites *AsyncWrites `yaml:"async_writes"` // writes acknowledged upstream before they reach the slave
+
+	VerifyWrites   bool   `yaml:"verify_writes"`    // read written coils and holding registers back and compare
+	WriteAuditFile string `yaml:"write_audit_file"` // JSON lines change history of the writes with the values before and after
+
+	// background polling
+	Shadow     bool        `yaml:"shadow"`      // answer reads only from the polled ranges, never from the slave
+	Poll       []PollRange `yaml:"poll"`        // ranges polled into the shadow store
+	PollJitter int         `yaml:"poll_jitter"` // random variation of poll intervals(percent), 0-50
+
+	AgeRegisters *AgeRegisters `yaml:"age_registers"` // virtual registers holding the age of each poll range
+
+	Snapshots        *SnapshotSchedule `yaml:"snapshots"`          // periodic snapshots of register ranges written to disk
+	RestoreSetpoints *RestoreSetpoints `yaml:"restore_setpoints"`  // setpoints written from the last snapshot after prolonged downtime
+	SimulateWhenDown *SimulateWhenDown `yaml:"simulate_when_down"` // answer from a simulated slave while the slave is unreachable
+
+	// connection monitoring, overrides the global settings
+	MonitorInterval int    `yaml:"monitor_interval"`
+	ProbeType       string `yaml:"probe_type"`
+	ProbeAddress    *int   `yaml:"probe_address"`
+	ProbeQuantity   int    `yaml:"probe_quantity"`
+
+	ReconnectBackoff *BackoffConfig `yaml:"reconnect_backoff"` // overrides the global reconnect backoff
+
+	SocketOptions *SocketOptions `yaml:"socket_options"` // TCP tuning of the slave connection, nil for the defaults
+
+	IdlePing *IdlePing `yaml:"idle_ping"` // check of idle TCP connections detecting half-open sessions, nil disabled
+}
+
+// IdlePing application level check sent when the connection of a TCP slave
+// has been idle
+type IdlePing struct {
+	Idle     int    `yaml:"idle"`     // idle time before a ping(seconds), default 30
+	Type     string `yaml:"type"`     // "loopback" (FC 8 return query data, default), "holding", "input", "coils" or "discrete"
+	Address  int    `yaml:"address"`  // read address of the other types
+	Quantity int    `yaml:"quantity"` // read quantity of the other types, default 1
+}
+
+// PollRange range polled in the background into the shadow store
+type PollRange struct {
+	Type     string `yaml:"type"` // "holding", "input", "coils" or "discrete"
+	Address  int    `yaml:"address"`
+	Quantity int    `yaml:"quantity"`
+	Interval int    `yaml:"interval"` // poll interval(milliseconds), default 1000
+}
+
+// Tag named register or coil of a server
+type Tag struct {
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"` // "holding" (default), "input", "coils" or "discrete"
+	Address int    `yaml:"address"`
+
+	// register tags only
+	Scale     float64 `yaml:"scale"`      // value = register value * scale, default 1
+	Unit      string  `yaml:"unit"`       // unit of the value, e.g. "degC", "kW" or "bar"
+	ConvertTo string  `yaml:"convert_to"` // unit of the values over MQTT and the API, default unit
+
+	// bit fields and enums of register tags
+	Bit       *int           `yaml:"bit"`        // lowest bit of a bit field, 0-15, nil for the whole register
+	Bits      int            `yaml:"bits"`       // width of the bit field, default 1
+	Enum      map[int]string `yaml:"enum"`       // names of the values
+	MaskWrite bool           `yaml:"mask_write"` // write the bit field with FC 22 instead of reading and writing the register
+
+	// register tags only
+	DataType  string `yaml:"data_type"`  // "uint16" (default), "int16", "uint32", "int32", "float32", "uint64", "int64", "float64" or "string"
+	WordOrder string `yaml:"word_order"` // 32 and 64-bit types: "big" (default), high word first, or "little"
+
+	// string tags, data_type "string"
+	Length    int    `yaml:"length"`     // registers of the string, 2 characters each
+	ByteOrder string `yaml:"byte_order"` // "big" (default), first character in the high byte, or "little"
+	Encoding  string `yaml:"encoding"`   // "utf-8" (default) or "ascii"
+	Trim      string `yaml:"trim"`       // "nul" (default), end at the first NUL; "space", also trim trailing spaces; or "none"
+}
+
+// AddressRange range of one register or bit type
+type AddressRange struct {
+	Type     string `yaml:"type"` // "holding", "input", "coils" or "discrete"
+	Address  int    `yaml:"address"`
+	Quantity int    `yaml:"quantity"`
+}
+
+// WriteLimit limit of writes to a range per time window
+type WriteLimit struct {
+	Type      string `yaml:"type"` // "holding" (default) or "coils"
+	Address   int    `yaml:"address"`
+	Quantity  int    `yaml:"quantity"`   // default 1
+	MaxWrites int    `yaml:"max_writes"` // writes allowed within the window
+	Window    int    `yaml:"window"`     // window(seconds), default 60
+	Exception string `yaml:"exception"`  // exception returned for excess writes, default "slave_device_busy"
+}
+
+// WriteRule allowed values of a holding register range, checked before
+// writes are forwarded
+type WriteRule struct {
+	Address  int   `yaml:"address"`
+	Quantity int   `yaml:"quantity"` // default 1
+	Signed   bool  `yaml:"signed"`   // values are int16 instead of uint16
+	Min      *int  `yaml:"min"`
+	Max      *int  `yaml:"max"`
+	Values   []int `yaml:"values"` // allowed values, replaces min and max
+	Clamp    bool  `yaml:"clamp"`  // write values outside min and max as the nearest limit instead of rejecting them
+}
+
+// WriteSchedule times writes to a slave are allowed, e.g. shift hours
+type WriteSchedule struct {
+	Allow     []string `yaml:"allow"`      // cron expressions (minute hour day month weekday) of the minutes writes are allowed
+	Timezone  string   `yaml:"timezone"`   // IANA time zone of the expressions, default local time
+	Exception string   `yaml:"exception"`  // exception returned for writes outside the schedule, default "illegal_function"
+	AuditFile string   `yaml:"audit_file"` // JSON lines log of the denied writes, empty to only log them
+
+	Windows  []cronExpr     `yaml:"-"`
+	Location *time.Location `yaml:"-"`
+}
+
+// AsyncWrites writes acknowledged upstream right away and forwarded to the
+// slave in the background, for masters with short response timeouts
+type AsyncWrites struct {
+	QueueSize    int    `yaml:"queue_size"`    // writes waiting for the slave, default 100
+	AuditFile    string `yaml:"audit_file"`    // JSON lines file recording the result of every write, empty to only log failures
+	FlushTimeout int    `yaml:"flush_timeout"` // time limit(seconds) for writing the queue on shutdown, default 10
+}
+
+// SimulateWhenDown simulated slave answering while the real one is
+// unreachable, e.g. for FAT testing and demos
+type SimulateWhenDown struct {
+	Snapshot string `yaml:"snapshot"` // JSON or CSV snapshot of the initial values, default the last scheduled snapshot
+}
+
+// BaudDetect detection of the line settings of an RTU slave
+type BaudDetect struct {
+	Candidates   []LineSettings `yaml:"candidates"`    // tried in order, default the common baud rates with parity E and N
+	ProbeType    string         `yaml:"probe_type"`    // "holding" (default), "input", "coils" or "discrete"
+	ProbeAddress int            `yaml:"probe_address"` // address read by the probe, default 0
+	ProbeTimeout int            `yaml:"probe_timeout"` // response timeout of each candidate(milliseconds), default 500
+}
+
+// LineSettings serial line settings tried by baud rate detection
+type LineSettings struct {
+	BaudRate int    `yaml:"baud_rate"`
+	Parity   string `yaml:"parity"` // "N", "E" or "O", default the server parity
+}
+
+// TimeoutRule response timeout of the requests to a range
+type TimeoutRule struct {
+	Type      string `yaml:"type"` // "holding" (default), "input", "coils" or "discrete"
+	Address   int    `yaml:"address"`
+	Quantity  int    `yaml:"quantity"`  // default 1
+	Functions []int  `yaml:"functions"` // only requests with these function codes, empty for all
+	Timeout   int    `yaml:"timeout"`   // response timeout(milliseconds)
+}
+
+// AgeRegisters virtual registers holding the seconds since the last
+// successful poll of each poll range, one register per range
+type AgeRegisters struct {
+	Type    string `yaml:"type"` // "holding" or "input", default "holding"
+	Address int    `yaml:"address"`
+}
+
+// SnapshotSchedule periodic snapshots of register ranges, read from the
+// slave and written to timestamped files
+type SnapshotSchedule struct {
+	Dir      string         `yaml:"dir"`      // directory of the snapshot files
+	Interval int            `yaml:"interval"` // snapshot interval(seconds), default 3600
+	Keep     int            `yaml:"keep"`     // number of snapshots kept, default 24
+	Format   string         `yaml:"format"`   // "json" (default) or "csv"
+	Ranges   []AddressRange `yaml:"ranges"`   // ranges read for each snapshot
+}
+
+// RestoreSetpoints setpoints written from the last scheduled snapshot when
+// the slave comes back online after prolonged downtime, e.g. after the
+// device was replaced
+type RestoreSetpoints struct {
+	MinDowntime int            `yaml:"min_downtime"` // downtime before setpoints are restored(seconds), default 300
+	Ranges      []AddressRange `yaml:"ranges"`       // holding register or coil ranges restored
 }
 
 func loadConfig(path string) error {
@@ -38,7 +524,84 @@ func loadConfig(path string) error {
 		return fmt.Errorf("failed to read config file: %v", err)
 	}
 
+	return parseConfig(content)
+}
+
+// maxUnitID highest unit ID of an addressable slave, 248-255 are reserved
+const maxUnitID = 247
+
+// checkUnitID check the unit ID of an addressable slave
+func checkUnitID(id int) error {
+	if id < 1 || id > maxUnitID {
+		return fmt.Errorf("invalid unit ID %d: must be between 1-%d, 248-255 are reserved", id, maxUnitID)
+	}
+	return nil
+}
+
+// parseUnitKey parse a unit ID key of the YAML config
+func parseUnitKey(key string) (int, error) {
+	id, err := strconv.Atoi(key)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unit ID %q: must be a number", key)
+	}
+	return id, nil
+}
+
+// ServerMap servers by unit ID
+type ServerMap map[byte]Server
+
+// UnmarshalYAML decode the servers, keys out of the unit ID range are
+// reported by key instead of failing as a YAML type error
+func (m *ServerMap) UnmarshalYAML(unmarshal func(any) error) error {
+	var servers map[string]Server
+	if err := unmarshal(&servers); err != nil {
+		return err
+	}
+	*m = make(ServerMap, len(servers))
+	for key, server := range servers {
+		id, err := parseUnitKey(key)
+		if err == nil {
+			err = checkUnitID(id)
+		}
+		if err != nil {
+			return fmt.Errorf("servers: %v", err)
+		}
+		(*m)[byte(id)] = server
+	}
+	return nil
+}
+
+// UnitMap routes from upstream unit IDs to servers
+type UnitMap map[byte]byte
+
+// UnmarshalYAML decode the routes, upstream unit IDs are 0-255 and servers
+// are addressable unit IDs
+func (m *UnitMap) UnmarshalYAML(unmarshal func(any) error) error {
+	var units map[string]int
+	if err := unmarshal(&units); err != nil {
+		return err
+	}
+	*m = make(UnitMap, len(units))
+	for key, slaveID := range units {
+		unit, err := parseUnitKey(key)
+		if err == nil && (unit < 0 || unit > 255) {
+			err = fmt.Errorf("invalid unit ID %d: must be between 0-255", unit)
+		}
+		if err != nil {
+			return fmt.Errorf("units: %v", err)
+		}
+		if checkUnitID(slaveID) != nil {
+			return fmt.Errorf("units: unit %d: invalid server %d, must be between 1-%d", unit, slaveID, maxUnitID)
+		}
+		(*m)[byte(unit)] = byte(slaveID)
+	}
+	return nil
+}
+
+// parseConfig parse and validate YAML config content into C
+func parseConfig(content []byte) error {
 	// unmarshal yaml
+	C = Config{}
 	if err := yaml.Unmarshal(content, &C); err != nil {
 		return fmt.Errorf("failed to parse config file: %v", err)
 	}
@@ -52,64 +615,1389 @@ func loadConfig(path string) error {
 }
 
 func validateConfig() error {
+	if C.Version == 0 {
+		C.Version = 1
+	}
+	if C.Version < 0 || C.Version > configVersion {
+		return fmt.Errorf("unsupported version %d, this build supports config versions up to %d", C.Version, configVersion)
+	}
+	if C.Version >= 2 {
+		for slaveID, server := range C.Servers {
+			if server.SlaveID != 0 {
+				return fmt.Errorf("server %d: slave_id was removed in version 2, the unit ID is the key of the server", slaveID)
+			}
+		}
+	}
+
 	if C.ListenPort <= 0 {
 		C.ListenPort = 1602 // Default port
 	}
 
-	if len(C.Servers) == 0 {
+	if _, err := parseLogLevel(C.LogLevel); err != nil {
+		return err
+	}
+
+	if C.LogSampleRate < 0 {
+		return fmt.Errorf("invalid log_sample_rate %d: must not be negative", C.LogSampleRate)
+	}
+
+	if C.MaxConnectionsPerClient < 0 {
+		return fmt.Errorf("invalid max_connections_per_client %d: must not be negative", C.MaxConnectionsPerClient)
+	}
+	switch C.ConnectionLimitPolicy {
+	case "":
+		C.ConnectionLimitPolicy = "reject" // Default, keep the existing connections
+	case "reject", "close_oldest":
+	default:
+		return fmt.Errorf("invalid connection_limit_policy %s, must be 'reject' or 'close_oldest'", C.ConnectionLimitPolicy)
+	}
+
+	if C.DuplicateWindow < 0 {
+		return fmt.Errorf("invalid duplicate_window %d: must not be negative", C.DuplicateWindow)
+	}
+
+	if C.FairScheduling != nil {
+		for client, weight := range C.FairScheduling.Weights {
+			if weight < 1 {
+				return fmt.Errorf("fair_scheduling: invalid weight %d of %s: must be at least 1", weight, client)
+			}
+		}
+		names := make(map[string]bool)
+		for i := range C.FairScheduling.Classes {
+			class := &C.FairScheduling.Classes[i]
+			if class.Name == "" {
+				return fmt.Errorf("fair_scheduling: class %d: name is required", i+1)
+			}
+			if names[class.Name] {
+				return fmt.Errorf("fair_scheduling: duplicate class %s", class.Name)
+			}
+			names[class.Name] = true
+			if class.Weight == 0 {
+				class.Weight = 1 // Default weight
+			}
+			if class.Weight < 0 {
+				return fmt.Errorf("fair_scheduling: class %s: invalid weight %d: must be at least 1", class.Name, class.Weight)
+			}
+			if class.Name == defaultQoSClass && len(class.Clients) > 0 {
+				return fmt.Errorf("fair_scheduling: class %s is for the unlisted clients, it can't list clients", class.Name)
+			}
+		}
+	}
+
+	if C.ListenUnixModeText != "" {
+		mode, err := strconv.ParseUint(C.ListenUnixModeText, 8, 32)
+		if err != nil || mode > 0777 {
+			return fmt.Errorf("invalid listen_unix_mode %q: must be an octal file mode", C.ListenUnixModeText)
+		}
+		C.ListenUnixMode = os.FileMode(mode)
+	}
+
+	switch C.StartupPolicy {
+	case "":
+		C.StartupPolicy = "fail_fast" // Default, abort when a slave can't be connected
+	case "fail_fast", "degrade":
+	default:
+		return fmt.Errorf("invalid startup_policy %s, must be 'fail_fast' or 'degrade'", C.StartupPolicy)
+	}
+
+	switch C.UnroutedUnit {
+	case "":
+		C.UnroutedUnit = "gateway_path_unavailable" // Default, exception 0x0A
+	case "gateway_path_unavailable", "slave_device_failure", "silent":
+	default:
+		return fmt.Errorf("invalid unrouted_unit %s, must be 'gateway_path_unavailable', 'slave_device_failure' or 'silent'", C.UnroutedUnit)
+	}
+
+	if C.Keepalive != nil {
+		switch C.Keepalive.EmptyFrames {
+		case "":
+			C.Keepalive.EmptyFrames = "echo" // Default, send the frame back
+		case "echo", "ignore", "close":
+		default:
+			return fmt.Errorf("invalid keepalive empty_frames %s, must be 'echo', 'ignore' or 'close'", C.Keepalive.EmptyFrames)
+		}
+	}
+
+	if C.ReconnectBackoff != nil {
+		if err := validateBackoff(C.ReconnectBackoff); err != nil {
+			return fmt.Errorf("reconnect_backoff: %v", err)
+		}
+	}
+
+	if C.MonitorInterval <= 0 {
+		C.MonitorInterval = 30 // Default monitor interval(seconds)
+	}
+	if C.ProbeType == "" {
+		C.ProbeType = "holding" // Default probe, read holding registers
+	}
+	if C.ProbeAddress == nil {
+		C.ProbeAddress = new(int)
+		*C.ProbeAddress = 1 // Default probe address
+	}
+	if C.ProbeQuantity <= 0 {
+		C.ProbeQuantity = 1 // Default probe quantity
+	}
+	if err := validateProbe(C.ProbeType, *C.ProbeAddress, C.ProbeQuantity); err != nil {
+		return err
+	}
+	if err := validateHealth(&C.Health); err != nil {
+		return fmt.Errorf("health: %v", err)
+	}
+
+	if len(C.Servers) == 0 && len(C.Sniffers) == 0 && len(C.Taps) == 0 {
 		return fmt.Errorf("no servers configured")
 	}
 
 	for slaveID, server := range C.Servers {
-		if err := validateServer(slaveID, server); err != nil {
+		if err := validateServer(slaveID, &server); err != nil {
 			return err
 		}
+		C.Servers[slaveID] = server
 	}
 
-	return nil
-}
+	// aliases must not collide with configured servers or other aliases
+	aliases := make(map[int]byte)
+	for slaveID, server := range C.Servers {
+		for _, alias := range server.Aliases {
+			if err := checkUnitID(alias); err != nil {
+				return fmt.Errorf("server %d: alias: %v", slaveID, err)
+			}
+			if _, exists := C.Servers[byte(alias)]; exists {
+				return fmt.Errorf("server %d: alias %d is also configured as a server", slaveID, alias)
+			}
+			if other, exists := aliases[alias]; exists {
+				return fmt.Errorf("server %d: alias %d is already an alias of server %d", slaveID, alias, other)
+			}
+			aliases[alias] = slaveID
+		}
+	}
 
-func validateServer(slaveID byte, server Server) error {
-	if slaveID < 1 || slaveID > 255 {
-		return fmt.Errorf("invalid slave_id %d: must be between 1-255", slaveID)
+	if err := validateUnitPolicy(0, &C.Unit0, aliases); err != nil {
+		return err
+	}
+	if err := validateUnitPolicy(255, &C.Unit255, aliases); err != nil {
+		return err
 	}
 
-	if server.ConnType == "" {
-		return fmt.Errorf("server %d: conn_type is required", slaveID)
+	if C.WSPath == "" {
+		C.WSPath = "/modbus" // Default WebSocket endpoint
+	}
+	if !strings.HasPrefix(C.WSPath, "/") {
+		return fmt.Errorf("invalid ws_path %s: must start with /", C.WSPath)
+	}
+	for _, origin := range C.WSAllowedOrigins {
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || u.Scheme == "" || u.Host == "" || u.Path != "") {
+			return fmt.Errorf("invalid ws_allowed_origins entry %q: must be scheme://host[:port] or *", origin)
+		}
+	}
+	for unit, slaveID := range C.WSUnits {
+		if _, exists := C.Servers[slaveID]; !exists {
+			return fmt.Errorf("ws_units: unit %d routes to server %d which is not configured", unit, slaveID)
+		}
+	}
+	if C.WSValuesPath == "" {
+		C.WSValuesPath = "/values" // Default tag value stream endpoint
+	}
+	if !strings.HasPrefix(C.WSValuesPath, "/") || C.WSValuesPath == C.WSPath {
+		return fmt.Errorf("invalid ws_values_path %s: must start with / and differ from ws_path", C.WSValuesPath)
+	}
+	if C.WSValuesInterval < 0 {
+		return fmt.Errorf("invalid ws_values_interval %d: must not be negative", C.WSValuesInterval)
+	}
+	if C.WSValuesInterval == 0 {
+		C.WSValuesInterval = 5000
+	}
+	if C.WSAuth && C.AdminAuth == nil {
+		return fmt.Errorf("ws_auth requires admin_auth")
 	}
 
-	if server.ConnType != "tcp" && server.ConnType != "rtu" {
-		return fmt.Errorf("server %d: invalid conn_type %s, must be 'tcp' or 'rtu'", slaveID, server.ConnType)
+	if C.ListenSocketOptions != nil {
+		if err := validateSocketOptions(C.ListenSocketOptions); err != nil {
+			return fmt.Errorf("listen_socket_options: %v", err)
+		}
 	}
 
-	if server.ConnType == "tcp" {
-		if server.Addr == "" {
-			return fmt.Errorf("server %d: addr is required for TCP connection", slaveID)
+	if C.TLS != nil {
+		if err := validateTLS(C.TLS); err != nil {
+			return fmt.Errorf("tls: %v", err)
 		}
-		if server.Port <= 0 {
-			server.Port = 502 // Default modbus port
+	}
+
+	if C.AdminAuth != nil {
+		if err := validateAdminAuth(C.AdminAuth); err != nil {
+			return fmt.Errorf("admin_auth: %v", err)
 		}
-	} else if server.ConnType == "rtu" {
-		if server.Addr == "" {
-			return fmt.Errorf("server %d: addr is required for RTU connection", slaveID)
+	}
+	if (C.AdminCertFile == "") != (C.AdminKeyFile == "") {
+		return fmt.Errorf("admin_cert_file and admin_key_file must be set together")
+	}
+	if C.AdminClientCAFile != "" && C.AdminCertFile == "" {
+		return fmt.Errorf("admin_client_ca_file requires admin_cert_file")
+	}
+	if C.AdminAuth != nil && len(C.AdminAuth.Certs) > 0 && C.AdminClientCAFile == "" {
+		return fmt.Errorf("admin_auth: certs require admin_client_ca_file")
+	}
+
+	ports := map[int]bool{C.ListenPort: len(C.Listen) == 0}
+	addresses := make(map[string]bool)
+	for i := range C.Listen {
+		a := &C.Listen[i]
+		port, err := validateListenAddress(a)
+		if err != nil {
+			return fmt.Errorf("listen %d: %v", i+1, err)
 		}
-		if server.BaudRate <= 0 {
-			server.BaudRate = 9600 // Default baud rate
+		if addresses[a.Address] {
+			return fmt.Errorf("listen %d: duplicate address %s", i+1, a.Address)
 		}
-		if server.DataBits <= 0 {
-			server.DataBits = 8 // Default data bits
+		addresses[a.Address] = true
+		ports[port] = true
+	}
+	if C.TLS != nil {
+		ports[C.TLS.ListenPort] = true
+	}
+	tenants := make(map[string]bool)
+	for i := range C.Tenants {
+		t := &C.Tenants[i]
+		if err := validateTenant(t); err != nil {
+			return fmt.Errorf("tenant %d: %v", i+1, err)
 		}
-		if server.StopBits <= 0 {
-			server.StopBits = 1 // Default stop bits
+		if tenants[t.Name] {
+			return fmt.Errorf("tenant %d: duplicate name %s", i+1, t.Name)
 		}
-		if server.Parity == "" {
-			server.Parity = "N" // Default parity
+		tenants[t.Name] = true
+		if ports[t.ListenPort] {
+			return fmt.Errorf("tenant %s: listen_port %d is already used", t.Name, t.ListenPort)
 		}
+		ports[t.ListenPort] = true
 	}
 
-	if server.Timeout <= 0 {
-		server.Timeout = 2 // Default timeout(seconds)
+	if C.MQTT != nil {
+		if err := validateMQTT(C.MQTT); err != nil {
+			return fmt.Errorf("mqtt: %v", err)
+		}
+	}
+
+	for i := range C.Hooks {
+		if err := validateHook(&C.Hooks[i]); err != nil {
+			return fmt.Errorf("hook %d: %v", i+1, err)
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range C.Sniffers {
+		sn := &C.Sniffers[i]
+		if err := validateSniffer(sn); err != nil {
+			return fmt.Errorf("sniffer %d: %v", i+1, err)
+		}
+		if names[sn.Name] {
+			return fmt.Errorf("sniffer %d: duplicate name %s", i+1, sn.Name)
+		}
+		names[sn.Name] = true
+		if sn.MQTTTopic != "" && C.MQTT == nil {
+			return fmt.Errorf("sniffer %s: mqtt_topic requires mqtt", sn.Name)
+		}
+	}
+	for i := range C.Taps {
+		t := &C.Taps[i]
+		if err := validateTap(t); err != nil {
+			return fmt.Errorf("tap %d: %v", i+1, err)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("tap %d: duplicate name %s", i+1, t.Name)
+		}
+		names[t.Name] = true
+		if t.MQTTTopic != "" && C.MQTT == nil {
+			return fmt.Errorf("tap %s: mqtt_topic requires mqtt", t.Name)
+		}
+	}
+	if C.SniffPath == "" {
+		C.SniffPath = "/sniff" // Default sniffer stream endpoint
+	}
+	if !strings.HasPrefix(C.SniffPath, "/") || C.SniffPath == C.WSPath || C.SniffPath == C.WSValuesPath {
+		return fmt.Errorf("invalid sniff_path %s: must start with / and differ from ws_path and ws_values_path", C.SniffPath)
+	}
+
+	if err := validateDerived(aliases); err != nil {
+		return err
+	}
+
+	if C.DiagnosticUnit != 0 {
+		if C.DiagnosticUnit < 1 || C.DiagnosticUnit > 255 {
+			return fmt.Errorf("invalid diagnostic_unit %d: must be between 1-255", C.DiagnosticUnit)
+		}
+		if _, exists := C.Servers[byte(C.DiagnosticUnit)]; exists {
+			return fmt.Errorf("diagnostic_unit %d is also configured as a server", C.DiagnosticUnit)
+		}
+		if slaveID, exists := aliases[C.DiagnosticUnit]; exists {
+			return fmt.Errorf("diagnostic_unit %d is also an alias of server %d", C.DiagnosticUnit, slaveID)
+		}
 	}
 
 	return nil
 }
+
+// validateDerived check the derived registers, each value they read must be
+// polled
+func validateDerived(aliases map[int]byte) error {
+	if C.DerivedUnit == 0 {
+		if len(C.DerivedRegisters) > 0 {
+			return fmt.Errorf("derived_registers require derived_unit")
+		}
+		return nil
+	}
+	if C.DerivedUnit < 1 || C.DerivedUnit > 255 {
+		return fmt.Errorf("invalid derived_unit %d: must be between 1-255", C.DerivedUnit)
+	}
+	if _, exists := C.Servers[byte(C.DerivedUnit)]; exists {
+		return fmt.Errorf("derived_unit %d is also configured as a server", C.DerivedUnit)
+	}
+	if slaveID, exists := aliases[C.DerivedUnit]; exists {
+		return fmt.Errorf("derived_unit %d is also an alias of server %d", C.DerivedUnit, slaveID)
+	}
+	if C.DerivedUnit == C.DiagnosticUnit {
+		return fmt.Errorf("derived_unit %d is also the diagnostic_unit", C.DerivedUnit)
+	}
+
+	names := make(map[string]bool)
+	addresses := make(map[int]string)
+	for i := range C.DerivedRegisters {
+		r := &C.DerivedRegisters[i]
+		if r.Name == "" {
+			return fmt.Errorf("derived register %d: name is required", i+1)
+		}
+		if names[r.Name] {
+			return fmt.Errorf("derived register %d: duplicate name %s", i+1, r.Name)
+		}
+		names[r.Name] = true
+		if r.Address < 0 || r.Address > 0xFFFF {
+			return fmt.Errorf("derived register %s: invalid address %d", r.Name, r.Address)
+		}
+		if other, exists := addresses[r.Address]; exists {
+			return fmt.Errorf("derived register %s: address %d is already used by %s", r.Name, r.Address, other)
+		}
+		addresses[r.Address] = r.Name
+		if r.Scale == 0 {
+			r.Scale = 1 // Default, the result as is
+		}
+
+		compiled, err := parseExpr(r.Expr)
+		if err != nil {
+			return fmt.Errorf("derived register %s: invalid expr: %v", r.Name, err)
+		}
+		for _, ref := range compiled.refs {
+			if _, exists := C.Servers[ref.slaveID]; !exists {
+				return fmt.Errorf("derived register %s: server %d is not configured", r.Name, ref.slaveID)
+			}
+			if !C.Servers[ref.slaveID].polls(ref.typ, ref.address) {
+				return fmt.Errorf("derived register %s: %s %d of server %d is not polled", r.Name, ref.typ, ref.address, ref.slaveID)
+			}
+		}
+		r.Compiled = compiled
+	}
+	return nil
+}
+
+// polls report whether a poll range of the server covers address
+func (server Server) polls(typ string, address int) bool {
+	for _, r := range server.Poll {
+		if r.Type == typ && address >= r.Address && address < r.Address+r.Quantity {
+			return true
+		}
+	}
+	return false
+}
+
+func validateServer(slaveID byte, server *Server) error {
+	if err := checkUnitID(int(slaveID)); err != nil {
+		return err
+	}
+
+	if server.ConnType == "" {
+		return fmt.Errorf("server %d: conn_type is required", slaveID)
+	}
+
+	if server.ConnType != "tcp" && server.ConnType != "rtu" && server.ConnType != "ws" {
+		return fmt.Errorf("server %d: invalid conn_type %s, must be 'tcp', 'rtu' or 'ws'", slaveID, server.ConnType)
+	}
+
+	if server.ConnType == "ws" {
+		u, err := url.Parse(server.Addr)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return fmt.Errorf("server %d: addr must be a ws:// or wss:// URL for WebSocket connection", slaveID)
+		}
+	}
+
+	if server.ConnType == "tcp" {
+		if server.Addr == "" {
+			return fmt.Errorf("server %d: addr is required for TCP connection", slaveID)
+		}
+		if server.Port <= 0 {
+			server.Port = 502 // Default modbus port
+		}
+	} else if server.ConnType == "rtu" {
+		if server.Addr == "" && server.USBSerial == "" {
+			return fmt.Errorf("server %d: addr or usb_serial is required for RTU connection", slaveID)
+		}
+		if server.SerialDriver == "" {
+			server.SerialDriver = "local" // Default serial driver
+		}
+		if !slices.Contains(serialDriverNames, server.SerialDriver) {
+			return fmt.Errorf("server %d: invalid serial_driver %s, must be 'local', 'rfc2217' or 'tcp'", slaveID, server.SerialDriver)
+		}
+		if server.USBSerial != "" && (server.Addr != "" || server.SerialDriver != "local") {
+			return fmt.Errorf("server %d: usb_serial replaces addr and requires serial_driver local", slaveID)
+		}
+		if _, err := filepath.Match(server.Addr, ""); err != nil {
+			return fmt.Errorf("server %d: invalid addr pattern %s: %v", slaveID, server.Addr, err)
+		}
+		if server.SerialDriver != "local" {
+			if _, _, err := net.SplitHostPort(server.Addr); err != nil {
+				return fmt.Errorf("server %d: addr must be host:port for serial_driver %s", slaveID, server.SerialDriver)
+			}
+		}
+		if server.BaudRate <= 0 {
+			server.BaudRate = 9600 // Default baud rate
+		}
+		if server.DataBits <= 0 {
+			server.DataBits = 8 // Default data bits
+		}
+		if server.StopBits <= 0 {
+			server.StopBits = 1 // Default stop bits
+		}
+		if server.Parity == "" {
+			server.Parity = "N" // Default parity
+		}
+		if server.InterCharTimeout < 0 || server.TurnaroundDelay < 0 {
+			return fmt.Errorf("server %d: inter_char_timeout and turnaround_delay must not be negative", slaveID)
+		}
+		if server.BaudDetect != nil {
+			if server.SerialDriver == "tcp" {
+				return fmt.Errorf("server %d: baud_detect requires serial_driver local or rfc2217", slaveID)
+			}
+			if err := validateBaudDetect(server.BaudDetect, server.Parity); err != nil {
+				return fmt.Errorf("server %d: baud_detect: %v", slaveID, err)
+			}
+		}
+	} else if server.InterCharTimeout != 0 || server.TurnaroundDelay != 0 || server.BaudDetect != nil {
+		return fmt.Errorf("server %d: inter_char_timeout, turnaround_delay and baud_detect are only allowed for RTU connections", slaveID)
+	}
+
+	if server.Timeout <= 0 {
+		server.Timeout = 2 // Default timeout(seconds)
+	}
+
+	for _, functions := range [][]int{server.AllowedFunctionCodes, server.DeniedFunctionCodes} {
+		for _, function := range functions {
+			if function < 1 || function > 127 {
+				return fmt.Errorf("server %d: invalid function code %d: must be between 1-127", slaveID, function)
+			}
+		}
+	}
+
+	if err := validateLimit(&server.MaxReadRegisters, 125, "max_read_registers"); err != nil {
+		return fmt.Errorf("server %d: %v", slaveID, err)
+	}
+	if err := validateLimit(&server.MaxReadBits, 2000, "max_read_bits"); err != nil {
+		return fmt.Errorf("server %d: %v", slaveID, err)
+	}
+	if err := validateLimit(&server.MaxWriteRegisters, 123, "max_write_registers"); err != nil {
+		return fmt.Errorf("server %d: %v", slaveID, err)
+	}
+
+	if server.ReadAheadBlock < 0 || server.ReadAheadBlock > server.MaxReadRegisters {
+		return fmt.Errorf("server %d: invalid read_ahead_block %d: must be between 0-%d", slaveID, server.ReadAheadBlock, server.MaxReadRegisters)
+	}
+	if server.ReadAheadTTL <= 0 {
+		server.ReadAheadTTL = 1000 // Default read-ahead lifetime(milliseconds)
+	}
+
+	if server.WriteCoalesceWindow < 0 {
+		return fmt.Errorf("server %d: invalid write_coalesce_window %d", slaveID, server.WriteCoalesceWindow)
+	}
+
+	for i, r := range server.HiddenRanges {
+		if err := validateRange(r.Type, r.Address, r.Quantity); err != nil {
+			return fmt.Errorf("server %d: hidden range %d: %v", slaveID, i+1, err)
+		}
+	}
+	for i, r := range server.StaticRanges {
+		if err := validateRange(r.Type, r.Address, r.Quantity); err != nil {
+			return fmt.Errorf("server %d: static range %d: %v", slaveID, i+1, err)
+		}
+	}
+
+	if server.AsyncWrites != nil {
+		if server.AsyncWrites.QueueSize <= 0 {
+			server.AsyncWrites.QueueSize = 100 // Default queue size
+		}
+		if server.AsyncWrites.FlushTimeout < 0 {
+			return fmt.Errorf("server %d: async_writes flush_timeout must not be negative", slaveID)
+		}
+		if server.AsyncWrites.FlushTimeout == 0 {
+			server.AsyncWrites.FlushTimeout = 10 // Default flush timeout
+		}
+		if server.WriteCoalesceWindow > 0 {
+			return fmt.Errorf("server %d: async_writes and write_coalesce_window can't be combined", slaveID)
+		}
+	}
+
+	for i := range server.TimeoutRules {
+		if err := validateTimeoutRule(&server.TimeoutRules[i]); err != nil {
+			return fmt.Errorf("server %d: timeout rule %d: %v", slaveID, i+1, err)
+		}
+	}
+
+	if server.WriteSchedule != nil {
+		if err := validateWriteSchedule(server.WriteSchedule); err != nil {
+			return fmt.Errorf("server %d: write_schedule: %v", slaveID, err)
+		}
+	}
+
+	for i := range server.WriteRules {
+		if err := validateWriteRule(&server.WriteRules[i]); err != nil {
+			return fmt.Errorf("server %d: write rule %d: %v", slaveID, i+1, err)
+		}
+	}
+
+	for i := range server.WriteLimits {
+		if err := validateWriteLimit(&server.WriteLimits[i]); err != nil {
+			return fmt.Errorf("server %d: write limit %d: %v", slaveID, i+1, err)
+		}
+	}
+
+	tags := make(map[string]bool)
+	for i := range server.Tags {
+		tag := &server.Tags[i]
+		if err := validateTag(tag); err != nil {
+			return fmt.Errorf("server %d: tag %d: %v", slaveID, i+1, err)
+		}
+		if tags[tag.Name] {
+			return fmt.Errorf("server %d: duplicate tag %s", slaveID, tag.Name)
+		}
+		tags[tag.Name] = true
+	}
+
+	for i := range server.Poll {
+		if err := validatePollRange(&server.Poll[i]); err != nil {
+			return fmt.Errorf("server %d: poll range %d: %v", slaveID, i+1, err)
+		}
+	}
+	if server.PollJitter < 0 || server.PollJitter > 50 {
+		return fmt.Errorf("server %d: invalid poll_jitter %d: must be between 0-50", slaveID, server.PollJitter)
+	}
+	if server.Shadow && len(server.Poll) == 0 {
+		return fmt.Errorf("server %d: shadow mode requires poll ranges", slaveID)
+	}
+	if ages := server.AgeRegisters; ages != nil {
+		if len(server.Poll) == 0 {
+			return fmt.Errorf("server %d: age_registers requires poll ranges", slaveID)
+		}
+		if ages.Type == "" {
+			ages.Type = "holding"
+		}
+		if ages.Type != "holding" && ages.Type != "input" {
+			return fmt.Errorf("server %d: invalid age_registers type %s, must be 'holding' or 'input'", slaveID, ages.Type)
+		}
+		if ages.Address < 0 || ages.Address+len(server.Poll) > 0x10000 {
+			return fmt.Errorf("server %d: invalid age_registers address %d", slaveID, ages.Address)
+		}
+	}
+
+	if server.Snapshots != nil {
+		if err := validateSnapshotSchedule(server.Snapshots); err != nil {
+			return fmt.Errorf("server %d: snapshots: %v", slaveID, err)
+		}
+	}
+	if r := server.RestoreSetpoints; r != nil {
+		if server.Snapshots == nil {
+			return fmt.Errorf("server %d: restore_setpoints requires snapshots", slaveID)
+		}
+		if err := validateRestoreSetpoints(r); err != nil {
+			return fmt.Errorf("server %d: restore_setpoints: %v", slaveID, err)
+		}
+	}
+
+	if sim := server.SimulateWhenDown; sim != nil && sim.Snapshot != "" {
+		if _, err := os.Stat(sim.Snapshot); err != nil {
+			return fmt.Errorf("server %d: simulate_when_down: %v", slaveID, err)
+		}
+	}
+
+	// inherit global monitor settings
+	if server.MonitorInterval <= 0 {
+		server.MonitorInterval = C.MonitorInterval
+	}
+	if server.ProbeType == "" {
+		server.ProbeType = C.ProbeType
+	}
+	if server.ProbeAddress == nil {
+		server.ProbeAddress = C.ProbeAddress
+	}
+	if server.ProbeQuantity <= 0 {
+		server.ProbeQuantity = C.ProbeQuantity
+	}
+	if err := validateProbe(server.ProbeType, *server.ProbeAddress, server.ProbeQuantity); err != nil {
+		return fmt.Errorf("server %d: %v", slaveID, err)
+	}
+	if server.ReconnectBackoff == nil {
+		server.ReconnectBackoff = C.ReconnectBackoff
+	} else if err := validateBackoff(server.ReconnectBackoff); err != nil {
+		return fmt.Errorf("server %d: reconnect_backoff: %v", slaveID, err)
+	}
+
+	if p := server.IdlePing; p != nil {
+		if server.ConnType != "tcp" {
+			return fmt.Errorf("server %d: idle_ping requires conn_type tcp", slaveID)
+		}
+		if err := validateIdlePing(p); err != nil {
+			return fmt.Errorf("server %d: idle_ping: %v", slaveID, err)
+		}
+	}
+
+	if o := server.SocketOptions; o != nil {
+		if server.ConnType == "rtu" && server.SerialDriver == "local" {
+			return fmt.Errorf("server %d: socket_options require a TCP connection, not a local serial port", slaveID)
+		}
+		if err := validateSocketOptions(o); err != nil {
+			return fmt.Errorf("server %d: socket_options: %v", slaveID, err)
+		}
+	}
+
+	return nil
+}
+
+func validateIdlePing(p *IdlePing) error {
+	if p.Idle <= 0 {
+		p.Idle = 30 // Default idle time
+	}
+	if p.Type == "" {
+		p.Type = "loopback" // Default ping, FC 8 return query data
+	}
+	if p.Quantity <= 0 {
+		p.Quantity = 1 // Default read quantity
+	}
+	switch p.Type {
+	case "loopback", "holding", "input", "coils", "discrete":
+	default:
+		return fmt.Errorf("invalid type %s, must be 'loopback', 'holding', 'input', 'coils' or 'discrete'", p.Type)
+	}
+	if p.Address < 0 || p.Address > 0xFFFF {
+		return fmt.Errorf("invalid address %d: must be between 0-65535", p.Address)
+	}
+	if p.Quantity > 125 {
+		return fmt.Errorf("invalid quantity %d: must be between 1-125", p.Quantity)
+	}
+	return nil
+}
+
+func validateTLS(c *TLSConfig) error {
+	if c.ListenPort <= 0 {
+		c.ListenPort = 802 // Default Modbus/TCP Security port
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return fmt.Errorf("cert_file and key_file are required")
+	}
+	names := make(map[string]bool)
+	for i, p := range c.Profiles {
+		if p.ServerName == "" {
+			return fmt.Errorf("profile %d: server_name is required", i+1)
+		}
+		if names[p.ServerName] {
+			return fmt.Errorf("profile %d: duplicate server_name %s", i+1, p.ServerName)
+		}
+		names[p.ServerName] = true
+		if (p.CertFile == "") != (p.KeyFile == "") {
+			return fmt.Errorf("profile %s: cert_file and key_file must be set together", p.ServerName)
+		}
+		for unit, slaveID := range p.Units {
+			if _, exists := C.Servers[slaveID]; !exists {
+				return fmt.Errorf("profile %s: unit %d routes to server %d which is not configured", p.ServerName, unit, slaveID)
+			}
+		}
+	}
+	return nil
+}
+
+func validateAdminAuth(a *AdminAuthConfig) error {
+	if len(a.Tokens)+len(a.Users)+len(a.Certs) == 0 {
+		return fmt.Errorf("no tokens, users or certs configured")
+	}
+	for name, caps := range a.Roles {
+		if _, ok := builtinRoles[name]; ok {
+			return fmt.Errorf("role %s: built-in roles cannot be redefined", name)
+		}
+		for _, c := range caps {
+			if !adminCapabilities[c] {
+				return fmt.Errorf("role %s: invalid capability %s, must be 'status', 'read', 'write' or 'config'", name, c)
+			}
+		}
+	}
+	// Default role viewer
+	role := func(r *string) error {
+		if *r == "" {
+			*r = "viewer"
+		}
+		if _, ok := builtinRoles[*r]; !ok && a.Roles[*r] == nil {
+			return fmt.Errorf("unknown role %s", *r)
+		}
+		return nil
+	}
+
+	names := make(map[string]bool)
+	for i := range a.Tokens {
+		t := &a.Tokens[i]
+		if t.Name == "" {
+			return fmt.Errorf("token %d: name is required", i+1)
+		}
+		if names[t.Name] {
+			return fmt.Errorf("token %d: duplicate name %s", i+1, t.Name)
+		}
+		names[t.Name] = true
+		if len(t.Token) < 16 {
+			return fmt.Errorf("token %s: token must be at least 16 characters", t.Name)
+		}
+		if err := role(&t.Role); err != nil {
+			return fmt.Errorf("token %s: %v", t.Name, err)
+		}
+	}
+	names = make(map[string]bool)
+	for i := range a.Users {
+		u := &a.Users[i]
+		if u.Username == "" || u.Password == "" {
+			return fmt.Errorf("user %d: username and password are required", i+1)
+		}
+		if names[u.Username] {
+			return fmt.Errorf("user %d: duplicate username %s", i+1, u.Username)
+		}
+		names[u.Username] = true
+		if err := role(&u.Role); err != nil {
+			return fmt.Errorf("user %s: %v", u.Username, err)
+		}
+	}
+	names = make(map[string]bool)
+	for i := range a.Certs {
+		c := &a.Certs[i]
+		if c.CommonName == "" {
+			return fmt.Errorf("cert %d: common_name is required", i+1)
+		}
+		if names[c.CommonName] {
+			return fmt.Errorf("cert %d: duplicate common_name %s", i+1, c.CommonName)
+		}
+		names[c.CommonName] = true
+		if err := role(&c.Role); err != nil {
+			return fmt.Errorf("cert %s: %v", c.CommonName, err)
+		}
+	}
+	return nil
+}
+
+// validateListenAddress check a listen address and return its port
+func validateListenAddress(a *ListenAddress) (int, error) {
+	host, portText, err := net.SplitHostPort(a.Address)
+	if err != nil {
+		return 0, fmt.Errorf("invalid address %q: %v", a.Address, err)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return 0, fmt.Errorf("invalid address %q: host must be an IP address", a.Address)
+	}
+	port, err := strconv.Atoi(portText)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid address %q: invalid port", a.Address)
+	}
+	for unit, slaveID := range a.Units {
+		if _, exists := C.Servers[slaveID]; !exists {
+			return 0, fmt.Errorf("%s: unit %d routes to server %d which is not configured", a.Address, unit, slaveID)
+		}
+	}
+	return port, nil
+}
+
+func validateTenant(t *TenantConfig) error {
+	if t.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if t.ListenPort < 1 || t.ListenPort > 65535 {
+		return fmt.Errorf("tenant %s: invalid listen_port %d", t.Name, t.ListenPort)
+	}
+	if len(t.Units) == 0 {
+		return fmt.Errorf("tenant %s: units are required", t.Name)
+	}
+	for unit, slaveID := range t.Units {
+		if _, exists := C.Servers[slaveID]; !exists {
+			return fmt.Errorf("tenant %s: unit %d routes to server %d which is not configured", t.Name, unit, slaveID)
+		}
+	}
+	if t.MaxConnections < 0 {
+		return fmt.Errorf("tenant %s: invalid max_connections %d", t.Name, t.MaxConnections)
+	}
+	if t.MaxRequestRate < 0 || t.RequestBurst < 0 {
+		return fmt.Errorf("tenant %s: invalid max_request_rate %d or request_burst %d", t.Name, t.MaxRequestRate, t.RequestBurst)
+	}
+	if t.RequestBurst == 0 {
+		t.RequestBurst = max(t.MaxRequestRate, 1)
+	}
+	return nil
+}
+
+func validateMQTT(c *MQTTConfig) error {
+	if c.Broker == "" {
+		return fmt.Errorf("broker is required")
+	}
+	if c.ClientID == "" {
+		c.ClientID = "mb-forwarder"
+	}
+	if c.CommandTopic == "" {
+		c.CommandTopic = "mbf/{slave}/{tag}/set"
+	}
+	if c.ResponseTopic == "" {
+		c.ResponseTopic = "mbf/{slave}/{tag}/result"
+	}
+	if c.StateTopic == "" {
+		c.StateTopic = "mbf/{slave}/{tag}/state"
+	}
+	if c.AvailabilityTopic == "" {
+		c.AvailabilityTopic = "mbf/{slave}/{tag}/availability"
+	}
+	if c.StateInterval < 0 {
+		return fmt.Errorf("invalid state_interval %d: must not be negative", c.StateInterval)
+	}
+	switch c.StateFormat {
+	case "":
+		c.StateFormat = "value"
+	case "value", "json":
+	default:
+		return fmt.Errorf("invalid state_format %s: must be value or json", c.StateFormat)
+	}
+	if c.Discovery && c.StateInterval == 0 {
+		c.StateInterval = 5000 // Default with discovery, entities need values
+	}
+	if c.DiscoveryPrefix == "" {
+		c.DiscoveryPrefix = "homeassistant"
+	}
+	for _, topic := range []string{c.CommandTopic, c.ResponseTopic, c.StateTopic, c.AvailabilityTopic} {
+		if strings.ContainsAny(topic, "+#") {
+			return fmt.Errorf("invalid topic %s: wildcards are not allowed, use {slave} and {tag}", topic)
+		}
+		for _, level := range strings.Split(topic, "/") {
+			if strings.Contains(level, "{") && level != "{slave}" && level != "{tag}" {
+				return fmt.Errorf("invalid topic %s: {slave} and {tag} must be whole topic levels", topic)
+			}
+		}
+	}
+	for _, placeholder := range []string{"{slave}", "{tag}"} {
+		if !strings.Contains(c.CommandTopic, placeholder) {
+			return fmt.Errorf("invalid command_topic %s: %s is required", c.CommandTopic, placeholder)
+		}
+		if !strings.Contains(c.StateTopic, placeholder) {
+			return fmt.Errorf("invalid state_topic %s: %s is required", c.StateTopic, placeholder)
+		}
+		if !strings.Contains(c.AvailabilityTopic, placeholder) {
+			return fmt.Errorf("invalid availability_topic %s: %s is required", c.AvailabilityTopic, placeholder)
+		}
+	}
+	if c.QoS < 0 || c.QoS > 2 {
+		return fmt.Errorf("invalid qos %d: must be 0, 1 or 2", c.QoS)
+	}
+	return nil
+}
+
+// validateUnitPolicy validate the policy of unit ID 0 or 255, which must not
+// also be a server or alias unless rejected
+func validateUnitPolicy(unit int, policy *UnitPolicy, aliases map[int]byte) error {
+	switch policy.Policy {
+	case "":
+		policy.Policy = "reject" // Default, requests fail like unknown unit IDs
+		return nil
+	case "reject":
+		return nil
+	case "broadcast":
+	case "forward":
+		if policy.Target == 0 && len(C.Servers) == 1 {
+			// a single TCP device behind the forwarder
+			for slaveID := range C.Servers {
+				policy.Target = int(slaveID)
+			}
+		}
+		if policy.Target == 0 {
+			return fmt.Errorf("unit_%d: target is required with more than one server", unit)
+		}
+		if _, exists := C.Servers[byte(policy.Target)]; checkUnitID(policy.Target) != nil || !exists {
+			return fmt.Errorf("unit_%d: target %d is not a configured server", unit, policy.Target)
+		}
+	default:
+		return fmt.Errorf("unit_%d: invalid policy %s, must be 'reject', 'broadcast' or 'forward'", unit, policy.Policy)
+	}
+
+	if _, exists := C.Servers[byte(unit)]; exists {
+		return fmt.Errorf("unit_%d: unit ID %d is also configured as a server", unit, unit)
+	}
+	if slaveID, exists := aliases[unit]; exists {
+		return fmt.Errorf("unit_%d: unit ID %d is also an alias of server %d", unit, unit, slaveID)
+	}
+	return nil
+}
+
+// validateLimit default a request size limit to the specification maximum
+func validateLimit(limit *int, max int, name string) error {
+	if *limit == 0 {
+		*limit = max
+	}
+	if *limit < 1 || *limit > max {
+		return fmt.Errorf("invalid %s %d: must be between 1-%d", name, *limit, max)
+	}
+	return nil
+}
+
+func validateRange(typ string, address, quantity int) error {
+	if _, ok := pollFunctions[typ]; !ok {
+		return fmt.Errorf("invalid type %s, must be 'holding', 'input', 'coils' or 'discrete'", typ)
+	}
+	if address < 0 || address > 0xFFFF {
+		return fmt.Errorf("invalid address %d: must be between 0-65535", address)
+	}
+	if quantity < 1 || address+quantity > 0x10000 {
+		return fmt.Errorf("invalid quantity %d: must be between 1-%d", quantity, 0x10000-address)
+	}
+	return nil
+}
+
+func validateHook(h *HookConfig) error {
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return fmt.Errorf("exactly one of command and url is required")
+	}
+	if h.URL != "" {
+		u, err := url.Parse(h.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid url %q: must be an http or https URL", h.URL)
+		}
+	}
+	for _, event := range h.Events {
+		if !slices.Contains(hookEvents, event) {
+			return fmt.Errorf("unknown event %q: must be one of %s", event, strings.Join(hookEvents, ", "))
+		}
+	}
+	if h.Timeout < 0 {
+		return fmt.Errorf("invalid timeout %d", h.Timeout)
+	}
+	if h.Timeout == 0 {
+		h.Timeout = 10 // Default hook time limit
+	}
+	if h.Name == "" {
+		h.Name = h.URL
+		if len(h.Command) > 0 {
+			h.Name = h.Command[0]
+		}
+	}
+	return nil
+}
+
+func validateSniffer(sn *SnifferConfig) error {
+	if sn.Addr == "" {
+		return fmt.Errorf("addr is required")
+	}
+	if sn.Name == "" {
+		sn.Name = sn.Addr
+	}
+	if sn.BaudRate <= 0 {
+		sn.BaudRate = 9600 // Default baud rate
+	}
+	if sn.DataBits <= 0 {
+		sn.DataBits = 8 // Default data bits
+	}
+	if sn.StopBits <= 0 {
+		sn.StopBits = 1 // Default stop bits
+	}
+	if sn.Parity == "" {
+		sn.Parity = "N" // Default parity
+	}
+	return nil
+}
+
+func validateTap(t *TapConfig) error {
+	if _, _, err := net.SplitHostPort(t.Listen); err != nil {
+		return fmt.Errorf("invalid listen %s: %v", t.Listen, err)
+	}
+	if _, _, err := net.SplitHostPort(t.Backend); err != nil {
+		return fmt.Errorf("invalid backend %s: %v", t.Backend, err)
+	}
+	if t.Name == "" {
+		t.Name = t.Listen
+	}
+	return nil
+}
+
+func validateTag(t *Tag) error {
+	if t.Name == "" || strings.ContainsAny(t.Name, "/+#") {
+		return fmt.Errorf("invalid name %q: must not be empty or contain '/', '+' or '#'", t.Name)
+	}
+	if t.Type == "" {
+		t.Type = "holding"
+	}
+	if t.DataType == "" {
+		t.DataType = "uint16"
+	}
+	if t.DataType == "string" {
+		if err := validateStringTag(t); err != nil {
+			return err
+		}
+	} else if _, ok := dataTypes[t.DataType]; !ok {
+		return fmt.Errorf("unknown data_type %s", t.DataType)
+	} else if t.Length != 0 || t.ByteOrder != "" || t.Encoding != "" || t.Trim != "" {
+		return fmt.Errorf("length, byte_order, encoding and trim are only allowed for string tags")
+	}
+	if t.DataType != "uint16" && t.Type != "holding" && t.Type != "input" {
+		return fmt.Errorf("data_type %s requires a holding or input register", t.DataType)
+	}
+	if t.DataType != "uint16" && (t.Bit != nil || len(t.Enum) > 0) {
+		return fmt.Errorf("bit and enum require data_type uint16")
+	}
+	if t.registers() > 1 && t.DataType != "string" {
+		if t.WordOrder == "" {
+			t.WordOrder = "big" // Default, high word first
+		}
+		if t.WordOrder != "big" && t.WordOrder != "little" {
+			return fmt.Errorf("invalid word_order %s: must be big or little", t.WordOrder)
+		}
+	} else if t.WordOrder != "" {
+		return fmt.Errorf("word_order is only allowed for 32 and 64-bit data types")
+	}
+	if err := validateRange(t.Type, t.Address, t.registers()); err != nil {
+		return err
+	}
+
+	bits := t.Type == "coils" || t.Type == "discrete"
+	if bits && (t.Scale != 0 || t.Unit != "" || t.ConvertTo != "" || t.Bit != nil || len(t.Enum) > 0) {
+		return fmt.Errorf("scale, unit, convert_to, bit and enum are only allowed for register tags")
+	}
+	if (t.Bit != nil || len(t.Enum) > 0) && (t.Scale != 0 || t.Unit != "") {
+		return fmt.Errorf("bit and enum can't be combined with scale or unit")
+	}
+	if t.Bit != nil {
+		if t.Bits == 0 {
+			t.Bits = 1 // Default, a single bit
+		}
+		if *t.Bit < 0 || t.Bits < 1 || *t.Bit+t.Bits > 16 {
+			return fmt.Errorf("invalid bit %d and bits %d: the field must be within bits 0-15", *t.Bit, t.Bits)
+		}
+	} else if t.Bits != 0 {
+		return fmt.Errorf("bits requires bit")
+	}
+	if t.MaskWrite && (t.Bit == nil || t.Type != "holding") {
+		return fmt.Errorf("mask_write requires bit and a holding register")
+	}
+	names := make(map[string]bool)
+	for value, name := range t.Enum {
+		max := 0xFFFF
+		if t.Bit != nil {
+			max = 1<<t.Bits - 1
+		}
+		if value < 0 || value > max {
+			return fmt.Errorf("invalid enum value %d: must be between 0-%d", value, max)
+		}
+		if name == "" || names[name] {
+			return fmt.Errorf("invalid enum name %q of value %d: must be unique and not empty", name, value)
+		}
+		names[name] = true
+	}
+	if t.Scale == 0 {
+		t.Scale = 1 // Default, the register value as is
+	}
+	if t.ConvertTo != "" && t.Unit == "" {
+		return fmt.Errorf("convert_to requires unit")
+	}
+	if t.ConvertTo == "" {
+		t.ConvertTo = t.Unit // Default, no conversion
+	}
+	for _, unit := range []string{t.Unit, t.ConvertTo} {
+		if _, ok := measureUnits[unit]; unit != "" && !ok {
+			return fmt.Errorf("unknown unit %s", unit)
+		}
+	}
+	if measureUnits[t.Unit].quantity != measureUnits[t.ConvertTo].quantity {
+		return fmt.Errorf("can't convert %s to %s", t.Unit, t.ConvertTo)
+	}
+	return nil
+}
+
+func validateStringTag(t *Tag) error {
+	if t.Scale != 0 || t.Unit != "" || t.ConvertTo != "" || t.Bit != nil || len(t.Enum) > 0 {
+		return fmt.Errorf("scale, unit, convert_to, bit and enum can't be used with string tags")
+	}
+	// a single write request at most
+	if t.Length < 1 || t.Length > 123 {
+		return fmt.Errorf("invalid length %d: must be between 1-123", t.Length)
+	}
+	if t.ByteOrder == "" {
+		t.ByteOrder = "big"
+	}
+	if t.ByteOrder != "big" && t.ByteOrder != "little" {
+		return fmt.Errorf("invalid byte_order %s: must be big or little", t.ByteOrder)
+	}
+	if t.Encoding == "" {
+		t.Encoding = "utf-8"
+	}
+	if t.Encoding != "utf-8" && t.Encoding != "ascii" {
+		return fmt.Errorf("invalid encoding %s: must be utf-8 or ascii", t.Encoding)
+	}
+	if t.Trim == "" {
+		t.Trim = "nul"
+	}
+	if t.Trim != "nul" && t.Trim != "space" && t.Trim != "none" {
+		return fmt.Errorf("invalid trim %s: must be nul, space or none", t.Trim)
+	}
+	return nil
+}
+
+func validateHealth(h *HealthConfig) error {
+	if h.Alpha == 0 {
+		h.Alpha = 0.1 // Default, about the last 20 transactions
+	}
+	if h.Alpha < 0 || h.Alpha > 1 {
+		return fmt.Errorf("invalid alpha %v: must be between 0-1", h.Alpha)
+	}
+	if h.LatencyTarget < 0 {
+		return fmt.Errorf("invalid latency_target %d", h.LatencyTarget)
+	}
+	if h.LatencyTarget == 0 {
+		h.LatencyTarget = 1000 // Default latency target(milliseconds)
+	}
+	if h.UpAbove == 0 {
+		h.UpAbove = h.DownBelow // Default, no hysteresis
+	}
+	if h.DownBelow < 0 || h.DownBelow > 1 || h.UpAbove > 1 || h.UpAbove < h.DownBelow {
+		return fmt.Errorf("invalid down_below %v and up_above %v: must be between 0-1, up_above at least down_below", h.DownBelow, h.UpAbove)
+	}
+	return nil
+}
+
+func validateBaudDetect(d *BaudDetect, parity string) error {
+	if len(d.Candidates) == 0 {
+		d.Candidates = defaultBaudCandidates // Default candidates
+	}
+	for i := range d.Candidates {
+		c := &d.Candidates[i]
+		if c.BaudRate <= 0 {
+			return fmt.Errorf("candidate %d: invalid baud_rate %d", i+1, c.BaudRate)
+		}
+		if c.Parity == "" {
+			c.Parity = parity // Default the server parity
+		}
+		if c.Parity != "N" && c.Parity != "E" && c.Parity != "O" {
+			return fmt.Errorf("candidate %d: invalid parity %s, must be N, E or O", i+1, c.Parity)
+		}
+	}
+	if d.ProbeType == "" {
+		d.ProbeType = "holding" // Default probe, read a holding register
+	}
+	if err := validateRange(d.ProbeType, d.ProbeAddress, 1); err != nil {
+		return fmt.Errorf("probe: %v", err)
+	}
+	if d.ProbeTimeout < 0 {
+		return fmt.Errorf("invalid probe_timeout %d", d.ProbeTimeout)
+	}
+	if d.ProbeTimeout == 0 {
+		d.ProbeTimeout = 500 // Default probe timeout(milliseconds)
+	}
+	return nil
+}
+
+func validateTimeoutRule(r *TimeoutRule) error {
+	if r.Type == "" {
+		r.Type = "holding"
+	}
+	if r.Quantity == 0 {
+		r.Quantity = 1
+	}
+	if err := validateRange(r.Type, r.Address, r.Quantity); err != nil {
+		return err
+	}
+	for _, function := range r.Functions {
+		if function < 1 || function > 127 {
+			return fmt.Errorf("invalid function code %d: must be between 1-127", function)
+		}
+	}
+	if r.Timeout <= 0 {
+		return fmt.Errorf("timeout is required")
+	}
+	return nil
+}
+
+func validateWriteLimit(l *WriteLimit) error {
+	if l.Type == "" {
+		l.Type = "holding"
+	}
+	if l.Type != "holding" && l.Type != "coils" {
+		return fmt.Errorf("invalid type %s, must be 'holding' or 'coils'", l.Type)
+	}
+	if l.Quantity == 0 {
+		l.Quantity = 1
+	}
+	if err := validateRange(l.Type, l.Address, l.Quantity); err != nil {
+		return err
+	}
+	if l.MaxWrites < 1 {
+		return fmt.Errorf("invalid max_writes %d: must be at least 1", l.MaxWrites)
+	}
+	if l.Window <= 0 {
+		l.Window = 60 // Default window(seconds)
+	}
+	if l.Exception == "" {
+		l.Exception = "slave_device_busy"
+	}
+	if _, ok := exceptionNames[l.Exception]; !ok {
+		return fmt.Errorf("invalid exception %s", l.Exception)
+	}
+	return nil
+}
+
+func validateWriteRule(r *WriteRule) error {
+	if r.Quantity == 0 {
+		r.Quantity = 1
+	}
+	if err := validateRange("holding", r.Address, r.Quantity); err != nil {
+		return err
+	}
+	if r.Min == nil && r.Max == nil && len(r.Values) == 0 {
+		return fmt.Errorf("min, max or values is required")
+	}
+	if len(r.Values) > 0 && (r.Min != nil || r.Max != nil || r.Clamp) {
+		return fmt.Errorf("values can't be combined with min, max or clamp")
+	}
+	lo, hi := 0, 65535
+	if r.Signed {
+		lo, hi = -32768, 32767
+	}
+	for _, v := range r.Values {
+		if v < lo || v > hi {
+			return fmt.Errorf("invalid value %d: must be between %d-%d", v, lo, hi)
+		}
+	}
+	for _, v := range []*int{r.Min, r.Max} {
+		if v != nil && (*v < lo || *v > hi) {
+			return fmt.Errorf("invalid limit %d: must be between %d-%d", *v, lo, hi)
+		}
+	}
+	if r.Min != nil && r.Max != nil && *r.Min > *r.Max {
+		return fmt.Errorf("min %d is greater than max %d", *r.Min, *r.Max)
+	}
+	return nil
+}
+
+func validateWriteSchedule(w *WriteSchedule) error {
+	if len(w.Allow) == 0 {
+		return fmt.Errorf("allow is required")
+	}
+	w.Windows = nil
+	for _, expr := range w.Allow {
+		c, err := parseCron(expr)
+		if err != nil {
+			return err
+		}
+		w.Windows = append(w.Windows, c)
+	}
+	w.Location = time.Local // Default local time
+	if w.Timezone != "" {
+		location, err := time.LoadLocation(w.Timezone)
+		if err != nil {
+			return fmt.Errorf("invalid timezone %s: %v", w.Timezone, err)
+		}
+		w.Location = location
+	}
+	if w.Exception == "" {
+		w.Exception = "illegal_function"
+	}
+	if _, ok := exceptionNames[w.Exception]; !ok {
+		return fmt.Errorf("invalid exception %s", w.Exception)
+	}
+	return nil
+}
+
+func validatePollRange(r *PollRange) error {
+	if err := validateRange(r.Type, r.Address, r.Quantity); err != nil {
+		return err
+	}
+	if r.Interval <= 0 {
+		r.Interval = 1000 // Default poll interval(milliseconds)
+	}
+	return nil
+}
+
+func validateSnapshotSchedule(c *SnapshotSchedule) error {
+	if c.Dir == "" {
+		return fmt.Errorf("dir is required")
+	}
+	if c.Interval <= 0 {
+		c.Interval = 3600 // Default snapshot interval(seconds)
+	}
+	if c.Keep <= 0 {
+		c.Keep = 24 // Default number of snapshots kept
+	}
+	if c.Format == "" {
+		c.Format = "json"
+	}
+	if c.Format != "json" && c.Format != "csv" {
+		return fmt.Errorf("invalid format %s, must be 'json' or 'csv'", c.Format)
+	}
+	if len(c.Ranges) == 0 {
+		return fmt.Errorf("ranges are required")
+	}
+	for i, r := range c.Ranges {
+		if err := validateRange(r.Type, r.Address, r.Quantity); err != nil {
+			return fmt.Errorf("range %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func validateRestoreSetpoints(r *RestoreSetpoints) error {
+	if r.MinDowntime <= 0 {
+		r.MinDowntime = 300 // Default downtime(seconds)
+	}
+	if len(r.Ranges) == 0 {
+		return fmt.Errorf("ranges are required")
+	}
+	for i, rng := range r.Ranges {
+		if rng.Type != "holding" && rng.Type != "coils" {
+			return fmt.Errorf("range %d: invalid type %s, must be 'holding' or 'coils'", i+1, rng.Type)
+		}
+		if err := validateRange(rng.Type, rng.Address, rng.Quantity); err != nil {
+			return fmt.Errorf("range %d: %v", i+1, err)
+		}
+	}
+	return nil
+}
+
+func validateBackoff(b *BackoffConfig) error {
+	switch b.Strategy {
+	case "":
+		b.Strategy = "exponential_jitter"
+	case "constant", "exponential", "exponential_jitter", "fibonacci":
+	default:
+		return fmt.Errorf("invalid strategy %s, must be 'constant', 'exponential', 'exponential_jitter' or 'fibonacci'", b.Strategy)
+	}
+	if b.Min <= 0 {
+		b.Min = 1000 // Default first delay(milliseconds)
+	}
+	if b.Max <= 0 {
+		b.Max = 60000 // Default maximum delay(milliseconds)
+	}
+	if b.Max < b.Min {
+		return fmt.Errorf("max %d is less than min %d", b.Max, b.Min)
+	}
+	return nil
+}
+
+func validateProbe(probeType string, address, quantity int) error {
+	switch probeType {
+	case "holding", "input", "coils", "discrete", "none":
+	default:
+		return fmt.Errorf("invalid probe_type %s, must be 'holding', 'input', 'coils', 'discrete' or 'none'", probeType)
+	}
+	if address < 0 || address > 0xFFFF {
+		return fmt.Errorf("invalid probe_address %d: must be between 0-65535", address)
+	}
+	if quantity > 125 {
+		return fmt.Errorf("invalid probe_quantity %d: must be between 1-125", quantity)
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// connectionKeys server settings a changed value of makes the forwarder
+// connect to the slave differently once restarted with the new config
+var connectionKeys = map[string]bool{
+	"conn_type": true, "addr": true, "port": true, "baud_rate": true, "data_bits": true,
+	"stop_bits": true, "parity": true, "serial_driver": true, "usb_serial": true,
+	"inter_char_timeout": true, "turnaround_delay": true, "baud_detect": true, "timeout": true,
+	"reconnect_backoff": true,
+}
+
+// secretKeys settings whose values are not shown in a plan
+var secretKeys = map[string]bool{"password": true, "token": true}
+
+// configChange one changed setting by dotted YAML path, a section added or
+// removed as a whole, e.g. a server, is one change without values
+type configChange struct {
+	Path string `json:"path"`
+	Kind string `json:"kind"` // "added", "removed" or "changed"
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+// configPlan differences between two configs and their impact
+type configPlan struct {
+	ServersAdded   []int          `json:"servers_added"`
+	ServersRemoved []int          `json:"servers_removed"`
+	ServersChanged []int          `json:"servers_changed"`
+	Reconnected    []int          `json:"connections_changed"` // servers connected differently with the new config
+	Changes        []configChange `json:"changes"`
+}
+
+// flattenConfig the settings of a YAML document by dotted path
+func flattenConfig(prefix string, v any, out map[string]string) {
+	switch v := v.(type) {
+	case map[any]any:
+		for key, value := range v {
+			flattenConfig(prefix+fmt.Sprint(key)+".", value, out)
+		}
+	case []any:
+		for i, value := range v {
+			flattenConfig(prefix+strconv.Itoa(i)+".", value, out)
+		}
+	case nil:
+		// not set
+	default:
+		out[strings.TrimSuffix(prefix, ".")] = fmt.Sprint(v)
+	}
+}
+
+// configSettings the settings of c by dotted path
+func configSettings(c *Config) (map[string]string, error) {
+	content, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var tree any
+	if err := yaml.Unmarshal(content, &tree); err != nil {
+		return nil, err
+	}
+	settings := make(map[string]string)
+	flattenConfig("", tree, settings)
+	return settings, nil
+}
+
+// planConfig compare the validated configs old and new
+func planConfig(old, new *Config) (configPlan, error) {
+	plan := configPlan{ServersAdded: []int{}, ServersRemoved: []int{}, ServersChanged: []int{}, Reconnected: []int{}, Changes: []configChange{}}
+	before, err := configSettings(old)
+	if err != nil {
+		return plan, err
+	}
+	after, err := configSettings(new)
+	if err != nil {
+		return plan, err
+	}
+
+	paths := make(map[string]bool)
+	for path := range before {
+		paths[path] = true
+	}
+	for path := range after {
+		paths[path] = true
+	}
+	oldSections, newSections := configSections(before), configSections(after)
+	sections := make(map[string]bool)
+	changed := make(map[int]bool)
+	reconnected := make(map[int]bool)
+	for path := range paths {
+		oldValue, existed := before[path]
+		newValue, exists := after[path]
+		if existed == exists && oldValue == newValue {
+			continue
+		}
+		change := configChange{Path: path, Kind: "changed", Old: oldValue, New: newValue}
+		if parts := strings.Split(path, "."); secretKeys[parts[len(parts)-1]] {
+			change.Old, change.New = maskSecret(change.Old), maskSecret(change.New)
+		}
+		switch {
+		case !existed:
+			change.Kind = "added"
+			// report a section added as a whole once
+			if section := sectionOf(path, oldSections); section != path {
+				change = configChange{Path: section, Kind: "added"}
+			}
+		case !exists:
+			change.Kind = "removed"
+			if section := sectionOf(path, newSections); section != path {
+				change = configChange{Path: section, Kind: "removed"}
+			}
+		}
+		if !sections[change.Path] {
+			sections[change.Path] = true
+			plan.Changes = append(plan.Changes, change)
+		}
+
+		parts := strings.SplitN(path, ".", 4)
+		if parts[0] != "servers" || len(parts) < 3 {
+			continue
+		}
+		id, _ := strconv.Atoi(parts[1])
+		_, inOld := old.Servers[byte(id)]
+		_, inNew := new.Servers[byte(id)]
+		if inOld && inNew {
+			changed[id] = true
+			if connectionKeys[parts[2]] {
+				reconnected[id] = true
+			}
+		}
+	}
+	sort.Slice(plan.Changes, func(i, j int) bool { return plan.Changes[i].Path < plan.Changes[j].Path })
+
+	for id := range old.Servers {
+		if _, ok := new.Servers[id]; !ok {
+			plan.ServersRemoved = append(plan.ServersRemoved, int(id))
+		}
+	}
+	for id := range new.Servers {
+		if _, ok := old.Servers[id]; !ok {
+			plan.ServersAdded = append(plan.ServersAdded, int(id))
+			reconnected[int(id)] = true
+		}
+	}
+	for id := range changed {
+		plan.ServersChanged = append(plan.ServersChanged, id)
+	}
+	for id := range reconnected {
+		plan.Reconnected = append(plan.Reconnected, id)
+	}
+	sort.Ints(plan.ServersAdded)
+	sort.Ints(plan.ServersRemoved)
+	sort.Ints(plan.ServersChanged)
+	sort.Ints(plan.Reconnected)
+	return plan, nil
+}
+
+// configSections the dotted paths of the sections containing settings
+func configSections(settings map[string]string) map[string]bool {
+	sections := make(map[string]bool)
+	for path := range settings {
+		parts := strings.Split(path, ".")
+		for i := 1; i < len(parts); i++ {
+			sections[strings.Join(parts[:i], ".")] = true
+		}
+	}
+	return sections
+}
+
+// sectionOf the outermost section of path missing from the other config,
+// path itself when only the setting is missing
+func sectionOf(path string, sections map[string]bool) string {
+	parts := strings.Split(path, ".")
+	for i := 1; i < len(parts); i++ {
+		if section := strings.Join(parts[:i], "."); !sections[section] {
+			return section
+		}
+	}
+	return path
+}
+
+// shownValue value as printed in a plan, empty strings quoted
+func shownValue(value string) string {
+	if value == "" {
+		return `""`
+	}
+	return value
+}
+
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "***"
+}
+
+// writePlan print plan for humans
+func writePlan(w io.Writer, plan configPlan) {
+	if len(plan.Changes) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return
+	}
+	list := func(ids []int) string {
+		s := make([]string, len(ids))
+		for i, id := range ids {
+			s[i] = strconv.Itoa(id)
+		}
+		return strings.Join(s, ", ")
+	}
+	for _, section := range []struct {
+		name string
+		ids  []int
+	}{
+		{"servers added", plan.ServersAdded},
+		{"servers removed", plan.ServersRemoved},
+		{"servers changed", plan.ServersChanged},
+		{"connections changed", plan.Reconnected},
+	} {
+		if len(section.ids) > 0 {
+			fmt.Fprintf(w, "%s: %s\n", section.name, list(section.ids))
+		}
+	}
+	fmt.Fprintln(w, "changes:")
+	for _, c := range plan.Changes {
+		switch {
+		case c.Kind == "changed":
+			fmt.Fprintf(w, "  ~ %s: %s -> %s\n", c.Path, shownValue(c.Old), shownValue(c.New))
+		case c.Kind == "added" && c.New != "":
+			fmt.Fprintf(w, "  + %s: %s\n", c.Path, c.New)
+		case c.Kind == "added":
+			fmt.Fprintf(w, "  + %s\n", c.Path)
+		case c.Old != "":
+			fmt.Fprintf(w, "  - %s: %s\n", c.Path, c.Old)
+		default:
+			fmt.Fprintf(w, "  - %s\n", c.Path)
+		}
+	}
+}
+
+// runConfigPlan compare the config file the forwarder runs with to a new
+// one and show what changes, without applying anything
+func runConfigPlan(args []string) int {
+	fs := flag.NewFlagSet("config plan", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the plan as JSON")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s config plan [-json] current.yaml new.yaml\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		fs.Usage()
+		return 2
+	}
+
+	if err := loadConfig(fs.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(0), err)
+		return 1
+	}
+	old := C
+	if err := loadConfig(fs.Arg(1)); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", fs.Arg(1), err)
+		return 1
+	}
+	plan, err := planConfig(&old, &C)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to compare configs: %v\n", err)
+		return 1
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(plan)
+		return 0
+	}
+	writePlan(os.Stdout, plan)
+	return 0
+}
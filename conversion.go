@@ -0,0 +1,40 @@
+package main
+
+import "math"
+
+// measureUnit unit of a tag value, converted through the base unit of its
+// quantity: base = value * factor + offset
+type measureUnit struct {
+	quantity string
+	factor   float64
+	offset   float64
+	symbol   string // shown by Home Assistant
+}
+
+// measureUnits units selectable as tag unit and convert_to
+var measureUnits = map[string]measureUnit{
+	"degC": {quantity: "temperature", factor: 1, symbol: "°C"},
+	"degF": {quantity: "temperature", factor: 5.0 / 9, offset: -160.0 / 9, symbol: "°F"},
+	"K":    {quantity: "temperature", factor: 1, offset: -273.15, symbol: "K"},
+	"W":    {quantity: "power", factor: 1, symbol: "W"},
+	"kW":   {quantity: "power", factor: 1000, symbol: "kW"},
+	"hp":   {quantity: "power", factor: 745.69987158227022, symbol: "hp"},
+	"Pa":   {quantity: "pressure", factor: 1, symbol: "Pa"},
+	"kPa":  {quantity: "pressure", factor: 1000, symbol: "kPa"},
+	"bar":  {quantity: "pressure", factor: 100000, symbol: "bar"},
+	"psi":  {quantity: "pressure", factor: 6894.757293168361, symbol: "psi"},
+}
+
+// convertUnit convert value from one unit to another of the same quantity
+func convertUnit(value float64, from, to string) float64 {
+	if from == to {
+		return value
+	}
+	f, t := measureUnits[from], measureUnits[to]
+	return (value*f.factor + f.offset - t.offset) / t.factor
+}
+
+// roundValue drop the floating point noise of scaled and converted values
+func roundValue(v float64) float64 {
+	return math.Round(v*1e6) / 1e6
+}
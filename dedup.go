@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// dupEntry result of one request kept for answering retransmissions
+type dupEntry struct {
+	done     chan struct{} // closed once response is set
+	response mbserver.Framer
+	received time.Time
+}
+
+// dupCache recent requests by client and request ADU
+type dupCache struct {
+	window time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*dupEntry
+}
+
+func newDupCache(window time.Duration) *dupCache {
+	return &dupCache{window: window, entries: make(map[string]*dupEntry)}
+}
+
+// size return the number of requests within the window at now, c may be nil
+func (c *dupCache) size(now time.Time) int {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for _, e := range c.entries {
+		if now.Sub(e.received) < c.window {
+			n++
+		}
+	}
+	return n
+}
+
+// deduplicate answer a retransmission of a request of client, same
+// transaction ID and payload within the duplicate window, with the response
+// of the original request instead of calling handle again
+func (s *Forwarder) deduplicate(client string, stats *upstreamStats, frame mbserver.Framer, handle func() mbserver.Framer) mbserver.Framer {
+	c := s.duplicates
+	if c == nil {
+		return handle()
+	}
+
+	key := client + "|" + string(frame.Bytes())
+	now := s.clock.Now()
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.Sub(e.received) >= c.window {
+			delete(c.entries, k)
+		}
+	}
+	if e, ok := c.entries[key]; ok {
+		c.mu.Unlock()
+		// the original may still be in progress on another connection
+		<-e.done
+		stats.duplicates.Add(1)
+		s.logger.Debugf("answered retransmitted request from %s with the original response", client)
+		return e.response
+	}
+	e := &dupEntry{done: make(chan struct{}), received: now}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	defer close(e.done)
+	e.response = handle()
+	return e.response
+}
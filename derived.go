@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tbrandon/mbserver"
+)
+
+var errDerivedValue = errors.New("result is not a number")
+
+// registerRef polled register or bit an expression reads
+type registerRef struct {
+	slaveID byte
+	typ     string // "holding", "input", "coils" or "discrete"
+	address int
+}
+
+// derivedExpr compiled expression of a derived register
+type derivedExpr struct {
+	refs []registerRef                  // registers read, in order of eval's values
+	eval func(values []float64) float64 // compute the result from the values of refs
+}
+
+// exprParser recursive descent parser of derived register expressions
+type exprParser struct {
+	tokens []string
+	pos    int
+	refs   []registerRef
+}
+
+// functions of derived register expressions, taking any number of arguments
+// and taking one
+var (
+	exprFunctions = map[string]func(args []float64) float64{
+		"min": func(args []float64) float64 {
+			v := args[0]
+			for _, a := range args[1:] {
+				v = math.Min(v, a)
+			}
+			return v
+		},
+		"max": func(args []float64) float64 {
+			v := args[0]
+			for _, a := range args[1:] {
+				v = math.Max(v, a)
+			}
+			return v
+		},
+	}
+	exprUnary = map[string]func(float64) float64{
+		"abs":   math.Abs,
+		"round": math.Round,
+		// reinterpret a register value as signed
+		"int16": func(v float64) float64 { return float64(int16(uint16(v))) },
+	}
+)
+
+// parseExpr compile an expression of numbers, + - * / %, parentheses, the
+// functions min, max, abs, round and int16, and polled values read with
+// holding(slave, address), input(...), coils(...) and discrete(...)
+func parseExpr(text string) (*derivedExpr, error) {
+	tokens, err := tokenizeExpr(text)
+	if err != nil {
+		return nil, err
+	}
+	p := &exprParser{tokens: tokens}
+	eval, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return &derivedExpr{refs: p.refs, eval: eval}, nil
+}
+
+// tokenizeExpr split text into numbers, names and operators
+func tokenizeExpr(text string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(text); {
+		c := rune(text[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case strings.ContainsRune("+-*/%(),", c):
+			tokens = append(tokens, string(c))
+			i++
+		case unicode.IsDigit(c) || c == '.' || unicode.IsLetter(c) || c == '_':
+			j := i
+			for j < len(text) && (unicode.IsDigit(rune(text[j])) || unicode.IsLetter(rune(text[j])) || text[j] == '_' || text[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, text[i:j])
+			i = j
+		default:
+			return nil, fmt.Errorf("unexpected %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+// next return the next token, empty at the end
+func (p *exprParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	p.pos++
+	return p.tokens[p.pos-1]
+}
+
+// peek return the next token without consuming it
+func (p *exprParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// expect consume token
+func (p *exprParser) expect(token string) error {
+	if t := p.next(); t != token {
+		if t == "" {
+			return fmt.Errorf("expected %q at the end", token)
+		}
+		return fmt.Errorf("expected %q, got %q", token, t)
+	}
+	return nil
+}
+
+// expr sum of terms
+func (p *exprParser) expr() (func([]float64) float64, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "+" || p.peek() == "-" {
+		op := p.next()
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		if op == "+" {
+			left = func(v []float64) float64 { return l(v) + right(v) }
+		} else {
+			left = func(v []float64) float64 { return l(v) - right(v) }
+		}
+	}
+	return left, nil
+}
+
+// term product of factors
+func (p *exprParser) term() (func([]float64) float64, error) {
+	left, err := p.unary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "*" || p.peek() == "/" || p.peek() == "%" {
+		op := p.next()
+		right, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		switch op {
+		case "*":
+			left = func(v []float64) float64 { return l(v) * right(v) }
+		case "/":
+			left = func(v []float64) float64 { return l(v) / right(v) }
+		default:
+			left = func(v []float64) float64 { return math.Mod(l(v), right(v)) }
+		}
+	}
+	return left, nil
+}
+
+// unary negated or plain primary
+func (p *exprParser) unary() (func([]float64) float64, error) {
+	if p.peek() == "-" {
+		p.next()
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(v []float64) float64 { return -operand(v) }, nil
+	}
+	return p.primary()
+}
+
+// primary number, parenthesized expression, function call or polled value
+func (p *exprParser) primary() (func([]float64) float64, error) {
+	token := p.next()
+	switch {
+	case token == "":
+		return nil, fmt.Errorf("unexpected end")
+	case token == "(":
+		inner, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case unicode.IsDigit(rune(token[0])) || token[0] == '.':
+		n, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", token)
+		}
+		return func([]float64) float64 { return n }, nil
+	}
+
+	if err := p.expect("("); err != nil {
+		return nil, fmt.Errorf("%s: %v", token, err)
+	}
+	if _, ok := pollFunctions[token]; ok {
+		return p.ref(token)
+	}
+	var args []func([]float64) float64
+	for {
+		arg, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+		if p.peek() != "," {
+			break
+		}
+		p.next()
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+
+	if f, ok := exprUnary[token]; ok {
+		if len(args) != 1 {
+			return nil, fmt.Errorf("%s takes one argument", token)
+		}
+		return func(v []float64) float64 { return f(args[0](v)) }, nil
+	}
+	f, ok := exprFunctions[token]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", token)
+	}
+	return func(v []float64) float64 {
+		values := make([]float64, len(args))
+		for i, arg := range args {
+			values[i] = arg(v)
+		}
+		return f(values)
+	}, nil
+}
+
+// ref polled value typ(slave, address), both integer literals
+func (p *exprParser) ref(typ string) (func([]float64) float64, error) {
+	slave, err := strconv.Atoi(p.next())
+	if err != nil || checkUnitID(slave) != nil {
+		return nil, fmt.Errorf("%s: invalid slave", typ)
+	}
+	if err := p.expect(","); err != nil {
+		return nil, fmt.Errorf("%s: %v", typ, err)
+	}
+	address, err := strconv.Atoi(p.next())
+	if err != nil || address < 0 || address > 0xFFFF {
+		return nil, fmt.Errorf("%s: invalid address", typ)
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, fmt.Errorf("%s: %v", typ, err)
+	}
+	i := len(p.refs)
+	p.refs = append(p.refs, registerRef{slaveID: byte(slave), typ: typ, address: address})
+	return func(v []float64) float64 { return v[i] }, nil
+}
+
+// qualityRank order of the polled value qualities, worst last
+var qualityRank = map[string]int{"good": 0, "stale": 1, "bad": 2, "never-read": 3}
+
+// polled return a polled value with its quality
+func (s *Forwarder) polled(ref registerRef, now time.Time) (float64, string, error) {
+	s.clientsMux.RLock()
+	client := s.clients[ref.slaveID]
+	s.clientsMux.RUnlock()
+	if client == nil || client.shadow == nil {
+		return 0, "", errNotPolled
+	}
+	function := pollFunctions[ref.typ]
+	for _, g := range client.shadow.groups {
+		if g.function != function || ref.address < g.address || ref.address >= g.address+g.quantity {
+			continue
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		quality := g.quality(now)
+		if g.data == nil {
+			return 0, quality, errNeverPolled
+		}
+		results, ok := extractRange(function, g.data, ref.address-g.address, 1)
+		if !ok {
+			return 0, quality, errNeverPolled
+		}
+		if function <= 2 {
+			return float64(results[0] & 1), quality, nil
+		}
+		return float64(binary.BigEndian.Uint16(results)), quality, nil
+	}
+	return 0, "", errNotPolled
+}
+
+// derive compute derived register r, return the result and the worst
+// quality of the values it was computed from
+func (s *Forwarder) derive(r DerivedRegister) (float64, string, error) {
+	now := s.clock.Now()
+	quality := "good"
+	values := make([]float64, len(r.Compiled.refs))
+	for i, ref := range r.Compiled.refs {
+		v, q, err := s.polled(ref, now)
+		if err != nil {
+			return 0, "never-read", err
+		}
+		if qualityRank[q] > qualityRank[quality] {
+			quality = q
+		}
+		values[i] = v
+	}
+	result := r.Compiled.eval(values) * r.Scale
+	if math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, "bad", errDerivedValue
+	}
+	return result, quality, nil
+}
+
+// registerValue round a derived result to a register, negative results are
+// stored as int16, the result is limited to the register range
+func registerValue(result float64) uint16 {
+	return uint16(int32(math.Round(math.Max(-0x8000, math.Min(0xFFFF, result)))))
+}
+
+// isDerivedUnit report whether unit is the configured derived unit ID
+func (s *Forwarder) isDerivedUnit(unit byte) bool {
+	return s.config.DerivedUnit != 0 && unit == byte(s.config.DerivedUnit)
+}
+
+// handleDerived answer a read of the derived registers, as holding or input
+// registers
+func (s *Forwarder) handleDerived(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	function := frame.GetFunction()
+	if function != 3 && function != 4 {
+		return nil, &mbserver.IllegalFunction
+	}
+	data := frame.GetData()
+	if len(data) < 4 {
+		return nil, &mbserver.IllegalDataValue
+	}
+	address := int(binary.BigEndian.Uint16(data))
+	quantity := int(binary.BigEndian.Uint16(data[2:]))
+	if quantity < 1 || quantity > 125 {
+		return nil, &mbserver.IllegalDataValue
+	}
+
+	results := make([]byte, quantity*2)
+	for i := 0; i < quantity; i++ {
+		r, ok := s.derivedRegister(address + i)
+		if !ok {
+			return nil, &mbserver.IllegalDataAddress
+		}
+		result, _, err := s.derive(r)
+		switch {
+		case errors.Is(err, errNeverPolled), errors.Is(err, errNotPolled):
+			return nil, &mbserver.GatewayTargetDeviceFailedtoRespond
+		case err != nil:
+			s.logger.Warnf("derived register %s: %v", r.Name, err)
+			return nil, &mbserver.SlaveDeviceFailure
+		}
+		binary.BigEndian.PutUint16(results[i*2:], registerValue(result))
+	}
+	return readResponse(results), &mbserver.Success
+}
+
+// derivedRegister find the derived register at address
+func (s *Forwarder) derivedRegister(address int) (DerivedRegister, bool) {
+	for _, r := range s.config.DerivedRegisters {
+		if r.Address == address {
+			return r, true
+		}
+	}
+	return DerivedRegister{}, false
+}
+
+// derivedValue current value of a derived register
+type derivedValue struct {
+	Name     string   `json:"name"`
+	Address  int      `json:"address"`
+	Value    *float64 `json:"value"`    // null while it can't be computed
+	Register *int     `json:"register"` // value served upstream
+	Quality  string   `json:"quality"`
+	Error    string   `json:"error,omitempty"`
+}
+
+// derivedValues compute all derived registers
+func (s *Forwarder) derivedValues() []derivedValue {
+	values := []derivedValue{}
+	for _, r := range s.config.DerivedRegisters {
+		v := derivedValue{Name: r.Name, Address: r.Address}
+		result, quality, err := s.derive(r)
+		v.Quality = quality
+		if err != nil {
+			v.Error = err.Error()
+		} else {
+			register := int(registerValue(result))
+			v.Value, v.Register = &result, &register
+		}
+		values = append(values, v)
+	}
+	return values
+}
+
+// handleDerivedValues GET /api/derived, derived register values with quality
+func (s *Forwarder) handleDerivedValues(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.derivedValues())
+}
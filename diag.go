@@ -0,0 +1,206 @@
+package main
+
+import (
+	"github.com/tbrandon/mbserver"
+)
+
+// diagnostic unit register map, served by the forwarder itself on the
+// holding and input registers of diagnostic_unit
+const (
+	diagUptime      = 0   // uptime seconds, 32 bit, high word first
+	diagSlaves      = 2   // configured slaves
+	diagSlavesUp    = 3   // slaves up
+	diagConnections = 4   // open upstream connections
+	diagQueued      = 5   // requests queued for all slaves
+	diagUpBits      = 16  // 16 registers, bit n%16 of register 16+n/16 is set when slave n is up
+	diagSlaveBase   = 100 // per slave block at 100+slave*8
+	diagSlaveSize   = 8   // state (0 unknown, 1 up, 2 down, 3 disabled), queue depth, requests, errors, reconnects (32 bit)
+	diagRegisters   = diagSlaveBase + 256*diagSlaveSize
+
+	// control registers, written by diagnostic_control clients, read as 0
+	diagReconnect     = 10 // write a slave ID to force it to reconnect, 0xFFFF for all slaves
+	diagClearCounters = 11 // write a slave ID to clear its counters, 0xFFFF for all slaves
+	diagAllSlaves     = 0xFFFF
+)
+
+// isDiagnosticUnit report whether unit is the configured diagnostic unit ID
+func (s *Forwarder) isDiagnosticUnit(unit byte) bool {
+	return s.config.DiagnosticUnit != 0 && unit == byte(s.config.DiagnosticUnit)
+}
+
+// diagnosticRegisters build the register image of the diagnostic unit
+func (s *Forwarder) diagnosticRegisters() []uint16 {
+	regs := make([]uint16, diagRegisters)
+	put32 := func(address int, v uint64) {
+		v = min(v, 0xFFFFFFFF)
+		regs[address], regs[address+1] = uint16(v>>16), uint16(v)
+	}
+
+	status := s.status()
+	put32(diagUptime, uint64(status.Uptime))
+	regs[diagSlaves] = uint16(len(status.Slaves))
+	for _, slave := range status.Slaves {
+		base := diagSlaveBase + slave.SlaveID*diagSlaveSize
+		switch slave.State {
+		case "up":
+			regs[diagSlavesUp]++
+			regs[diagUpBits+slave.SlaveID/16] |= 1 << (slave.SlaveID % 16)
+			regs[base] = 1
+		case "down":
+			regs[base] = 2
+		case "disabled":
+			regs[base] = 3
+		}
+		regs[diagQueued] += uint16(slave.QueueDepth)
+		regs[base+1] = uint16(slave.QueueDepth)
+		put32(base+2, slave.Requests)
+		put32(base+4, slave.Errors)
+		put32(base+6, slave.Reconnects)
+	}
+
+	s.connsMux.Lock()
+	regs[diagConnections] = uint16(len(s.conns))
+	s.connsMux.Unlock()
+	return regs
+}
+
+// handleDiagnostic answer a request of the upstream client to the diagnostic unit
+func (s *Forwarder) handleDiagnostic(frame mbserver.Framer, client string) ([]byte, *mbserver.Exception) {
+	data := frame.GetData()
+	if len(data) < 4 {
+		return nil, &mbserver.IllegalDataValue
+	}
+	address := int(data[0])<<8 | int(data[1])
+	quantity := int(data[2])<<8 | int(data[3])
+
+	switch frame.GetFunction() {
+	case 1:
+		// slave enabled bits, coil n is slave n
+		if quantity < 1 || quantity > 2000 {
+			return nil, &mbserver.IllegalDataValue
+		}
+		if address+quantity > 256 {
+			return nil, &mbserver.IllegalDataAddress
+		}
+		response := make([]byte, 1+(quantity+7)/8)
+		response[0] = byte(len(response) - 1)
+		for i := 0; i < quantity; i++ {
+			if _, err := s.getClient(byte(address + i)); err == nil {
+				response[1+i/8] |= 1 << (i % 8)
+			}
+		}
+		return response, &mbserver.Success
+	case 5, 6:
+		if !s.diagnosticControl(client) {
+			s.logger.Warnf("diagnostic unit: client %s is not allowed to write", client)
+			return nil, &mbserver.IllegalFunction
+		}
+		if frame.GetFunction() == 5 {
+			return s.diagnosticEnable(address, quantity, data)
+		}
+		return s.diagnosticCommand(address, quantity, data)
+	case 2:
+		// slave up bits, discrete input n is slave n
+		if quantity < 1 || quantity > 2000 {
+			return nil, &mbserver.IllegalDataValue
+		}
+		if address+quantity > 256 {
+			return nil, &mbserver.IllegalDataAddress
+		}
+		regs := s.diagnosticRegisters()
+		response := make([]byte, 1+(quantity+7)/8)
+		response[0] = byte(len(response) - 1)
+		for i := 0; i < quantity; i++ {
+			slave := address + i
+			if regs[diagUpBits+slave/16]&(1<<(slave%16)) != 0 {
+				response[1+i/8] |= 1 << (i % 8)
+			}
+		}
+		return response, &mbserver.Success
+	case 3, 4:
+		if quantity < 1 || quantity > 125 {
+			return nil, &mbserver.IllegalDataValue
+		}
+		if address+quantity > diagRegisters {
+			return nil, &mbserver.IllegalDataAddress
+		}
+		regs := s.diagnosticRegisters()
+		response := make([]byte, 1+quantity*2)
+		response[0] = byte(quantity * 2)
+		for i, v := range regs[address : address+quantity] {
+			response[1+i*2], response[2+i*2] = byte(v>>8), byte(v)
+		}
+		return response, &mbserver.Success
+	}
+	return nil, &mbserver.IllegalFunction
+}
+
+// diagnosticControl report whether client may write the diagnostic unit
+func (s *Forwarder) diagnosticControl(client string) bool {
+	for _, allowed := range s.config.DiagnosticControl {
+		if allowed == client {
+			return true
+		}
+	}
+	return false
+}
+
+// diagnosticEnable enable or disable slave address by writing its coil
+func (s *Forwarder) diagnosticEnable(address, value int, data []byte) ([]byte, *mbserver.Exception) {
+	if value != 0xFF00 && value != 0x0000 {
+		return nil, &mbserver.IllegalDataValue
+	}
+	s.clientsMux.RLock()
+	client, exists := s.clients[byte(address)]
+	s.clientsMux.RUnlock()
+	if address > 255 || !exists {
+		return nil, &mbserver.IllegalDataAddress
+	}
+
+	enable := value == 0xFF00
+	if client.disabled.Swap(!enable) == !enable {
+		return data[0:4], &mbserver.Success
+	}
+	if enable {
+		s.logger.Infof("slave %d enabled over the diagnostic unit", address)
+	} else {
+		s.logger.Infof("slave %d disabled over the diagnostic unit", address)
+	}
+	return data[0:4], &mbserver.Success
+}
+
+// diagnosticCommand run the action of a control register write
+func (s *Forwarder) diagnosticCommand(address, value int, data []byte) ([]byte, *mbserver.Exception) {
+	var action func(slaveID byte, client *modbusClient)
+	switch address {
+	case diagReconnect:
+		action = func(slaveID byte, client *modbusClient) {
+			s.logger.Infof("slave %d reconnect forced over the diagnostic unit", slaveID)
+			client.transporter.Close()
+		}
+	case diagClearCounters:
+		action = func(slaveID byte, client *modbusClient) {
+			s.logger.Infof("slave %d counters cleared over the diagnostic unit", slaveID)
+			client.requests.Store(0)
+			client.failures.Store(0)
+			client.reconnects.Store(0)
+		}
+	default:
+		return nil, &mbserver.IllegalDataAddress
+	}
+
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	if value != diagAllSlaves {
+		client, exists := s.clients[byte(value)]
+		if value > 255 || !exists {
+			return nil, &mbserver.IllegalDataValue
+		}
+		action(byte(value), client)
+		return data[0:4], &mbserver.Success
+	}
+	for slaveID, client := range s.clients {
+		action(slaveID, client)
+	}
+	return data[0:4], &mbserver.Success
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DumpState write a snapshot of the forwarder runtime state to w
+func (s *Forwarder) DumpState(w io.Writer) {
+	status := s.status()
+	fmt.Fprintf(w, "=== mb-forwarder state dump at %s ===\n", s.clock.Now().Format(time.RFC3339))
+	fmt.Fprintf(w, "version: %s\n", status.Version)
+	if !status.StartTime.IsZero() {
+		fmt.Fprintf(w, "uptime: %s\n", time.Duration(status.Uptime*float64(time.Second)).Truncate(time.Second))
+	}
+	fmt.Fprintf(w, "log level: %s\n", s.logger.Level())
+
+	now := s.clock.Now()
+	for _, slave := range status.Slaves {
+		lastSuccess, lastError := "never", "none"
+		if slave.LastSuccess != nil {
+			lastSuccess = slave.LastSuccess.Format(time.RFC3339)
+		}
+		if slave.LastError != "" {
+			lastError = slave.LastError
+		}
+		fmt.Fprintf(w, "slave %d (%s %s): state=%s last_success=%s last_error=%q requests=%d errors=%d reconnects=%d queued=%d\n",
+			slave.SlaveID, slave.ConnType, slave.Target, slave.State, lastSuccess, lastError,
+			slave.Requests, slave.Errors, slave.Reconnects, slave.QueueDepth)
+		s.clientsMux.RLock()
+		client := s.clients[byte(slave.SlaveID)]
+		s.clientsMux.RUnlock()
+		if client != nil {
+			staticCached, staticTotal := client.static.size()
+			polled, groups := client.shadow.size()
+			fmt.Fprintf(w, "slave %d caches: read_ahead_blocks=%d static_ranges=%d/%d poll_groups=%d/%d\n",
+				slave.SlaveID, client.cache.size(now), staticCached, staticTotal, polled, groups)
+		}
+	}
+	if s.duplicates != nil {
+		fmt.Fprintf(w, "duplicate cache: requests=%d\n", s.duplicates.size(now))
+	}
+	for _, client := range s.upstreams.snapshot() {
+		fmt.Fprintf(w, "client %s: connections=%d active=%d requests=%d errors=%d duplicates=%d bytes_in=%d bytes_out=%d\n",
+			client.Addr, client.Connections, client.Active, client.Requests, client.Errors, client.Duplicates, client.BytesIn, client.BytesOut)
+	}
+	fmt.Fprintf(w, "=== end of state dump ===\n")
+}
+
+// dumpState write state dump to the configured dump file, or to the log
+func (s *Forwarder) dumpState() {
+	if s.config.DumpFile != "" {
+		f, err := os.Create(s.config.DumpFile)
+		if err != nil {
+			s.logger.Errorf("failed to create dump file: %v", err)
+			return
+		}
+		defer f.Close()
+		s.DumpState(f)
+		s.logger.Infof("state dumped to %s", s.config.DumpFile)
+		return
+	}
+
+	var b strings.Builder
+	s.DumpState(&b)
+	for _, line := range strings.Split(strings.TrimRight(b.String(), "\n"), "\n") {
+		s.logger.Printf("%s", line)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	_ "embed"
+	"fmt"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// configSource source of the config structs, their field comments document
+// the options of the example configuration
+//
+//go:embed config.go
+var configSource string
+
+// exampleSkipped fields left out of the example configuration, by type and
+// field name
+var exampleSkipped = map[string]bool{
+	"Server.SlaveID": true, // removed in version 2
+}
+
+// exampleConfig minimal config whose validated form provides the defaults
+const exampleConfig = `
+version: 2
+servers:
+  1:
+    conn_type: "tcp"
+    addr: "192.168.1.100"
+    port: 502
+`
+
+// writeExampleConfig write a reference configuration with every option,
+// its default and its comment; optional sections that are disabled by
+// default are commented out
+func writeExampleConfig(w io.Writer) error {
+	comments, err := fieldComments(configSource)
+	if err != nil {
+		return err
+	}
+	if err := parseConfig([]byte(exampleConfig)); err != nil {
+		return fmt.Errorf("invalid example config: %v", err)
+	}
+	e := &exampleWriter{w: w, comments: comments}
+	fmt.Fprintf(w, "# mb-forwarder reference configuration, version %d\n", configVersion)
+	fmt.Fprintf(w, "# generated by 'mb-forwarder config example' (%s), optional sections are commented out\n\n", version)
+	e.writeStruct(reflect.ValueOf(C), 0, "")
+	return e.err
+}
+
+// fieldComments return the comments of the struct fields in source by type
+// and field name
+func fieldComments(source string) (map[string]map[string]string, error) {
+	file, err := parser.ParseFile(token.NewFileSet(), "config.go", source, parser.ParseComments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse config source: %v", err)
+	}
+	comments := make(map[string]map[string]string)
+	ast.Inspect(file, func(n ast.Node) bool {
+		spec, ok := n.(*ast.TypeSpec)
+		if !ok {
+			return true
+		}
+		st, ok := spec.Type.(*ast.StructType)
+		if !ok {
+			return false
+		}
+		fields := make(map[string]string)
+		for _, field := range st.Fields.List {
+			group := field.Comment
+			if group == nil {
+				group = field.Doc
+			}
+			if group == nil {
+				continue
+			}
+			text := strings.Join(strings.Fields(group.Text()), " ")
+			for _, name := range field.Names {
+				fields[name.Name] = text
+			}
+		}
+		comments[spec.Name.Name] = fields
+		return false
+	})
+	return comments, nil
+}
+
+// exampleWriter YAML writer of the example configuration
+type exampleWriter struct {
+	w        io.Writer
+	comments map[string]map[string]string
+	item     bool // the next line starts a list element
+	err      error
+}
+
+// line write one line, prefix comments it out
+func (e *exampleWriter) line(depth int, prefix, text, comment string) {
+	if e.item {
+		e.item = false
+		depth--
+		text = "- " + text
+	}
+	if comment != "" {
+		text += " # " + comment
+	}
+	if _, err := fmt.Fprintf(e.w, "%s%s%s\n", prefix, strings.Repeat("  ", depth), text); err != nil && e.err == nil {
+		e.err = err
+	}
+}
+
+// writeStruct write the fields of struct v
+func (e *exampleWriter) writeStruct(v reflect.Value, depth int, prefix string) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" || !field.IsExported() || exampleSkipped[t.Name()+"."+field.Name] {
+			continue
+		}
+		e.writeValue(name, v.Field(i), e.comments[t.Name()][field.Name], depth, prefix)
+	}
+}
+
+// writeValue write the key name with value v
+func (e *exampleWriter) writeValue(name string, v reflect.Value, comment string, depth int, prefix string) {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if !v.IsNil() {
+			e.writeValue(name, v.Elem(), comment, depth, prefix)
+			return
+		}
+		zero := reflect.New(v.Type().Elem()).Elem()
+		if zero.Kind() == reflect.Struct {
+			// disabled section, show its options commented out
+			e.line(depth, "# ", name+":", comment)
+			e.writeStruct(zero, depth+1, "# ")
+			return
+		}
+		e.line(depth, "# ", name+": "+exampleScalar(zero), comment)
+	case reflect.Struct:
+		e.line(depth, prefix, name+":", comment)
+		e.writeStruct(v, depth+1, prefix)
+	case reflect.Slice:
+		elem := v.Type().Elem()
+		if elem.Kind() != reflect.Struct {
+			e.line(depth, prefix, name+": []", comment)
+			return
+		}
+		// list of sections, show one element commented out
+		if prefix == "" {
+			e.line(depth, prefix, name+": []", comment)
+			comment = ""
+		}
+		e.line(depth, "# ", name+":", comment)
+		e.item = true
+		e.writeStruct(reflect.New(elem).Elem(), depth+2, "# ")
+	case reflect.Map:
+		if v.Len() == 0 || v.Type().Elem().Kind() != reflect.Struct {
+			e.line(depth, prefix, name+": {}", comment)
+			return
+		}
+		e.line(depth, prefix, name+":", comment)
+		iter := v.MapRange()
+		for iter.Next() {
+			e.line(depth+1, prefix, fmt.Sprintf("%v:", iter.Key()), "")
+			e.writeStruct(iter.Value(), depth+2, prefix)
+		}
+	default:
+		e.line(depth, prefix, name+": "+exampleScalar(v), comment)
+	}
+}
+
+// exampleScalar format a scalar value as YAML
+func exampleScalar(v reflect.Value) string {
+	if v.Kind() == reflect.String {
+		return strconv.Quote(v.String())
+	}
+	return fmt.Sprint(v.Interface())
+}
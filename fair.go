@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net"
+	"sync"
+)
+
+// defaultQoSClass class of the clients not listed in any QoS class
+const defaultQoSClass = "default"
+
+// fairQueue hand out the turns of a slave to the waiting upstream clients
+// instead of first-come-first-served: round-robin between the QoS classes,
+// then between the clients of the class; a class or client with weight n
+// gets up to n turns in a row
+type fairQueue struct {
+	weights      map[string]int // client address -> weight, 1 when not listed
+	classWeights map[string]int // class -> weight, 1 when not listed
+	classes      []QoSClass
+
+	mu      sync.Mutex
+	busy    bool                       // a client has the turn
+	waiting map[string][]chan struct{} // waiting requests by client
+	turns   roundRobin                 // classes with waiting requests
+	members map[string]*roundRobin     // class -> clients with waiting requests
+}
+
+// roundRobin turn order of the members with waiting requests
+type roundRobin struct {
+	order   []string // in turn order, the next one first
+	current string   // member with the turn
+	served  int      // turns of current in a row
+}
+
+// next return the member getting the next turn, the current one again
+// until it used up its weight
+func (r *roundRobin) next(weight func(string) int) string {
+	next := r.order[0]
+	if next == r.current && r.served >= weight(next) && len(r.order) > 1 {
+		// the member used up its turns, the others go first
+		r.order = append(r.order[1:], next)
+		next = r.order[0]
+	}
+	r.start(next)
+	return next
+}
+
+// start count a turn of member
+func (r *roundRobin) start(member string) {
+	if member != r.current {
+		r.current, r.served = member, 0
+	}
+	r.served++
+}
+
+func newFairQueue(config *FairScheduling) *fairQueue {
+	q := &fairQueue{
+		weights:      config.Weights,
+		classWeights: make(map[string]int),
+		classes:      config.Classes,
+		waiting:      make(map[string][]chan struct{}),
+		members:      make(map[string]*roundRobin),
+	}
+	for _, class := range config.Classes {
+		q.classWeights[class.Name] = class.Weight
+	}
+	return q
+}
+
+func (q *fairQueue) weight(client string) int {
+	if weight, ok := q.weights[client]; ok {
+		return weight
+	}
+	return 1
+}
+
+func (q *fairQueue) classWeight(class string) int {
+	if weight, ok := q.classWeights[class]; ok {
+		return weight
+	}
+	return 1
+}
+
+// class return the QoS class of client: the first class listing its address
+// or a network containing it
+func (q *fairQueue) class(client string) string {
+	ip := net.ParseIP(client)
+	for _, class := range q.classes {
+		for _, member := range class.Clients {
+			if member == client {
+				return class.Name
+			}
+			if _, network, err := net.ParseCIDR(member); err == nil && ip != nil && network.Contains(ip) {
+				return class.Name
+			}
+		}
+	}
+	return defaultQoSClass
+}
+
+// acquire wait for the turn of client, the returned function ends the turn
+func (q *fairQueue) acquire(client string) func() {
+	class := q.class(client)
+	q.mu.Lock()
+	members := q.members[class]
+	if members == nil {
+		members = &roundRobin{}
+		q.members[class] = members
+	}
+	if !q.busy {
+		q.busy = true
+		q.turns.start(class)
+		members.start(client)
+		q.mu.Unlock()
+		return q.release
+	}
+	turn := make(chan struct{})
+	if len(members.order) == 0 {
+		q.turns.order = append(q.turns.order, class)
+	}
+	if len(q.waiting[client]) == 0 {
+		members.order = append(members.order, client)
+	}
+	q.waiting[client] = append(q.waiting[client], turn)
+	q.mu.Unlock()
+
+	<-turn
+	return q.release
+}
+
+// release end the current turn and hand the next one out
+func (q *fairQueue) release() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.turns.order) == 0 {
+		q.busy = false
+		return
+	}
+	class := q.turns.next(q.classWeight)
+	members := q.members[class]
+	client := members.next(q.weight)
+
+	turn := q.waiting[client][0]
+	q.waiting[client] = q.waiting[client][1:]
+	if len(q.waiting[client]) == 0 {
+		delete(q.waiting, client)
+		members.order = members.order[1:]
+		if len(members.order) == 0 {
+			q.turns.order = q.turns.order[1:]
+		}
+	}
+	close(turn)
+}
+
+// fairTurn wait for the turn of client on slaveID when fair scheduling is
+// enabled, the returned function ends the turn
+func (s *Forwarder) fairTurn(slaveID byte, client string) func() {
+	s.clientsMux.RLock()
+	c := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	if c == nil || c.fair == nil {
+		return func() {}
+	}
+	return c.fair.acquire(client)
+}
@@ -2,125 +2,465 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net"
+	"net/http"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
 	"github.com/tbrandon/mbserver"
 )
 
 // Forwarder modbus forwarder
 type Forwarder struct {
 	config     *Config
-	server     *mbserver.Server
+	handlers   [256]functionHandler   // function code -> handler
 	clients    map[byte]*modbusClient // slaveID -> client
 	clientsMux sync.RWMutex
+	units      map[byte]byte // upstream unit ID -> slaveID, including aliases
 	ctx        context.Context
 	cancel     context.CancelFunc
+	startTime  time.Time
+	setupOnce  sync.Once
+	setupErr   error
+	wg         sync.WaitGroup // background goroutines
+	errs       []error        // runtime errors returned by Run
+	errsMux    sync.Mutex
+
+	admin      *http.Server
+	adminAudit *captureFile    // admin API audit log, nil when disabled
+	ws         *http.Server    // upstream WebSocket listener
+	mqtt       mqtt.Client     // MQTT command topics, nil when disabled
+	mqttOnline availability    // availability of the published tag values
+	hooks      *hookRunner     // event hooks, nil when none are configured
+	sniffs     *wsHub          // WebSocket subscribers of the sniffers and taps, nil without them
+	tagEvents  *wsHub          // WebSocket subscribers of the tag values, nil without ws_listen or tags
+	upstreams  upstreamClients // upstream client statistics
+	duplicates *dupCache       // recent requests for duplicate suppression, nil when disabled
+
+	broadcasts    chan broadcastWrite // broadcast writes waiting for the slaves
+	broadcastOnce sync.Once           // starts the broadcast fan-out
+
+	sampleCount atomic.Uint64 // successful reads seen by logSampled
+	listeners   map[net.Listener]struct{}
+	conns       map[net.Conn]struct{}
+	clientConns map[string][]net.Conn     // admitted connections per client address, oldest first
+	tlsProfiles map[string]*accessProfile // TLS profiles by server name
+	tenants     []*accessProfile          // tenants in config order
+	wsAccess    *accessProfile            // WebSocket connections, nil for the default routing
+	wsReadOnly  *accessProfile            // WebSocket connections of ws_auth identities without the write capability
+	connsMux    sync.Mutex
+
+	logger  *Logger
+	clock   Clock
+	dialer  Dialer
+	metrics Metrics
+
+	serialDrivers map[string]SerialDriver // drivers replacing the built-in ones by name, see WithSerialDriver
 }
 
 // modbusClient modbus client connection
 type modbusClient struct {
-	client    modbus.Client
-	handler   modbus.ClientHandler
-	connType  string
-	addr      string
-	port      int
-	baudRate  int
-	dataBits  int
-	stopBits  int
-	parity    string
-	timeout   time.Duration
+	client      modbus.Client
+	packager    modbus.Packager
+	transporter transport
+	connType    string
+	addr        string
+	port        int
+	baudRate    int
+	dataBits    int
+	stopBits    int
+	parity      string
+	timeout     time.Duration
+
+	maxReadRegisters  int
+	maxReadBits       int
+	maxWriteRegisters int
+	splitReads        bool
+	readAhead         int             // read-ahead block size, 0 disabled
+	cache             *readCache      // read-ahead blocks, nil when disabled
+	static            *staticCache    // ranges read once, nil when none are configured
+	coalescer         *writeCoalescer // pending single register writes, nil when disabled
+	async             *asyncWriter    // acknowledged writes, nil when writes are synchronous
+	shadow            *shadowStore    // polled ranges, nil when nothing is polled
+	shadowReads       bool            // answer reads only from the shadow store
+	deniedFunctions   [256]bool       // function codes rejected with IllegalFunction
+	rawPassthrough    bool            // forward function codes without a handler as is
+	hiddenRanges      []AddressRange  // ranges reads are rejected for with IllegalDataAddress
+	writeLimits       *writeLimits    // write rate limits, nil when not configured
+	schedule          *writeSchedule  // times writes are allowed, nil for any time
+	writeRules        []WriteRule     // allowed register values
+
+	backoff *backoffDialer // reconnect backoff, nil when not configured
+
+	monitorInterval time.Duration
+	probeType       string
+	probeAddress    uint16
+	probeQuantity   uint16
+
+	mu        sync.Mutex // protects lastError, lastConn and downSince
 	lastError error
 	lastConn  time.Time
+	downSince time.Time // start of the current downtime
+
+	requests   atomic.Uint64 // downstream transactions
+	failures   atomic.Uint64 // failed downstream transactions
+	busy       atomic.Int64  // total time of the downstream transactions, nanoseconds
+	reconnects atomic.Uint64 // down to up transitions
+	malformed  malformedFrames
+	events     commEventLog // last transactions for FC 12
+	health     *healthScore
+	queued     *atomic.Int32 // requests waiting for or in a downstream transaction
+	fair       *fairQueue    // turns of the upstream clients, nil for first-come-first-served
+	sim        *SimSlave     // answers while the slave is down, nil when not configured
+	disabled   atomic.Bool   // disabled at runtime, requests are not forwarded
+	draining   atomic.Bool   // connection restart waiting for the queue, new requests are answered busy
+
+	verifyWrites bool         // read written coils and registers back
+	writeAudit   *captureFile // change history of the writes, nil when disabled
+
+	idlePing     *IdlePing    // check of the idle connection, nil when disabled
+	lastActivity atomic.Int64 // end of the last downstream transaction, unix nanoseconds
+}
+
+// target return connection target description
+func (c *modbusClient) target() string {
+	if c.connType == "tcp" || c.connType == "TCP" {
+		return fmt.Sprintf("%s:%d", c.addr, c.port)
+	}
+	return c.addr
 }
 
 // NewForwarder create new forwarder
-func NewForwarder(config *Config) *Forwarder {
+func NewForwarder(config *Config, opts ...Option) *Forwarder {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Forwarder{
-		config:  config,
-		clients: make(map[byte]*modbusClient),
-		ctx:     ctx,
-		cancel:  cancel,
+	s := &Forwarder{
+		config:      config,
+		clients:     make(map[byte]*modbusClient),
+		units:       unitRoutes(config),
+		ctx:         ctx,
+		cancel:      cancel,
+		listeners:   make(map[net.Listener]struct{}),
+		conns:       make(map[net.Conn]struct{}),
+		clientConns: make(map[string][]net.Conn),
+		logger:      logger,
+		clock:       systemClock{},
+		dialer:      &net.Dialer{},
+		metrics:     nopMetrics{},
+	}
+	if len(config.Sniffers) > 0 || len(config.Taps) > 0 {
+		s.sniffs = newWSHub()
+	}
+	if config.DuplicateWindow > 0 {
+		s.duplicates = newDupCache(time.Duration(config.DuplicateWindow) * time.Millisecond)
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	s.hooks = newHookRunner(config.Hooks, s.logger)
+	return s
+}
+
+// record update counters and metrics after a downstream transaction
+func (s *Forwarder) record(client *modbusClient, slaveID byte, function uint8, start time.Time, err error) {
+	duration := s.clock.Now().Sub(start)
+	client.lastActivity.Store(s.clock.Now().UnixNano())
+	client.requests.Add(1)
+	client.busy.Add(int64(duration))
+	client.health.observe(err == nil, duration)
+	client.events.add(commEvent(err))
+	if err != nil {
+		client.failures.Add(1)
+		client.malformed.add(malformedResponse(err))
+	} else {
+		s.markUp(slaveID, client)
+	}
+	s.metrics.ObserveRequest(slaveID, function, duration, err)
 }
 
 // Start start forwarder
 func (s *Forwarder) Start() error {
-	// create modbus server
-	s.server = mbserver.NewServer()
-
-	// register function code handlers
-	s.registerHandlers()
+	if err := s.setup(); err != nil {
+		return err
+	}
 
-	// initialize client connections
-	if err := s.initClients(); err != nil {
-		return fmt.Errorf("failed to init clients: %v", err)
+	// use sockets inherited from systemd socket activation if any
+	activated, err := systemdListeners()
+	if err != nil {
+		return err
+	}
+	for _, l := range activated {
+		s.logger.Infof("modbus forwarder listening on %s (systemd socket activation)", l.Addr())
+		s.serveListener(l)
 	}
 
 	// start listening
-	listenAddr := fmt.Sprintf("0.0.0.0:%d", s.config.ListenPort)
-	log.Printf("modbus forwarder listening on %s", listenAddr)
+	if len(activated) == 0 {
+		if err := s.listenTCP(); err != nil {
+			s.closeListeners()
+			return err
+		}
+
+		if s.config.TLS != nil {
+			l, err := s.listenTLS()
+			if err != nil {
+				s.closeListeners()
+				return err
+			}
+			s.logger.Infof("modbus forwarder listening on %s (TLS)", l.Addr())
+			s.serveListener(l)
+		}
 
-	if err := s.server.ListenTCP(listenAddr); err != nil {
-		return fmt.Errorf("failed to listen on %s: %v", listenAddr, err)
+		if s.config.ListenUnix != "" {
+			l, err := listenUnix(s.config.ListenUnix, s.config.ListenUnixMode)
+			if err != nil {
+				s.closeListeners()
+				return err
+			}
+			s.logger.Infof("modbus forwarder listening on unix socket %s", s.config.ListenUnix)
+			s.serveListener(l)
+		}
 	}
 
-	// start connection monitoring
-	go s.monitorConnections()
+	if err := s.listenTenants(); err != nil {
+		s.closeListeners()
+		return err
+	}
 
-	log.Printf("modbus forwarder started with %d servers", len(s.config.Servers))
+	if err := s.startWebSocket(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	if err := s.startMQTT(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	if err := s.startSniffers(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	if err := s.startTaps(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	if err := s.startAdmin(); err != nil {
+		s.closeListeners()
+		return err
+	}
+
+	s.logger.Infof("modbus forwarder started with %d servers", len(s.config.Servers))
 	return nil
 }
 
+// setup register handlers, initialize slave connections and start
+// monitoring, only once for Start and Serve
+func (s *Forwarder) setup() error {
+	s.setupOnce.Do(func() {
+		s.startTime = s.clock.Now()
+
+		// register function code handlers
+		s.registerHandlers()
+
+		// initialize client connections
+		if err := s.initClients(); err != nil {
+			s.setupErr = fmt.Errorf("failed to init clients: %v", err)
+			return
+		}
+
+		// start polling the shadow store ranges
+		s.startPolling()
+
+		// start the scheduled snapshots
+		s.startSnapshots()
+
+		// start forwarding acknowledged writes
+		s.startAsyncWriters()
+
+		// start pinging idle connections
+		s.startIdlePings()
+
+		// start connection monitoring
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.monitorConnections()
+		}()
+	})
+	return s.setupErr
+}
+
+// Run start the forwarder and block until ctx is cancelled or a listener
+// fails, then stop it and return the aggregated errors
+func (s *Forwarder) Run(ctx context.Context) error {
+	if err := s.Start(); err != nil {
+		return err
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-s.ctx.Done():
+	}
+
+	s.stop()
+	s.errsMux.Lock()
+	defer s.errsMux.Unlock()
+	return errors.Join(s.errs...)
+}
+
 // Stop stop forwarder
 func (s *Forwarder) Stop() {
+	s.stop()
+}
+
+// stop close listeners and connections and wait for background
+// goroutines, close errors are collected for Run
+func (s *Forwarder) stop() {
 	s.cancel()
-	if s.server != nil {
-		s.server.Close()
+	s.closeListeners()
+	if s.admin != nil {
+		s.admin.Close()
+	}
+	if s.ws != nil {
+		s.ws.Close()
+	}
+	if s.mqtt != nil {
+		s.publishOffline()
+		s.mqtt.Disconnect(250)
 	}
+	s.wg.Wait()
 
 	s.clientsMux.Lock()
 	defer s.clientsMux.Unlock()
 
-	for _, client := range s.clients {
-		if client.handler != nil {
-			// for TCP and RTU connections, close underlying connection
-			if tcpHandler, ok := client.handler.(*modbus.TCPClientHandler); ok {
-				tcpHandler.Close()
-			} else if rtuHandler, ok := client.handler.(*modbus.RTUClientHandler); ok {
-				rtuHandler.Close()
-			}
+	for slaveID, client := range s.clients {
+		// close underlying TCP or serial connection
+		if err := client.transporter.Close(); err != nil {
+			s.fail(fmt.Errorf("failed to close slave %d connection: %v", slaveID, err))
+		}
+		if client.async != nil && client.async.audit != nil {
+			client.async.audit.close()
+		}
+		if client.schedule != nil && client.schedule.audit != nil {
+			client.schedule.audit.close()
+		}
+		if client.writeAudit != nil {
+			client.writeAudit.close()
 		}
 	}
+	s.hooks.close()
 
-	log.Println("modbus forwarder stopped")
+	s.logger.Infof("modbus forwarder stopped")
+}
+
+// fail record a runtime error returned by Run
+func (s *Forwarder) fail(err error) {
+	s.errsMux.Lock()
+	defer s.errsMux.Unlock()
+
+	s.errs = append(s.errs, err)
 }
 
 // registerHandlers register function code handlers
 func (s *Forwarder) registerHandlers() {
 	// read coils (function code 1)
-	s.server.RegisterFunctionHandler(1, s.readCoils)
+	s.registerHandler(1, s.readCoils)
 	// read discrete inputs (function code 2)
-	s.server.RegisterFunctionHandler(2, s.readDiscreteInputs)
+	s.registerHandler(2, s.readDiscreteInputs)
 	// read holding registers (function code 3)
-	s.server.RegisterFunctionHandler(3, s.readHoldingRegisters)
+	s.registerHandler(3, s.readHoldingRegisters)
 	// read input registers (function code 4)
-	s.server.RegisterFunctionHandler(4, s.readInputRegisters)
+	s.registerHandler(4, s.readInputRegisters)
 	// write single coil (function code 5)
-	s.server.RegisterFunctionHandler(5, s.writeSingleCoil)
+	s.registerHandler(5, s.writeSingleCoil)
 	// write single register (function code 6)
-	s.server.RegisterFunctionHandler(6, s.writeSingleRegister)
+	s.registerHandler(6, s.writeSingleRegister)
+	// read exception status (function code 7)
+	s.registerHandler(7, s.readExceptionStatus)
+	// diagnostics (function code 8)
+	s.registerHandler(8, s.diagnostics)
+	// get comm event counter (function code 11)
+	s.registerHandler(11, s.commEventCounter)
+	// get comm event log (function code 12)
+	s.registerHandler(12, s.commEventLog)
 	// write multiple coils (function code 15)
-	s.server.RegisterFunctionHandler(15, s.writeMultipleCoils)
+	s.registerHandler(15, s.writeMultipleCoils)
 	// write multiple registers (function code 16)
-	s.server.RegisterFunctionHandler(16, s.writeMultipleRegisters)
+	s.registerHandler(16, s.writeMultipleRegisters)
+	// report server id (function code 17)
+	s.registerHandler(17, s.reportServerID)
+	// read file record (function code 20)
+	s.registerHandler(20, s.fileRecord)
+	// write file record (function code 21)
+	s.registerHandler(21, s.fileRecord)
+	// mask write register (function code 22)
+	s.registerHandler(22, s.maskWriteRegister)
+	// read/write multiple registers (function code 23)
+	s.registerHandler(23, s.readWriteMultipleRegisters)
+	// read FIFO queue (function code 24)
+	s.registerHandler(24, s.readFIFOQueue)
+	// read device identification (function code 43, MEI type 14)
+	s.registerHandler(43, s.readDeviceIdentification)
+}
+
+// registerHandler register handler for function code
+func (s *Forwarder) registerHandler(function uint8, handler functionHandler) {
+	s.handlers[function] = handler
 }
 
-// initClients initialize client connections
+// listenTCP start the Modbus TCP listeners, one for each listen address or
+// 0.0.0.0:listen_port when none is configured
+func (s *Forwarder) listenTCP() error {
+	addresses := s.config.Listen
+	if len(addresses) == 0 {
+		addresses = []ListenAddress{{Address: fmt.Sprintf("0.0.0.0:%d", s.config.ListenPort)}}
+	}
+	for _, a := range addresses {
+		l, err := net.Listen("tcp", a.Address)
+		if err != nil {
+			return fmt.Errorf("failed to listen on %s: %v", a.Address, err)
+		}
+		if len(a.Units) == 0 && !a.ReadOnly {
+			s.logger.Infof("modbus forwarder listening on %s", a.Address)
+			s.serveListener(l)
+			continue
+		}
+		profile := &accessProfile{kind: "listener", name: a.Address, readOnly: a.ReadOnly}
+		if len(a.Units) > 0 {
+			profile.units = a.Units
+		}
+		s.logger.Infof("modbus forwarder listening on %s (%d units, read only %t)", a.Address, len(a.Units), a.ReadOnly)
+		s.serveListener(&profileListener{Listener: l, profile: profile})
+	}
+	return nil
+}
+
+// serveListener serve listener in the background, a failing listener
+// stops the forwarder
+func (s *Forwarder) serveListener(l net.Listener) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.Serve(l); err != nil {
+			s.logger.Errorf("listener %s stopped: %v", l.Addr(), err)
+			s.fail(fmt.Errorf("listener %s: %v", l.Addr(), err))
+			s.cancel()
+		}
+	}()
+}
+
+// initClients initialize client connections, connecting all slaves
+// concurrently within the startup timeout
 func (s *Forwarder) initClients() error {
 	for slaveID, serverConfig := range s.config.Servers {
 		client, err := s.createClient(slaveID, serverConfig)
@@ -131,55 +471,370 @@ func (s *Forwarder) initClients() error {
 		s.clientsMux.Lock()
 		s.clients[slaveID] = client
 		s.clientsMux.Unlock()
+	}
+
+	type connectResult struct {
+		slaveID byte
+		err     error
+	}
+	results := make(chan connectResult, len(s.clients))
+	pending := make(map[byte]*modbusClient, len(s.clients))
+	s.clientsMux.RLock()
+	for slaveID, client := range s.clients {
+		pending[slaveID] = client
+		go func() {
+			results <- connectResult{slaveID, client.transporter.Connect()}
+		}()
+	}
+	s.clientsMux.RUnlock()
+
+	var timeout <-chan time.Time
+	if s.config.StartupTimeout > 0 {
+		timeout = s.clock.After(time.Duration(s.config.StartupTimeout) * time.Second)
+	}
 
-		log.Printf("initialized slave %d connection (%s)", slaveID, serverConfig.ConnType)
+	var errs []error
+	for len(pending) > 0 {
+		select {
+		case result := <-results:
+			client, ok := pending[result.slaveID]
+			if !ok {
+				continue
+			}
+			delete(pending, result.slaveID)
+			if err := s.initClient(result.slaveID, client, result.err); err != nil {
+				errs = append(errs, err)
+			}
+		case <-timeout:
+			for slaveID, client := range pending {
+				err := fmt.Errorf("not connected within startup_timeout of %ds", s.config.StartupTimeout)
+				if err := s.initClient(slaveID, client, err); err != nil {
+					errs = append(errs, err)
+				}
+			}
+			pending = nil
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// initClient apply the startup policy to the connect result of one slave
+func (s *Forwarder) initClient(slaveID byte, client *modbusClient, err error) error {
+	if err != nil {
+		if s.config.StartupPolicy != "degrade" && client.sim == nil {
+			// simulated slaves may be absent
+			return fmt.Errorf("failed to connect slave %d: %v", slaveID, err)
+		}
+		s.logger.Errorf("failed to connect slave %d, marked down and retrying in background: %v", slaveID, err)
+		s.markDown(slaveID, client, err)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.reconnect(slaveID, client)
+		}()
+		return nil
 	}
+
+	s.markUp(slaveID, client)
+	s.logger.Infof("initialized slave %d connection (%s)", slaveID, client.connType)
 	return nil
 }
 
+// reconnect retry connecting a slave that failed at startup until it
+// succeeds or the forwarder stops, every monitor interval or after the
+// reconnect backoff delay
+func (s *Forwarder) reconnect(slaveID byte, client *modbusClient) {
+	for {
+		delay := client.monitorInterval
+		if client.backoff != nil {
+			delay = client.backoff.retryIn()
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.clock.After(delay):
+		}
+
+		if err := client.transporter.Connect(); err != nil {
+			s.logger.Debugf("slave %d reconnect failed: %v", slaveID, err)
+			s.markDown(slaveID, client, err)
+			continue
+		}
+		s.markUp(slaveID, client)
+		return
+	}
+}
+
+// logSampled log a successful read, only 1-in-log_sample_rate when
+// sampling is configured and not at all when log_sample_rate is 0
+func (s *Forwarder) logSampled(format string, v ...any) {
+	rate := uint64(s.config.LogSampleRate)
+	if rate == 0 {
+		return
+	}
+	if rate > 1 {
+		if s.sampleCount.Add(1)%rate != 1 {
+			return
+		}
+		format += fmt.Sprintf(" [sampled 1/%d]", rate)
+	}
+	s.logger.Infof(format, v...)
+}
+
+// markUp record a successful transaction, logging the transition when the
+// slave was down
+func (s *Forwarder) markUp(slaveID byte, client *modbusClient) {
+	client.mu.Lock()
+	client.lastConn = s.clock.Now()
+	// a down slave stays down until its health score recovered
+	restored := client.lastError != nil && client.health.score() >= s.config.Health.UpAbove
+	if restored {
+		client.lastError = nil
+	}
+	downtime := client.lastConn.Sub(client.downSince)
+	client.mu.Unlock()
+
+	if restored {
+		client.reconnects.Add(1)
+		s.logger.Infof("slave %d connection restored", slaveID)
+		s.metrics.SetConnectionState(slaveID, true)
+		s.restoreSetpoints(slaveID, downtime)
+		s.emitHook(hookEvent{Event: hookSlaveUp, Slave: slaveID, Downtime: downtime.Seconds()})
+	}
+}
+
+// markDown record a connection failure, logging each distinct error once
+func (s *Forwarder) markDown(slaveID byte, client *modbusClient, err error) {
+	client.mu.Lock()
+	wasUp := client.lastError == nil
+	changed := wasUp || client.lastError.Error() != err.Error()
+	client.lastError = err
+	if wasUp {
+		client.downSince = s.clock.Now()
+	}
+	client.mu.Unlock()
+
+	if changed {
+		s.logger.Errorf("slave %d connection exception: %v", slaveID, err)
+	}
+	if wasUp {
+		s.metrics.SetConnectionState(slaveID, false)
+		s.emitHook(hookEvent{Event: hookSlaveDown, Slave: slaveID, Error: err.Error()})
+	}
+}
+
 // createClient create modbus client
 func (s *Forwarder) createClient(slaveID byte, config Server) (*modbusClient, error) {
-	var handler modbus.ClientHandler
+	var packager modbus.Packager
+	var transporter transport
+	var backoff *backoffDialer
 
 	timeout := time.Duration(config.Timeout) * time.Second
+	// wrap a dialer with the reconnect backoff if configured
+	withBackoff := func(d Dialer) Dialer {
+		if config.ReconnectBackoff == nil {
+			return d
+		}
+		backoff = &backoffDialer{Dialer: d, clock: s.clock, backoff: newBackoff(config.ReconnectBackoff)}
+		return backoff
+	}
+	// TCP connections to the slave, tuned with the socket options
+	dialer := withSocketOptions(s.dialer, config.SocketOptions)
+	// dump downstream frames when debug logging is enabled
+	frameLogger := s.logger.stdLogger(LevelDebug)
 
 	switch config.ConnType {
 	case "tcp", "TCP":
 		addr := fmt.Sprintf("%s:%d", config.Addr, config.Port)
-		handler = modbus.NewTCPClientHandler(addr)
-		if tcpHandler, ok := handler.(*modbus.TCPClientHandler); ok {
-			tcpHandler.Timeout = timeout
-			tcpHandler.SlaveId = byte(slaveID)
-		}
+		// the TCP handler only encodes frames, I/O goes through the configured dialer
+		tcpHandler := modbus.NewTCPClientHandler(addr)
+		tcpHandler.SlaveId = byte(slaveID)
+		packager = tcpHandler
+		tcp := newTCPTransport(addr, timeout, withBackoff(dialer), frameLogger)
+		tcp.timeouts = config.TimeoutRules
+		tcp.clock = s.clock
+		transporter = tcp
+	case "ws":
+		// MBAP over WebSocket, addr is the URL, e.g. ws://relay:8502/modbus
+		tcpHandler := modbus.NewTCPClientHandler(config.Addr)
+		tcpHandler.SlaveId = byte(slaveID)
+		packager = tcpHandler
+		ws := newTCPTransport(config.Addr, timeout, withBackoff(wsDialer{dialer: dialer}), frameLogger)
+		ws.timeouts = config.TimeoutRules
+		ws.clock = s.clock
+		transporter = ws
 	case "rtu", "RTU":
-		handler = modbus.NewRTUClientHandler(config.Addr)
-		if rtuHandler, ok := handler.(*modbus.RTUClientHandler); ok {
-			rtuHandler.BaudRate = config.BaudRate
-			rtuHandler.DataBits = config.DataBits
-			rtuHandler.StopBits = config.StopBits
-			rtuHandler.Parity = config.Parity
-			rtuHandler.Timeout = timeout
-			rtuHandler.SlaveId = byte(slaveID)
+		// the RTU handler only encodes frames, I/O goes through the serial driver
+		rtuHandler := modbus.NewRTUClientHandler(config.Addr)
+		rtuHandler.SlaveId = byte(slaveID)
+		packager = rtuHandler
+		rtu := &rtuTransport{
+			driver: s.serialDriver(config.SerialDriver, dialer, withBackoff),
+			config: SerialConfig{
+				Address:  config.Addr,
+				BaudRate: config.BaudRate,
+				DataBits: config.DataBits,
+				StopBits: config.StopBits,
+				Parity:   config.Parity,
+				Timeout:  timeout,
+
+				USBSerial:        config.USBSerial,
+				InterCharTimeout: time.Duration(config.InterCharTimeout) * time.Millisecond,
+				TurnaroundDelay:  time.Duration(config.TurnaroundDelay) * time.Millisecond,
+			},
+			timeouts: config.TimeoutRules,
+			logger:   frameLogger,
+		}
+		if d := config.BaudDetect; d != nil {
+			rtu.detector = &baudDetector{
+				slaveID:    byte(slaveID),
+				function:   pollFunctions[d.ProbeType],
+				address:    uint16(d.ProbeAddress),
+				timeout:    time.Duration(d.ProbeTimeout) * time.Millisecond,
+				candidates: d.Candidates,
+				logf:       s.logger.Infof,
+			}
 		}
+		transporter = rtu
 	}
 
-	if handler == nil {
+	if packager == nil {
 		return nil, fmt.Errorf("failed to create handler for %s connection", config.ConnType)
 	}
 
-	client := modbus.NewClient(handler)
+	queued := new(atomic.Int32)
+	transporter = &queueTransport{transport: transporter, queued: queued}
+	client := modbus.NewClient2(packager, transporter)
+
+	var cache *readCache
+	if config.ReadAheadBlock > 0 {
+		cache = newReadCache(time.Duration(config.ReadAheadTTL) * time.Millisecond)
+	}
+
+	var static *staticCache
+	if len(config.StaticRanges) > 0 {
+		static = newStaticCache(config.StaticRanges)
+	}
+
+	var coalescer *writeCoalescer
+	if config.WriteCoalesceWindow > 0 {
+		coalescer = newWriteCoalescer(time.Duration(config.WriteCoalesceWindow) * time.Millisecond)
+	}
+
+	var async *asyncWriter
+	if config.AsyncWrites != nil {
+		async = &asyncWriter{
+			queue:        make(chan asyncWrite, config.AsyncWrites.QueueSize),
+			flushTimeout: time.Duration(config.AsyncWrites.FlushTimeout) * time.Second,
+		}
+		if config.AsyncWrites.AuditFile != "" {
+			audit, err := openCapture(config.AsyncWrites.AuditFile)
+			if err != nil {
+				return nil, err
+			}
+			async.audit = audit
+		}
+	}
+
+	var shadow *shadowStore
+	if len(config.Poll) > 0 {
+		shadow = newShadowStore(config.Poll, config.PollJitter, config.AgeRegisters)
+	}
+
+	var deniedFunctions [256]bool
+	if len(config.AllowedFunctionCodes) > 0 {
+		for function := range deniedFunctions {
+			deniedFunctions[function] = true
+		}
+		for _, function := range config.AllowedFunctionCodes {
+			deniedFunctions[function] = false
+		}
+	}
+	for _, function := range config.DeniedFunctionCodes {
+		deniedFunctions[function] = true
+	}
+
+	var schedule *writeSchedule
+	if config.WriteSchedule != nil {
+		var err error
+		if schedule, err = newWriteSchedule(config.WriteSchedule); err != nil {
+			return nil, err
+		}
+	}
+
+	var fair *fairQueue
+	if s.config.FairScheduling != nil {
+		fair = newFairQueue(s.config.FairScheduling)
+	}
+
+	var sim *SimSlave
+	if config.SimulateWhenDown != nil {
+		var err error
+		if sim, err = newSimulation(slaveID, config); err != nil {
+			return nil, err
+		}
+	}
+
+	var writeAudit *captureFile
+	if config.WriteAuditFile != "" {
+		var err error
+		if writeAudit, err = openCapture(config.WriteAuditFile); err != nil {
+			return nil, err
+		}
+	}
+
+	var limits *writeLimits
+	if len(config.WriteLimits) > 0 {
+		limits = newWriteLimits(config.WriteLimits)
+	}
 
 	return &modbusClient{
-		client:   client,
-		handler:  handler,
-		connType: config.ConnType,
-		addr:     config.Addr,
-		port:     config.Port,
-		baudRate: config.BaudRate,
-		dataBits: config.DataBits,
-		stopBits: config.StopBits,
-		parity:   config.Parity,
-		timeout:  timeout,
+		client:      client,
+		packager:    packager,
+		transporter: transporter,
+		connType:    config.ConnType,
+		addr:        config.Addr,
+		port:        config.Port,
+		baudRate:    config.BaudRate,
+		dataBits:    config.DataBits,
+		stopBits:    config.StopBits,
+		parity:      config.Parity,
+		timeout:     timeout,
+
+		maxReadRegisters:  config.MaxReadRegisters,
+		maxReadBits:       config.MaxReadBits,
+		maxWriteRegisters: config.MaxWriteRegisters,
+		splitReads:        config.SplitReads,
+		readAhead:         config.ReadAheadBlock,
+		cache:             cache,
+		static:            static,
+		coalescer:         coalescer,
+		async:             async,
+		shadow:            shadow,
+		shadowReads:       config.Shadow,
+		deniedFunctions:   deniedFunctions,
+		rawPassthrough:    config.RawPassthrough,
+		hiddenRanges:      config.HiddenRanges,
+		writeLimits:       limits,
+		schedule:          schedule,
+		writeRules:        config.WriteRules,
+
+		backoff: backoff,
+
+		monitorInterval: time.Duration(config.MonitorInterval) * time.Second,
+		probeType:       config.ProbeType,
+		probeAddress:    uint16(*config.ProbeAddress),
+		probeQuantity:   uint16(config.ProbeQuantity),
+		queued:          queued,
+		health:          newHealthScore(s.config.Health),
+		fair:            fair,
+		sim:             sim,
+
+		verifyWrites: config.VerifyWrites,
+		writeAudit:   writeAudit,
+
+		idlePing: config.IdlePing,
 	}, nil
 }
 
@@ -190,230 +845,495 @@ func (s *Forwarder) getClient(slaveID byte) (*modbusClient, error) {
 	s.clientsMux.RUnlock()
 
 	if !exists {
-		return nil, fmt.Errorf("slave %d not configured", slaveID)
+		return nil, fmt.Errorf("slave %d: %w", slaveID, errSlaveNotConfigured)
+	}
+	if client.disabled.Load() {
+		return nil, fmt.Errorf("slave %d: %w", slaveID, errSlaveDisabled)
 	}
 
 	return client, nil
 }
 
-// monitorConnections monitor connection status
+// handler return the function handler of function on slaveID, the raw
+// passthrough for function codes without one when the slave has
+// raw_passthrough, nil when the function is not supported
+func (s *Forwarder) handler(slaveID byte, function uint8) functionHandler {
+	if handler := s.handlers[function]; handler != nil {
+		return handler
+	}
+	s.clientsMux.RLock()
+	client, exists := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	if exists && client.rawPassthrough {
+		return s.rawFunction
+	}
+	return nil
+}
+
+// functionAllowed report whether the function code may be forwarded to
+// slaveID according to its allowed and denied function codes
+func (s *Forwarder) functionAllowed(slaveID byte, function uint8) bool {
+	s.clientsMux.RLock()
+	client, exists := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	return !exists || !client.deniedFunctions[function]
+}
+
+// hidden report whether a read overlaps one of the hidden ranges
+func (c *modbusClient) hidden(function uint8, address, quantity int) bool {
+	for _, r := range c.hiddenRanges {
+		if pollFunctions[r.Type] == function && address < r.Address+r.Quantity && r.Address < address+quantity {
+			return true
+		}
+	}
+	return false
+}
+
+// errHidden read overlaps a hidden range
+var errHidden = errors.New("range is hidden")
+
+// errSlaveDisabled slave was disabled at runtime
+var errSlaveDisabled = errors.New("disabled")
+
+// errSlaveNotConfigured request routed to a slave without a server config
+var errSlaveNotConfigured = errors.New("not configured")
+
+// isTimeout report whether err is the slave not answering in time, the
+// dial or the response timeout
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, os.ErrDeadlineExceeded) || errors.Is(err, context.DeadlineExceeded) ||
+		errors.Is(err, serial.ErrTimeout) || (errors.As(err, &netErr) && netErr.Timeout())
+}
+
+// isUnreachable report whether err is a failed or lost connection to the
+// slave, e.g. a refused dial or a connection closed by the slave
+func isUnreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
+
+// errorException map an error to the exception returned upstream, the
+// exceptions of the slave are passed through; as a gateway, unconfigured
+// slaves are answered with gateway path unavailable, and timeouts and slaves
+// that can't be reached with gateway target device failed to respond
+func errorException(err error) *mbserver.Exception {
+	switch {
+	case errors.Is(err, errNotPolled), errors.Is(err, errHidden):
+		return &mbserver.IllegalDataAddress
+	case errors.Is(err, errNeverPolled):
+		return &mbserver.GatewayTargetDeviceFailedtoRespond
+	case errors.Is(err, errSlaveDisabled), errors.Is(err, errSlaveNotConfigured):
+		return &mbserver.GatewayPathUnavailable
+	case isTimeout(err), isUnreachable(err):
+		return &mbserver.GatewayTargetDeviceFailedtoRespond
+	}
+	var modbusErr *modbus.ModbusError
+	if errors.As(err, &modbusErr) {
+		// the exception of the slave, e.g. illegal data address
+		exception := mbserver.Exception(modbusErr.ExceptionCode)
+		return &exception
+	}
+	return &mbserver.SlaveDeviceFailure
+}
+
+// read answer a read from the static ranges, the shadow store, the
+// read-ahead cache or the slave
+func (s *Forwarder) read(client *modbusClient, slaveID byte, function uint8, address, quantity int) ([]byte, error) {
+	if client.hidden(function, address, quantity) {
+		return nil, errHidden
+	}
+	if r := client.static.find(function, address, quantity); r != nil {
+		return s.readStatic(client, slaveID, r, address, quantity)
+	}
+	if results, ok := client.shadow.ages(function, address, quantity, s.clock.Now()); ok {
+		return results, nil
+	}
+	if client.shadowReads {
+		return client.shadow.read(function, address, quantity)
+	}
+	if client.cache != nil {
+		if results, ok, err := s.readAhead(client, slaveID, function, address, quantity); ok || err != nil {
+			return results, err
+		}
+	}
+
+	return s.readDirect(client, slaveID, function, address, quantity)
+}
+
+// readDirect read from the slave, splitting reads larger than the slave
+// limit into several requests and stitching the results together
+func (s *Forwarder) readDirect(client *modbusClient, slaveID byte, function uint8, address, quantity int) ([]byte, error) {
+	limit := client.readLimit(function)
+	if quantity <= limit {
+		return s.readOnce(client, slaveID, function, address, quantity)
+	}
+
+	bits := function == 1 || function == 2
+	var results []byte
+	if bits {
+		results = make([]byte, (quantity+7)/8)
+	}
+	for offset := 0; offset < quantity; offset += limit {
+		count := min(limit, quantity-offset)
+		chunk, err := s.readOnce(client, slaveID, function, address+offset, count)
+		if err != nil {
+			return nil, err
+		}
+		if !bits {
+			results = append(results, chunk...)
+			continue
+		}
+		copyBits(results, offset, chunk, 0, min(count, len(chunk)*8))
+	}
+	s.logger.Debugf("split read (slave %d, function %d, addr %d, count %d) into requests of %d", slaveID, function, address, quantity, limit)
+	return results, nil
+}
+
+// readOnce perform one downstream read with the given function code
+func (s *Forwarder) readOnce(client *modbusClient, slaveID byte, function uint8, address, quantity int) (results []byte, err error) {
+	start := s.clock.Now()
+	switch function {
+	case 1:
+		results, err = client.client.ReadCoils(uint16(address), uint16(quantity))
+	case 2:
+		results, err = client.client.ReadDiscreteInputs(uint16(address), uint16(quantity))
+	case 3:
+		results, err = client.client.ReadHoldingRegisters(uint16(address), uint16(quantity))
+	case 4:
+		results, err = client.client.ReadInputRegisters(uint16(address), uint16(quantity))
+	default:
+		return nil, fmt.Errorf("function %d is not a read function", function)
+	}
+	s.record(client, slaveID, function, start, err)
+	return results, err
+}
+
+// written invalidate the cached values and update the polled values after a
+// successful write
+func (c *modbusClient) written(function uint8, address, quantity int, data []byte) {
+	c.cache.invalidate(function, address, quantity)
+	c.static.invalidate(function, address, quantity)
+	c.shadow.update(function, address, quantity, data)
+}
+
+// readLimit return the maximum quantity of one read request with the given function code
+func (c *modbusClient) readLimit(function uint8) int {
+	if function == 1 || function == 2 {
+		return c.maxReadBits
+	}
+	return c.maxReadRegisters
+}
+
+// checkLimit reject requests larger than the configured limit of the slave
+func (s *Forwarder) checkLimit(slaveID byte, quantity, limit int, name string) *mbserver.Exception {
+	if quantity <= limit {
+		return nil
+	}
+	s.logger.Warnf("rejected request for slave %d: quantity %d exceeds %s %d", slaveID, quantity, name, limit)
+	return &mbserver.IllegalDataValue
+}
+
+// monitorConnections monitor connection status of every slave with its
+// own interval
 func (s *Forwarder) monitorConnections() {
-	ticker := time.NewTicker(30 * time.Second)
+	s.clientsMux.RLock()
+	var wg sync.WaitGroup
+	for slaveID, client := range s.clients {
+		if client.probeType == "none" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.monitorConnection(slaveID, client)
+		}()
+	}
+	s.clientsMux.RUnlock()
+	wg.Wait()
+}
+
+// monitorConnection periodically probe one slave until the forwarder stops
+func (s *Forwarder) monitorConnection(slaveID byte, client *modbusClient) {
+	ticker := s.clock.NewTicker(client.monitorInterval)
 	defer ticker.Stop()
 
 	for {
 		select {
 		case <-s.ctx.Done():
 			return
-		case <-ticker.C:
-			s.checkConnections()
+		case <-ticker.C():
+			s.checkConnection(slaveID, client)
 		}
 	}
 }
 
-// checkConnections check connection status
-func (s *Forwarder) checkConnections() {
-	s.clientsMux.RLock()
-	defer s.clientsMux.RUnlock()
-
-	for slaveID, client := range s.clients {
-		// try to read a register to test connection
-		_, err := client.client.ReadHoldingRegisters(1, 1)
-		if err != nil {
-			if client.lastError == nil || client.lastError.Error() != err.Error() {
-				log.Printf("slave %d connection exception: %v", slaveID, err)
-				client.lastError = err
-			}
-		} else {
-			if client.lastError != nil {
-				log.Printf("slave %d connection restored", slaveID)
-				client.lastError = nil
-			}
-			client.lastConn = time.Now()
+// checkConnection check connection status with the configured probe
+func (s *Forwarder) checkConnection(slaveID byte, client *modbusClient) {
+	if client.disabled.Load() {
+		return
+	}
+	start := s.clock.Now()
+	err := client.probe()
+	client.lastActivity.Store(s.clock.Now().UnixNano())
+	client.health.observe(err == nil, s.clock.Now().Sub(start))
+	if err != nil {
+		if score := client.health.score(); score >= s.config.Health.DownBelow && s.config.Health.DownBelow > 0 {
+			s.logger.Debugf("slave %d probe failed with health score %.3f, not marked down: %v", slaveID, score, err)
+			return
 		}
+		s.markDown(slaveID, client, err)
+		return
 	}
+	s.markUp(slaveID, client)
+}
+
+// probe read the configured probe target to test the connection
+func (c *modbusClient) probe() (err error) {
+	switch c.probeType {
+	case "holding":
+		_, err = c.client.ReadHoldingRegisters(c.probeAddress, c.probeQuantity)
+	case "input":
+		_, err = c.client.ReadInputRegisters(c.probeAddress, c.probeQuantity)
+	case "coils":
+		_, err = c.client.ReadCoils(c.probeAddress, c.probeQuantity)
+	case "discrete":
+		_, err = c.client.ReadDiscreteInputs(c.probeAddress, c.probeQuantity)
+	}
+	return err
 }
 
 // ===================== below are the implementations of the function code handlers =====================
 
 // readCoils read coils, function code 1
-func (s *Forwarder) readCoils(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) readCoils(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, quantity, err := s.parseRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse read coils request: %v", err)
+		s.logger.Warnf("failed to parse read coils request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if !client.splitReads && !client.shadowReads {
+		if exception := s.checkLimit(slaveID, quantity, client.maxReadBits, "max_read_bits"); exception != nil {
+			return nil, exception
+		}
 	}
 
-	results, err := client.client.ReadCoils(uint16(address), uint16(quantity))
+	results, err := s.read(client, slaveID, 1, address, quantity)
 	if err != nil {
-		log.Printf("failed to read coils (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Errorf("failed to read coils (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
+		return nil, errorException(err)
 	}
 
-	// construct response
-	response := make([]byte, 1+len(results))
-	response[0] = byte(len(results))
-	copy(response[1:], results)
+	response := readResponse(results)
 
-	// log.Printf("read coils success (slave %d, addr %d, count %d)", slaveID, address, quantity)
+	s.logSampled("read coils success (slave %d, addr %d, count %d)", slaveID, address, quantity)
 	return response, &mbserver.Success
 }
 
 // readDiscreteInputs read discrete inputs, function code 2
-func (s *Forwarder) readDiscreteInputs(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) readDiscreteInputs(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, quantity, err := s.parseRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse read discrete inputs request: %v", err)
+		s.logger.Warnf("failed to parse read discrete inputs request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if !client.splitReads && !client.shadowReads {
+		if exception := s.checkLimit(slaveID, quantity, client.maxReadBits, "max_read_bits"); exception != nil {
+			return nil, exception
+		}
 	}
 
-	results, err := client.client.ReadDiscreteInputs(uint16(address), uint16(quantity))
+	results, err := s.read(client, slaveID, 2, address, quantity)
 	if err != nil {
-		log.Printf("failed to read discrete inputs (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Errorf("failed to read discrete inputs (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
+		return nil, errorException(err)
 	}
 
-	response := make([]byte, 1+len(results))
-	response[0] = byte(len(results))
-	copy(response[1:], results)
+	response := readResponse(results)
 
-	// log.Printf("read discrete inputs success (slave %d, addr %d, count %d)", slaveID, address, quantity)
+	s.logSampled("read discrete inputs success (slave %d, addr %d, count %d)", slaveID, address, quantity)
 	return response, &mbserver.Success
 }
 
 // readHoldingRegisters read holding registers, function code 3
-func (s *Forwarder) readHoldingRegisters(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) readHoldingRegisters(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, quantity, err := s.parseRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse read holding registers request: %v", err)
+		s.logger.Warnf("failed to parse read holding registers request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
 	}
 
-	results, err := client.client.ReadHoldingRegisters(uint16(address), uint16(quantity))
-	if err != nil {
-		log.Printf("failed to read holding registers (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
-		return nil, &mbserver.SlaveDeviceFailure
+	if !client.splitReads && !client.shadowReads {
+		if exception := s.checkLimit(slaveID, quantity, client.maxReadRegisters, "max_read_registers"); exception != nil {
+			return nil, exception
+		}
 	}
 
-	response := make([]byte, 1+len(results))
-	response[0] = byte(len(results) * 2)
-	for i, value := range results {
-		response[1+i] = value
+	results, err := s.read(client, slaveID, 3, address, quantity)
+	if err != nil {
+		s.logger.Errorf("failed to read holding registers (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
+		return nil, errorException(err)
 	}
 
-	// log.Printf("read holding registers success (slave %d, addr %d, count %d)", slaveID, address, quantity)
+	response := readResponse(results)
+
+	s.logSampled("read holding registers success (slave %d, addr %d, count %d)", slaveID, address, quantity)
 	return response, &mbserver.Success
 }
 
 // readInputRegisters read input registers, function code 4
-func (s *Forwarder) readInputRegisters(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) readInputRegisters(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, quantity, err := s.parseRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse read input registers request: %v", err)
+		s.logger.Warnf("failed to parse read input registers request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
 	}
 
-	results, err := client.client.ReadInputRegisters(uint16(address), uint16(quantity))
-	if err != nil {
-		log.Printf("failed to read input registers (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
-		return nil, &mbserver.SlaveDeviceFailure
+	if !client.splitReads && !client.shadowReads {
+		if exception := s.checkLimit(slaveID, quantity, client.maxReadRegisters, "max_read_registers"); exception != nil {
+			return nil, exception
+		}
 	}
 
-	response := make([]byte, 1+len(results))
-	response[0] = byte(len(results) * 2)
-	for i, value := range results {
-		response[1+i] = value
+	results, err := s.read(client, slaveID, 4, address, quantity)
+	if err != nil {
+		s.logger.Errorf("failed to read input registers (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
+		return nil, errorException(err)
 	}
 
-	// log.Printf("read input registers success (slave %d, addr %d, count %d)", slaveID, address, quantity)
+	response := readResponse(results)
+
+	s.logSampled("read input registers success (slave %d, addr %d, count %d)", slaveID, address, quantity)
 	return response, &mbserver.Success
 }
 
 // writeSingleCoil write single coil, function code 5
-func (s *Forwarder) writeSingleCoil(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) writeSingleCoil(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, value, err := s.parseWriteSingleRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse write single coil request: %v", err)
+		s.logger.Warnf("failed to parse write single coil request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if exception := s.checkWriteRate(client, slaveID, 1, address, 1); exception != nil {
+		return nil, exception
 	}
 
 	coilValue := value == 0xFF00
+	before := s.beforeWrite(client, slaveID, 1, address, 1)
+	start := s.clock.Now()
 	_, err = client.client.WriteSingleCoil(uint16(address), uint16(value))
+	s.record(client, slaveID, 5, start, err)
 	if err != nil {
-		log.Printf("failed to write single coil (slave %d, addr %d, value %v): %v", slaveID, address, coilValue, err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Errorf("failed to write single coil (slave %d, addr %d, value %v): %v", slaveID, address, coilValue, err)
+		return nil, errorException(err)
+	}
+	coilBytes := []byte{0}
+	if coilValue {
+		coilBytes[0] = 1
 	}
+	client.written(1, address, 1, coilBytes)
+	s.afterWrite(client, slaveID, 5, 1, address, 1, before, coilBytes)
 
-	log.Printf("write single coil success (slave %d, addr %d, value %v)", slaveID, address, coilValue)
+	s.logger.Infof("write single coil success (slave %d, addr %d, value %v)", slaveID, address, coilValue)
 	return frame.GetData()[0:4], &mbserver.Success
 }
 
 // writeSingleRegister write single register, function code 6
-func (s *Forwarder) writeSingleRegister(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) writeSingleRegister(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, value, err := s.parseWriteSingleRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse write single register request: %v", err)
+		s.logger.Warnf("failed to parse write single register request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
 	}
 
-	_, err = client.client.WriteSingleRegister(uint16(address), uint16(value))
-	if err != nil {
-		log.Printf("failed to write single register (slave %d, addr %d, value %d): %v", slaveID, address, value, err)
-		return nil, &mbserver.SlaveDeviceFailure
+	if exception := s.checkWriteRate(client, slaveID, 3, address, 1); exception != nil {
+		return nil, exception
+	}
+
+	if client.coalescer != nil {
+		s.coalesceWrite(client, slaveID, uint16(address), uint16(value))
+		return frame.GetData()[0:4], &mbserver.Success
 	}
 
-	log.Printf("write single register success (slave %d, addr %d, value %d)", slaveID, address, value)
+	if err := s.writeRegister(client, slaveID, uint16(address), uint16(value)); err != nil {
+		s.logger.Errorf("failed to write single register (slave %d, addr %d, value %d): %v", slaveID, address, value, err)
+		return nil, errorException(err)
+	}
+
+	s.logger.Infof("write single register success (slave %d, addr %d, value %d)", slaveID, address, value)
 	return frame.GetData()[0:4], &mbserver.Success
 }
 
+// writeRegister perform one downstream single register write
+func (s *Forwarder) writeRegister(client *modbusClient, slaveID byte, address, value uint16) error {
+	before := s.beforeWrite(client, slaveID, 3, int(address), 1)
+	start := s.clock.Now()
+	_, err := client.client.WriteSingleRegister(address, value)
+	s.record(client, slaveID, 6, start, err)
+	if err == nil {
+		data := []byte{byte(value >> 8), byte(value)}
+		client.written(3, int(address), 1, data)
+		s.afterWrite(client, slaveID, 6, 3, int(address), 1, before, data)
+	}
+	return err
+}
+
 // writeMultipleCoils write multiple coils, function code 15
-func (s *Forwarder) writeMultipleCoils(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) writeMultipleCoils(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, quantity, data, err := s.parseWriteMultipleRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse write multiple coils request: %v", err)
+		s.logger.Warnf("failed to parse write multiple coils request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if exception := s.checkWriteRate(client, slaveID, 1, address, quantity); exception != nil {
+		return nil, exception
 	}
 
 	// convert data format
@@ -436,34 +1356,41 @@ func (s *Forwarder) writeMultipleCoils(server *mbserver.Server, frame mbserver.F
 		}
 	}
 
+	before := s.beforeWrite(client, slaveID, 1, address, quantity)
+	start := s.clock.Now()
 	_, err = client.client.WriteMultipleCoils(uint16(address), uint16(quantity), coilBytes)
+	s.record(client, slaveID, 15, start, err)
 	if err != nil {
-		log.Printf("failed to write multiple coils (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Errorf("failed to write multiple coils (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
+		return nil, errorException(err)
 	}
+	client.written(1, address, quantity, coilBytes)
+	s.afterWrite(client, slaveID, 15, 1, address, quantity, before, coilBytes)
 
-	log.Printf("write multiple coils success (slave %d, addr %d, count %d)", slaveID, address, quantity)
-	// safe return data, avoid array out of bounds
-	frameData := frame.GetData()
-	maxLen := len(frameData)
-	if quantity*4 > maxLen {
-		return frameData[0:maxLen], &mbserver.Success
-	}
-	return frameData[0 : quantity*4], &mbserver.Success
+	s.logger.Infof("write multiple coils success (slave %d, addr %d, count %d)", slaveID, address, quantity)
+	return writeMultipleResponse(address, quantity), &mbserver.Success
 }
 
 // writeMultipleRegisters write multiple registers, function code 16
-func (s *Forwarder) writeMultipleRegisters(server *mbserver.Server, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+func (s *Forwarder) writeMultipleRegisters(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
 	slaveID, address, quantity, data, err := s.parseWriteMultipleRequest(frame)
 	if err != nil {
-		log.Printf("failed to parse write multiple registers request: %v", err)
+		s.logger.Warnf("failed to parse write multiple registers request: %v", err)
 		return nil, &mbserver.IllegalDataAddress
 	}
 
 	client, err := s.getClient(slaveID)
 	if err != nil {
-		log.Printf("failed to get client: %v", err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if exception := s.checkWriteRate(client, slaveID, 3, address, quantity); exception != nil {
+		return nil, exception
+	}
+
+	if exception := s.checkLimit(slaveID, quantity, client.maxWriteRegisters, "max_write_registers"); exception != nil {
+		return nil, exception
 	}
 
 	// convert data format
@@ -479,20 +1406,141 @@ func (s *Forwarder) writeMultipleRegisters(server *mbserver.Server, frame mbserv
 		registerBytes[i*2+1] = byte(value)
 	}
 
+	before := s.beforeWrite(client, slaveID, 3, address, quantity)
+	start := s.clock.Now()
 	_, err = client.client.WriteMultipleRegisters(uint16(address), uint16(quantity), registerBytes)
+	s.record(client, slaveID, 16, start, err)
 	if err != nil {
-		log.Printf("failed to write multiple registers (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
-		return nil, &mbserver.SlaveDeviceFailure
+		s.logger.Errorf("failed to write multiple registers (slave %d, addr %d, count %d): %v", slaveID, address, quantity, err)
+		return nil, errorException(err)
 	}
+	client.written(3, address, quantity, registerBytes)
+	s.afterWrite(client, slaveID, 16, 3, address, quantity, before, registerBytes)
 
-	log.Printf("write multiple registers success (slave %d, addr %d, count %d)", slaveID, address, quantity)
-	// safe return data, avoid array out of bounds
-	frameData := frame.GetData()
-	maxLen := len(frameData)
-	if quantity*4 > maxLen {
-		return frameData[0:maxLen], &mbserver.Success
+	s.logger.Infof("write multiple registers success (slave %d, addr %d, count %d)", slaveID, address, quantity)
+	return writeMultipleResponse(address, quantity), &mbserver.Success
+}
+
+// maskWriteRegister modify bits of a holding register, function code 22
+func (s *Forwarder) maskWriteRegister(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	data := frame.GetData()
+	if len(data) < 6 {
+		s.logger.Warnf("failed to parse mask write register request: insufficient data")
+		return nil, &mbserver.IllegalDataAddress
+	}
+	address := int(data[0])<<8 | int(data[1])
+	andMask := uint16(data[2])<<8 | uint16(data[3])
+	orMask := uint16(data[4])<<8 | uint16(data[5])
+
+	slaveID := getSlaveID(frame)
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if exception := s.checkWriteRate(client, slaveID, 3, address, 1); exception != nil {
+		return nil, exception
+	}
+	if exception := s.checkMaskWrite(client, slaveID, address, andMask, orMask); exception != nil {
+		return nil, exception
 	}
-	return frameData[0 : quantity*4], &mbserver.Success
+
+	start := s.clock.Now()
+	_, err = client.client.MaskWriteRegister(uint16(address), andMask, orMask)
+	s.record(client, slaveID, 22, start, err)
+	if err != nil {
+		s.logger.Errorf("failed to mask write register (slave %d, addr %d, and %04x, or %04x): %v", slaveID, address, andMask, orMask, err)
+		return nil, errorException(err)
+	}
+	client.cache.invalidate(3, address, 1)
+	client.static.invalidate(3, address, 1)
+	client.shadow.mask(address, andMask, orMask)
+
+	s.logger.Infof("mask write register success (slave %d, addr %d, and %04x, or %04x)", slaveID, address, andMask, orMask)
+	return data[0:6], &mbserver.Success
+}
+
+// readWriteMultipleRegisters write holding registers and read holding
+// registers in one transaction, function code 23; the slave performs the
+// write before the read
+func (s *Forwarder) readWriteMultipleRegisters(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	data := frame.GetData()
+	if len(data) < 9 {
+		s.logger.Warnf("failed to parse read/write multiple registers request: insufficient data")
+		return nil, &mbserver.IllegalDataAddress
+	}
+	readAddress := int(data[0])<<8 | int(data[1])
+	readQuantity := int(data[2])<<8 | int(data[3])
+	writeAddress := int(data[4])<<8 | int(data[5])
+	writeQuantity := int(data[6])<<8 | int(data[7])
+	byteCount := int(data[8])
+	if byteCount != writeQuantity*2 {
+		s.logger.Warnf("failed to parse read/write multiple registers request: byte count %d does not match write quantity %d", byteCount, writeQuantity)
+		return nil, &mbserver.IllegalDataValue
+	}
+	if len(data) < 9+byteCount {
+		s.logger.Warnf("failed to parse read/write multiple registers request: insufficient data for byte count")
+		return nil, &mbserver.IllegalDataAddress
+	}
+	values := data[9 : 9+byteCount]
+
+	slaveID := getSlaveID(frame)
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	if readQuantity < 1 || writeQuantity < 1 {
+		s.logger.Warnf("rejected read/write multiple registers request for slave %d: read quantity %d, write quantity %d", slaveID, readQuantity, writeQuantity)
+		return nil, &mbserver.IllegalDataValue
+	}
+	if exception := s.checkLimit(slaveID, readQuantity, client.maxReadRegisters, "max_read_registers"); exception != nil {
+		return nil, exception
+	}
+	// the write quantity of FC 23 is limited to 121 by the request size
+	if exception := s.checkLimit(slaveID, writeQuantity, min(client.maxWriteRegisters, 121), "max_write_registers"); exception != nil {
+		return nil, exception
+	}
+	if client.hidden(3, readAddress, readQuantity) {
+		s.logger.Warnf("rejected read/write multiple registers request for slave %d: read (addr %d, count %d) overlaps a hidden range", slaveID, readAddress, readQuantity)
+		return nil, &mbserver.IllegalDataAddress
+	}
+	if exception := s.checkWriteRate(client, slaveID, 3, writeAddress, writeQuantity); exception != nil {
+		return nil, exception
+	}
+
+	before := s.beforeWrite(client, slaveID, 3, writeAddress, writeQuantity)
+	start := s.clock.Now()
+	results, err := client.client.ReadWriteMultipleRegisters(uint16(readAddress), uint16(readQuantity), uint16(writeAddress), uint16(writeQuantity), values)
+	s.record(client, slaveID, 23, start, err)
+	if err != nil {
+		s.logger.Errorf("failed to read/write multiple registers (slave %d, read addr %d, count %d, write addr %d, count %d): %v",
+			slaveID, readAddress, readQuantity, writeAddress, writeQuantity, err)
+		return nil, errorException(err)
+	}
+	client.written(3, writeAddress, writeQuantity, values)
+	s.afterWrite(client, slaveID, 23, 3, writeAddress, writeQuantity, before, values)
+
+	s.logger.Infof("read/write multiple registers success (slave %d, read addr %d, count %d, write addr %d, count %d)",
+		slaveID, readAddress, readQuantity, writeAddress, writeQuantity)
+	return readResponse(results), &mbserver.Success
+}
+
+// readResponse build the data of a read response: the byte count followed
+// by a copy of the coil, input or register bytes read from the slave
+func readResponse(results []byte) []byte {
+	response := make([]byte, 1+len(results))
+	response[0] = byte(len(results))
+	copy(response[1:], results)
+	return response
+}
+
+// writeMultipleResponse build the data of a write multiple response: the
+// starting address and quantity of the request
+func writeMultipleResponse(address, quantity int) []byte {
+	return []byte{byte(address >> 8), byte(address), byte(quantity >> 8), byte(quantity)}
 }
 
 // parseRequest parse read request
@@ -504,19 +1552,17 @@ func (s *Forwarder) parseRequest(frame mbserver.Framer) (slaveID byte, address,
 
 	// extract slaveID from frame
 	frameSlaveID := getSlaveID(frame)
-	if frameSlaveID == 0 {
-		return 0, 0, 0, fmt.Errorf("failed to get slaveID from frame")
-	}
 
-	// validate slaveID is in config
-	if _, exists := s.config.Servers[frameSlaveID]; !exists {
+	// resolve unit ID aliases to the configured server
+	slaveID, exists := s.units[frameSlaveID]
+	if !exists {
 		return 0, 0, 0, fmt.Errorf("slave %d not configured", frameSlaveID)
 	}
 
 	address = int(data[0])<<8 | int(data[1])
 	quantity = int(data[2])<<8 | int(data[3])
 
-	return frameSlaveID, address, quantity, nil
+	return slaveID, address, quantity, nil
 }
 
 // parseWriteSingleRequest parse write single request
@@ -528,19 +1574,17 @@ func (s *Forwarder) parseWriteSingleRequest(frame mbserver.Framer) (slaveID byte
 
 	// extract slaveID from frame
 	frameSlaveID := getSlaveID(frame)
-	if frameSlaveID == 0 {
-		return 0, 0, 0, fmt.Errorf("failed to get slaveID from frame")
-	}
 
-	// validate slaveID is in config
-	if _, exists := s.config.Servers[frameSlaveID]; !exists {
+	// resolve unit ID aliases to the configured server
+	slaveID, exists := s.units[frameSlaveID]
+	if !exists {
 		return 0, 0, 0, fmt.Errorf("slave %d not configured", frameSlaveID)
 	}
 
 	address = int(data[0])<<8 | int(data[1])
 	value = int(data[2])<<8 | int(data[3])
 
-	return frameSlaveID, address, value, nil
+	return slaveID, address, value, nil
 }
 
 // parseWriteMultipleRequest parse write multiple request
@@ -552,12 +1596,10 @@ func (s *Forwarder) parseWriteMultipleRequest(frame mbserver.Framer) (slaveID by
 
 	// extract slaveID from frame
 	frameSlaveID := getSlaveID(frame)
-	if frameSlaveID == 0 {
-		return 0, 0, 0, nil, fmt.Errorf("failed to get slaveID from frame")
-	}
 
-	// validate slaveID is in config
-	if _, exists := s.config.Servers[frameSlaveID]; !exists {
+	// resolve unit ID aliases to the configured server
+	slaveID, exists := s.units[frameSlaveID]
+	if !exists {
 		return 0, 0, 0, nil, fmt.Errorf("slave %d not configured", frameSlaveID)
 	}
 
@@ -571,7 +1613,7 @@ func (s *Forwarder) parseWriteMultipleRequest(frame mbserver.Framer) (slaveID by
 
 	data = frameData[5 : 5+byteCount]
 
-	return frameSlaveID, address, quantity, data, nil
+	return slaveID, address, quantity, data, nil
 }
 
 func getSlaveID(frame mbserver.Framer) byte {
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// roundTrip send a request ADU on conn and return the response ADU
+func roundTrip(t *testing.T, conn net.Conn, request []byte) []byte {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, 6)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	rest := make([]byte, int(response[4])<<8|int(response[5]))
+	if _, err := io.ReadFull(conn, rest); err != nil {
+		t.Fatal(err)
+	}
+	return append(response, rest...)
+}
+
+// bits unpack the first n bits of packed coils, LSB first
+func bits(packed []byte, n int) []bool {
+	values := make([]bool, n)
+	for i := range values {
+		values[i] = packed[i/8]&(1<<(i%8)) != 0
+	}
+	return values
+}
+
+func TestReadResponse(t *testing.T) {
+	tests := []struct {
+		results  []byte
+		response []byte
+	}{
+		{[]byte{0xCD, 0x6B, 0x05}, []byte{0x03, 0xCD, 0x6B, 0x05}},
+		{[]byte{0x02, 0x2B, 0x00, 0x00, 0x00, 0x64}, []byte{0x06, 0x02, 0x2B, 0x00, 0x00, 0x00, 0x64}},
+		{[]byte{0x00}, []byte{0x01, 0x00}},
+	}
+	for _, tt := range tests {
+		if got := readResponse(tt.results); !bytes.Equal(got, tt.response) {
+			t.Errorf("readResponse(% x) = % x, expected % x", tt.results, got, tt.response)
+		}
+	}
+}
+
+func TestWriteMultipleResponse(t *testing.T) {
+	tests := []struct {
+		address, quantity int
+		response          []byte
+	}{
+		{0x0013, 10, []byte{0x00, 0x13, 0x00, 0x0A}},
+		{0x0001, 2, []byte{0x00, 0x01, 0x00, 0x02}},
+		{0xFFFF, 0x7B, []byte{0xFF, 0xFF, 0x00, 0x7B}},
+	}
+	for _, tt := range tests {
+		if got := writeMultipleResponse(tt.address, tt.quantity); !bytes.Equal(got, tt.response) {
+			t.Errorf("writeMultipleResponse(%d, %d) = % x, expected % x", tt.address, tt.quantity, got, tt.response)
+		}
+	}
+}
+
+// TestGoldenFrames compare the response ADUs of every forwarded function
+// code with frames captured from spec-conformant devices, the request and
+// response examples of the Modbus application protocol specification
+func TestGoldenFrames(t *testing.T) {
+	h := startHarness(t, harnessConfig)
+	slave := h.Slave("10.0.0.1:502")
+	slave.SetCoils(0x13, bits([]byte{0xCD, 0x6B, 0x05}, 19)...)
+	slave.SetDiscrete(0xC4, bits([]byte{0xAC, 0xDB, 0x35}, 22)...)
+	slave.SetHolding(0x6B, 0x022B, 0x0000, 0x0064)
+	slave.SetInput(0x08, 0x000A)
+	slave.SetHolding(0x03, 0x00FE, 0x0ACD, 0x0001, 0x0003, 0x000D, 0x00FF)
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		request  string
+		response string
+	}{
+		{"read coils", "0001 0000 0006 01 01 0013 0013", "0001 0000 0006 01 01 03 cd6b05"},
+		{"read discrete inputs", "0002 0000 0006 01 02 00c4 0016", "0002 0000 0006 01 02 03 acdb35"},
+		{"read holding registers", "0003 0000 0006 01 03 006b 0003", "0003 0000 0009 01 03 06 022b 0000 0064"},
+		{"read input registers", "0004 0000 0006 01 04 0008 0001", "0004 0000 0005 01 04 02 000a"},
+		{"write single coil", "0005 0000 0006 01 05 00ac ff00", "0005 0000 0006 01 05 00ac ff00"},
+		{"write single register", "0006 0000 0006 01 06 0001 0003", "0006 0000 0006 01 06 0001 0003"},
+		{"write multiple coils", "0007 0000 0009 01 0f 0013 000a 02 cd01", "0007 0000 0006 01 0f 0013 000a"},
+		{"write multiple registers", "0008 0000 000b 01 10 0001 0002 04 000a 0102", "0008 0000 0006 01 10 0001 0002"},
+		{"read/write multiple registers", "0009 0000 0011 01 17 0003 0006 000e 0003 06 00ff 00ff 00ff",
+			"0009 0000 000f 01 17 0c 00fe 0acd 0001 0003 000d 00ff"},
+		{"unit ID kept in the response", "000a 0000 0006 02 03 0000 0001", "000a 0000 0005 02 03 02 0000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := roundTrip(t, conn, unhex(t, tt.request)), unhex(t, tt.response); !bytes.Equal(got, want) {
+				t.Errorf("response % x, expected % x", got, want)
+			}
+		})
+	}
+
+	if !slave.Coil(0xAC) {
+		t.Errorf("coil 0xac not set by the write single coil")
+	}
+	if got := slave.Holding(0x0E); got != 0x00FF {
+		t.Errorf("holding 0x0e is %#x after the read/write multiple registers, expected 0xff", got)
+	}
+}
+
+// stepClock clock advanced only by the test
+type stepClock struct{ now time.Time }
+
+func (c *stepClock) Now() time.Time { return c.now }
+
+func (c *stepClock) After(d time.Duration) <-chan time.Time { return make(chan time.Time) }
+
+func (c *stepClock) NewTicker(d time.Duration) Ticker { return nil }
+
+func TestAsyncWriteFlushTimeout(t *testing.T) {
+	clock := &stepClock{now: time.Unix(0, 0)}
+	s := &Forwarder{logger: quietLogger(), clock: clock}
+	written := 0
+	s.handlers[6] = func(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+		// every write takes 4s of the 10s flush budget
+		written++
+		clock.now = clock.now.Add(4 * time.Second)
+		return frame.GetData(), &mbserver.Success
+	}
+	a := &asyncWriter{queue: make(chan asyncWrite, 5), flushTimeout: 10 * time.Second}
+	for i := range 5 {
+		frame := &mbserver.TCPFrame{Device: 1, Function: 6, Data: []byte{0, byte(i), 0, 1}}
+		a.queue <- asyncWrite{frame: frame, client: "10.0.0.20", acked: clock.now}
+	}
+
+	s.flushAsyncWrites(1, a)
+	if written != 3 {
+		t.Errorf("%d writes flushed, expected 3", written)
+	}
+	if len(a.queue) != 0 {
+		t.Errorf("%d writes left in the queue, expected the rest dropped", len(a.queue))
+	}
+}
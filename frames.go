@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+)
+
+// malformed frame kinds
+const (
+	malformedUndersized = "undersized" // too short for the function code or truncated
+	malformedByteCount  = "byte_count" // byte count not matching the quantity or the frame length
+	malformedParse      = "parse"      // not a valid frame, e.g. invalid MBAP length, CRC or echo
+)
+
+// errMalformedFrame upstream frame that could not be parsed
+var errMalformedFrame = errors.New("malformed frame")
+
+// malformedFrames counters of malformed frames by kind
+type malformedFrames struct {
+	undersized atomic.Uint64
+	byteCount  atomic.Uint64
+	parse      atomic.Uint64
+}
+
+// malformedStatus malformed frame counts of a client or slave
+type malformedStatus struct {
+	Undersized uint64 `json:"undersized"`
+	ByteCount  uint64 `json:"byte_count"`
+	Parse      uint64 `json:"parse"`
+}
+
+// add count a malformed frame of kind, empty kinds are ignored
+func (m *malformedFrames) add(kind string) {
+	switch kind {
+	case malformedUndersized:
+		m.undersized.Add(1)
+	case malformedByteCount:
+		m.byteCount.Add(1)
+	case malformedParse:
+		m.parse.Add(1)
+	}
+}
+
+func (m *malformedFrames) snapshot() malformedStatus {
+	return malformedStatus{Undersized: m.undersized.Load(), ByteCount: m.byteCount.Load(), Parse: m.parse.Load()}
+}
+
+// requestMinimum minimum request PDU data length by function code
+var requestMinimum = map[uint8]int{1: 4, 2: 4, 3: 4, 4: 4, 5: 4, 6: 4, 8: 2, 15: 5, 16: 5, 20: 1, 21: 1, 22: 6, 23: 9, 24: 2, 43: 3}
+
+// malformedRequest classify the request PDU data of function, empty when it
+// is well formed or the function code is not known to the forwarder
+func malformedRequest(function uint8, data []byte) string {
+	if len(data) < requestMinimum[function] {
+		return malformedUndersized
+	}
+	var quantity, byteCount, values int
+	switch function {
+	case 15:
+		quantity, byteCount, values = int(data[2])<<8|int(data[3]), int(data[4]), 5
+		quantity = (quantity + 7) / 8
+	case 16:
+		quantity, byteCount, values = int(data[2])<<8|int(data[3]), int(data[4]), 5
+		quantity *= 2
+	case 23:
+		quantity, byteCount, values = int(data[6])<<8|int(data[7]), int(data[8]), 9
+		quantity *= 2
+	case 20, 21:
+		// the byte count covers the sub-requests
+		quantity, byteCount, values = len(data)-1, int(data[0]), 1
+	default:
+		return ""
+	}
+	if byteCount != quantity || len(data) != values+byteCount {
+		return malformedByteCount
+	}
+	return ""
+}
+
+// invalidRequest check the quantity, byte count and coil value fields of the
+// request PDU data of function against the limits of the Modbus spec, nil
+// when they are valid; data too short to hold the fields is left to the
+// function handlers
+func invalidRequest(function uint8, data []byte) error {
+	if len(data) < requestMinimum[function] {
+		return nil
+	}
+	var quantity, limit, byteCount, expected int
+	switch function {
+	case 1, 2:
+		quantity, limit = int(data[2])<<8|int(data[3]), 2000
+	case 3, 4:
+		quantity, limit = int(data[2])<<8|int(data[3]), 125
+	case 5:
+		if value := int(data[2])<<8 | int(data[3]); value != 0x0000 && value != 0xFF00 {
+			return fmt.Errorf("coil value %04x is neither 0000 nor FF00", value)
+		}
+		return nil
+	case 15:
+		quantity, limit = int(data[2])<<8|int(data[3]), 1968
+		byteCount, expected = int(data[4]), (quantity+7)/8
+	case 16:
+		quantity, limit = int(data[2])<<8|int(data[3]), 123
+		byteCount, expected = int(data[4]), quantity*2
+	case 23:
+		if read := int(data[2])<<8 | int(data[3]); read < 1 || read > 125 {
+			return fmt.Errorf("read quantity %d is not between 1-125", read)
+		}
+		quantity, limit = int(data[6])<<8|int(data[7]), 121
+		byteCount, expected = int(data[8]), quantity*2
+	default:
+		return nil
+	}
+	if quantity < 1 || quantity > limit {
+		return fmt.Errorf("quantity %d is not between 1-%d", quantity, limit)
+	}
+	if byteCount != expected {
+		return fmt.Errorf("byte count %d does not match quantity %d", byteCount, quantity)
+	}
+	return nil
+}
+
+// malformedResponse classify the error of a downstream transaction, empty
+// when the slave did not answer with a malformed frame, e.g. on timeouts
+func malformedResponse(err error) string {
+	if err == nil {
+		return ""
+	}
+	msg := err.Error()
+	switch {
+	case strings.Contains(msg, "does not meet minimum"),
+		strings.Contains(msg, "is less than expected"),
+		strings.Contains(msg, "response data is empty"),
+		strings.Contains(msg, "inter-character timeout"):
+		return malformedUndersized
+	case strings.Contains(msg, "response data size"),
+		strings.Contains(msg, "does not match pdu data length"):
+		return malformedByteCount
+	case strings.Contains(msg, "response crc"),
+		strings.Contains(msg, "response lrc"),
+		strings.Contains(msg, "in response header"),
+		strings.Contains(msg, "does not match request"),
+		strings.Contains(msg, "is not started with"),
+		strings.Contains(msg, "is not ended with"),
+		strings.Contains(msg, "is not an even number"):
+		return malformedParse
+	}
+	return ""
+}
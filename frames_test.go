@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInvalidRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		function uint8
+		data     string
+		invalid  bool
+	}{
+		{"read coils 1", 1, "0000 0001", false},
+		{"read coils 2000", 1, "0000 07d0", false},
+		{"read coils 0", 1, "0000 0000", true},
+		{"read coils 2001", 1, "0000 07d1", true},
+		{"read discrete inputs 2001", 2, "0000 07d1", true},
+		{"read holding registers 125", 3, "0000 007d", false},
+		{"read holding registers 0", 3, "0000 0000", true},
+		{"read holding registers 126", 3, "0000 007e", true},
+		{"read input registers 126", 4, "0000 007e", true},
+		{"write single coil on", 5, "0000 ff00", false},
+		{"write single coil off", 5, "0000 0000", false},
+		{"write single coil 0001", 5, "0000 0001", true},
+		{"write single register", 6, "0000 1234", false},
+		{"write multiple coils", 15, "0013 000a 02 cd01", false},
+		{"write multiple coils 1968", 15, "0000 07b0 f6", false},
+		{"write multiple coils 1969", 15, "0000 07b1 f7", true},
+		{"write multiple coils byte count", 15, "0013 000a 01 cd", true},
+		{"write multiple registers", 16, "0001 0002 04 000a 0102", false},
+		{"write multiple registers 0", 16, "0001 0000 00", true},
+		{"write multiple registers 124", 16, "0001 007c f8", true},
+		{"write multiple registers byte count", 16, "0001 0002 03 000a 01", true},
+		{"read/write multiple registers", 23, "0003 0006 000e 0003 06 00ff 00ff 00ff", false},
+		{"read/write multiple registers read 0", 23, "0003 0000 000e 0001 02 00ff", true},
+		{"read/write multiple registers read 126", 23, "0003 007e 000e 0001 02 00ff", true},
+		{"read/write multiple registers write 122", 23, "0003 0001 000e 007a f4", true},
+		{"read/write multiple registers byte count", 23, "0003 0001 000e 0001 04 00ff", true},
+		{"too short, left to the handler", 3, "0000", false},
+		{"not checked", 8, "0000 a537", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := invalidRequest(tt.function, unhex(t, tt.data))
+			if (err != nil) != tt.invalid {
+				t.Errorf("invalidRequest(%d, %s) = %v, expected invalid %t", tt.function, tt.data, err, tt.invalid)
+			}
+		})
+	}
+}
+
+func TestMalformedRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		function uint8
+		data     string
+		kind     string
+	}{
+		{"read holding registers", 3, "0000 0001", ""},
+		{"read holding registers short", 3, "0000 00", malformedUndersized},
+		{"write single coil short", 5, "0000", malformedUndersized},
+		{"write multiple registers", 16, "0001 0002 04 000a 0102", ""},
+		{"write multiple registers short", 16, "0001 0002", malformedUndersized},
+		{"write multiple registers byte count", 16, "0001 0002 03 000a 01", malformedByteCount},
+		{"write multiple registers truncated", 16, "0001 0002 04 000a", malformedByteCount},
+		{"write multiple coils byte count", 15, "0013 000a 01 cd", malformedByteCount},
+		{"read/write multiple registers byte count", 23, "0003 0001 000e 0001 04 00ff", malformedByteCount},
+		{"read file record byte count", 20, "08 06 0004 0007 0002", malformedByteCount},
+		{"unknown function", 65, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := malformedRequest(tt.function, unhex(t, tt.data)); got != tt.kind {
+				t.Errorf("malformedRequest(%d, %s) = %q, expected %q", tt.function, tt.data, got, tt.kind)
+			}
+		})
+	}
+}
+
+// TestExceptionResponses check the exception responses of requests the
+// forwarder rejects before they reach the slave
+func TestExceptionResponses(t *testing.T) {
+	h := startHarness(t, harnessConfig)
+	slave := h.Slave("10.0.0.1:502")
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		unit     byte
+		request  string
+		response string
+	}{
+		{"quantity 0", 1, "03 0000 0000", "83 03"},
+		{"quantity above the limit", 1, "01 0000 07d1", "81 03"},
+		{"byte count", 1, "10 0001 0002 03 000a 01", "90 03"},
+		{"coil value", 1, "05 0000 1234", "85 03"},
+		{"unknown function code", 1, "41 0000", "c1 01"},
+		{"unconfigured unit", 9, "03 0000 0001", "83 0a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := exchange(t, conn, tt.unit, unhex(t, tt.request)), unhex(t, tt.response); !bytes.Equal(got, want) {
+				t.Errorf("response % x, expected % x", got, want)
+			}
+		})
+	}
+	if n := slave.Requests(); n != 0 {
+		t.Errorf("%d rejected requests reached the slave", n)
+	}
+}
@@ -3,9 +3,17 @@ module github.com/TwoMental/mb-forwarder
 go 1.24.0
 
 require (
+	github.com/eclipse/paho.mqtt.golang v1.5.1
 	github.com/goburrow/modbus v0.1.0
+	github.com/goburrow/serial v0.1.0
+	github.com/gorilla/websocket v1.5.3
 	github.com/tbrandon/mbserver v0.0.0-20231208015628-36eb59221ac2
+	golang.org/x/net v0.44.0
 	gopkg.in/yaml.v2 v2.4.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
-require github.com/goburrow/serial v0.1.0 // indirect
+require (
+	golang.org/x/sync v0.17.0 // indirect
+	golang.org/x/sys v0.36.0 // indirect
+)
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/tbrandon/mbserver"
+)
+
+// Harness forwarder whose upstream connections and TCP slaves are connected
+// in memory over net.Pipe, for integration tests of routing, exceptions and
+// reconnection without sockets or hardware
+type Harness struct {
+	Forwarder *Forwarder
+
+	listener *pipeListener
+	mu       sync.Mutex
+	slaves   map[string]*TestSlave // by "addr:port"
+	done     chan error
+}
+
+// NewHarness parse the YAML config and create a forwarder reaching its TCP
+// slaves through simulated slaves, see Slave. The dialer option is replaced.
+// The config is parsed into the global config C, harnesses must not be
+// created concurrently.
+func NewHarness(config string, opts ...Option) (*Harness, error) {
+	if err := parseConfig([]byte(config)); err != nil {
+		return nil, err
+	}
+	c := C
+
+	h := &Harness{
+		listener: newPipeListener(),
+		slaves:   make(map[string]*TestSlave),
+	}
+	opts = append(opts, WithDialer(harnessDialer{h}))
+	h.Forwarder = NewForwarder(&c, opts...)
+	return h, nil
+}
+
+// Slave return the simulated slave at address "addr:port", created on first
+// use; slaves are also created when the forwarder first connects to them
+func (h *Harness) Slave(address string) *TestSlave {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	slave, ok := h.slaves[address]
+	if !ok {
+		slave = newTestSlave()
+		h.slaves[address] = slave
+	}
+	return slave
+}
+
+// Start start serving upstream connections in the background, the slaves
+// are connected first like with Serve
+func (h *Harness) Start() {
+	h.done = make(chan error, 1)
+	go func() {
+		h.done <- h.Forwarder.Serve(h.listener)
+	}()
+}
+
+// Dial open an upstream connection to the forwarder
+func (h *Harness) Dial() (net.Conn, error) {
+	return h.listener.DialContext(context.Background(), "pipe", "forwarder")
+}
+
+// Client return a Modbus client sending its requests to unit through the forwarder
+func (h *Harness) Client(unit byte) modbus.Client {
+	handler := modbus.NewTCPClientHandler("forwarder")
+	handler.SlaveId = unit
+	transporter := newTCPTransport("forwarder", 5*time.Second, h.listener, nil)
+	return modbus.NewClient2(handler, transporter)
+}
+
+// Close stop the forwarder and return the error of Serve
+func (h *Harness) Close() error {
+	h.Forwarder.Stop()
+	h.listener.Close()
+	if h.done == nil {
+		return nil
+	}
+	return <-h.done
+}
+
+// harnessDialer connect the forwarder to the simulated slaves
+type harnessDialer struct {
+	h *Harness
+}
+
+// DialContext connect to the simulated slave at address
+func (d harnessDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	slave := d.h.Slave(address)
+	client, server := net.Pipe()
+	if !slave.accept(server) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("connection refused by simulated slave %s", address)}
+	}
+	go slave.serve(server)
+	return client, nil
+}
+
+// pipeListener listener accepting in-memory connections created by DialContext
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Accept wait for the next connection
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stop accepting connections
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+// Addr return the listener address
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// DialContext create a connection and wait until it is accepted
+func (l *pipeListener) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := net.Pipe()
+	select {
+	case l.conns <- server:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+
+func (pipeAddr) String() string { return "pipe" }
+
+// TestSlave simulated Modbus TCP slave of a Harness, a SimSlave reachable
+// over net.Pipe whose answers, delay and availability tests control
+type TestSlave struct {
+	*SimSlave
+
+	mu         sync.Mutex
+	exceptions map[uint8]mbserver.Exception // by function code
+	delay      time.Duration
+	down       bool
+	requests   int
+	accepted   int
+	conns      map[net.Conn]struct{}
+}
+
+func newTestSlave() *TestSlave {
+	return &TestSlave{
+		SimSlave:   NewSimSlave(),
+		exceptions: make(map[uint8]mbserver.Exception),
+		conns:      make(map[net.Conn]struct{}),
+	}
+}
+
+// Holding return holding register at address
+func (m *SimSlave) Holding(address uint16) uint16 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.holding[address]
+}
+
+// Coil return coil at address
+func (m *SimSlave) Coil(address uint16) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.coils[address]
+}
+
+// SetExceptionStatus set the exception status outputs answered to FC 7
+func (m *SimSlave) SetExceptionStatus(status byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.status = status
+}
+
+// SetException answer requests with function by exception, Success to
+// answer them normally again
+func (m *TestSlave) SetException(function uint8, exception mbserver.Exception) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if exception == mbserver.Success {
+		delete(m.exceptions, function)
+	} else {
+		m.exceptions[function] = exception
+	}
+}
+
+// SetDelay delay every response by d, e.g. beyond the slave timeout
+func (m *TestSlave) SetDelay(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.delay = d
+}
+
+// SetDown take the slave off the network, closing its connections and
+// refusing new ones, or bring it back
+func (m *TestSlave) SetDown(down bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.down = down
+	if down {
+		for conn := range m.conns {
+			conn.Close()
+		}
+	}
+}
+
+// Requests return the number of requests received
+func (m *TestSlave) Requests() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.requests
+}
+
+// Connections return the number of connections accepted
+func (m *TestSlave) Connections() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.accepted
+}
+
+// accept add a connection unless the slave is down
+func (m *TestSlave) accept(conn net.Conn) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.down {
+		return false
+	}
+	m.conns[conn] = struct{}{}
+	m.accepted++
+	return true
+}
+
+// serve answer the requests of conn until it is closed
+func (m *TestSlave) serve(conn net.Conn) {
+	defer func() {
+		m.mu.Lock()
+		delete(m.conns, conn)
+		m.mu.Unlock()
+		conn.Close()
+	}()
+
+	for {
+		frame, err := readTCPFrame(conn)
+		if err != nil {
+			return
+		}
+		response, delay := m.respond(frame)
+		if delay > 0 {
+			time.Sleep(delay)
+		}
+		if _, err := conn.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// respond build the response to frame
+func (m *TestSlave) respond(frame *mbserver.TCPFrame) (mbserver.Framer, time.Duration) {
+	m.mu.Lock()
+	m.requests++
+	exception, ok := m.exceptions[frame.Function]
+	delay := m.delay
+	m.mu.Unlock()
+
+	response := frame.Copy()
+	if !ok {
+		var data []byte
+		data, exception = m.handle(frame.Function, frame.Data)
+		response.SetData(data)
+	}
+	if exception != mbserver.Success {
+		response.SetException(&exception)
+	}
+	return response, delay
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// hassComponents Home Assistant entity component of each tag type
+var hassComponents = map[string]string{
+	"holding":  "number",
+	"input":    "sensor",
+	"coils":    "switch",
+	"discrete": "binary_sensor",
+}
+
+// hassDevice Home Assistant device grouping the entities of one slave
+type hassDevice struct {
+	Identifiers []string `json:"identifiers"`
+	Name        string   `json:"name"`
+	Model       string   `json:"model,omitempty"`
+}
+
+// hassEntity Home Assistant MQTT discovery payload of one tag
+type hassEntity struct {
+	Name              string     `json:"name"`
+	UniqueID          string     `json:"unique_id"`
+	StateTopic        string     `json:"state_topic"`
+	AvailabilityTopic string     `json:"availability_topic"`
+	ValueTemplate     string     `json:"value_template,omitempty"`
+	CommandTopic      string     `json:"command_topic,omitempty"`
+	PayloadOn         string     `json:"payload_on,omitempty"`
+	PayloadOff        string     `json:"payload_off,omitempty"`
+	StateOn           string     `json:"state_on,omitempty"`
+	StateOff          string     `json:"state_off,omitempty"`
+	Min               *float64   `json:"min,omitempty"`
+	Max               *float64   `json:"max,omitempty"`
+	Step              float64    `json:"step,omitempty"`
+	Mode              string     `json:"mode,omitempty"`
+	Unit              string     `json:"unit_of_measurement,omitempty"`
+	Options           []string   `json:"options,omitempty"`
+	Device            hassDevice `json:"device"`
+}
+
+// publishDiscovery publish retained Home Assistant discovery messages for
+// the tags of all servers
+func (s *Forwarder) publishDiscovery(client mqtt.Client) {
+	c := s.config.MQTT
+	node := hassID(c.ClientID)
+	count := 0
+	for slaveID, server := range s.config.Servers {
+		device := hassDevice{
+			Identifiers: []string{fmt.Sprintf("%s_%d", node, slaveID)},
+			Name:        fmt.Sprintf("%s slave %d", c.ClientID, slaveID),
+			Model:       strings.ToUpper(server.ConnType),
+		}
+		for _, tag := range server.Tags {
+			component := hassComponent(tag)
+			objectID := hassID(fmt.Sprintf("%d_%s", slaveID, tag.Name))
+			entity := hassEntity{
+				Name:              tag.Name,
+				UniqueID:          node + "_" + objectID,
+				StateTopic:        tagTopic(c.StateTopic, slaveID, tag.Name),
+				AvailabilityTopic: tagTopic(c.AvailabilityTopic, slaveID, tag.Name),
+				Unit:              measureUnits[tag.ConvertTo].symbol,
+				Device:            device,
+			}
+			if c.StateFormat == "json" {
+				entity.ValueTemplate = "{{ value_json.value }}"
+			}
+			switch component {
+			case "number":
+				min, max := tag.limits()
+				entity.CommandTopic = tagTopic(c.CommandTopic, slaveID, tag.Name)
+				entity.Min, entity.Max, entity.Mode = &min, &max, "box"
+				switch {
+				case tag.DataType == "float32" || tag.DataType == "float64":
+					entity.Step = 0.001 // the smallest step Home Assistant allows
+				case tag.scaled():
+					// one register step in the convert_to unit
+					entity.Step = roundValue(math.Abs(tag.value(1) - tag.value(0)))
+				}
+			case "switch":
+				entity.CommandTopic = tagTopic(c.CommandTopic, slaveID, tag.Name)
+				entity.PayloadOn, entity.PayloadOff = "1", "0"
+				entity.StateOn, entity.StateOff = "1", "0"
+			case "select":
+				entity.CommandTopic = tagTopic(c.CommandTopic, slaveID, tag.Name)
+				for _, value := range slices.Sorted(maps.Keys(tag.Enum)) {
+					entity.Options = append(entity.Options, tag.Enum[value])
+				}
+			case "text":
+				// max length in characters, of ASCII at least
+				length := float64(2 * tag.Length)
+				entity.CommandTopic = tagTopic(c.CommandTopic, slaveID, tag.Name)
+				entity.Max = &length
+			case "binary_sensor":
+				entity.PayloadOn, entity.PayloadOff = "1", "0"
+			}
+
+			payload, _ := json.Marshal(entity)
+			topic := fmt.Sprintf("%s/%s/%s/%s/config", c.DiscoveryPrefix, component, node, objectID)
+			client.Publish(topic, byte(c.QoS), true, payload)
+			count++
+		}
+	}
+	s.logger.Infof("published Home Assistant discovery for %d tags", count)
+}
+
+// hassComponent Home Assistant entity component of tag: enums of holding
+// registers are selects, single bits switches or binary sensors, strings
+// texts or sensors
+func hassComponent(tag Tag) string {
+	writable := tag.Type == "holding"
+	switch {
+	case tag.DataType == "string" && writable:
+		return "text"
+	case tag.DataType == "string":
+		return "sensor"
+	case len(tag.Enum) > 0 && writable:
+		return "select"
+	case len(tag.Enum) > 0:
+		return "sensor"
+	case tag.Bit != nil && tag.Bits == 1 && writable:
+		return "switch"
+	case tag.Bit != nil && tag.Bits == 1:
+		return "binary_sensor"
+	}
+	return hassComponents[tag.Type]
+}
+
+// hassID replace the characters not allowed in discovery topic IDs
+func hassID(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' {
+			return r
+		}
+		return '_'
+	}, s)
+}
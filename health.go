@@ -0,0 +1,61 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// healthScore exponential moving averages of the transactions with one
+// slave, a smoother measure than up or down for flaky links
+type healthScore struct {
+	alpha  float64 // weight of the latest transaction
+	target float64 // latency target, seconds
+
+	mu      sync.Mutex
+	success float64 // moving average of the success rate, 0-1
+	latency float64 // moving average of the latency of successful transactions, seconds
+	sampled bool    // latency has a sample
+}
+
+func newHealthScore(config HealthConfig) *healthScore {
+	return &healthScore{
+		alpha:   config.Alpha,
+		target:  (time.Duration(config.LatencyTarget) * time.Millisecond).Seconds(),
+		success: 1,
+	}
+}
+
+// observe add the result of a transaction
+func (h *healthScore) observe(ok bool, latency time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	result := 0.0
+	if ok {
+		result = 1
+		if h.sampled {
+			h.latency += h.alpha * (latency.Seconds() - h.latency)
+		} else {
+			h.latency, h.sampled = latency.Seconds(), true
+		}
+	}
+	h.success += h.alpha * (result - h.success)
+}
+
+// snapshot return the score, the success rate and the latency averages;
+// the score is the success rate, scaled down by the latency beyond target
+func (h *healthScore) snapshot() (score, success, latency float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	score = h.success
+	if h.latency > h.target {
+		score *= h.target / h.latency
+	}
+	return math.Round(score*1000) / 1000, roundValue(h.success), roundValue(h.latency)
+}
+
+// score return the health score, 1 for a healthy slave, 0 for a dead one
+func (h *healthScore) score() float64 {
+	score, _, _ := h.snapshot()
+	return score
+}
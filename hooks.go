@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// hook events
+const (
+	hookSlaveDown     = "slave_down"     // a slave connection failed
+	hookSlaveUp       = "slave_up"       // a down slave is reachable again
+	hookListenerStart = "listener_start" // a Modbus TCP listener accepts connections
+	hookListenerStop  = "listener_stop"  // a Modbus TCP listener stopped
+	hookWriteDenied   = "write_denied"   // a write was rejected before reaching the slave
+)
+
+// hookEvents events hooks can run on
+var hookEvents = []string{hookSlaveDown, hookSlaveUp, hookListenerStart, hookListenerStop, hookWriteDenied}
+
+// hookQueueSize events waiting for the hooks, later ones are dropped
+const hookQueueSize = 64
+
+// hookEvent details of an event passed to the hooks
+type hookEvent struct {
+	Event    string  `json:"event"`
+	Time     string  `json:"time"`
+	Slave    byte    `json:"slave,omitempty"`
+	Listener string  `json:"listener,omitempty"` // listen address of listener events
+	Client   string  `json:"client,omitempty"`   // upstream client of a denied write
+	Function uint8   `json:"function,omitempty"`
+	Address  *int    `json:"address,omitempty"` // first coil or register of a denied write
+	Quantity int     `json:"quantity,omitempty"`
+	Reason   string  `json:"reason,omitempty"` // why a write was denied, e.g. "write_schedule"
+	Error    string  `json:"error,omitempty"`
+	Downtime float64 `json:"downtime,omitempty"` // seconds a slave was down, slave_up
+}
+
+// env the event as MBF_* environment variables, unset fields are left out
+func (e *hookEvent) env() []string {
+	env := []string{"MBF_EVENT=" + e.Event, "MBF_TIME=" + e.Time}
+	add := func(name, value string) {
+		if value != "" {
+			env = append(env, name+"="+value)
+		}
+	}
+	if e.Slave != 0 {
+		add("MBF_SLAVE", strconv.Itoa(int(e.Slave)))
+	}
+	add("MBF_LISTENER", e.Listener)
+	add("MBF_CLIENT", e.Client)
+	if e.Function != 0 {
+		add("MBF_FUNCTION", strconv.Itoa(int(e.Function)))
+	}
+	if e.Address != nil {
+		add("MBF_ADDRESS", strconv.Itoa(*e.Address))
+		add("MBF_QUANTITY", strconv.Itoa(e.Quantity))
+	}
+	add("MBF_REASON", e.Reason)
+	add("MBF_ERROR", e.Error)
+	if e.Downtime != 0 {
+		add("MBF_DOWNTIME", strconv.FormatFloat(e.Downtime, 'f', 3, 64))
+	}
+	return env
+}
+
+// hookRunner runs the configured hooks for the events one after the other
+// in the background, so slow hooks don't delay the requests
+type hookRunner struct {
+	hooks  []HookConfig
+	http   *http.Client
+	logger *Logger
+
+	mu     sync.Mutex // protects closed and sending on events
+	closed bool
+	events chan hookEvent
+	done   chan struct{}
+}
+
+// newHookRunner start running hooks, nil when none are configured
+func newHookRunner(hooks []HookConfig, logger *Logger) *hookRunner {
+	if len(hooks) == 0 {
+		return nil
+	}
+	r := &hookRunner{
+		hooks:  hooks,
+		http:   &http.Client{},
+		logger: logger,
+		events: make(chan hookEvent, hookQueueSize),
+		done:   make(chan struct{}),
+	}
+	go func() {
+		defer close(r.done)
+		for event := range r.events {
+			r.run(event)
+		}
+	}()
+	return r
+}
+
+// close run the queued events and stop, r may be nil
+func (r *hookRunner) close() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.events)
+	}
+	r.mu.Unlock()
+	<-r.done
+}
+
+// emit queue event for the hooks, r may be nil
+func (r *hookRunner) emit(event hookEvent) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	select {
+	case r.events <- event:
+	default:
+		r.logger.Warnf("dropped %s hook event, %d events are waiting", event.Event, hookQueueSize)
+	}
+}
+
+// run the hooks of event
+func (r *hookRunner) run(event hookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	for _, h := range r.hooks {
+		if len(h.Events) > 0 && !slices.Contains(h.Events, event.Event) {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(h.Timeout)*time.Second)
+		if len(h.Command) > 0 {
+			err = r.runCommand(ctx, h, &event, body)
+		} else {
+			err = r.post(ctx, h, body)
+		}
+		cancel()
+		if err != nil {
+			r.logger.Warnf("hook %s failed on %s: %v", h.Name, event.Event, err)
+		} else {
+			r.logger.Debugf("hook %s ran on %s", h.Name, event.Event)
+		}
+	}
+}
+
+// runCommand run the command of h with the event in the environment and
+// as JSON on stdin
+func (r *hookRunner) runCommand(ctx context.Context, h HookConfig, event *hookEvent, body []byte) error {
+	cmd := exec.CommandContext(ctx, h.Command[0], h.Command[1:]...)
+	cmd.Env = append(os.Environ(), event.env()...)
+	cmd.Stdin = bytes.NewReader(body)
+	output, err := cmd.CombinedOutput()
+	if len(output) > 0 {
+		r.logger.Debugf("hook %s output: %s", h.Name, bytes.TrimSpace(output))
+	}
+	return err
+}
+
+// post POST the event JSON to the webhook of h
+func (r *hookRunner) post(ctx context.Context, h HookConfig, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// emitHook queue event for the hooks, stamped with the current time
+func (s *Forwarder) emitHook(event hookEvent) {
+	if s.hooks == nil {
+		return
+	}
+	event.Time = s.clock.Now().UTC().Format(time.RFC3339Nano)
+	s.hooks.emit(event)
+}
+
+// writeDenied report a write rejected before reaching slaveID to the hooks,
+// reason names the check rejecting it
+func (s *Forwarder) writeDenied(slaveID byte, client string, function uint8, data []byte, reason string) {
+	if s.hooks == nil {
+		return
+	}
+	event := hookEvent{Event: hookWriteDenied, Slave: slaveID, Client: client, Function: function, Reason: reason}
+	if _, address, quantity, ok := pduRange(append([]byte{function}, data...)); ok {
+		event.Address, event.Quantity = &address, quantity
+	}
+	s.emitHook(event)
+}
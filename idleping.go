@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+// startIdlePings start pinging the idle connections of the slaves with
+// idle_ping
+func (s *Forwarder) startIdlePings() {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	for slaveID, client := range s.clients {
+		if client.idlePing == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.idlePingLoop(slaveID, client)
+		}()
+	}
+}
+
+// idlePingLoop ping the connection of a slave whenever it has been idle for
+// the configured time, until the forwarder stops
+func (s *Forwarder) idlePingLoop(slaveID byte, client *modbusClient) {
+	idle := time.Duration(client.idlePing.Idle) * time.Second
+	// idle since startup
+	client.lastActivity.CompareAndSwap(0, s.clock.Now().UnixNano())
+	for {
+		wait := idle - s.clock.Now().Sub(time.Unix(0, client.lastActivity.Load()))
+		if wait <= 0 {
+			s.ping(slaveID, client)
+			wait = idle
+		}
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.clock.After(wait):
+		}
+	}
+}
+
+// ping check an idle connection; a connection that does not answer is
+// closed, so a half-open session is replaced before real traffic fails on it
+func (s *Forwarder) ping(slaveID byte, client *modbusClient) {
+	if client.disabled.Load() {
+		return
+	}
+	start := s.clock.Now()
+	client.lastActivity.Store(start.UnixNano())
+	var err error
+	switch p := client.idlePing; p.Type {
+	case "loopback":
+		_, err = client.send(8, []byte{0x00, 0x00, 0xA5, 0x5A})
+	case "holding":
+		_, err = client.client.ReadHoldingRegisters(uint16(p.Address), uint16(p.Quantity))
+	case "input":
+		_, err = client.client.ReadInputRegisters(uint16(p.Address), uint16(p.Quantity))
+	case "coils":
+		_, err = client.client.ReadCoils(uint16(p.Address), uint16(p.Quantity))
+	case "discrete":
+		_, err = client.client.ReadDiscreteInputs(uint16(p.Address), uint16(p.Quantity))
+	}
+	var modbusErr *modbus.ModbusError
+	if err == nil || errors.As(err, &modbusErr) {
+		// an exception response proves the session alive as well
+		s.logger.Debugf("slave %d idle ping answered in %s", slaveID, s.clock.Now().Sub(start))
+		client.health.observe(true, s.clock.Now().Sub(start))
+		s.markUp(slaveID, client)
+		return
+	}
+
+	s.logger.Warnf("slave %d idle ping failed, closing the connection: %v", slaveID, err)
+	client.transporter.Close()
+	client.health.observe(false, s.clock.Now().Sub(start))
+	s.markDown(slaveID, client, err)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"net"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// emptyFrameError MBAP frame with a unit ID but no PDU, sent by some masters
+// as keepalive
+type emptyFrameError struct {
+	header []byte // MBAP header including the unit ID
+}
+
+// Error implement error
+func (e *emptyFrameError) Error() string {
+	return "MBAP frame without PDU"
+}
+
+// isLoopback report whether frame is a FC 8 return query data request
+// answered by the forwarder
+func (s *Forwarder) isLoopback(frame mbserver.Framer) bool {
+	if s.config.Keepalive == nil || !s.config.Keepalive.Loopback || frame.GetFunction() != 8 {
+		return false
+	}
+	data := frame.GetData()
+	return len(data) >= 2 && data[0] == 0 && data[1] == 0
+}
+
+// keepaliveEmpty answer an empty frame of an upstream connection according
+// to keepalive empty_frames, false when the connection is to be closed
+func (s *Forwarder) keepaliveEmpty(conn net.Conn, header []byte) bool {
+	if s.config.Keepalive == nil {
+		return false
+	}
+	switch s.config.Keepalive.EmptyFrames {
+	case "echo":
+		if _, err := conn.Write(header); err != nil {
+			s.logger.Warnf("upstream connection %s: failed to write keepalive: %v", conn.RemoteAddr(), err)
+			return false
+		}
+	case "ignore":
+	default:
+		return false
+	}
+	s.logger.Debugf("upstream keepalive: % x", header)
+	return true
+}
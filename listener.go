@@ -0,0 +1,460 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// functionHandler handle one upstream function code, return response data or exception
+type functionHandler func(frame mbserver.Framer) ([]byte, *mbserver.Exception)
+
+// Serve accept upstream Modbus TCP connections on l and forward their
+// requests, until the listener fails or the forwarder is stopped
+func (s *Forwarder) Serve(l net.Listener) error {
+	if err := s.setup(); err != nil {
+		l.Close()
+		return err
+	}
+	if !s.trackListener(l, true) {
+		l.Close()
+		return net.ErrClosed
+	}
+	defer s.trackListener(l, false)
+	s.emitHook(hookEvent{Event: hookListenerStart, Listener: l.Addr().String()})
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			stopped := hookEvent{Event: hookListenerStop, Listener: l.Addr().String()}
+			if errors.Is(err, net.ErrClosed) || s.ctx.Err() != nil {
+				s.emitHook(stopped)
+				return nil
+			}
+			err = fmt.Errorf("failed to accept connection: %v", err)
+			stopped.Error = err.Error()
+			s.emitHook(stopped)
+			return err
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn handle requests of one upstream connection
+func (s *Forwarder) serveConn(conn net.Conn) {
+	if !s.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	addr := clientAddr(conn.RemoteAddr())
+	stats := s.upstreams.get(addr)
+	stats.connections.Add(1)
+	if !s.admitConn(addr, conn, stats) {
+		return
+	}
+	defer s.releaseConn(addr, conn)
+	stats.active.Add(1)
+	defer stats.active.Add(-1)
+	if err := applySocketOptions(conn, s.config.ListenSocketOptions); err != nil {
+		s.logger.Warnf("upstream connection %s: %v", conn.RemoteAddr(), err)
+	}
+
+	profile, ok := s.connProfile(conn)
+	if !ok {
+		return
+	}
+
+	s.logger.Debugf("upstream connection from %s", conn.RemoteAddr())
+	for {
+		frame, err := readTCPFrame(conn)
+		var empty *emptyFrameError
+		if errors.As(err, &empty) && s.keepaliveEmpty(conn, empty.header) {
+			stats.lastSeen.Store(s.clock.Now().UnixNano())
+			continue
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) && !errors.Is(err, io.ErrClosedPipe) {
+				s.logger.Warnf("upstream connection %s: %v", conn.RemoteAddr(), err)
+				if empty != nil || errors.Is(err, io.ErrUnexpectedEOF) {
+					// no PDU or a frame cut short
+					stats.malformed.add(malformedUndersized)
+				} else if errors.Is(err, errMalformedFrame) {
+					stats.malformed.add(malformedParse)
+				}
+			}
+			return
+		}
+		request := frame.Bytes()
+		s.logger.Debugf("upstream request: % x", request)
+		stats.requests.Add(1)
+		stats.bytesIn.Add(uint64(len(request)))
+		stats.lastSeen.Store(s.clock.Now().UnixNano())
+		if kind := malformedRequest(frame.GetFunction(), frame.GetData()); kind != "" {
+			s.logger.Debugf("upstream connection %s: malformed request (%s): % x", conn.RemoteAddr(), kind, request)
+			stats.malformed.add(kind)
+		}
+
+		response := s.deduplicate(addr, stats, frame, func() mbserver.Framer {
+			return s.handle(frame, addr, profile)
+		})
+		if response == nil {
+			continue
+		}
+		exception := response.GetFunction()&0x80 != 0
+		if exception {
+			stats.errors.Add(1)
+		}
+		profile.count(exception)
+		out := response.Bytes()
+		s.logger.Debugf("upstream response: % x", out)
+		if _, err := conn.Write(out); err != nil {
+			s.logger.Warnf("upstream connection %s: failed to write response: %v", conn.RemoteAddr(), err)
+			return
+		}
+		stats.bytesOut.Add(uint64(len(out)))
+	}
+}
+
+// handle dispatch request of the upstream client to the registered function
+// handler and build the response frame, nil when there is no response.
+// profile is the TLS profile or tenant of the connection, nil for plain connections.
+func (s *Forwarder) handle(frame mbserver.Framer, client string, profile *accessProfile) mbserver.Framer {
+	var data []byte
+	var exception *mbserver.Exception
+
+	units, restricted := s.units, profile != nil && profile.units != nil
+	if restricted {
+		units = profile.units
+	}
+	readOnly := profile != nil && profile.readOnly
+
+	unit := getSlaveID(frame)
+	if s.isBroadcast(unit) && !restricted {
+		// no response to broadcasts
+		if readOnly {
+			s.logger.Warnf("dropped broadcast request with function %d from %s %s", frame.GetFunction(), profile.kind, profile.name)
+			return nil
+		}
+		s.broadcast(frame, client)
+		return nil
+	}
+
+	response := frame.Copy()
+	if s.isLoopback(frame) {
+		// keepalive of the master, keep it off the bus
+		response.SetData(frame.GetData())
+		return response
+	}
+	diagnostic := s.isDiagnosticUnit(unit) && !restricted
+	derived := s.isDerivedUnit(unit) && !restricted
+	slaveID, routed := units[unit]
+	if !routed && !diagnostic && !derived {
+		switch s.config.UnroutedUnit {
+		case "silent":
+			s.logger.Debugf("dropped request to unrouted unit %d", unit)
+			return nil
+		case "slave_device_failure":
+			response.SetException(&mbserver.SlaveDeviceFailure)
+		default:
+			response.SetException(&mbserver.GatewayPathUnavailable)
+		}
+		s.logger.Debugf("request to unrouted unit %d", unit)
+		return response
+	}
+
+	function := frame.GetFunction()
+	if profile != nil && !profile.allow(s.clock.Now()) {
+		s.logger.Debugf("request rate limit of %s %s exceeded", profile.kind, profile.name)
+		exception = &mbserver.SlaveDeviceBusy
+	} else if readOnly && (isWriteFunction(function) || s.handlers[function] == nil) {
+		// functions forwarded raw may write as well, so may writes to the
+		// diagnostic and derived units
+		s.logger.Warnf("function %d is not allowed for %s %s", function, profile.kind, profile.name)
+		s.writeDenied(slaveID, client, function, frame.GetData(), "read_only")
+		exception = &mbserver.IllegalFunction
+	} else if diagnostic {
+		data, exception = s.handleDiagnostic(frame, client)
+		response.SetData(data)
+	} else if derived {
+		data, exception = s.handleDerived(frame)
+		response.SetData(data)
+	} else if !s.functionAllowed(slaveID, function) {
+		s.logger.Warnf("function %d is not allowed on slave %d", function, slaveID)
+		if isWriteFunction(function) {
+			s.writeDenied(slaveID, client, function, frame.GetData(), "function_code")
+		}
+		exception = &mbserver.IllegalFunction
+	} else if denied := s.checkWriteSchedule(slaveID, client, frame); denied != nil {
+		exception = denied
+	} else if handler := s.handler(slaveID, function); handler != nil {
+		data, exception = s.dispatch(handler, routeFrame(frame, slaveID), slaveID, client)
+		response.SetData(data)
+	} else {
+		// never answered from anywhere but the slave
+		s.logger.Warnf("function %d is not supported (slave %d)", function, slaveID)
+		exception = &mbserver.IllegalFunction
+	}
+
+	if exception != &mbserver.Success {
+		response.SetException(exception)
+	}
+	return response
+}
+
+// dispatch pass a routed request to its function handler after checkRequest,
+// see forward
+func (s *Forwarder) dispatch(handler functionHandler, frame mbserver.Framer, slaveID byte, client string) ([]byte, *mbserver.Exception) {
+	checked, exception := s.checkRequest(frame, slaveID, client)
+	if exception != nil {
+		return nil, exception
+	}
+	return s.forward(handler, frame, checked, slaveID, client)
+}
+
+// checkRequest check the fields of a routed request against the Modbus spec
+// and the values of register writes against the write rules, return the
+// frame to forward, a copy with the clamped values if any were clamped
+func (s *Forwarder) checkRequest(frame mbserver.Framer, slaveID byte, client string) (mbserver.Framer, *mbserver.Exception) {
+	if err := invalidRequest(frame.GetFunction(), frame.GetData()); err != nil {
+		s.logger.Warnf("rejected function %d request from %s for slave %d: %v", frame.GetFunction(), client, slaveID, err)
+		return nil, &mbserver.IllegalDataValue
+	}
+	values, exception := s.checkWriteValues(slaveID, client, frame)
+	if exception != nil {
+		return nil, exception
+	}
+	if values != nil {
+		// forward the clamped values
+		frame = frame.Copy()
+		frame.SetData(values)
+	}
+	return frame, nil
+}
+
+// forward pass frame, request after checkRequest, to its function handler
+// after waiting for the turn of client with fair_scheduling; writes to
+// slaves with async_writes are acknowledged and queued, requests to a slave
+// whose connection restart is draining its queue are answered busy
+func (s *Forwarder) forward(handler functionHandler, request, frame mbserver.Framer, slaveID byte, client string) ([]byte, *mbserver.Exception) {
+	data, exception, simulated := s.simulate(frame, slaveID, false)
+	if !simulated {
+		if s.draining(slaveID) {
+			s.logger.Warnf("function %d request from %s for slave %d rejected, the connection is restarting", frame.GetFunction(), client, slaveID)
+			return nil, &mbserver.SlaveDeviceBusy
+		}
+		var queued bool
+		data, exception, queued = s.queueWrite(frame, slaveID, client)
+		if !queued {
+			release := s.fairTurn(slaveID, client)
+			data, exception = handler(frame)
+			release()
+		}
+		if exception == &mbserver.SlaveDeviceFailure || exception == &mbserver.GatewayTargetDeviceFailedtoRespond {
+			// the slave did not answer, not an exception response
+			if simData, simException, ok := s.simulate(frame, slaveID, true); ok {
+				data, exception = simData, simException
+			}
+		}
+	}
+	if frame != request && exception == &mbserver.Success && frame.GetFunction() == 6 {
+		// the response echoes the request of the master
+		data = request.GetData()[0:4]
+	}
+	return data, exception
+}
+
+// routeFrame return frame addressed to slaveID, the response keeps the
+// unit ID of the original frame
+func routeFrame(frame mbserver.Framer, slaveID byte) mbserver.Framer {
+	tcpFrame, ok := frame.(*mbserver.TCPFrame)
+	if !ok || tcpFrame.Device == slaveID {
+		return frame
+	}
+	routed := *tcpFrame
+	routed.Device = slaveID
+	return &routed
+}
+
+// isWriteFunction report whether function writes to the slave
+func isWriteFunction(function uint8) bool {
+	switch function {
+	case 5, 6, 15, 16, 21, 22, 23:
+		return true
+	}
+	return false
+}
+
+// readTCPFrame read one MBAP framed request
+func readTCPFrame(r io.Reader) (*mbserver.TCPFrame, error) {
+	packet := make([]byte, tcpMaxLength)
+	if _, err := io.ReadFull(r, packet[:tcpHeaderSize]); err != nil {
+		return nil, err
+	}
+	// length covers unit id, function code and data
+	length := int(binary.BigEndian.Uint16(packet[4:6]))
+	if length == 1 {
+		return nil, &emptyFrameError{header: packet[:tcpHeaderSize]}
+	}
+	if length < 2 || length > tcpMaxLength-tcpHeaderSize+1 {
+		return nil, fmt.Errorf("%w: invalid MBAP length %d", errMalformedFrame, length)
+	}
+	packet = packet[:tcpHeaderSize-1+length]
+	if _, err := io.ReadFull(r, packet[tcpHeaderSize:]); err != nil {
+		return nil, err
+	}
+	if len(packet) == tcpHeaderSize+1 {
+		// function code without data, e.g. FC 17, too short for NewTCPFrame
+		return &mbserver.TCPFrame{
+			TransactionIdentifier: binary.BigEndian.Uint16(packet[0:2]),
+			ProtocolIdentifier:    binary.BigEndian.Uint16(packet[2:4]),
+			Length:                binary.BigEndian.Uint16(packet[4:6]),
+			Device:                packet[6],
+			Function:              packet[7],
+		}, nil
+	}
+	frame, err := mbserver.NewTCPFrame(packet)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errMalformedFrame, err)
+	}
+	return frame, nil
+}
+
+// listenUnix listen on a unix domain socket, replacing a stale socket file
+// left behind by a previous run
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on unix socket %s: %v", path, err)
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, fmt.Errorf("failed to set mode of unix socket %s: %v", path, err)
+		}
+	}
+	return l, nil
+}
+
+// trackListener add or remove an active listener, adding fails once the forwarder is stopped
+func (s *Forwarder) trackListener(l net.Listener, add bool) bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// addWorker count a goroutine started outside the goroutines of the
+// forwarder, e.g. by the WebSocket HTTP server, in s.wg; false once the
+// forwarder is stopping. stop waits for s.wg only after closeListeners
+// took connsMux, so the Add never races with the Wait
+func (s *Forwarder) addWorker() bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.wg.Add(1)
+	return true
+}
+
+// trackConn add or remove an active upstream connection, adding fails once the forwarder is stopped
+func (s *Forwarder) trackConn(conn net.Conn, add bool) bool {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	if !add {
+		delete(s.conns, conn)
+		return true
+	}
+	if s.ctx.Err() != nil {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	return true
+}
+
+// admitConn enforce max_connections_per_client for a new connection of
+// addr, either rejecting it or closing the oldest connection of addr
+func (s *Forwarder) admitConn(addr string, conn net.Conn, stats *upstreamStats) bool {
+	limit := s.config.MaxConnectionsPerClient
+	if limit <= 0 {
+		return true
+	}
+
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	conns := s.clientConns[addr]
+	if len(conns) >= limit {
+		if s.config.ConnectionLimitPolicy != "close_oldest" {
+			stats.rejected.Add(1)
+			s.logger.Warnf("upstream connection from %s rejected, client has %d connections", conn.RemoteAddr(), len(conns))
+			return false
+		}
+		oldest := conns[0]
+		conns = conns[1:]
+		oldest.Close()
+		stats.evicted.Add(1)
+		s.logger.Warnf("closed oldest upstream connection %s, client has %d connections", oldest.RemoteAddr(), limit)
+	}
+	s.clientConns[addr] = append(conns, conn)
+	return true
+}
+
+// releaseConn remove a closed connection admitted by admitConn
+func (s *Forwarder) releaseConn(addr string, conn net.Conn) {
+	if s.config.MaxConnectionsPerClient <= 0 {
+		return
+	}
+
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+	conns := s.clientConns[addr]
+	for i, c := range conns {
+		if c == conn {
+			conns = append(conns[:i:i], conns[i+1:]...)
+			break
+		}
+	}
+	if len(conns) == 0 {
+		delete(s.clientConns, addr)
+	} else {
+		s.clientConns[addr] = conns
+	}
+}
+
+// closeListeners close all listeners and upstream connections
+func (s *Forwarder) closeListeners() {
+	s.connsMux.Lock()
+	defer s.connsMux.Unlock()
+
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/gorilla/websocket"
+	"github.com/tbrandon/mbserver"
+)
+
+// harnessConfig two TCP slaves, unit 1 and unit 2
+const harnessConfig = `
+servers:
+  1:
+    conn_type: "tcp"
+    addr: "10.0.0.1"
+  2:
+    conn_type: "tcp"
+    addr: "10.0.0.2"
+`
+
+// quietLogger logger of the test forwarders, only errors are kept and
+// discarded
+func quietLogger() *Logger {
+	return NewLogger(log.New(io.Discard, "", 0), LevelError)
+}
+
+// startHarness start a harness of config, closed when the test ends
+func startHarness(t *testing.T, config string) *Harness {
+	t.Helper()
+	h, err := NewHarness(config, WithLogger(quietLogger()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.Start()
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+// exchange send the request PDU for unit on conn and return the response PDU
+func exchange(t *testing.T, conn net.Conn, unit byte, pdu []byte) []byte {
+	t.Helper()
+	request := append([]byte{0x00, 0x01, 0x00, 0x00, 0x00, byte(len(pdu) + 1), unit}, pdu...)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(request); err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatal(err)
+	}
+	response := make([]byte, int(header[4])<<8|int(header[5])-1)
+	if _, err := io.ReadFull(conn, response); err != nil {
+		t.Fatal(err)
+	}
+	if header[6] != unit {
+		t.Fatalf("response unit %d, expected %d", header[6], unit)
+	}
+	return response
+}
+
+// unhex decode a hex frame, spaces are ignored
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(string(bytes.ReplaceAll([]byte(s), []byte(" "), nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestHarnessRouting(t *testing.T) {
+	h := startHarness(t, harnessConfig)
+	h.Slave("10.0.0.1:502").SetHolding(0, 7, 8)
+	h.Slave("10.0.0.2:502").SetHolding(0, 9)
+
+	results, err := h.Client(1).ReadHoldingRegisters(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(results, []byte{0, 7, 0, 8}) {
+		t.Errorf("unit 1 read % x, expected 00 07 00 08", results)
+	}
+	results, err = h.Client(2).ReadHoldingRegisters(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(results, []byte{0, 9}) {
+		t.Errorf("unit 2 read % x, expected 00 09", results)
+	}
+
+	if _, err := h.Client(2).WriteSingleRegister(5, 42); err != nil {
+		t.Fatal(err)
+	}
+	if got := h.Slave("10.0.0.2:502").Holding(5); got != 42 {
+		t.Errorf("slave 2 holding 5 is %d, expected 42", got)
+	}
+	if got := h.Slave("10.0.0.1:502").Holding(5); got != 0 {
+		t.Errorf("slave 1 holding 5 is %d, the write reached the wrong slave", got)
+	}
+}
+
+func TestHarnessExceptions(t *testing.T) {
+	h := startHarness(t, harnessConfig)
+	slave := h.Slave("10.0.0.1:502")
+	slave.SetException(3, mbserver.IllegalDataAddress)
+
+	_, err := h.Client(1).ReadHoldingRegisters(0, 1)
+	var modbusErr *modbus.ModbusError
+	if !errors.As(err, &modbusErr) || modbusErr.ExceptionCode != 2 {
+		t.Errorf("read answered %v, expected the exception 02 of the slave", err)
+	}
+
+	_, err = h.Client(9).ReadHoldingRegisters(0, 1)
+	if !errors.As(err, &modbusErr) || modbusErr.ExceptionCode != 0x0A {
+		t.Errorf("read of an unknown unit answered %v, expected exception 0A", err)
+	}
+
+	slave.SetException(3, mbserver.Success)
+	slave.SetDown(true)
+	_, err = h.Client(1).ReadHoldingRegisters(0, 1)
+	if !errors.As(err, &modbusErr) || modbusErr.ExceptionCode != 0x0B {
+		t.Errorf("read of a down slave answered %v, expected exception 0B", err)
+	}
+
+	slave.SetDown(false)
+	if _, err := h.Client(1).ReadHoldingRegisters(0, 1); err != nil {
+		t.Errorf("read after the slave is back: %v", err)
+	}
+}
+
+func TestHarnessReconnect(t *testing.T) {
+	h := startHarness(t, harnessConfig)
+	slave := h.Slave("10.0.0.1:502")
+	slave.SetHolding(0, 7)
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	read, answer := unhex(t, "03 0000 0001"), unhex(t, "03 02 0007")
+
+	if got := exchange(t, conn, 1, read); !bytes.Equal(got, answer) {
+		t.Fatalf("response % x, expected % x", got, answer)
+	}
+	connections := slave.Connections()
+
+	// the slave drops its connection mid-session and refuses new ones
+	slave.SetDown(true)
+	for i := 0; i < 2; i++ {
+		if got, want := exchange(t, conn, 1, read), unhex(t, "83 0b"); !bytes.Equal(got, want) {
+			t.Errorf("response % x while the slave is down, expected % x", got, want)
+		}
+	}
+
+	slave.SetDown(false)
+	if got := exchange(t, conn, 1, read); !bytes.Equal(got, answer) {
+		t.Errorf("response % x after the slave is back, expected % x", got, answer)
+	}
+	if n := slave.Connections(); n <= connections {
+		t.Errorf("%d connections after the slave is back, expected a new one", n)
+	}
+}
+
+func TestHarnessPassthrough(t *testing.T) {
+	h := startHarness(t, harnessConfig)
+	slave := h.Slave("10.0.0.1:502")
+	slave.SetExceptionStatus(0x6D)
+	slave.SetHolding(100, 0x12)
+	slave.SetHolding(200, 2, 0x01B8, 0x1284)
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		request  string
+		response string
+	}{
+		{"read exception status", "07", "07 6d"},
+		{"diagnostics return query data", "08 0000 a537", "08 0000 a537"},
+		{"report server id", "11", "11 09 53696d536c617665 ff"},
+		{"write file record", "15 0d 06 0004 0007 0003 06af 04be 100d", "15 0d 06 0004 0007 0003 06af 04be 100d"},
+		{"read file record", "14 07 06 0004 0007 0002", "14 06 05 06 06af 04be"},
+		{"mask write register", "16 0064 00f2 0025", "16 0064 00f2 0025"},
+		{"read FIFO queue", "18 00c8", "18 0006 0002 01b8 1284"},
+		{"read device identification", "2b 0e 04 01", "2b 0e 04 01 00 00 01 01 08 53696d536c617665"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := exchange(t, conn, 1, unhex(t, tt.request)), unhex(t, tt.response); !bytes.Equal(got, want) {
+				t.Errorf("response % x, expected % x", got, want)
+			}
+		})
+	}
+	if got := slave.Holding(100); got != 0x17 {
+		t.Errorf("holding 100 is %#x after the mask write, expected 0x17", got)
+	}
+}
+
+func TestHarnessBroadcastWriteRules(t *testing.T) {
+	h := startHarness(t, `
+unit_0:
+  policy: "broadcast"
+servers:
+  1:
+    conn_type: "tcp"
+    addr: "10.0.0.1"
+  2:
+    conn_type: "tcp"
+    addr: "10.0.0.2"
+    write_rules:
+      - {address: 5, max: 100}
+`)
+
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// broadcasts are not answered, the second one breaks the write rule of
+	// slave 2 and must reach neither slave
+	for _, value := range []string{"0032", "03e8"} {
+		if _, err := conn.Write(append(unhex(t, "0001 0000 0006 00 06 0005"), unhex(t, value)...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if h.Slave("10.0.0.1:502").Holding(5) == 50 && h.Slave("10.0.0.2:502").Holding(5) == 50 {
+			break
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	for _, address := range []string{"10.0.0.1:502", "10.0.0.2:502"} {
+		if got := h.Slave(address).Holding(5); got != 50 {
+			t.Errorf("%s holding 5 is %d, expected 50 of the allowed broadcast", address, got)
+		}
+	}
+}
+
+func TestHarnessMaskWriteRules(t *testing.T) {
+	h := startHarness(t, `
+servers:
+  1:
+    conn_type: "tcp"
+    addr: "10.0.0.1"
+    write_rules:
+      - {address: 100, max: 32, clamp: true}
+`)
+	slave := h.Slave("10.0.0.1:502")
+	slave.SetHolding(100, 0x12)
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	tests := []struct {
+		name     string
+		request  string
+		response string
+		value    uint16
+	}{
+		{"result within the rule", "16 0064 00f2 0025", "16 0064 00f2 0025", 0x17},
+		{"result above max", "16 0064 0000 00ff", "96 03", 0x17},
+		{"register without rules", "16 0065 0000 00ff", "16 0065 0000 00ff", 0x17},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, want := exchange(t, conn, 1, unhex(t, tt.request)), unhex(t, tt.response); !bytes.Equal(got, want) {
+				t.Errorf("response % x, expected % x", got, want)
+			}
+			if got := slave.Holding(100); got != tt.value {
+				t.Errorf("holding 100 is %#x, expected %#x", got, tt.value)
+			}
+		})
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	h := startHarness(t, harnessConfig+`
+ws_allowed_origins: ["https://hmi.example.com"]
+`)
+	h.Slave("10.0.0.1:502").SetHolding(0, 7)
+	server := httptest.NewServer(h.Forwarder.wsHandler())
+	defer server.Close()
+	address := "ws" + strings.TrimPrefix(server.URL, "http") + "/modbus"
+
+	tests := []struct {
+		name    string
+		origin  string
+		allowed bool
+	}{
+		{"no origin", "", true},
+		{"allowed origin", "https://hmi.example.com", true},
+		{"same origin", server.URL, true},
+		{"foreign origin", "https://attacker.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.origin != "" {
+				header.Set("Origin", tt.origin)
+			}
+			conn, resp, err := websocket.DefaultDialer.Dial(address, header)
+			if !tt.allowed {
+				if err == nil {
+					conn.Close()
+					t.Fatal("upgrade accepted")
+				}
+				if resp == nil || resp.StatusCode != http.StatusForbidden {
+					t.Errorf("upgrade answered %v, expected 403", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			if got, want := exchange(t, &wsConn{Conn: conn}, 1, unhex(t, "03 0000 0001")), unhex(t, "03 02 0007"); !bytes.Equal(got, want) {
+				t.Errorf("response % x, expected % x", got, want)
+			}
+		})
+	}
+}
+
+func TestAdminClient(t *testing.T) {
+	s := &Forwarder{logger: quietLogger(), config: &Config{}}
+	var client string
+	handler := func(w http.ResponseWriter, r *http.Request) { client = adminClient(r) }
+
+	s.authorize(capWrite, handler)(httptest.NewRecorder(), httptest.NewRequest("PUT", "/api/tags/1/setpoint", nil))
+	if client != "admin" {
+		t.Errorf("client without admin_auth is %q, expected admin", client)
+	}
+
+	s.config.AdminAuth = &AdminAuthConfig{Tokens: []AdminToken{{Name: "deploy", Token: "0123456789abcdef", Role: "operator"}}}
+	r := httptest.NewRequest("PUT", "/api/tags/1/setpoint", nil)
+	r.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	s.authorize(capWrite, handler)(httptest.NewRecorder(), r)
+	if client != "token:deploy" {
+		t.Errorf("client with admin_auth is %q, expected token:deploy", client)
+	}
+}
+
+func TestTagQuality(t *testing.T) {
+	h := startHarness(t, `
+servers:
+  1:
+    conn_type: "tcp"
+    addr: "10.0.0.1"
+    tags:
+      - {name: "setpoint", address: 100}
+`)
+	slave := h.Slave("10.0.0.1:502")
+	slave.SetHolding(100, 1200)
+	// the slaves are connected once the forwarder serves
+	if _, err := h.Client(1).ReadHoldingRegisters(100, 1); err != nil {
+		t.Fatal(err)
+	}
+	tag := h.Forwarder.config.Servers[1].Tags[0]
+
+	v := h.Forwarder.sampleTag(1, tag)
+	if v.Quality != "good" || v.Timestamp == nil || v.Value == nil {
+		t.Errorf("tag read from the slave is %+v, expected a good value with a timestamp", v)
+	}
+
+	slave.SetDown(true)
+	v = h.Forwarder.sampleTag(1, tag)
+	if v.Quality != "bad" || v.Timestamp != nil || v.Value != nil || v.Error == "" {
+		t.Errorf("tag of a down slave is %+v, expected bad without a value", v)
+	}
+}
+
+func TestDumpStateCaches(t *testing.T) {
+	h := startHarness(t, `
+servers:
+  1:
+    conn_type: "tcp"
+    addr: "10.0.0.1"
+    read_ahead_block: 16
+`)
+	if _, err := h.Client(1).ReadHoldingRegisters(0, 1); err != nil {
+		t.Fatal(err)
+	}
+	var b strings.Builder
+	h.Forwarder.DumpState(&b)
+	if want := "slave 1 caches: read_ahead_blocks=1 static_ranges=0/0 poll_groups=0/0"; !strings.Contains(b.String(), want) {
+		t.Errorf("dump\n%s\nmisses %q", b.String(), want)
+	}
+}
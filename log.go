@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel log verbosity level
+type LogLevel int32
+
+const (
+	LevelError LogLevel = iota
+	LevelWarn
+	LevelInfo
+	LevelDebug
+	LevelTrace
+)
+
+// String return level name
+func (l LogLevel) String() string {
+	switch l {
+	case LevelError:
+		return "error"
+	case LevelWarn:
+		return "warn"
+	case LevelInfo:
+		return "info"
+	case LevelDebug:
+		return "debug"
+	case LevelTrace:
+		return "trace"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// parseLogLevel parse level name from config
+func parseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(name) {
+	case "error":
+		return LevelError, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "debug":
+		return LevelDebug, nil
+	case "trace":
+		return LevelTrace, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// Logger leveled logger on top of the stdlib logger
+type Logger struct {
+	out     *log.Logger
+	level   atomic.Int32
+	restore atomic.Int32 // level to restore when debug is toggled off
+}
+
+// NewLogger create new leveled logger
+func NewLogger(out *log.Logger, level LogLevel) *Logger {
+	l := &Logger{out: out}
+	l.SetLevel(level)
+	// toggling debug off when started at debug level
+	l.restore.Store(int32(LevelInfo))
+	return l
+}
+
+// logger default logger, level is set from config and command line flags
+var logger = NewLogger(log.Default(), LevelInfo)
+
+// SetLevel change log level
+func (l *Logger) SetLevel(level LogLevel) {
+	l.level.Store(int32(level))
+}
+
+// Level get current log level
+func (l *Logger) Level() LogLevel {
+	return LogLevel(l.level.Load())
+}
+
+// ToggleDebug switch debug logging on or off, return whether debug is now enabled
+func (l *Logger) ToggleDebug() bool {
+	if l.Enabled(LevelDebug) {
+		restore := LogLevel(l.restore.Load())
+		if restore >= LevelDebug {
+			restore = LevelInfo
+		}
+		l.SetLevel(restore)
+		return false
+	}
+	l.restore.Store(int32(l.Level()))
+	l.SetLevel(LevelDebug)
+	return true
+}
+
+// Enabled report whether messages of level are logged
+func (l *Logger) Enabled(level LogLevel) bool {
+	return level <= l.Level()
+}
+
+func (l *Logger) logf(level LogLevel, format string, v ...any) {
+	if !l.Enabled(level) {
+		return
+	}
+	l.out.Output(3, fmt.Sprintf(format, v...))
+}
+
+// Errorf log error message, always printed
+func (l *Logger) Errorf(format string, v ...any) { l.logf(LevelError, format, v...) }
+
+// Warnf log warning message
+func (l *Logger) Warnf(format string, v ...any) { l.logf(LevelWarn, format, v...) }
+
+// Infof log info message
+func (l *Logger) Infof(format string, v ...any) { l.logf(LevelInfo, format, v...) }
+
+// Debugf log debug message
+func (l *Logger) Debugf(format string, v ...any) { l.logf(LevelDebug, format, v...) }
+
+// Tracef log trace message
+func (l *Logger) Tracef(format string, v ...any) { l.logf(LevelTrace, format, v...) }
+
+// Writer return a writer logging each write at level, for libraries
+// that only accept a *log.Logger
+func (l *Logger) Writer(level LogLevel) io.Writer {
+	return levelWriter{logger: l, level: level}
+}
+
+// stdLogger return a *log.Logger writing at level
+func (l *Logger) stdLogger(level LogLevel) *log.Logger {
+	return log.New(l.Writer(level), "", 0)
+}
+
+type levelWriter struct {
+	logger *Logger
+	level  LogLevel
+}
+
+func (w levelWriter) Write(p []byte) (int, error) {
+	if w.logger.Enabled(w.level) {
+		w.logger.out.Output(4, strings.TrimRight(string(p), "\n"))
+	}
+	return len(p), nil
+}
+
+// Printf log message regardless of level, used for explicitly requested output
+func (l *Logger) Printf(format string, v ...any) {
+	l.out.Output(2, fmt.Sprintf(format, v...))
+}
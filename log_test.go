@@ -0,0 +1,29 @@
+package main
+
+import (
+	"io"
+	"log"
+	"testing"
+)
+
+func TestToggleDebug(t *testing.T) {
+	tests := []struct {
+		start, restored LogLevel
+	}{
+		{LevelWarn, LevelWarn},
+		{LevelInfo, LevelInfo},
+		{LevelDebug, LevelInfo},
+		{LevelTrace, LevelInfo},
+	}
+	for _, tt := range tests {
+		l := NewLogger(log.New(io.Discard, "", 0), tt.start)
+		if tt.start < LevelDebug {
+			if !l.ToggleDebug() || l.Level() != LevelDebug {
+				t.Errorf("started at %s: debug not enabled, level %s", tt.start, l.Level())
+			}
+		}
+		if l.ToggleDebug() || l.Level() != tt.restored {
+			t.Errorf("started at %s: level %s after toggling debug off, expected %s", tt.start, l.Level(), tt.restored)
+		}
+	}
+}
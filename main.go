@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -9,39 +11,107 @@ import (
 )
 
 var (
-	configFile string = ""
+	configFile  string = ""
+	verbose     bool   = false
+	veryVerbose bool   = false
+	quiet       bool   = false
 )
 
 func parseArgs() {
 	flag.StringVar(&configFile, "config", configFile, "config file")
+	flag.BoolVar(&verbose, "v", verbose, "verbose output, same as log_level debug")
+	flag.BoolVar(&veryVerbose, "vv", veryVerbose, "very verbose output, same as log_level trace")
+	flag.BoolVar(&quiet, "q", quiet, "quiet mode, only log errors")
 	flag.Parse()
 }
 
+// logLevel resolve log level from config, command line flags take precedence
+func logLevel() LogLevel {
+	switch {
+	case quiet:
+		return LevelError
+	case veryVerbose:
+		return LevelTrace
+	case verbose:
+		return LevelDebug
+	}
+	level, _ := parseLogLevel(C.LogLevel)
+	return level
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(versionString())
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "snapshot" {
+		os.Exit(runSnapshot(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		os.Exit(runTop(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "ports" {
+		os.Exit(runPorts(os.Args[2:]))
+	}
+
 	parseArgs()
 
 	// load config
 	if err := loadConfig(configFile); err != nil {
 		log.Fatalf("load config failed: %v", err)
 	}
+	logger.SetLevel(logLevel())
+	logger.Infof("starting %s", versionString())
+	if C.Version < configVersion {
+		logger.Infof("config schema version %d, run '%s config migrate' to upgrade it to version %d", C.Version, os.Args[0], configVersion)
+	}
 
 	// create forwarder
-	forwarder := NewForwarder(&C)
+	forwarder := NewForwarder(&C, WithLogger(logger))
 
-	// start forwarder
-	if err := forwarder.Start(); err != nil {
-		log.Fatalf("start forwarder failed: %v", err)
-	}
+	// stop on interrupt signal
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	go handleSignals(ctx, forwarder)
 
-	// wait for interrupt signal
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	logger.Infof("Modbus forwarder starting, press Ctrl+C to stop...")
+	if err := forwarder.Run(ctx); err != nil {
+		log.Fatalf("forwarder failed: %v", err)
+	}
+	logger.Infof("forwarder stopped")
+}
 
-	log.Println("Modbus forwarder started, press Ctrl+C to stop...")
-	<-sigChan
+// handleSignals handle diagnostic signals until ctx is cancelled
+func handleSignals(ctx context.Context, forwarder *Forwarder) {
+	dumpChan := make(chan os.Signal, 1)
+	if len(dumpSignals) > 0 {
+		signal.Notify(dumpChan, dumpSignals...)
+	}
+	debugChan := make(chan os.Signal, 1)
+	if len(debugSignals) > 0 {
+		signal.Notify(debugChan, debugSignals...)
+	}
+	defer signal.Stop(dumpChan)
+	defer signal.Stop(debugChan)
 
-	// graceful shutdown
-	log.Println("stopping forwarder...")
-	forwarder.Stop()
-	log.Println("forwarder stopped")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-dumpChan:
+			forwarder.dumpState()
+		case <-debugChan:
+			if logger.ToggleDebug() {
+				logger.Printf("debug logging enabled")
+			} else {
+				logger.Printf("debug logging disabled")
+			}
+		}
+	}
 }
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// handleMetrics GET /metrics, slave and upstream client counters in the
+// Prometheus text exposition format
+func (s *Forwarder) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.writeMetrics(w)
+}
+
+// writeMetrics write all metrics in the Prometheus text exposition format
+func (s *Forwarder) writeMetrics(w io.Writer) {
+	status := s.status()
+	clients := s.upstreams.snapshot()
+
+	metric(w, "mbf_uptime_seconds", "gauge", "Seconds since the forwarder started.")
+	fmt.Fprintf(w, "mbf_uptime_seconds %g\n", status.Uptime)
+
+	metric(w, "mbf_slave_up", "gauge", "Whether the slave connection is up.")
+	for _, slave := range status.Slaves {
+		up := 0
+		if slave.State == "up" {
+			up = 1
+		}
+		fmt.Fprintf(w, "mbf_slave_up{slave=\"%d\"} %d\n", slave.SlaveID, up)
+	}
+	metric(w, "mbf_slave_requests_total", "counter", "Downstream transactions per slave.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_requests_total{slave=\"%d\"} %d\n", slave.SlaveID, slave.Requests)
+	}
+	metric(w, "mbf_slave_errors_total", "counter", "Failed downstream transactions per slave.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_errors_total{slave=\"%d\"} %d\n", slave.SlaveID, slave.Errors)
+	}
+	metric(w, "mbf_slave_request_seconds_total", "counter", "Total time of the downstream transactions per slave.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_request_seconds_total{slave=\"%d\"} %g\n", slave.SlaveID, slave.BusySeconds)
+	}
+	metric(w, "mbf_slave_reconnects_total", "counter", "Slave connection restorations.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_reconnects_total{slave=\"%d\"} %d\n", slave.SlaveID, slave.Reconnects)
+	}
+
+	metric(w, "mbf_slave_malformed_frames_total", "counter", "Malformed responses per slave by kind: undersized, byte_count or parse.")
+	for _, slave := range status.Slaves {
+		writeMalformed(w, "mbf_slave_malformed_frames_total", fmt.Sprintf("slave=\"%d\"", slave.SlaveID), slave.Malformed)
+	}
+
+	metric(w, "mbf_slave_health_score", "gauge", "Health score of the slave, the success rate lowered by latency beyond the target, 0-1.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_health_score{slave=\"%d\"} %g\n", slave.SlaveID, slave.HealthScore)
+	}
+	metric(w, "mbf_slave_success_rate", "gauge", "Moving average of the downstream transaction success rate per slave.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_success_rate{slave=\"%d\"} %g\n", slave.SlaveID, slave.SuccessRate)
+	}
+	metric(w, "mbf_slave_latency_ema_seconds", "gauge", "Moving average of the downstream transaction latency per slave.")
+	for _, slave := range status.Slaves {
+		fmt.Fprintf(w, "mbf_slave_latency_ema_seconds{slave=\"%d\"} %g\n", slave.SlaveID, slave.LatencyEMA)
+	}
+
+	metric(w, "mbf_client_connections_total", "counter", "Accepted upstream connections per client.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_connections_total{client=%s} %d\n", strconv.Quote(client.Addr), client.Connections)
+	}
+	metric(w, "mbf_client_active_connections", "gauge", "Open upstream connections per client.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_active_connections{client=%s} %d\n", strconv.Quote(client.Addr), client.Active)
+	}
+	metric(w, "mbf_client_rejected_connections_total", "counter", "Upstream connections rejected by the per client connection cap.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_rejected_connections_total{client=%s} %d\n", strconv.Quote(client.Addr), client.Rejected)
+	}
+	metric(w, "mbf_client_evicted_connections_total", "counter", "Upstream connections closed by the per client connection cap.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_evicted_connections_total{client=%s} %d\n", strconv.Quote(client.Addr), client.Evicted)
+	}
+	metric(w, "mbf_client_requests_total", "counter", "Upstream requests per client.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_requests_total{client=%s} %d\n", strconv.Quote(client.Addr), client.Requests)
+	}
+	metric(w, "mbf_client_errors_total", "counter", "Exception responses per client.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_errors_total{client=%s} %d\n", strconv.Quote(client.Addr), client.Errors)
+	}
+	metric(w, "mbf_client_duplicates_total", "counter", "Retransmitted requests answered from the original response per client.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_duplicates_total{client=%s} %d\n", strconv.Quote(client.Addr), client.Duplicates)
+	}
+	metric(w, "mbf_client_malformed_frames_total", "counter", "Malformed requests per client by kind: undersized, byte_count or parse.")
+	for _, client := range clients {
+		writeMalformed(w, "mbf_client_malformed_frames_total", "client="+strconv.Quote(client.Addr), client.Malformed)
+	}
+	metric(w, "mbf_client_received_bytes_total", "counter", "Bytes received from upstream clients.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_received_bytes_total{client=%s} %d\n", strconv.Quote(client.Addr), client.BytesIn)
+	}
+	metric(w, "mbf_client_sent_bytes_total", "counter", "Bytes sent to upstream clients.")
+	for _, client := range clients {
+		fmt.Fprintf(w, "mbf_client_sent_bytes_total{client=%s} %d\n", strconv.Quote(client.Addr), client.BytesOut)
+	}
+
+	if len(s.tenants) == 0 {
+		return
+	}
+	metric(w, "mbf_tenant_active_connections", "gauge", "Open upstream connections per tenant.")
+	for _, t := range s.tenants {
+		fmt.Fprintf(w, "mbf_tenant_active_connections{tenant=%s} %d\n", strconv.Quote(t.name), t.active.Load())
+	}
+	metric(w, "mbf_tenant_rejected_connections_total", "counter", "Upstream connections rejected by the tenant connection limit.")
+	for _, t := range s.tenants {
+		fmt.Fprintf(w, "mbf_tenant_rejected_connections_total{tenant=%s} %d\n", strconv.Quote(t.name), t.rejected.Load())
+	}
+	metric(w, "mbf_tenant_requests_total", "counter", "Upstream requests per tenant.")
+	for _, t := range s.tenants {
+		fmt.Fprintf(w, "mbf_tenant_requests_total{tenant=%s} %d\n", strconv.Quote(t.name), t.requests.Load())
+	}
+	metric(w, "mbf_tenant_errors_total", "counter", "Exception responses per tenant.")
+	for _, t := range s.tenants {
+		fmt.Fprintf(w, "mbf_tenant_errors_total{tenant=%s} %d\n", strconv.Quote(t.name), t.errors.Load())
+	}
+	metric(w, "mbf_tenant_throttled_total", "counter", "Upstream requests rejected by the tenant request rate limit.")
+	for _, t := range s.tenants {
+		fmt.Fprintf(w, "mbf_tenant_throttled_total{tenant=%s} %d\n", strconv.Quote(t.name), t.throttled.Load())
+	}
+}
+
+// writeMalformed write the samples of a malformed frame counter, one per kind
+func writeMalformed(w io.Writer, name, labels string, m malformedStatus) {
+	fmt.Fprintf(w, "%s{%s,kind=%q} %d\n", name, labels, malformedUndersized, m.Undersized)
+	fmt.Fprintf(w, "%s{%s,kind=%q} %d\n", name, labels, malformedByteCount, m.ByteCount)
+	fmt.Fprintf(w, "%s{%s,kind=%q} %d\n", name, labels, malformedParse, m.Parse)
+}
+
+// metric write HELP and TYPE header of a metric
+func metric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// configVersion current config schema version, files without a version are
+// version 1
+const configVersion = 2
+
+// configMigration upgrade of a config document to version
+type configMigration struct {
+	version int
+	apply   func(root *yamlv3.Node) []string // returns a note per change
+}
+
+// configMigrations migrations in order, one per schema version
+var configMigrations = []configMigration{
+	{version: 2, apply: migrateV2},
+}
+
+// migrateV2 drop the ignored slave_id of the servers, the unit ID of a
+// server is its key
+func migrateV2(root *yamlv3.Node) []string {
+	var notes []string
+	servers := mappingValue(root, "servers")
+	if servers == nil || servers.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(servers.Content); i += 2 {
+		key, server := servers.Content[i], servers.Content[i+1]
+		slaveID := mappingValue(server, "slave_id")
+		if slaveID == nil {
+			continue
+		}
+		note := fmt.Sprintf("servers.%s: removed slave_id", key.Value)
+		if slaveID.Value != key.Value {
+			note += fmt.Sprintf(" %s, it was ignored and the slave is addressed as unit %s", slaveID.Value, key.Value)
+		}
+		removeMappingKey(server, "slave_id")
+		notes = append(notes, note)
+	}
+	return notes
+}
+
+// migrateConfig upgrade YAML config content to the current schema version,
+// keeping comments where possible
+func migrateConfig(content []byte) ([]byte, []string, error) {
+	var doc yamlv3.Node
+	if err := yamlv3.Unmarshal(content, &doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse config: %v", err)
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yamlv3.MappingNode {
+		return nil, nil, fmt.Errorf("config is not a YAML mapping")
+	}
+	root := doc.Content[0]
+
+	version := 1
+	if v := mappingValue(root, "version"); v != nil {
+		n, err := strconv.Atoi(v.Value)
+		if err != nil || n < 1 {
+			return nil, nil, fmt.Errorf("invalid version %q", v.Value)
+		}
+		version = n
+	}
+	if version > configVersion {
+		return nil, nil, fmt.Errorf("config version %d is newer than the supported version %d", version, configVersion)
+	}
+
+	var notes []string
+	for _, m := range configMigrations {
+		if m.version <= version {
+			continue
+		}
+		notes = append(notes, m.apply(root)...)
+		version = m.version
+	}
+
+	// set the version as the first key
+	removeMappingKey(root, "version")
+	root.Content = append([]*yamlv3.Node{
+		{Kind: yamlv3.ScalarNode, Value: "version"},
+		{Kind: yamlv3.ScalarNode, Tag: "!!int", Value: strconv.Itoa(version)},
+	}, root.Content...)
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("failed to encode config: %v", err)
+	}
+	enc.Close()
+	return buf.Bytes(), notes, nil
+}
+
+// mappingValue return the value of key in a mapping node, nil if missing
+func mappingValue(node *yamlv3.Node, key string) *yamlv3.Node {
+	if node.Kind != yamlv3.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeMappingKey remove key and its value from a mapping node
+func removeMappingKey(node *yamlv3.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// runConfig config file tools, return the exit code
+func runConfig(args []string) int {
+	if len(args) > 0 && args[0] == "example" {
+		if err := writeExampleConfig(os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write example config: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if len(args) > 0 && args[0] == "plan" {
+		return runConfigPlan(args[1:])
+	}
+	if len(args) == 0 || args[0] != "migrate" {
+		fmt.Fprintf(os.Stderr, "usage: %s config migrate|example|plan [flags]\n", os.Args[0])
+		return 2
+	}
+
+	fs := flag.NewFlagSet("config migrate", flag.ExitOnError)
+	output := fs.String("o", "", "write the migrated config to this file instead of stdout")
+	inPlace := fs.Bool("w", false, "overwrite the config file, keeping the original as .bak")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s config migrate [-o file | -w] config.yaml\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+	if fs.NArg() != 1 || (*output != "" && *inPlace) {
+		fs.Usage()
+		return 2
+	}
+
+	path := fs.Arg(0)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read config file: %v\n", err)
+		return 1
+	}
+	migrated, notes, err := migrateConfig(content)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "migration failed: %v\n", err)
+		return 1
+	}
+	for _, note := range notes {
+		fmt.Fprintln(os.Stderr, note)
+	}
+	if err := parseConfig(migrated); err != nil {
+		fmt.Fprintf(os.Stderr, "warning: the migrated config is not valid: %v\n", err)
+	}
+
+	switch {
+	case *inPlace:
+		if err := os.WriteFile(path+".bak", content, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write backup: %v\n", err)
+			return 1
+		}
+		*output = path
+	case *output == "":
+		os.Stdout.Write(migrated)
+		return 0
+	}
+	if err := os.WriteFile(*output, migrated, 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write config: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "migrated %s to version %d\n", path, configVersion)
+	return 0
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/tbrandon/mbserver"
+)
+
+// mqttClientName upstream client name of MQTT writes in logs and the diagnostic unit
+const mqttClientName = "mqtt"
+
+// mqttResult result of a command published to the response topic
+type mqttResult struct {
+	Value any    `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+	Time  string `json:"time"`
+}
+
+// availability last availability published to each availability topic
+type availability struct {
+	mu     sync.Mutex
+	online map[string]bool
+}
+
+// set record online for topic, report whether it changed
+func (a *availability) set(topic string, online bool) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.online == nil {
+		a.online = make(map[string]bool)
+	}
+	last, published := a.online[topic]
+	a.online[topic] = online
+	return !published || last != online
+}
+
+// onlineTopics the topics last published online
+func (a *availability) onlineTopics() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var topics []string
+	for topic, online := range a.online {
+		if online {
+			topics = append(topics, topic)
+		}
+	}
+	return topics
+}
+
+// startMQTT connect to the MQTT broker and subscribe to the command topic,
+// the subscription is renewed on every reconnect
+func (s *Forwarder) startMQTT() error {
+	c := s.config.MQTT
+	if c == nil {
+		return nil
+	}
+
+	opts := mqtt.NewClientOptions().
+		AddBroker(c.Broker).
+		SetClientID(c.ClientID).
+		SetUsername(c.Username).
+		SetPassword(c.Password).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false)
+	opts.SetOnConnectHandler(func(client mqtt.Client) {
+		topic := topicFilter(c.CommandTopic)
+		token := client.Subscribe(topic, byte(c.QoS), s.handleCommand)
+		if token.WaitTimeout(10*time.Second) && token.Error() != nil {
+			s.logger.Errorf("failed to subscribe to MQTT topic %s: %v", topic, token.Error())
+			return
+		}
+		s.logger.Infof("MQTT connected to %s, subscribed to %s", c.Broker, topic)
+		if c.Discovery {
+			s.publishDiscovery(client)
+		}
+	})
+	opts.SetConnectionLostHandler(func(client mqtt.Client, err error) {
+		s.logger.Warnf("MQTT connection lost: %v", err)
+	})
+
+	s.mqtt = mqtt.NewClient(opts)
+	// with connect retry the token completes once connected, don't wait for
+	// an unavailable broker
+	token := s.mqtt.Connect()
+	if token.WaitTimeout(time.Second) && token.Error() != nil {
+		return fmt.Errorf("failed to connect to MQTT broker %s: %v", c.Broker, token.Error())
+	}
+
+	if c.StateInterval > 0 {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.publishStates(time.Duration(c.StateInterval) * time.Millisecond)
+		}()
+	}
+	return nil
+}
+
+// publishStates publish the values of all readable tags every interval
+// until the forwarder stops
+func (s *Forwarder) publishStates(interval time.Duration) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.clock.After(interval):
+		}
+		if !s.mqtt.IsConnectionOpen() {
+			continue
+		}
+		for slaveID, server := range s.config.Servers {
+			for _, tag := range server.Tags {
+				s.publishState(slaveID, tag)
+			}
+		}
+		s.publishDerived()
+	}
+}
+
+// publishDerived publish the derived registers that can be computed to the
+// state topic, as tags of derived_unit
+func (s *Forwarder) publishDerived() {
+	c := s.config.MQTT
+	for _, r := range s.config.DerivedRegisters {
+		result, _, err := s.derive(r)
+		if err != nil {
+			s.publishAvailability(byte(s.config.DerivedUnit), r.Name, false)
+			continue
+		}
+		value := strconv.FormatFloat(result, 'f', -1, 64)
+		s.mqtt.Publish(tagTopic(c.StateTopic, byte(s.config.DerivedUnit), r.Name), byte(c.QoS), false, value)
+		s.publishAvailability(byte(s.config.DerivedUnit), r.Name, true)
+	}
+}
+
+// publishState read tag of slaveID and publish its value to the state
+// topic, with state_format json as JSON with its quality and timestamp
+func (s *Forwarder) publishState(slaveID byte, tag Tag) {
+	c := s.config.MQTT
+	v := s.sampleTag(slaveID, tag)
+	if v.Error != "" {
+		s.logger.Debugf("failed to read tag %s of slave %d: %s", tag.Name, slaveID, v.Error)
+		s.publishAvailability(slaveID, tag.Name, false)
+		return
+	}
+	payload := []byte(formatTagValue(v.Value))
+	if c.StateFormat == "json" {
+		payload, _ = json.Marshal(v)
+	}
+	s.mqtt.Publish(tagTopic(c.StateTopic, slaveID, tag.Name), byte(c.QoS), false, payload)
+	s.publishAvailability(slaveID, tag.Name, true)
+}
+
+// publishAvailability publish whether the state of tag name of slaveID is
+// current to its availability topic, retained, when it changed
+func (s *Forwarder) publishAvailability(slaveID byte, name string, online bool) {
+	c := s.config.MQTT
+	topic := tagTopic(c.AvailabilityTopic, slaveID, name)
+	if !s.mqttOnline.set(topic, online) {
+		return
+	}
+	payload := "offline"
+	if online {
+		payload = "online"
+	}
+	s.mqtt.Publish(topic, byte(c.QoS), true, payload)
+}
+
+// publishOffline mark the tags published online offline when the forwarder
+// stops, their values are no longer updated
+func (s *Forwarder) publishOffline() {
+	if !s.mqtt.IsConnectionOpen() {
+		return
+	}
+	c := s.config.MQTT
+	for _, topic := range s.mqttOnline.onlineTopics() {
+		s.mqtt.Publish(topic, byte(c.QoS), true, "offline").WaitTimeout(time.Second)
+	}
+}
+
+// handleCommand write the value of a command message to its tag through
+// the upstream request pipeline and publish the result
+func (s *Forwarder) handleCommand(client mqtt.Client, msg mqtt.Message) {
+	c := s.config.MQTT
+	unit, name, ok := matchTopic(c.CommandTopic, msg.Topic())
+	if !ok {
+		return
+	}
+	payload := strings.TrimSpace(string(msg.Payload()))
+
+	value, err := s.command(unit, name, payload)
+	result := mqttResult{Value: value, Time: s.clock.Now().UTC().Format(time.RFC3339)}
+	if err != nil {
+		s.logger.Warnf("MQTT command %s %q failed: %v", msg.Topic(), payload, err)
+		result.Error = err.Error()
+	}
+
+	out, _ := json.Marshal(result)
+	topic := strings.NewReplacer("{slave}", unit, "{tag}", name).Replace(c.ResponseTopic)
+	client.Publish(topic, byte(c.QoS), false, out)
+}
+
+// command write payload to tag name of the slave routed from unit, then
+// publish the new value right away instead of at the next interval
+func (s *Forwarder) command(unit, name, payload string) (any, error) {
+	id, err := strconv.ParseUint(unit, 10, 8)
+	if err != nil {
+		return nil, fmt.Errorf("invalid unit ID %s", unit)
+	}
+	slaveID, ok := s.units[byte(id)]
+	if !ok {
+		return nil, fmt.Errorf("unit %d is not routed", id)
+	}
+	tag, ok := s.config.Servers[slaveID].tag(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown tag %s of slave %d", name, slaveID)
+	}
+
+	value, err := s.writeTag(byte(id), tag, payload, mqttClientName)
+	if err == nil && s.config.MQTT.StateInterval > 0 {
+		s.publishState(slaveID, tag)
+	}
+	return value, err
+}
+
+// tag find tag name of the server
+func (server Server) tag(name string) (Tag, bool) {
+	for _, tag := range server.Tags {
+		if tag.Name == name {
+			return tag, true
+		}
+	}
+	return Tag{}, false
+}
+
+// exceptionName return the config name of exception, the code when it has none
+func exceptionName(exception mbserver.Exception) string {
+	for name, e := range exceptionNames {
+		if *e == exception {
+			return name
+		}
+	}
+	return fmt.Sprintf("%02X", uint8(exception))
+}
+
+// tagTopic fill the placeholders of pattern for tag name of slaveID
+func tagTopic(pattern string, slaveID byte, name string) string {
+	return strings.NewReplacer("{slave}", strconv.Itoa(int(slaveID)), "{tag}", name).Replace(pattern)
+}
+
+// topicFilter replace the placeholders of pattern by single level wildcards
+func topicFilter(pattern string) string {
+	return strings.NewReplacer("{slave}", "+", "{tag}", "+").Replace(pattern)
+}
+
+// matchTopic match topic against pattern, return the {slave} and {tag} levels
+func matchTopic(pattern, topic string) (slave, tag string, ok bool) {
+	levels, topicLevels := strings.Split(pattern, "/"), strings.Split(topic, "/")
+	if len(levels) != len(topicLevels) {
+		return "", "", false
+	}
+	for i, level := range levels {
+		switch level {
+		case "{slave}":
+			slave = topicLevels[i]
+		case "{tag}":
+			tag = topicLevels[i]
+		default:
+			if level != topicLevels[i] {
+				return "", "", false
+			}
+		}
+	}
+	return slave, tag, true
+}
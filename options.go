@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Option configure optional Forwarder dependencies
+type Option func(*Forwarder)
+
+// WithLogger set the logger, defaults to the process wide logger
+func WithLogger(l *Logger) Option {
+	return func(s *Forwarder) {
+		s.logger = l
+	}
+}
+
+// WithClock set the time source, defaults to the system clock
+func WithClock(c Clock) Option {
+	return func(s *Forwarder) {
+		s.clock = c
+	}
+}
+
+// WithDialer set the dialer used for TCP slave connections and remote serial
+// ports, defaults to net.Dialer
+func WithDialer(d Dialer) Option {
+	return func(s *Forwarder) {
+		s.dialer = d
+	}
+}
+
+// WithSerialDriver replace the serial driver name, e.g. "local", used by
+// RTU slaves with that serial_driver; tests can stub the serial layer with it
+func WithSerialDriver(name string, d SerialDriver) Option {
+	return func(s *Forwarder) {
+		if s.serialDrivers == nil {
+			s.serialDrivers = make(map[string]SerialDriver)
+		}
+		s.serialDrivers[name] = d
+	}
+}
+
+// WithMetrics set the metrics sink, defaults to discarding all measurements
+func WithMetrics(m Metrics) Option {
+	return func(s *Forwarder) {
+		s.metrics = m
+	}
+}
+
+// Clock time source
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker ticker created by a Clock
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// systemClock clock backed by the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (systemClock) NewTicker(d time.Duration) Ticker { return systemTicker{time.NewTicker(d)} }
+
+type systemTicker struct{ t *time.Ticker }
+
+func (t systemTicker) C() <-chan time.Time { return t.t.C }
+
+func (t systemTicker) Stop() { t.t.Stop() }
+
+// Dialer dial TCP slave connections, satisfied by *net.Dialer
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Metrics receive forwarder measurements
+type Metrics interface {
+	// ObserveRequest record one downstream transaction
+	ObserveRequest(slaveID byte, function uint8, duration time.Duration, err error)
+	// SetConnectionState record a slave connection state change
+	SetConnectionState(slaveID byte, up bool)
+}
+
+// nopMetrics metrics sink discarding all measurements
+type nopMetrics struct{}
+
+func (nopMetrics) ObserveRequest(byte, uint8, time.Duration, error) {}
+
+func (nopMetrics) SetConnectionState(byte, bool) {}
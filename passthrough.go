@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/goburrow/modbus"
+	"github.com/tbrandon/mbserver"
+)
+
+// send send a raw request PDU to the slave and return the response PDU
+// data, for function codes the modbus client has no method for; exception
+// responses are returned as *modbus.ModbusError
+func (c *modbusClient) send(function uint8, data []byte) ([]byte, error) {
+	request := &modbus.ProtocolDataUnit{FunctionCode: function, Data: data}
+	aduRequest, err := c.packager.Encode(request)
+	if err != nil {
+		return nil, err
+	}
+	aduResponse, err := c.transporter.Send(aduRequest)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.packager.Verify(aduRequest, aduResponse); err != nil {
+		return nil, err
+	}
+	response, err := c.packager.Decode(aduResponse)
+	if err != nil {
+		return nil, err
+	}
+	if response.FunctionCode == function|0x80 && len(response.Data) > 0 {
+		return nil, &modbus.ModbusError{FunctionCode: response.FunctionCode, ExceptionCode: response.Data[0]}
+	}
+	if response.FunctionCode != function {
+		return nil, fmt.Errorf("modbus: response function code '%v' does not match request '%v'", response.FunctionCode, function)
+	}
+	if len(response.Data) == 0 {
+		return nil, fmt.Errorf("modbus: response data is empty")
+	}
+	return response.Data, nil
+}
+
+// passthrough forward the request of frame to the slave as is and return
+// the response data of the slave unchanged, name is the function name logged
+func (s *Forwarder) passthrough(frame mbserver.Framer, name string) ([]byte, *mbserver.Exception) {
+	slaveID := getSlaveID(frame)
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		s.logger.Warnf("failed to get client: %v", err)
+		return nil, errorException(err)
+	}
+
+	function := frame.GetFunction()
+	start := s.clock.Now()
+	data, err := client.send(function, frame.GetData())
+	s.record(client, slaveID, function, start, err)
+	if err != nil {
+		s.logger.Errorf("failed to %s (slave %d): %v", name, slaveID, err)
+		return nil, errorException(err)
+	}
+
+	s.logger.Infof("%s success (slave %d)", name, slaveID)
+	return data, &mbserver.Success
+}
+
+// readExceptionStatus read the eight exception status outputs of the slave,
+// function code 7
+func (s *Forwarder) readExceptionStatus(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	if len(frame.GetData()) != 0 {
+		s.logger.Warnf("failed to parse read exception status request: unexpected data")
+		return nil, &mbserver.IllegalDataValue
+	}
+	data, exception := s.passthrough(frame, "read exception status")
+	if exception == &mbserver.Success && len(data) != 1 {
+		s.logger.Errorf("failed to read exception status (slave %d): response length %d, expected 1", getSlaveID(frame), len(data))
+		return nil, &mbserver.SlaveDeviceFailure
+	}
+	return data, exception
+}
+
+// diagnostics forward a diagnostics request, function code 8, e.g. return
+// query data, restart communications or the counters; return query data is
+// answered by the forwarder instead with keepalive loopback
+func (s *Forwarder) diagnostics(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	data := frame.GetData()
+	if len(data) < 2 {
+		s.logger.Warnf("failed to parse diagnostics request: insufficient data")
+		return nil, &mbserver.IllegalDataValue
+	}
+	if subFunction := binary.BigEndian.Uint16(data); subFunction == 4 {
+		// the slave does not answer force listen only mode
+		s.logger.Warnf("diagnostics sub-function %d (force listen only mode) is not forwarded", subFunction)
+		return nil, &mbserver.IllegalFunction
+	}
+	return s.passthrough(frame, "diagnostics")
+}
+
+// rawFunction forward a request with a function code the forwarder has no
+// handler for, e.g. a vendor specific one, to a slave with raw_passthrough
+func (s *Forwarder) rawFunction(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	return s.passthrough(frame, fmt.Sprintf("forward function %d", frame.GetFunction()))
+}
+
+// reportServerID report the server ID of the slave, function code 17
+func (s *Forwarder) reportServerID(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	return s.passthrough(frame, "report server id")
+}
+
+// fileRecord forward a read or write file record request, function code 20
+// or 21, the sub-requests are passed to the slave as they are
+func (s *Forwarder) fileRecord(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	name := "read file record"
+	minimum, maximum := 0x07, 0xF5
+	if frame.GetFunction() == 21 {
+		name = "write file record"
+		minimum, maximum = 0x09, 0xFB
+	}
+	data := frame.GetData()
+	if len(data) < 1 || int(data[0]) != len(data)-1 || int(data[0]) < minimum || int(data[0]) > maximum {
+		s.logger.Warnf("failed to parse %s request: invalid byte count", name)
+		return nil, &mbserver.IllegalDataValue
+	}
+	return s.passthrough(frame, name)
+}
+
+// readFIFOQueue read the FIFO queue of registers at the FIFO pointer address,
+// function code 24; the count and the queued registers of the slave are
+// returned unchanged
+func (s *Forwarder) readFIFOQueue(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	data := frame.GetData()
+	if len(data) != 2 {
+		s.logger.Warnf("failed to parse read FIFO queue request: expected 2 bytes, got %d", len(data))
+		return nil, &mbserver.IllegalDataValue
+	}
+	slaveID := getSlaveID(frame)
+	address := int(binary.BigEndian.Uint16(data))
+	if client, err := s.getClient(slaveID); err == nil && client.hidden(3, address, 1) {
+		s.logger.Warnf("rejected read FIFO queue request for slave %d: addr %d is in a hidden range", slaveID, address)
+		return nil, &mbserver.IllegalDataAddress
+	}
+	return s.passthrough(frame, "read FIFO queue")
+}
+
+// readDeviceIdentification read the identification objects of the slave,
+// function code 43 with MEI type 14; other MEI types are not supported
+func (s *Forwarder) readDeviceIdentification(frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	data := frame.GetData()
+	if len(data) < 3 {
+		s.logger.Warnf("failed to parse read device identification request: insufficient data")
+		return nil, &mbserver.IllegalDataValue
+	}
+	if data[0] != 0x0E {
+		s.logger.Warnf("encapsulated interface transport with MEI type %d is not supported", data[0])
+		return nil, &mbserver.IllegalFunction
+	}
+	return s.passthrough(frame, "read device identification")
+}
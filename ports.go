@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// serialPortInfo serial device of the host
+type serialPortInfo struct {
+	Device       string `json:"device"`                  // e.g. /dev/ttyUSB0
+	ByID         string `json:"by_id,omitempty"`         // stable /dev/serial/by-id link to the device
+	Driver       string `json:"driver,omitempty"`        // kernel driver, e.g. ftdi_sio
+	VendorID     string `json:"vendor_id,omitempty"`     // USB vendor ID, hex
+	ProductID    string `json:"product_id,omitempty"`    // USB product ID, hex
+	SerialNumber string `json:"serial_number,omitempty"` // USB serial number of the adapter
+	Manufacturer string `json:"manufacturer,omitempty"`
+	Product      string `json:"product,omitempty"`
+	Servers      []int  `json:"servers,omitempty"` // slave IDs of the RTU servers configured on the device
+}
+
+// resolveSerialDevice return the device node of a local serial port: of the
+// USB adapter with serial number usbSerial, or of the single device matching
+// the pattern addr, e.g. /dev/serial/by-id/usb-FTDI_*-port0; device nodes
+// are renumbered on reboots and replugging, links and serial numbers are not
+func resolveSerialDevice(addr, usbSerial string) (string, error) {
+	if usbSerial != "" {
+		ports, err := listSerialPorts()
+		if err != nil {
+			return "", err
+		}
+		var devices []string
+		for _, p := range ports {
+			if p.SerialNumber == usbSerial {
+				devices = append(devices, p.Device)
+			}
+		}
+		switch len(devices) {
+		case 0:
+			return "", fmt.Errorf("no serial port with USB serial number %s", usbSerial)
+		case 1:
+			return devices[0], nil
+		}
+		return "", fmt.Errorf("USB serial number %s matches %d serial ports %s, use an addr pattern of /dev/serial/by-id instead",
+			usbSerial, len(devices), strings.Join(devices, ", "))
+	}
+	if !strings.ContainsAny(addr, "*?[") {
+		return addr, nil
+	}
+	matches, err := filepath.Glob(addr)
+	if err != nil {
+		return "", err
+	}
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no serial port matches %s", addr)
+	case 1:
+		return filepath.EvalSymlinks(matches[0])
+	}
+	return "", fmt.Errorf("%s matches %d serial ports %s", addr, len(matches), strings.Join(matches, ", "))
+}
+
+// markServers set the local RTU servers of config using each port
+func markServers(ports []serialPortInfo, config *Config) {
+	devices := make(map[string][]int)
+	for slaveID, server := range config.Servers {
+		if server.ConnType != "rtu" || server.SerialDriver != "local" {
+			continue
+		}
+		device, err := resolveSerialDevice(server.Addr, server.USBSerial)
+		if err != nil {
+			continue
+		}
+		if resolved, err := filepath.EvalSymlinks(device); err == nil {
+			device = resolved
+		}
+		devices[device] = append(devices[device], int(slaveID))
+	}
+	for i := range ports {
+		ports[i].Servers = devices[ports[i].Device]
+		slices.Sort(ports[i].Servers)
+	}
+}
+
+// handlePorts GET /api/ports, serial devices of the host with the servers
+// configured on them
+func (s *Forwarder) handlePorts(w http.ResponseWriter, r *http.Request) {
+	ports, err := listSerialPorts()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	markServers(ports, s.config)
+	if ports == nil {
+		ports = []serialPortInfo{}
+	}
+	writeJSON(w, http.StatusOK, ports)
+}
+
+// runPorts run the ports subcommand, list the serial devices of the host
+func runPorts(args []string) int {
+	fs := flag.NewFlagSet("ports", flag.ExitOnError)
+	config := fs.String("config", "", "config file, show the servers configured on each device")
+	asJSON := fs.Bool("json", false, "print JSON instead of a table")
+	fs.Parse(args)
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return 2
+	}
+
+	ports, err := listSerialPorts()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list serial ports: %v\n", err)
+		return 1
+	}
+	if *config != "" {
+		if err := loadConfig(*config); err != nil {
+			fmt.Fprintf(os.Stderr, "load config failed: %v\n", err)
+			return 1
+		}
+		markServers(ports, &C)
+	}
+
+	if *asJSON {
+		if ports == nil {
+			ports = []serialPortInfo{}
+		}
+		out, _ := json.MarshalIndent(ports, "", "  ")
+		fmt.Println(string(out))
+		return 0
+	}
+	if len(ports) == 0 {
+		fmt.Println("no serial ports found")
+		return 0
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DEVICE\tDRIVER\tVID:PID\tSERIAL\tPRODUCT\tSERVERS\tBY-ID")
+	for _, p := range ports {
+		id := ""
+		if p.VendorID != "" {
+			id = p.VendorID + ":" + p.ProductID
+		}
+		product := strings.TrimSpace(p.Manufacturer + " " + p.Product)
+		var servers []string
+		for _, slaveID := range p.Servers {
+			servers = append(servers, strconv.Itoa(slaveID))
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", p.Device, p.Driver, id, p.SerialNumber, product, strings.Join(servers, ","), p.ByID)
+	}
+	w.Flush()
+	return 0
+}
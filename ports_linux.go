@@ -0,0 +1,79 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// sysTTY sysfs directory of the tty devices
+const sysTTY = "/sys/class/tty"
+
+// listSerialPorts list the serial devices of the host from sysfs, with the
+// USB descriptors of USB adapters
+func listSerialPorts() ([]serialPortInfo, error) {
+	entries, err := os.ReadDir(sysTTY)
+	if err != nil {
+		return nil, err
+	}
+	byID := serialLinks("/dev/serial/by-id")
+
+	var ports []serialPortInfo
+	for _, entry := range entries {
+		dir := filepath.Join(sysTTY, entry.Name())
+		device, err := filepath.EvalSymlinks(filepath.Join(dir, "device"))
+		if err != nil {
+			// virtual terminals and pseudo terminals have no device
+			continue
+		}
+		p := serialPortInfo{Device: "/dev/" + entry.Name(), ByID: byID["/dev/"+entry.Name()]}
+		if driver, err := os.Readlink(filepath.Join(device, "driver")); err == nil {
+			p.Driver = filepath.Base(driver)
+		}
+		if sysAttr(dir, "type") == "0" {
+			// no UART behind the port, e.g. the unused legacy ttyS ports
+			continue
+		}
+		// the USB device is an ancestor of the interface of the tty
+		for usb := device; usb != "/" && usb != "."; usb = filepath.Dir(usb) {
+			if vendor := sysAttr(usb, "idVendor"); vendor != "" {
+				p.VendorID = vendor
+				p.ProductID = sysAttr(usb, "idProduct")
+				p.SerialNumber = sysAttr(usb, "serial")
+				p.Manufacturer = sysAttr(usb, "manufacturer")
+				p.Product = sysAttr(usb, "product")
+				break
+			}
+		}
+		ports = append(ports, p)
+	}
+	sort.Slice(ports, func(i, j int) bool {
+		return ports[i].Device < ports[j].Device
+	})
+	return ports, nil
+}
+
+// serialLinks map the devices to the links in dir pointing to them
+func serialLinks(dir string) map[string]string {
+	links := make(map[string]string)
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		link := filepath.Join(dir, entry.Name())
+		if device, err := filepath.EvalSymlinks(link); err == nil {
+			links[device] = link
+		}
+	}
+	return links
+}
+
+// sysAttr read a sysfs attribute, empty when missing
+func sysAttr(dir, name string) string {
+	b, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(b))
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// listSerialPorts list the serial devices of the host, only supported on
+// linux
+func listSerialPorts() ([]serialPortInfo, error) {
+	return nil, fmt.Errorf("listing serial ports is not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// exceptionNames exceptions selectable in the config
+var exceptionNames = map[string]*mbserver.Exception{
+	"illegal_function":         &mbserver.IllegalFunction,
+	"illegal_data_address":     &mbserver.IllegalDataAddress,
+	"illegal_data_value":       &mbserver.IllegalDataValue,
+	"slave_device_failure":     &mbserver.SlaveDeviceFailure,
+	"slave_device_busy":        &mbserver.SlaveDeviceBusy,
+	"negative_acknowledge":     &mbserver.NegativeAcknowledge,
+	"gateway_path_unavailable": &mbserver.GatewayPathUnavailable,
+}
+
+// writeLimiter sliding window write counter of one write limit rule
+type writeLimiter struct {
+	function  uint8 // 1 for coils, 3 for holding registers
+	address   int
+	quantity  int
+	maxWrites int
+	window    time.Duration
+	exception *mbserver.Exception
+
+	writes []time.Time // writes within the window, oldest first
+}
+
+// overlaps report whether a write to address and quantity touches the rule range
+func (l *writeLimiter) overlaps(function uint8, address, quantity int) bool {
+	return l.function == function && address < l.address+l.quantity && l.address < address+quantity
+}
+
+// expire drop the writes that left the window
+func (l *writeLimiter) expire(now time.Time) {
+	i := 0
+	for i < len(l.writes) && now.Sub(l.writes[i]) >= l.window {
+		i++
+	}
+	l.writes = l.writes[i:]
+}
+
+// writeLimits write limit rules of one slave
+type writeLimits struct {
+	mu       sync.Mutex
+	limiters []*writeLimiter
+}
+
+func newWriteLimits(limits []WriteLimit) *writeLimits {
+	w := &writeLimits{}
+	for _, limit := range limits {
+		w.limiters = append(w.limiters, &writeLimiter{
+			function:  pollFunctions[limit.Type],
+			address:   limit.Address,
+			quantity:  limit.Quantity,
+			maxWrites: limit.MaxWrites,
+			window:    time.Duration(limit.Window) * time.Second,
+			exception: exceptionNames[limit.Exception],
+		})
+	}
+	return w
+}
+
+// allow count a write of quantity coils (function 1) or registers (function
+// 3) at address, return the exception of the first exceeded rule, the write
+// is not counted then
+func (w *writeLimits) allow(function uint8, address, quantity int, now time.Time) *mbserver.Exception {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var matched []*writeLimiter
+	for _, l := range w.limiters {
+		if !l.overlaps(function, address, quantity) {
+			continue
+		}
+		l.expire(now)
+		if len(l.writes) >= l.maxWrites {
+			return l.exception
+		}
+		matched = append(matched, l)
+	}
+	for _, l := range matched {
+		l.writes = append(l.writes, now)
+	}
+	return nil
+}
+
+// checkWriteRate reject writes exceeding the slave write limits
+func (s *Forwarder) checkWriteRate(client *modbusClient, slaveID byte, function uint8, address, quantity int) *mbserver.Exception {
+	if exception := client.writeLimits.allow(function, address, quantity, s.clock.Now()); exception != nil {
+		s.logger.Warnf("write to slave %d (addr %d, count %d) exceeds the write limit, rejected", slaveID, address, quantity)
+		s.emitHook(hookEvent{Event: hookWriteDenied, Slave: slaveID, Address: &address, Quantity: quantity, Reason: "write_limits"})
+		return exception
+	}
+	return nil
+}
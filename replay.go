@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+// replayStats outcome of a replay
+type replayStats struct {
+	sent, matched, differed, failed, skipped int
+}
+
+// runReplay re-issue the requests of a capture file against a Modbus TCP
+// target and diff the responses with the recorded ones, return the exit code
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := fs.String("target", "", "Modbus TCP address requests are sent to, e.g. 192.168.1.10:502")
+	speed := fs.Float64("speed", 1, "timing relative to the capture, e.g. 2 for twice as fast, 0 for no delays")
+	unit := fs.Int("unit", -1, "replay only requests to this unit ID")
+	writes := fs.Bool("writes", false, "also replay write requests, which change the device")
+	timeout := fs.Duration("timeout", 2*time.Second, "response timeout")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s replay -target host:port [flags] capture.jsonl\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if *target == "" || fs.NArg() != 1 || *speed < 0 {
+		fs.Usage()
+		return 2
+	}
+
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to open capture file: %v\n", err)
+		return 1
+	}
+	defer file.Close()
+
+	transporter := newTCPTransport(*target, *timeout, &net.Dialer{}, nil)
+	defer transporter.Close()
+
+	stats, err := replay(file, os.Stdout, transporter, *speed, *unit, *writes)
+	fmt.Printf("%d requests sent, %d matched, %d differed, %d failed, %d skipped\n",
+		stats.sent, stats.matched, stats.differed, stats.failed, stats.skipped)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "replay failed: %v\n", err)
+		return 1
+	}
+	if stats.differed > 0 || stats.failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replay send the requests read from capture through transporter, reporting
+// every difference to out
+func replay(capture io.Reader, out io.Writer, transporter transport, speed float64, unit int, writes bool) (replayStats, error) {
+	var stats replayStats
+	var first time.Time
+	start := time.Now()
+
+	scanner := bufio.NewScanner(capture)
+	for line := 1; scanner.Scan(); line++ {
+		var tx transaction
+		if err := json.Unmarshal(scanner.Bytes(), &tx); err != nil {
+			return stats, fmt.Errorf("line %d: %v", line, err)
+		}
+		pdu, err := hex.DecodeString(tx.Request)
+		if err != nil || len(pdu) == 0 {
+			return stats, fmt.Errorf("line %d: invalid request %q", line, tx.Request)
+		}
+		if (unit >= 0 && int(tx.Unit) != unit) || (!writes && isWriteFunction(pdu[0])) || tx.Unit == 0 {
+			stats.skipped++
+			continue
+		}
+
+		// keep the recorded spacing of the requests, scaled by speed
+		if t, err := time.Parse(time.RFC3339Nano, tx.Time); err == nil && speed > 0 {
+			if first.IsZero() {
+				first = t
+			}
+			due := start.Add(time.Duration(float64(t.Sub(first)) / speed))
+			time.Sleep(time.Until(due))
+		}
+
+		adu := make([]byte, tcpHeaderSize, tcpHeaderSize+len(pdu))
+		binary.BigEndian.PutUint16(adu, uint16(stats.sent+1))
+		binary.BigEndian.PutUint16(adu[4:], uint16(len(pdu)+1))
+		adu[6] = tx.Unit
+		adu = append(adu, pdu...)
+		stats.sent++
+
+		response, err := transporter.Send(adu)
+		var got string
+		if err == nil {
+			got = hex.EncodeToString(response[tcpHeaderSize:])
+		}
+		switch {
+		case err != nil && tx.Response == "":
+			// no response then and now
+			stats.matched++
+		case err != nil:
+			stats.failed++
+			fmt.Fprintf(out, "line %d: unit %d request %s: recorded %s, got error: %v\n", line, tx.Unit, tx.Request, tx.Response, err)
+		case got == tx.Response:
+			stats.matched++
+		default:
+			stats.differed++
+			recorded := tx.Response
+			if recorded == "" {
+				recorded = "no response"
+			}
+			fmt.Fprintf(out, "line %d: unit %d request %s: recorded %s, got %s\n", line, tx.Unit, tx.Request, recorded, got)
+		}
+	}
+	return stats, scanner.Err()
+}
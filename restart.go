@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// restartResult result of a connection restart through the admin API
+type restartResult struct {
+	SlaveID   int    `json:"slave_id"`
+	Drained   bool   `json:"drained"`         // the queue was empty before the connection was closed
+	Connected bool   `json:"connected"`       // the new connection is established
+	Error     string `json:"error,omitempty"` // why the new connection failed
+}
+
+// drain wait up to timeout for the queued requests and acknowledged writes
+// of client to reach the slave, false when they did not in time
+func (s *Forwarder) drain(client *modbusClient, timeout time.Duration) bool {
+	deadline := s.clock.Now().Add(timeout)
+	for {
+		pending := int(client.queued.Load())
+		if client.async != nil {
+			pending += len(client.async.queue)
+		}
+		if pending == 0 {
+			return true
+		}
+		if !s.clock.Now().Before(deadline) {
+			return false
+		}
+		select {
+		case <-s.ctx.Done():
+			return false
+		case <-s.clock.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// draining report whether the connection of slaveID is restarting and waits
+// for its queue, new requests are not queued meanwhile
+func (s *Forwarder) draining(slaveID byte) bool {
+	s.clientsMux.RLock()
+	client := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	return client != nil && client.draining.Load()
+}
+
+// restartConnection close and reopen the connection of a slave after its
+// queue drained; a transaction in progress always completes first, requests
+// arriving meanwhile are answered with exception 06 (Slave Device Busy)
+// until the connection is reopened
+func (s *Forwarder) restartConnection(slaveID byte, client *modbusClient, timeout time.Duration) restartResult {
+	client.draining.Store(true)
+	defer client.draining.Store(false)
+	result := restartResult{SlaveID: int(slaveID), Drained: s.drain(client, timeout)}
+	if !result.Drained {
+		s.logger.Warnf("slave %d queue not drained within %s, restarting the connection anyway", slaveID, timeout)
+	}
+	if err := client.transporter.Close(); err != nil {
+		s.logger.Warnf("failed to close slave %d connection: %v", slaveID, err)
+	}
+	if err := client.transporter.Connect(); err != nil {
+		s.logger.Errorf("slave %d connection restart failed: %v", slaveID, err)
+		s.markDown(slaveID, client, err)
+		result.Error = err.Error()
+		return result
+	}
+	s.markUp(slaveID, client)
+	s.logger.Infof("slave %d connection restarted", slaveID)
+	result.Connected = true
+	return result
+}
+
+// handleRestart POST /api/slaves/{slave_id}/restart[?drain_timeout=seconds],
+// close and reopen the connection of a slave, waiting up to drain_timeout
+// (default 10) for its queue to drain first
+func (s *Forwarder) handleRestart(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("slave_id"))
+	s.clientsMux.RLock()
+	client, ok := s.clients[byte(id)]
+	s.clientsMux.RUnlock()
+	if err != nil || id < 0 || id > 255 || !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown slave %q", r.PathValue("slave_id"))})
+		return
+	}
+	timeout := 10 * time.Second
+	if q := r.URL.Query(); q.Has("drain_timeout") {
+		seconds, err := strconv.Atoi(q.Get("drain_timeout"))
+		if err != nil || seconds < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid drain_timeout %q", q.Get("drain_timeout"))})
+			return
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+
+	s.logger.Infof("slave %d connection restart requested through the admin API", id)
+	result := s.restartConnection(byte(id), client, timeout)
+	status := http.StatusOK
+	if !result.Connected {
+		status = http.StatusBadGateway
+	}
+	writeJSON(w, status, result)
+}
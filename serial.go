@@ -0,0 +1,578 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+)
+
+const (
+	rtuMinSize       = 4
+	rtuMaxSize       = 256
+	rtuExceptionSize = 5
+)
+
+// SerialConfig line settings of a serial slave
+type SerialConfig struct {
+	Address  string // device name or pattern, or host:port of a remote serial port
+	BaudRate int
+	DataBits int
+	StopBits int
+	Parity   string // "N", "E" or "O"
+	Timeout  time.Duration
+
+	USBSerial        string        // serial number of the USB adapter of a local port, instead of Address
+	InterCharTimeout time.Duration // max silence within a response, 0 for none
+	TurnaroundDelay  time.Duration // min silence between a response and the next request
+}
+
+// SerialPort byte stream of an open serial line
+type SerialPort interface {
+	io.ReadWriteCloser
+	// SetDeadline set the deadline of reads and writes, ports with a fixed
+	// read timeout may ignore it
+	SetDeadline(t time.Time) error
+}
+
+// SerialDriver open serial lines of RTU slaves
+type SerialDriver interface {
+	Open(ctx context.Context, c SerialConfig) (SerialPort, error)
+}
+
+// serialDriverNames names of the built-in serial drivers
+var serialDriverNames = []string{"local", "rfc2217", "tcp"}
+
+// serialDriver return the serial driver name, remote serial ports are
+// dialed with dialer wrapped by withBackoff
+func (s *Forwarder) serialDriver(name string, dialer Dialer, withBackoff func(Dialer) Dialer) SerialDriver {
+	if driver := s.serialDrivers[name]; driver != nil {
+		return driver
+	}
+	switch name {
+	case "rfc2217":
+		return rfc2217Driver{dialer: withBackoff(dialer)}
+	case "tcp":
+		return tcpSerialDriver{dialer: withBackoff(dialer)}
+	}
+	return localSerialDriver{}
+}
+
+// localSerialDriver serial port of this host, e.g. /dev/ttyUSB0 or COM3
+type localSerialDriver struct{}
+
+// Open open the serial device
+func (localSerialDriver) Open(ctx context.Context, c SerialConfig) (SerialPort, error) {
+	device, err := resolveSerialDevice(c.Address, c.USBSerial)
+	if err != nil {
+		return nil, err
+	}
+	port, err := serial.Open(&serial.Config{
+		Address:  device,
+		BaudRate: c.BaudRate,
+		DataBits: c.DataBits,
+		StopBits: c.StopBits,
+		Parity:   c.Parity,
+		Timeout:  localSerialPoll,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &localSerialPort{ReadWriteCloser: port}, nil
+}
+
+// localSerialPoll read timeout of local serial ports, reads are repeated
+// until the deadline
+const localSerialPoll = 100 * time.Millisecond
+
+// localSerialPort serial device
+type localSerialPort struct {
+	io.ReadWriteCloser
+	deadline time.Time
+}
+
+// SetDeadline set the deadline of reads
+func (p *localSerialPort) SetDeadline(t time.Time) error {
+	p.deadline = t
+	return nil
+}
+
+// Read read until data arrives or the deadline passes
+func (p *localSerialPort) Read(b []byte) (int, error) {
+	for {
+		n, err := p.ReadWriteCloser.Read(b)
+		if n > 0 || !errors.Is(err, serial.ErrTimeout) || (!p.deadline.IsZero() && !time.Now().Before(p.deadline)) {
+			return n, err
+		}
+	}
+}
+
+// tcpSerialDriver raw TCP connection to a serial device server, the line
+// settings are configured on the device server
+type tcpSerialDriver struct {
+	dialer Dialer
+}
+
+// Open connect to the device server
+func (d tcpSerialDriver) Open(ctx context.Context, c SerialConfig) (SerialPort, error) {
+	return d.dialer.DialContext(ctx, "tcp", c.Address)
+}
+
+// telnet commands and options used by RFC 2217
+const (
+	telnetSE      = 240
+	telnetSB      = 250
+	telnetWILL    = 251
+	telnetWONT    = 252
+	telnetDO      = 253
+	telnetDONT    = 254
+	telnetIAC     = 255
+	telnetBinary  = 0
+	telnetSGA     = 3 // suppress go ahead
+	telnetComPort = 44
+
+	// COM-PORT-OPTION client commands
+	comPortSetBaudRate = 1
+	comPortSetDataSize = 2
+	comPortSetParity   = 3
+	comPortSetStopSize = 4
+)
+
+// rfc2217Driver serial port of a device server speaking telnet with the
+// RFC 2217 COM port control option, the line settings are sent on connect
+type rfc2217Driver struct {
+	dialer Dialer
+}
+
+// Open connect to the device server and set the line settings
+func (d rfc2217Driver) Open(ctx context.Context, c SerialConfig) (SerialPort, error) {
+	conn, err := d.dialer.DialContext(ctx, "tcp", c.Address)
+	if err != nil {
+		return nil, err
+	}
+	parity := map[string]byte{"N": 1, "O": 2, "E": 3}[c.Parity]
+	baud := binary.BigEndian.AppendUint32(nil, uint32(c.BaudRate))
+	cmds := [][]byte{
+		{telnetIAC, telnetWILL, telnetBinary},
+		{telnetIAC, telnetDO, telnetBinary},
+		{telnetIAC, telnetWILL, telnetComPort},
+		comPortCommand(comPortSetBaudRate, baud...),
+		comPortCommand(comPortSetDataSize, byte(c.DataBits)),
+		comPortCommand(comPortSetParity, parity),
+		comPortCommand(comPortSetStopSize, byte(c.StopBits)),
+	}
+	t := &telnetConn{Conn: conn}
+	for _, cmd := range cmds {
+		if err := t.writeRaw(cmd); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to configure %s: %v", c.Address, err)
+		}
+	}
+	return t, nil
+}
+
+// comPortCommand COM-PORT-OPTION subnegotiation, IAC in the value is escaped
+func comPortCommand(cmd byte, value ...byte) []byte {
+	b := []byte{telnetIAC, telnetSB, telnetComPort, cmd}
+	for _, v := range value {
+		b = append(b, v)
+		if v == telnetIAC {
+			b = append(b, telnetIAC)
+		}
+	}
+	return append(b, telnetIAC, telnetSE)
+}
+
+// telnetConn data stream of a telnet connection, IAC bytes of the data are
+// escaped and the telnet commands of the server are answered or skipped
+type telnetConn struct {
+	net.Conn
+
+	wmu   sync.Mutex
+	state int  // telnet parser state of Read
+	verb  byte // WILL, WONT, DO or DONT being parsed
+}
+
+// telnet parser states
+const (
+	telnetData = iota
+	telnetCommand
+	telnetOption
+	telnetSub
+	telnetSubIAC
+)
+
+// Read read data bytes, skipping telnet commands
+func (t *telnetConn) Read(b []byte) (int, error) {
+	for {
+		buf := make([]byte, len(b))
+		n, err := t.Conn.Read(buf)
+		m := 0
+		for _, c := range buf[:n] {
+			switch t.state {
+			case telnetData:
+				if c == telnetIAC {
+					t.state = telnetCommand
+				} else {
+					b[m] = c
+					m++
+				}
+			case telnetCommand:
+				switch c {
+				case telnetIAC: // escaped 0xFF data byte
+					b[m] = c
+					m++
+					t.state = telnetData
+				case telnetWILL, telnetWONT, telnetDO, telnetDONT:
+					t.verb = c
+					t.state = telnetOption
+				case telnetSB:
+					t.state = telnetSub
+				default:
+					t.state = telnetData
+				}
+			case telnetOption:
+				t.answer(t.verb, c)
+				t.state = telnetData
+			case telnetSub:
+				// server notifications and confirmations of the settings
+				if c == telnetIAC {
+					t.state = telnetSubIAC
+				}
+			case telnetSubIAC:
+				if c == telnetSE {
+					t.state = telnetData
+				} else {
+					t.state = telnetSub
+				}
+			}
+		}
+		if m > 0 || err != nil {
+			return m, err
+		}
+	}
+}
+
+// answer refuse the options requested by the server other than those of
+// the client
+func (t *telnetConn) answer(verb, option byte) {
+	switch {
+	case verb == telnetDO && option != telnetBinary && option != telnetComPort:
+		t.writeRaw([]byte{telnetIAC, telnetWONT, option})
+	case verb == telnetWILL && option != telnetBinary && option != telnetSGA && option != telnetComPort:
+		t.writeRaw([]byte{telnetIAC, telnetDONT, option})
+	}
+}
+
+// Write write data bytes, escaping IAC
+func (t *telnetConn) Write(b []byte) (int, error) {
+	escaped := make([]byte, 0, len(b))
+	for _, c := range b {
+		escaped = append(escaped, c)
+		if c == telnetIAC {
+			escaped = append(escaped, telnetIAC)
+		}
+	}
+	if err := t.writeRaw(escaped); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// writeRaw write bytes as they are
+func (t *telnetConn) writeRaw(b []byte) error {
+	t.wmu.Lock()
+	defer t.wmu.Unlock()
+	_, err := t.Conn.Write(b)
+	return err
+}
+
+// rtuTransport RTU transporter over a serial line opened by a SerialDriver,
+// access to the line is serialized, upstream connections are served
+// concurrently
+type rtuTransport struct {
+	driver   SerialDriver
+	config   SerialConfig
+	timeouts timeoutRules // per range timeouts overriding the configured timeout
+	logger   *log.Logger
+	detector *baudDetector // line settings probe on first connect, nil once detected or disabled
+
+	mu   sync.Mutex
+	port SerialPort
+	last time.Time // end of the last transaction
+}
+
+// Send send request ADU and read the response ADU
+func (t *rtuTransport) Send(aduRequest []byte) ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.connect(); err != nil {
+		return nil, err
+	}
+	aduResponse, err := t.send(aduRequest)
+	t.last = time.Now()
+	if err != nil {
+		// a late response would be taken for the answer of the next
+		// request, start over with the line reopened
+		t.close()
+		return nil, err
+	}
+	return aduResponse, nil
+}
+
+// send one transaction, caller must hold the mutex
+func (t *rtuTransport) send(aduRequest []byte) ([]byte, error) {
+	var deadline time.Time
+	if len(aduRequest) < rtuMinSize {
+		return nil, fmt.Errorf("modbus: request too short")
+	}
+	if timeout := t.timeouts.timeout(aduRequest[1:len(aduRequest)-2], t.config.Timeout); timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := t.port.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	if wait := t.config.TurnaroundDelay - time.Since(t.last); wait > 0 {
+		time.Sleep(wait)
+	}
+	t.logf("modbus: sending % x", aduRequest)
+	if _, err := t.port.Write(aduRequest); err != nil {
+		return nil, err
+	}
+	function := aduRequest[1]
+	bytesToRead := rtuResponseLength(aduRequest)
+	time.Sleep(rtuTransmitDelay(t.config.BaudRate, len(aduRequest)+bytesToRead))
+
+	// read the minimum, then the rest of a normal or an exception response
+	var data [rtuMaxSize]byte
+	n, err := t.read(data[:], 0, rtuMinSize, deadline)
+	if err != nil {
+		return nil, err
+	}
+	switch data[1] {
+	case function:
+		if !rtuLengthKnown(function) {
+			// e.g. vendor specific functions forwarded raw
+			if n, err = t.readFrame(data[:], n, deadline); err != nil {
+				return nil, err
+			}
+			break
+		}
+		// variable length responses are read until their length is known
+		for counted := rtuCountedLength(data[:n]); counted > n && counted <= rtuMaxSize; counted = rtuCountedLength(data[:n]) {
+			if n, err = t.read(data[:counted], n, counted, deadline); err != nil {
+				return nil, err
+			}
+		}
+		if n < bytesToRead && bytesToRead <= rtuMaxSize {
+			if n, err = t.read(data[:bytesToRead], n, bytesToRead, deadline); err != nil {
+				return nil, err
+			}
+		}
+	case function | 0x80:
+		if n < rtuExceptionSize {
+			if n, err = t.read(data[:rtuExceptionSize], n, rtuExceptionSize, deadline); err != nil {
+				return nil, err
+			}
+		}
+	}
+	aduResponse := append([]byte(nil), data[:n]...)
+	t.logf("modbus: received % x", aduResponse)
+	return aduResponse, nil
+}
+
+// read read into data after its first n bytes until it holds at least min
+// bytes, once the response started the silence between reads is limited to
+// the inter-character timeout, caller must hold the mutex
+func (t *rtuTransport) read(data []byte, n, min int, deadline time.Time) (int, error) {
+	for n < min {
+		interChar := n > 0 && t.config.InterCharTimeout > 0
+		if interChar {
+			d := time.Now().Add(t.config.InterCharTimeout)
+			if !deadline.IsZero() && deadline.Before(d) {
+				d = deadline
+			}
+			if err := t.port.SetDeadline(d); err != nil {
+				return n, err
+			}
+		}
+		m, err := t.port.Read(data[n:])
+		n += m
+		if err != nil {
+			if interChar && m == 0 && (deadline.IsZero() || time.Now().Before(deadline)) {
+				return n, fmt.Errorf("modbus: inter-character timeout after %d bytes of the response", n)
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readFrame read into data after its first n bytes until the line stays
+// silent for the frame gap, or inter_char_timeout if longer, for responses
+// of unknown length; caller must hold the mutex
+func (t *rtuTransport) readFrame(data []byte, n int, deadline time.Time) (int, error) {
+	gap := max(rtuTransmitDelay(t.config.BaudRate, 0), t.config.InterCharTimeout)
+	for n < len(data) {
+		d := time.Now().Add(gap)
+		if !deadline.IsZero() && deadline.Before(d) {
+			d = deadline
+		}
+		if err := t.port.SetDeadline(d); err != nil {
+			return n, err
+		}
+		m, err := t.port.Read(data[n:])
+		n += m
+		if err != nil {
+			if m == 0 && isTimeout(err) {
+				// the silence ends the frame
+				return n, nil
+			}
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Connect open the serial line ahead of the first request
+func (t *rtuTransport) Connect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.connect()
+}
+
+// Close close the serial line
+func (t *rtuTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.close()
+}
+
+// connect open the serial line if not open, caller must hold the mutex
+func (t *rtuTransport) connect() error {
+	if t.port != nil {
+		return nil
+	}
+	if t.detector != nil {
+		return t.detect()
+	}
+	port, err := t.open(t.config)
+	if err != nil {
+		return err
+	}
+	t.port = port
+	return nil
+}
+
+// open open the serial line with config within the timeout
+func (t *rtuTransport) open(config SerialConfig) (SerialPort, error) {
+	ctx := context.Background()
+	if t.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.config.Timeout)
+		defer cancel()
+	}
+	return t.driver.Open(ctx, config)
+}
+
+// close close the serial line, caller must hold the mutex
+func (t *rtuTransport) close() (err error) {
+	if t.port != nil {
+		err = t.port.Close()
+		t.port = nil
+	}
+	return err
+}
+
+func (t *rtuTransport) logf(format string, v ...any) {
+	if t.logger != nil {
+		t.logger.Printf(format, v...)
+	}
+}
+
+// rtuTransmitDelay time to transmit chars characters and the frame gap,
+// see MODBUS over Serial Line - Specification and Implementation Guide
+func rtuTransmitDelay(baudRate, chars int) time.Duration {
+	characterDelay, frameDelay := 750, 1750 // us, fixed above 19200 baud
+	if baudRate > 0 && baudRate <= 19200 {
+		characterDelay = 15000000 / baudRate
+		frameDelay = 35000000 / baudRate
+	}
+	return time.Duration(characterDelay*chars+frameDelay) * time.Microsecond
+}
+
+// rtuResponseLength expected length of the response ADU to a request ADU,
+// the minimum length when it is not known in advance
+func rtuResponseLength(adu []byte) int {
+	length := rtuMinSize
+	switch adu[1] {
+	case 0x01, 0x02:
+		count := int(binary.BigEndian.Uint16(adu[4:]))
+		length += 1 + (count+7)/8
+	case 0x03, 0x04, 0x17:
+		count := int(binary.BigEndian.Uint16(adu[4:]))
+		length += 1 + count*2
+	case 0x07:
+		length++
+	case 0x08:
+		// diagnostics responses are as long as the request
+		length = len(adu)
+	case 0x05, 0x06, 0x0F, 0x10:
+		length += 4
+	case 0x16:
+		length += 6
+	}
+	return length
+}
+
+// rtuLengthKnown report whether the response length of function is known
+// from the request or the response, see rtuResponseLength and
+// rtuCountedLength
+func rtuLengthKnown(function byte) bool {
+	switch function {
+	case 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x0F, 0x10,
+		0x11, 0x14, 0x15, 0x16, 0x17, 0x18, 0x2B:
+		return true
+	}
+	return false
+}
+
+// rtuCountedLength length of the response ADU of a function with a variable
+// length response, as far as it is known from the bytes received: the full
+// length, or the length needed to know more; 0 for other functions
+func rtuCountedLength(adu []byte) int {
+	switch adu[1] {
+	case 0x11, 0x14, 0x15:
+		return 3 + int(adu[2]) + 2
+	case 0x18:
+		// read FIFO queue: two byte count
+		return 4 + int(binary.BigEndian.Uint16(adu[2:])) + 2
+	case 0x2B:
+		// read device identification: MEI type, code, conformity level,
+		// more follows, next object ID, number of objects, then the objects
+		// with ID, length and value
+		length := 8
+		if len(adu) < length+2 {
+			return length + 2
+		}
+		for i := 0; i < int(adu[7]); i++ {
+			if len(adu) < length+2+2 {
+				return length + 2 + 2
+			}
+			length += 2 + int(adu[length+1])
+		}
+		return length + 2
+	}
+	return 0
+}
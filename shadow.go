@@ -0,0 +1,393 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errNotPolled   = errors.New("range is not covered by a poll range")
+	errNeverPolled = errors.New("range has not been polled yet")
+)
+
+// pollGroup one range polled in the background into the shadow store
+type pollGroup struct {
+	typ      string
+	function uint8
+	address  int
+	quantity int
+	interval time.Duration
+	offset   time.Duration // delay of the first poll, spreads groups across the interval
+	jitter   time.Duration // maximum random deviation of each interval
+
+	mu      sync.Mutex // protects the fields below
+	data    []byte     // last values, packed bits or big endian registers
+	updated time.Time  // last successful poll
+	err     error      // last poll error, nil after a successful poll
+	next    time.Time  // next scheduled poll
+	writes  uint64     // writes to the range, results of polls started before one are dropped
+}
+
+// quality classify the polled values, the caller must hold g.mu
+//   - "never-read": no successful poll yet
+//   - "bad": the last poll failed, the values are the last known ones
+//   - "stale": the last successful poll is older than three intervals
+//   - "good": otherwise
+func (g *pollGroup) quality(now time.Time) string {
+	switch {
+	case g.data == nil:
+		return "never-read"
+	case g.err != nil:
+		return "bad"
+	case now.Sub(g.updated) > 3*g.interval:
+		return "stale"
+	}
+	return "good"
+}
+
+// nextDelay return the interval with a random jitter applied
+func (g *pollGroup) nextDelay() time.Duration {
+	if g.jitter <= 0 {
+		return g.interval
+	}
+	return g.interval - g.jitter + rand.N(2*g.jitter+1)
+}
+
+// shadowStore image of the polled ranges of one slave
+type shadowStore struct {
+	groups []*pollGroup
+
+	ageFunction uint8 // function code of the age virtual registers, 0 disabled
+	ageAddress  int   // address of the age register of the first group
+}
+
+// newShadowStore create the poll groups of ranges, the first polls of the
+// groups are spread evenly across their interval and every interval varies
+// by up to jitter percent
+func newShadowStore(ranges []PollRange, jitter int, ages *AgeRegisters) *shadowStore {
+	sh := &shadowStore{}
+	if ages != nil {
+		sh.ageFunction, sh.ageAddress = pollFunctions[ages.Type], ages.Address
+	}
+	for i, r := range ranges {
+		interval := time.Duration(r.Interval) * time.Millisecond
+		sh.groups = append(sh.groups, &pollGroup{
+			typ:      r.Type,
+			function: pollFunctions[r.Type],
+			address:  r.Address,
+			quantity: r.Quantity,
+			interval: interval,
+			offset:   interval * time.Duration(i) / time.Duration(len(ranges)),
+			jitter:   interval * time.Duration(jitter) / 100,
+		})
+	}
+	return sh
+}
+
+// pollFunctions read function code for each poll range type
+var pollFunctions = map[string]uint8{
+	"coils":    1,
+	"discrete": 2,
+	"holding":  3,
+	"input":    4,
+}
+
+// ages answer a read of the age virtual registers, one register per poll
+// group holding the seconds since its last successful poll, 0xFFFF when
+// never polled. ok is false when the range is not within the age registers.
+func (sh *shadowStore) ages(function uint8, address, quantity int, now time.Time) (results []byte, ok bool) {
+	if sh == nil || sh.ageFunction == 0 || function != sh.ageFunction ||
+		address < sh.ageAddress || address+quantity > sh.ageAddress+len(sh.groups) {
+		return nil, false
+	}
+	for _, g := range sh.groups[address-sh.ageAddress : address-sh.ageAddress+quantity] {
+		age := 0xFFFF
+		g.mu.Lock()
+		if g.data != nil {
+			age = min(int(now.Sub(g.updated).Seconds()), 0xFFFF)
+		}
+		g.mu.Unlock()
+		results = append(results, byte(age>>8), byte(age))
+	}
+	return results, true
+}
+
+// read answer a read from the poll group covering the whole range
+func (sh *shadowStore) read(function uint8, address, quantity int) ([]byte, error) {
+	for _, g := range sh.groups {
+		if g.function != function || address < g.address || address+quantity > g.address+g.quantity {
+			continue
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		if g.data == nil {
+			return nil, errNeverPolled
+		}
+		results, ok := extractRange(function, g.data, address-g.address, quantity)
+		if !ok {
+			return nil, errNeverPolled
+		}
+		return results, nil
+	}
+	return nil, errNotPolled
+}
+
+// size return the number of poll groups holding values and of all groups,
+// sh may be nil
+func (sh *shadowStore) size() (polled, total int) {
+	if sh == nil {
+		return 0, 0
+	}
+	for _, g := range sh.groups {
+		g.mu.Lock()
+		if g.data != nil {
+			polled++
+		}
+		g.mu.Unlock()
+	}
+	return polled, len(sh.groups)
+}
+
+// sample return the quality of the poll group covering the whole range and
+// the time of its last successful poll, ok is false when none covers it
+func (sh *shadowStore) sample(function uint8, address, quantity int, now time.Time) (quality string, updated time.Time, ok bool) {
+	for _, g := range sh.groups {
+		if g.function != function || address < g.address || address+quantity > g.address+g.quantity {
+			continue
+		}
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		return g.quality(now), g.updated, true
+	}
+	return "", time.Time{}, false
+}
+
+// update apply a successful write to the polled values
+func (sh *shadowStore) update(function uint8, address, quantity int, data []byte) {
+	if sh == nil {
+		return
+	}
+	for _, g := range sh.groups {
+		if g.function != function {
+			continue
+		}
+		g.mu.Lock()
+		if address < g.address+g.quantity && address+quantity > g.address {
+			g.writes++
+		}
+		if g.data != nil {
+			mergeRange(function, g.data, g.address, address, quantity, data)
+		}
+		g.mu.Unlock()
+	}
+}
+
+// mask apply a successful mask write of a holding register to the polled
+// values
+func (sh *shadowStore) mask(address int, andMask, orMask uint16) {
+	if sh == nil {
+		return
+	}
+	for _, g := range sh.groups {
+		if g.function != 3 {
+			continue
+		}
+		g.mu.Lock()
+		if address >= g.address && address < g.address+g.quantity {
+			g.writes++
+		}
+		maskRegister(g.data, g.address, address, andMask, orMask)
+		g.mu.Unlock()
+	}
+}
+
+// startPolling start a poller for every poll group of every slave
+func (s *Forwarder) startPolling() {
+	s.clientsMux.RLock()
+	defer s.clientsMux.RUnlock()
+	for slaveID, client := range s.clients {
+		if client.shadow == nil {
+			continue
+		}
+		for _, g := range client.shadow.groups {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.pollLoop(slaveID, client, g)
+			}()
+		}
+	}
+}
+
+// pollLoop poll one group until the forwarder stops
+func (s *Forwarder) pollLoop(slaveID byte, client *modbusClient, g *pollGroup) {
+	delay := g.offset
+	for {
+		g.mu.Lock()
+		g.next = s.clock.Now().Add(delay)
+		g.mu.Unlock()
+
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.clock.After(delay):
+		}
+		s.poll(slaveID, client, g)
+		delay = g.nextDelay()
+	}
+}
+
+// poll read one group from the slave into the shadow store, keeping the
+// last values on failure; values read while a write to the range completed
+// may predate it and are dropped, the write already updated the store
+func (s *Forwarder) poll(slaveID byte, client *modbusClient, g *pollGroup) {
+	if client.disabled.Load() {
+		return
+	}
+	g.mu.Lock()
+	writes := g.writes
+	g.mu.Unlock()
+	data, err := s.readDirect(client, slaveID, g.function, g.address, g.quantity)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.err = err
+	if err != nil {
+		s.logger.Debugf("failed to poll slave %d (function %d, addr %d, count %d): %v", slaveID, g.function, g.address, g.quantity, err)
+		return
+	}
+	if g.writes != writes {
+		s.logger.Debugf("dropped poll of slave %d (function %d, addr %d, count %d), the range was written meanwhile", slaveID, g.function, g.address, g.quantity)
+		return
+	}
+	g.data = data
+	g.updated = s.clock.Now()
+}
+
+// pollSchedule effective schedule of one poll group
+type pollSchedule struct {
+	SlaveID   int        `json:"slave_id"`
+	Type      string     `json:"type"`
+	Address   int        `json:"address"`
+	Quantity  int        `json:"quantity"`
+	Interval  int64      `json:"interval_ms"`
+	Offset    int64      `json:"offset_ms"`
+	Jitter    int64      `json:"jitter_ms"`
+	NextPoll  time.Time  `json:"next_poll"`
+	LastPoll  *time.Time `json:"last_poll,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// schedule take a snapshot of all poll groups, sorted by slave ID
+func (s *Forwarder) schedule() []pollSchedule {
+	schedule := []pollSchedule{}
+	s.clientsMux.RLock()
+	for slaveID, client := range s.clients {
+		if client.shadow == nil {
+			continue
+		}
+		for _, g := range client.shadow.groups {
+			entry := pollSchedule{
+				SlaveID:  int(slaveID),
+				Type:     g.typ,
+				Address:  g.address,
+				Quantity: g.quantity,
+				Interval: g.interval.Milliseconds(),
+				Offset:   g.offset.Milliseconds(),
+				Jitter:   g.jitter.Milliseconds(),
+			}
+			g.mu.Lock()
+			entry.NextPoll = g.next
+			if !g.updated.IsZero() {
+				updated := g.updated
+				entry.LastPoll = &updated
+			}
+			if g.err != nil {
+				entry.LastError = g.err.Error()
+			}
+			g.mu.Unlock()
+			schedule = append(schedule, entry)
+		}
+	}
+	s.clientsMux.RUnlock()
+
+	sort.SliceStable(schedule, func(i, j int) bool {
+		return schedule[i].SlaveID < schedule[j].SlaveID
+	})
+	return schedule
+}
+
+// handleSchedule GET /api/schedule, effective poll schedule
+func (s *Forwarder) handleSchedule(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.schedule())
+}
+
+// pollValue one polled value with its quality
+type pollValue struct {
+	SlaveID   int        `json:"slave_id"`
+	Type      string     `json:"type"`
+	Address   int        `json:"address"`
+	Value     *int       `json:"value"` // null until read
+	Quality   string     `json:"quality"`
+	Timestamp *time.Time `json:"timestamp,omitempty"` // time of the poll the value was read in
+}
+
+// values take a snapshot of the polled values of slaveID, or of all slaves
+// when slaveID is negative
+func (s *Forwarder) values(slaveID int) []pollValue {
+	values := []pollValue{}
+	now := s.clock.Now()
+	s.clientsMux.RLock()
+	for id, client := range s.clients {
+		if client.shadow == nil || (slaveID >= 0 && int(id) != slaveID) {
+			continue
+		}
+		for _, g := range client.shadow.groups {
+			g.mu.Lock()
+			quality := g.quality(now)
+			for i := 0; i < g.quantity; i++ {
+				v := pollValue{SlaveID: int(id), Type: g.typ, Address: g.address + i, Quality: quality}
+				if g.data != nil {
+					var value int
+					if g.function == 1 || g.function == 2 {
+						if i/8 < len(g.data) {
+							value = int(g.data[i/8]>>(i%8)) & 1
+						}
+					} else if i*2+1 < len(g.data) {
+						value = int(g.data[i*2])<<8 | int(g.data[i*2+1])
+					}
+					updated := g.updated
+					v.Value, v.Timestamp = &value, &updated
+				}
+				values = append(values, v)
+			}
+			g.mu.Unlock()
+		}
+	}
+	s.clientsMux.RUnlock()
+
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].SlaveID < values[j].SlaveID
+	})
+	return values
+}
+
+// handleValues GET /api/values[?slave_id=N], polled values with quality
+func (s *Forwarder) handleValues(w http.ResponseWriter, r *http.Request) {
+	slaveID := -1
+	if param := r.URL.Query().Get("slave_id"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil || id < 0 || id > 255 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid slave_id %q", param)})
+			return
+		}
+		slaveID = id
+	}
+	writeJSON(w, http.StatusOK, s.values(slaveID))
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// dumpSignals signals that trigger a runtime state dump
+var dumpSignals = []os.Signal{syscall.SIGUSR1}
+
+// debugSignals signals that toggle debug logging
+var debugSignals = []os.Signal{syscall.SIGUSR2}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// dumpSignals signals that trigger a runtime state dump, none on windows
+var dumpSignals = []os.Signal{}
+
+// debugSignals signals that toggle debug logging, none on windows
+var debugSignals = []os.Signal{}
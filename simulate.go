@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// newSimulation create the simulated slave answering while slaveID is
+// unreachable, seeded from the configured snapshot or the last scheduled
+// snapshot; without a snapshot all coils and registers are zero
+func newSimulation(slaveID byte, config Server) (*SimSlave, error) {
+	sim := NewSimSlave()
+	name := config.SimulateWhenDown.Snapshot
+	if name == "" && config.Snapshots != nil {
+		if files, err := snapshotFiles(config.Snapshots.Dir, slaveID); err == nil && len(files) > 0 {
+			name = files[len(files)-1]
+		}
+	}
+	if name == "" {
+		return sim, nil
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("simulate_when_down: %v", err)
+	}
+	defer file.Close()
+	snap, err := readSnapshot(file)
+	if err != nil {
+		return nil, fmt.Errorf("simulate_when_down: %s: %v", name, err)
+	}
+	for _, v := range snap.Values {
+		if v.Address < 0 || v.Address > 0xFFFF {
+			return nil, fmt.Errorf("simulate_when_down: %s: invalid address %d", name, v.Address)
+		}
+		address := uint16(v.Address)
+		switch v.Type {
+		case "holding":
+			sim.SetHolding(address, uint16(v.Value))
+		case "input":
+			sim.SetInput(address, uint16(v.Value))
+		case "coils":
+			sim.SetCoils(address, v.Value != 0)
+		case "discrete":
+			sim.SetDiscrete(address, v.Value != 0)
+		}
+	}
+	return sim, nil
+}
+
+// simulate answer frame from the simulated slave of slaveID when it has one
+// and the slave is down or failed is set; writes only change the simulated
+// slave. Return false when the request has to go to the slave
+func (s *Forwarder) simulate(frame mbserver.Framer, slaveID byte, failed bool) ([]byte, *mbserver.Exception, bool) {
+	s.clientsMux.RLock()
+	client := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	if client == nil || client.sim == nil || client.disabled.Load() {
+		return nil, nil, false
+	}
+	if !failed {
+		client.mu.Lock()
+		failed = client.lastError != nil
+		client.mu.Unlock()
+		if !failed {
+			return nil, nil, false
+		}
+	}
+
+	function := frame.GetFunction()
+	if function == 11 || function == 12 {
+		// answered by the forwarder
+		return nil, nil, false
+	}
+	s.logger.Debugf("simulated function %d of slave %d", function, slaveID)
+	switch function {
+	case 1, 2, 3, 4, 5, 6, 15, 16, 23:
+	default:
+		return nil, &mbserver.IllegalFunction, true
+	}
+	data, exception := client.sim.handle(function, frame.GetData())
+	if exception == mbserver.Success {
+		return data, &mbserver.Success, true
+	}
+	return nil, &exception, true
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"encoding/binary"
+	"sync"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// SimSlave simulated Modbus slave answering from in-memory coils, registers
+// and file records, used by simulate_when_down and by the test harness
+type SimSlave struct {
+	mu       sync.Mutex
+	coils    [0x10000]bool
+	discrete [0x10000]bool
+	holding  [0x10000]uint16
+	input    [0x10000]uint16
+	files    map[uint16][]uint16 // file number -> records, created on first write
+	status   byte                // exception status outputs, FC 7
+}
+
+// simServerID server ID and device identification of the simulated slave
+const simServerID = "SimSlave"
+
+// NewSimSlave create a simulated slave with all coils and registers zero
+func NewSimSlave() *SimSlave {
+	return &SimSlave{files: make(map[uint16][]uint16)}
+}
+
+// SetHolding set holding registers starting at address
+func (m *SimSlave) SetHolding(address uint16, values ...uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copy(m.holding[address:], values)
+}
+
+// SetInput set input registers starting at address
+func (m *SimSlave) SetInput(address uint16, values ...uint16) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copy(m.input[address:], values)
+}
+
+// SetCoils set coils starting at address
+func (m *SimSlave) SetCoils(address uint16, values ...bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copy(m.coils[address:], values)
+}
+
+// SetDiscrete set discrete inputs starting at address
+func (m *SimSlave) SetDiscrete(address uint16, values ...bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	copy(m.discrete[address:], values)
+}
+
+// handle run a request PDU against the coils and registers
+func (m *SimSlave) handle(function uint8, data []byte) ([]byte, mbserver.Exception) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.execute(function, data)
+}
+
+// execute run a request PDU against the coils and registers, caller must
+// hold the mutex
+func (m *SimSlave) execute(function uint8, data []byte) ([]byte, mbserver.Exception) {
+	switch function {
+	case 7:
+		return []byte{m.status}, mbserver.Success
+	case 17:
+		response := append([]byte{byte(len(simServerID) + 1)}, simServerID...)
+		return append(response, 0xFF), mbserver.Success
+	case 20:
+		return m.readFileRecord(data)
+	case 21:
+		return m.writeFileRecord(data)
+	case 24:
+		return m.readFIFOQueue(data)
+	case 43:
+		return m.readDeviceIdentification(data)
+	}
+	if len(data) < 4 {
+		return nil, mbserver.IllegalDataValue
+	}
+	address := int(binary.BigEndian.Uint16(data))
+	quantity := int(binary.BigEndian.Uint16(data[2:]))
+
+	switch function {
+	case 1, 2:
+		if quantity < 1 || quantity > 2000 || address+quantity > 0x10000 {
+			return nil, mbserver.IllegalDataAddress
+		}
+		bits := m.coils[address : address+quantity]
+		if function == 2 {
+			bits = m.discrete[address : address+quantity]
+		}
+		response := make([]byte, 1+(quantity+7)/8)
+		response[0] = byte(len(response) - 1)
+		for i, bit := range bits {
+			if bit {
+				response[1+i/8] |= 1 << (i % 8)
+			}
+		}
+		return response, mbserver.Success
+	case 3, 4:
+		if quantity < 1 || quantity > 125 || address+quantity > 0x10000 {
+			return nil, mbserver.IllegalDataAddress
+		}
+		registers := m.holding[address : address+quantity]
+		if function == 4 {
+			registers = m.input[address : address+quantity]
+		}
+		response := make([]byte, 1+2*quantity)
+		response[0] = byte(2 * quantity)
+		for i, value := range registers {
+			binary.BigEndian.PutUint16(response[1+2*i:], value)
+		}
+		return response, mbserver.Success
+	case 5:
+		if quantity != 0 && quantity != 0xFF00 {
+			return nil, mbserver.IllegalDataValue
+		}
+		m.coils[address] = quantity == 0xFF00
+		return data[:4], mbserver.Success
+	case 6:
+		m.holding[address] = uint16(quantity)
+		return data[:4], mbserver.Success
+	case 15:
+		if len(data) < 5+(quantity+7)/8 || address+quantity > 0x10000 {
+			return nil, mbserver.IllegalDataAddress
+		}
+		for i := 0; i < quantity; i++ {
+			m.coils[address+i] = data[5+i/8]&(1<<(i%8)) != 0
+		}
+		return data[:4], mbserver.Success
+	case 16:
+		if len(data) < 5+2*quantity || address+quantity > 0x10000 {
+			return nil, mbserver.IllegalDataAddress
+		}
+		for i := 0; i < quantity; i++ {
+			m.holding[address+i] = binary.BigEndian.Uint16(data[5+2*i:])
+		}
+		return data[:4], mbserver.Success
+	case 23:
+		if len(data) < 9 {
+			return nil, mbserver.IllegalDataValue
+		}
+		writeAddress := int(binary.BigEndian.Uint16(data[4:]))
+		writeQuantity := int(binary.BigEndian.Uint16(data[6:]))
+		if quantity < 1 || quantity > 125 || address+quantity > 0x10000 ||
+			len(data) < 9+2*writeQuantity || writeAddress+writeQuantity > 0x10000 {
+			return nil, mbserver.IllegalDataAddress
+		}
+		// the write is performed before the read
+		for i := 0; i < writeQuantity; i++ {
+			m.holding[writeAddress+i] = binary.BigEndian.Uint16(data[9+2*i:])
+		}
+		response := make([]byte, 1+2*quantity)
+		response[0] = byte(2 * quantity)
+		for i, value := range m.holding[address : address+quantity] {
+			binary.BigEndian.PutUint16(response[1+2*i:], value)
+		}
+		return response, mbserver.Success
+	case 8:
+		switch address {
+		case 0x00, 0x01, 0x0A:
+			// return query data, restart communications, clear counters
+			return data, mbserver.Success
+		case 0x0B, 0x0C, 0x0D, 0x0E, 0x0F, 0x10, 0x11, 0x12:
+			// the counters stay zero
+			return []byte{data[0], data[1], 0, 0}, mbserver.Success
+		}
+		return nil, mbserver.IllegalFunction
+	case 22:
+		if len(data) < 6 {
+			return nil, mbserver.IllegalDataValue
+		}
+		andMask, orMask := uint16(quantity), binary.BigEndian.Uint16(data[4:])
+		m.holding[address] = m.holding[address]&andMask | orMask&^andMask
+		return data[:6], mbserver.Success
+	}
+	return nil, mbserver.IllegalFunction
+}
+
+// simFileRecords records of a simulated file, numbers 0-9999
+const simFileRecords = 10000
+
+// fileRecordGroups split the sub-requests of a read (size 7) or write file
+// record request into file number, record number and record length
+func fileRecordGroups(data []byte, write bool) (groups [][3]int, ok bool) {
+	if len(data) < 1 || int(data[0]) != len(data)-1 {
+		return nil, false
+	}
+	for rest := data[1:]; len(rest) > 0; {
+		if len(rest) < 7 || rest[0] != 6 {
+			return nil, false
+		}
+		group := [3]int{int(binary.BigEndian.Uint16(rest[1:])), int(binary.BigEndian.Uint16(rest[3:])), int(binary.BigEndian.Uint16(rest[5:]))}
+		size := 7
+		if write {
+			size += 2 * group[2]
+		}
+		if len(rest) < size {
+			return nil, false
+		}
+		groups = append(groups, group)
+		rest = rest[size:]
+	}
+	return groups, len(groups) > 0
+}
+
+// readFileRecord answer a read file record request, FC 20
+func (m *SimSlave) readFileRecord(data []byte) ([]byte, mbserver.Exception) {
+	groups, ok := fileRecordGroups(data, false)
+	if !ok {
+		return nil, mbserver.IllegalDataValue
+	}
+	response := []byte{0}
+	for _, g := range groups {
+		file, record, length := g[0], g[1], g[2]
+		if file == 0 || record+length > simFileRecords {
+			return nil, mbserver.IllegalDataAddress
+		}
+		response = append(response, byte(1+2*length), 6)
+		records := m.files[uint16(file)]
+		for i := record; i < record+length; i++ {
+			var value uint16
+			if records != nil {
+				value = records[i]
+			}
+			response = binary.BigEndian.AppendUint16(response, value)
+		}
+	}
+	if len(response) > 0xF6 {
+		return nil, mbserver.IllegalDataValue
+	}
+	response[0] = byte(len(response) - 1)
+	return response, mbserver.Success
+}
+
+// writeFileRecord answer a write file record request, FC 21, the response
+// echoes the request
+func (m *SimSlave) writeFileRecord(data []byte) ([]byte, mbserver.Exception) {
+	groups, ok := fileRecordGroups(data, true)
+	if !ok {
+		return nil, mbserver.IllegalDataValue
+	}
+	for _, g := range groups {
+		if g[0] == 0 || g[1]+g[2] > simFileRecords {
+			return nil, mbserver.IllegalDataAddress
+		}
+	}
+	rest := data[1:]
+	for _, g := range groups {
+		file, record, length := uint16(g[0]), g[1], g[2]
+		if m.files[file] == nil {
+			m.files[file] = make([]uint16, simFileRecords)
+		}
+		for i := 0; i < length; i++ {
+			m.files[file][record+i] = binary.BigEndian.Uint16(rest[7+2*i:])
+		}
+		rest = rest[7+2*length:]
+	}
+	return data, mbserver.Success
+}
+
+// readFIFOQueue answer a read FIFO queue request, FC 24: the holding
+// register at the pointer address is the FIFO count, the queued registers
+// follow it
+func (m *SimSlave) readFIFOQueue(data []byte) ([]byte, mbserver.Exception) {
+	if len(data) != 2 {
+		return nil, mbserver.IllegalDataValue
+	}
+	address := int(binary.BigEndian.Uint16(data))
+	count := int(m.holding[address])
+	if count > 31 {
+		return nil, mbserver.IllegalDataValue
+	}
+	if address+1+count > 0x10000 {
+		return nil, mbserver.IllegalDataAddress
+	}
+	response := binary.BigEndian.AppendUint16(nil, uint16(2+2*count))
+	response = binary.BigEndian.AppendUint16(response, uint16(count))
+	for _, value := range m.holding[address+1 : address+1+count] {
+		response = binary.BigEndian.AppendUint16(response, value)
+	}
+	return response, mbserver.Success
+}
+
+// readDeviceIdentification answer a read device identification request,
+// FC 43 with MEI type 14, with the basic objects: vendor name, product code
+// and revision
+func (m *SimSlave) readDeviceIdentification(data []byte) ([]byte, mbserver.Exception) {
+	if len(data) != 3 || data[0] != 0x0E {
+		return nil, mbserver.IllegalFunction
+	}
+	objects := []string{"mb-forwarder", simServerID, "1.0"}
+	code, first := data[1], int(data[2])
+	last := len(objects) - 1
+	switch {
+	case code < 1 || code > 4:
+		return nil, mbserver.IllegalDataValue
+	case first > last:
+		return nil, mbserver.IllegalDataAddress
+	case code == 4:
+		// one specific object
+		last = first
+	}
+	response := []byte{0x0E, code, 0x01, 0x00, 0x00, byte(last - first + 1)}
+	for id := first; id <= last; id++ {
+		response = append(response, byte(id), byte(len(objects[id])))
+		response = append(response, objects[id]...)
+	}
+	return response, mbserver.Success
+}
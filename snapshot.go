@@ -0,0 +1,601 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// snapshot polled values of one slave
+type snapshot struct {
+	SlaveID int             `json:"slave_id"`
+	Time    time.Time       `json:"time"`
+	Values  []snapshotValue `json:"values"`
+}
+
+// snapshotValue one register or bit of a snapshot
+type snapshotValue struct {
+	Type    string `json:"type"` // "holding", "input", "coils" or "discrete"
+	Address int    `json:"address"`
+	Value   int    `json:"value"`
+}
+
+// snapshotWrite one write restoring a run of consecutive values
+type snapshotWrite struct {
+	Type     string `json:"type"` // "holding" or "coils"
+	Address  int    `json:"address"`
+	Quantity int    `json:"quantity"`
+	Error    string `json:"error,omitempty"`
+	values   []int
+}
+
+// rangeFilter optional filter on the type and address range of values
+type rangeFilter struct {
+	typ      string // empty for all types
+	address  int
+	quantity int // 0 for all addresses
+}
+
+// match report whether the value is within the filter
+func (f rangeFilter) match(typ string, address int) bool {
+	return (f.typ == "" || f.typ == typ) &&
+		(f.quantity == 0 || (address >= f.address && address < f.address+f.quantity))
+}
+
+// parseRangeFilter parse the type, address and quantity query parameters
+func parseRangeFilter(q url.Values) (rangeFilter, error) {
+	var f rangeFilter
+	f.typ = q.Get("type")
+	if f.typ != "" {
+		if _, ok := pollFunctions[f.typ]; !ok {
+			return f, fmt.Errorf("invalid type %s", f.typ)
+		}
+	}
+	for name, v := range map[string]*int{"address": &f.address, "quantity": &f.quantity} {
+		if param := q.Get(name); param != "" {
+			n, err := strconv.Atoi(param)
+			if err != nil || n < 0 || n > 0x10000 {
+				return f, fmt.Errorf("invalid %s %q", name, param)
+			}
+			*v = n
+		}
+	}
+	return f, nil
+}
+
+// takeSnapshot snapshot the polled values of slaveID within filter, values
+// never read are left out
+func (s *Forwarder) takeSnapshot(slaveID byte, filter rangeFilter) snapshot {
+	snap := snapshot{SlaveID: int(slaveID), Time: s.clock.Now(), Values: []snapshotValue{}}
+	for _, v := range s.values(int(slaveID)) {
+		if v.Value != nil && filter.match(v.Type, v.Address) {
+			snap.Values = append(snap.Values, snapshotValue{Type: v.Type, Address: v.Address, Value: *v.Value})
+		}
+	}
+	return snap
+}
+
+// restorePlan group the writable values within filter into writes of
+// consecutive values, at most limit registers or 1968 coils each
+func restorePlan(values []snapshotValue, filter rangeFilter, limit int) []snapshotWrite {
+	sorted := make([]snapshotValue, 0, len(values))
+	for _, v := range values {
+		if (v.Type == "holding" || v.Type == "coils") && filter.match(v.Type, v.Address) {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type > sorted[j].Type // holding registers first
+		}
+		return sorted[i].Address < sorted[j].Address
+	})
+
+	var plan []snapshotWrite
+	for _, v := range sorted {
+		max := limit
+		if v.Type == "coils" {
+			max = 1968
+		}
+		if n := len(plan); n > 0 {
+			w := &plan[n-1]
+			if w.Type == v.Type && w.Address+w.Quantity == v.Address && w.Quantity < max {
+				w.Quantity++
+				w.values = append(w.values, v.Value)
+				continue
+			}
+			if w.Type == v.Type && w.Address+w.Quantity > v.Address {
+				continue // duplicate address, the first value wins
+			}
+		}
+		plan = append(plan, snapshotWrite{Type: v.Type, Address: v.Address, Quantity: 1, values: []int{v.Value}})
+	}
+	return plan
+}
+
+// restore execute the writes of plan on slaveID through the upstream
+// request pipeline as clientName, recording the error of each write
+func (s *Forwarder) restore(slaveID byte, plan []snapshotWrite, clientName string) (failed int) {
+	for i := range plan {
+		w := &plan[i]
+		data := make([]byte, 5)
+		binary.BigEndian.PutUint16(data, uint16(w.Address))
+		binary.BigEndian.PutUint16(data[2:], uint16(w.Quantity))
+		function := uint8(16)
+		if w.Type == "coils" {
+			function = 15
+			bits := make([]byte, (w.Quantity+7)/8)
+			for j, v := range w.values {
+				if v != 0 {
+					bits[j/8] |= 1 << (j % 8)
+				}
+			}
+			data = append(data, bits...)
+		} else {
+			for _, v := range w.values {
+				data = binary.BigEndian.AppendUint16(data, uint16(v))
+			}
+		}
+		data[4] = byte(len(data) - 5)
+
+		frame := &mbserver.TCPFrame{Device: slaveID, Function: function, Data: data}
+		response := s.handle(frame, clientName, nil)
+		if response.GetFunction()&0x80 != 0 {
+			w.Error = "exception " + exceptionName(mbserver.Exception(response.GetData()[0]))
+			failed++
+		}
+	}
+	return failed
+}
+
+// startSnapshots start writing the scheduled snapshots of every slave
+func (s *Forwarder) startSnapshots() {
+	for slaveID, server := range s.config.Servers {
+		if server.Snapshots == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			interval := time.Duration(server.Snapshots.Interval) * time.Second
+			for {
+				select {
+				case <-s.ctx.Done():
+					return
+				case <-s.clock.After(interval):
+				}
+				if err := s.scheduledSnapshot(slaveID, server.Snapshots); err != nil {
+					s.logger.Warnf("failed to snapshot slave %d: %v", slaveID, err)
+				}
+			}
+		}()
+	}
+}
+
+// scheduledSnapshot read the ranges of c from the slave, write them to a
+// timestamped file and remove the oldest files beyond c.Keep; nothing is
+// written unless every range was read
+func (s *Forwarder) scheduledSnapshot(slaveID byte, c *SnapshotSchedule) error {
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		return err
+	}
+	if client.disabled.Load() {
+		return fmt.Errorf("slave is disabled")
+	}
+	// a replaced device must not overwrite the last snapshot before its
+	// setpoints are restored, only snapshot slaves known to be up
+	client.mu.Lock()
+	down := client.lastError != nil
+	client.mu.Unlock()
+	if down {
+		return fmt.Errorf("slave is down")
+	}
+
+	snap := snapshot{SlaveID: int(slaveID), Time: s.clock.Now(), Values: []snapshotValue{}}
+	for _, r := range c.Ranges {
+		function := pollFunctions[r.Type]
+		results, err := s.readDirect(client, slaveID, function, r.Address, r.Quantity)
+		if err != nil {
+			return fmt.Errorf("%s %d-%d: %v", r.Type, r.Address, r.Address+r.Quantity-1, err)
+		}
+		values := unpackRegisters(results)
+		if function == 1 || function == 2 {
+			values = unpackBits(results, r.Quantity)
+		}
+		for i, v := range values {
+			snap.Values = append(snap.Values, snapshotValue{Type: r.Type, Address: r.Address + i, Value: int(v)})
+		}
+	}
+
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("slave%d-", slaveID)
+	name := filepath.Join(c.Dir, prefix+snap.Time.UTC().Format("20060102T150405Z")+"."+c.Format)
+	var buf bytes.Buffer
+	writeSnapshot(&buf, snap, c.Format)
+	// write then rename so that a snapshot file is never partial
+	if err := os.WriteFile(name+".tmp", buf.Bytes(), 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	s.logger.Debugf("wrote snapshot of slave %d to %s", slaveID, name)
+
+	files, err := snapshotFiles(c.Dir, slaveID)
+	if err != nil {
+		return err
+	}
+	for len(files) > c.Keep {
+		if err := os.Remove(files[0]); err != nil {
+			return err
+		}
+		files = files[1:]
+	}
+	return nil
+}
+
+// restoreSetpoints write the configured setpoints of the last scheduled
+// snapshot to a slave that was down for at least min_downtime
+func (s *Forwarder) restoreSetpoints(slaveID byte, downtime time.Duration) {
+	server, ok := s.config.Servers[slaveID]
+	if !ok || server.RestoreSetpoints == nil || server.Snapshots == nil ||
+		downtime < time.Duration(server.RestoreSetpoints.MinDowntime)*time.Second {
+		return
+	}
+	// pick the snapshot now, before a new one can be written
+	files, err := snapshotFiles(server.Snapshots.Dir, slaveID)
+	if err != nil || len(files) == 0 {
+		s.logger.Errorf("slave %d was down for %s, no snapshot to restore setpoints from: %v", slaveID, downtime.Round(time.Second), err)
+		return
+	}
+	name := files[len(files)-1]
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		file, err := os.Open(name)
+		if err != nil {
+			s.logger.Errorf("failed to restore setpoints of slave %d: %v", slaveID, err)
+			return
+		}
+		snap, err := readSnapshot(file)
+		file.Close()
+		if err != nil {
+			s.logger.Errorf("failed to restore setpoints of slave %d from %s: %v", slaveID, name, err)
+			return
+		}
+
+		var plan []snapshotWrite
+		for _, r := range server.RestoreSetpoints.Ranges {
+			filter := rangeFilter{typ: r.Type, address: r.Address, quantity: r.Quantity}
+			plan = append(plan, restorePlan(snap.Values, filter, server.MaxWriteRegisters)...)
+		}
+		s.logger.Infof("slave %d was down for %s, restoring setpoints from %s with %d writes",
+			slaveID, downtime.Round(time.Second), name, len(plan))
+		if failed := s.restore(slaveID, plan, "restore"); failed > 0 {
+			for _, w := range plan {
+				if w.Error != "" {
+					s.logger.Errorf("failed to restore %s %d-%d of slave %d: %s", w.Type, w.Address, w.Address+w.Quantity-1, slaveID, w.Error)
+				}
+			}
+		}
+	}()
+}
+
+// snapshotFiles return the snapshot files of slaveID in dir, oldest first
+func snapshotFiles(dir string, slaveID byte) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := fmt.Sprintf("slave%d-", slaveID)
+	var files []string
+	for _, e := range entries {
+		name := e.Name()
+		if !e.IsDir() && strings.HasPrefix(name, prefix) &&
+			(strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".csv")) {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+	// the timestamps sort chronologically, os.ReadDir sorts by name
+	return files, nil
+}
+
+// writeSnapshot encode snap as JSON or CSV
+func writeSnapshot(w io.Writer, snap snapshot, format string) error {
+	if format != "csv" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(snap)
+	}
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"type", "address", "value"})
+	for _, v := range snap.Values {
+		cw.Write([]string{v.Type, strconv.Itoa(v.Address), strconv.Itoa(v.Value)})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readSnapshot decode a JSON or CSV snapshot
+func readSnapshot(r io.Reader) (snapshot, error) {
+	var snap snapshot
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return snap, fmt.Errorf("failed to read snapshot: %v", err)
+	}
+	content = bytes.TrimSpace(content)
+	if bytes.HasPrefix(content, []byte("{")) {
+		if err := json.Unmarshal(content, &snap); err != nil {
+			return snap, fmt.Errorf("invalid JSON snapshot: %v", err)
+		}
+		return snap, nil
+	}
+
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return snap, fmt.Errorf("invalid CSV snapshot: %v", err)
+	}
+	for i, record := range records {
+		if len(record) != 3 {
+			return snap, fmt.Errorf("line %d: expected type, address and value", i+1)
+		}
+		if i == 0 && record[0] == "type" {
+			continue
+		}
+		address, err1 := strconv.Atoi(record[1])
+		value, err2 := strconv.Atoi(record[2])
+		if _, ok := pollFunctions[record[0]]; !ok || err1 != nil || err2 != nil {
+			return snap, fmt.Errorf("line %d: invalid value %v", i+1, record)
+		}
+		snap.Values = append(snap.Values, snapshotValue{Type: record[0], Address: address, Value: value})
+	}
+	return snap, nil
+}
+
+// snapshotSlave parse the slave_id query parameter of a configured slave
+func (s *Forwarder) snapshotSlave(q url.Values) (byte, error) {
+	id, err := strconv.Atoi(q.Get("slave_id"))
+	if err != nil || checkUnitID(id) != nil {
+		return 0, fmt.Errorf("invalid slave_id %q", q.Get("slave_id"))
+	}
+	if _, err := s.getClient(byte(id)); err != nil {
+		return 0, err
+	}
+	return byte(id), nil
+}
+
+// handleSnapshotExport GET /api/snapshot?slave_id=N[&format=csv][&type=&address=&quantity=],
+// polled values of a slave
+func (s *Forwarder) handleSnapshotExport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	slaveID, err := s.snapshotSlave(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	filter, err := parseRangeFilter(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	snap := s.takeSnapshot(slaveID, filter)
+	if q.Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		writeSnapshot(w, snap, "csv")
+		return
+	}
+	writeJSON(w, http.StatusOK, snap)
+}
+
+// handleSnapshotImport POST /api/snapshot?slave_id=N[&type=&address=&quantity=][&confirm=true],
+// write the holding registers and coils of a JSON or CSV snapshot to a
+// slave; without confirm only the planned writes are returned
+func (s *Forwarder) handleSnapshotImport(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	slaveID, err := s.snapshotSlave(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	filter, err := parseRangeFilter(q)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	snap, err := readSnapshot(http.MaxBytesReader(w, r.Body, 16<<20))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	plan := restorePlan(snap.Values, filter, s.config.Servers[slaveID].MaxWriteRegisters)
+	result := struct {
+		SlaveID   int             `json:"slave_id"`
+		Confirmed bool            `json:"confirmed"`
+		Failed    int             `json:"failed"`
+		Writes    []snapshotWrite `json:"writes"`
+	}{SlaveID: int(slaveID), Confirmed: q.Get("confirm") == "true", Writes: plan}
+	if result.Confirmed {
+		s.logger.Infof("restoring snapshot to slave %d with %d writes by %s", slaveID, len(plan), adminClient(r))
+		result.Failed = s.restore(slaveID, plan, adminClient(r))
+	}
+	if result.Writes == nil {
+		result.Writes = []snapshotWrite{}
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// adminRequest send a request to the admin API with the given credentials
+func adminRequest(method, url string, body []byte, token, user string) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if username, password, ok := strings.Cut(user, ":"); ok {
+		req.SetBasicAuth(username, password)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/octet-stream")
+	}
+	return http.DefaultClient.Do(req)
+}
+
+// runSnapshot export or import a snapshot through the admin API of a
+// running forwarder, return the exit code
+func runSnapshot(args []string) int {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		fmt.Fprintf(os.Stderr, "usage: %s snapshot export|import -admin URL -slave N [flags] [file]\n", os.Args[0])
+		return 2
+	}
+	command := args[0]
+	fs := flag.NewFlagSet("snapshot "+command, flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:8080", "admin API URL of the forwarder")
+	slave := fs.Int("slave", 0, "slave ID")
+	format := fs.String("format", "json", "export format, json or csv")
+	typ := fs.String("type", "", "only values of this type: holding, input, coils or discrete")
+	address := fs.Int("address", 0, "start address of the values, with -quantity")
+	quantity := fs.Int("quantity", 0, "only this many addresses from -address")
+	yes := fs.Bool("yes", false, "import without asking for confirmation")
+	token := fs.String("token", os.Getenv("MBF_ADMIN_TOKEN"), "admin API bearer token, default $MBF_ADMIN_TOKEN")
+	user := fs.String("user", "", "admin API basic auth credentials as user:password")
+	fs.Parse(args[1:])
+	if *slave < 1 || *slave > 255 || fs.NArg() > 1 {
+		fs.Usage()
+		return 2
+	}
+
+	q := url.Values{"slave_id": {strconv.Itoa(*slave)}}
+	if *typ != "" {
+		q.Set("type", *typ)
+	}
+	if *quantity > 0 {
+		q.Set("address", strconv.Itoa(*address))
+		q.Set("quantity", strconv.Itoa(*quantity))
+	}
+	endpoint := strings.TrimSuffix(*admin, "/") + "/api/snapshot?"
+
+	if command == "export" {
+		q.Set("format", *format)
+		resp, err := adminRequest("GET", endpoint+q.Encode(), nil, *token, *user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+			return 1
+		}
+		defer resp.Body.Close()
+		out := io.Writer(os.Stdout)
+		if fs.NArg() == 1 {
+			file, err := os.Create(fs.Arg(0))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "export failed: %v\n", err)
+				return 1
+			}
+			defer file.Close()
+			out = file
+		}
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Fprintf(os.Stderr, "export failed: %s %s\n", resp.Status, bytes.TrimSpace(body))
+			return 1
+		}
+		io.Copy(out, resp.Body)
+		return 0
+	}
+
+	in := io.Reader(os.Stdin)
+	if fs.NArg() == 1 {
+		file, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+			return 1
+		}
+		defer file.Close()
+		in = file
+	} else if !*yes {
+		fmt.Fprintln(os.Stderr, "import from stdin requires -yes")
+		return 2
+	}
+	body, err := io.ReadAll(in)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+		return 1
+	}
+
+	// show the planned writes, then confirm
+	var result struct {
+		Confirmed bool            `json:"confirmed"`
+		Failed    int             `json:"failed"`
+		Writes    []snapshotWrite `json:"writes"`
+		Error     string          `json:"error"`
+	}
+	for _, confirm := range []bool{false, true} {
+		if confirm {
+			q.Set("confirm", "true")
+		}
+		resp, err := adminRequest("POST", endpoint+q.Encode(), body, *token, *user)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "import failed: %v\n", err)
+			return 1
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "import failed: %s %s\n", resp.Status, result.Error)
+			return 1
+		}
+		if confirm {
+			break
+		}
+
+		fmt.Printf("%d writes to slave %d:\n", len(result.Writes), *slave)
+		for _, w := range result.Writes {
+			fmt.Printf("  %s %d-%d\n", w.Type, w.Address, w.Address+w.Quantity-1)
+		}
+		if len(result.Writes) == 0 {
+			return 0
+		}
+		if !*yes {
+			fmt.Print("write these values to the device? [y/N] ")
+			answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+			if a := strings.TrimSpace(strings.ToLower(answer)); a != "y" && a != "yes" {
+				fmt.Println("aborted")
+				return 1
+			}
+		}
+	}
+
+	for _, w := range result.Writes {
+		if w.Error != "" {
+			fmt.Printf("%s %d-%d failed: %s\n", w.Type, w.Address, w.Address+w.Quantity-1, w.Error)
+		}
+	}
+	fmt.Printf("%d writes, %d failed\n", len(result.Writes), result.Failed)
+	if result.Failed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/goburrow/serial"
+	"github.com/gorilla/websocket"
+	"github.com/tbrandon/mbserver"
+)
+
+// wsHub fan out messages, e.g. decoded transactions, to WebSocket subscribers
+type wsHub struct {
+	mu          sync.Mutex
+	subscribers map[chan []byte]struct{}
+}
+
+func newWSHub() *wsHub {
+	return &wsHub{subscribers: make(map[chan []byte]struct{})}
+}
+
+// subscribe register a subscriber, call the returned function to unregister
+func (h *wsHub) subscribe() (chan []byte, func()) {
+	ch := make(chan []byte, 64)
+	h.mu.Lock()
+	h.subscribers[ch] = struct{}{}
+	h.mu.Unlock()
+	return ch, func() {
+		h.mu.Lock()
+		delete(h.subscribers, ch)
+		h.mu.Unlock()
+	}
+}
+
+// idle report whether nobody is subscribed
+func (h *wsHub) idle() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers) == 0
+}
+
+// publish send msg to all subscribers, slow subscribers miss messages
+func (h *wsHub) publish(msg []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// sniffer passive decoder of the RTU traffic on one serial port
+type sniffer struct {
+	txObserver
+	config SnifferConfig
+	port   io.ReadCloser
+
+	pending     *mbserver.RTUFrame // request waiting for its response
+	pendingTime time.Time
+}
+
+// startSniffers open the serial ports of the configured sniffers and start
+// decoding their traffic, nothing is ever transmitted
+func (s *Forwarder) startSniffers() error {
+	for _, c := range s.config.Sniffers {
+		port, err := serial.Open(&serial.Config{
+			Address:  c.Addr,
+			BaudRate: c.BaudRate,
+			DataBits: c.DataBits,
+			StopBits: c.StopBits,
+			Parity:   c.Parity,
+			Timeout:  rtuFrameGap(c.BaudRate),
+		})
+		if err != nil {
+			return fmt.Errorf("sniffer %s: failed to open %s: %v", c.Name, c.Addr, err)
+		}
+		s.logger.Infof("sniffer %s listening on %s", c.Name, c.Addr)
+
+		sn := &sniffer{
+			txObserver: txObserver{kind: "sniffer", name: c.Name, mqttTopic: c.MQTTTopic},
+			config:     c,
+			port:       port,
+		}
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			<-s.ctx.Done()
+			port.Close()
+		}()
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.sniff(sn)
+		}()
+	}
+	return nil
+}
+
+// rtuFrameGap silent interval of 3.5 characters ending an RTU frame, 1.75ms
+// above 19200 baud
+func rtuFrameGap(baudRate int) time.Duration {
+	if baudRate <= 0 || baudRate > 19200 {
+		return 1750 * time.Microsecond
+	}
+	return time.Duration(3.5 * 11 * float64(time.Second) / float64(baudRate))
+}
+
+// sniff read the serial port and decode frames until the port is closed
+func (s *Forwarder) sniff(sn *sniffer) {
+	var buf []byte
+	chunk := make([]byte, 256)
+	for {
+		n, err := sn.port.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+		if err != nil && !errors.Is(err, serial.ErrTimeout) {
+			if s.ctx.Err() == nil {
+				s.logger.Errorf("sniffer %s stopped: %v", sn.config.Name, err)
+			}
+			return
+		}
+
+		for {
+			frame, size := nextRTUFrame(buf, sn.expectsResponse(buf))
+			if frame == nil {
+				break
+			}
+			buf = buf[size:]
+			s.observe(sn, frame)
+		}
+		if len(buf) == 0 {
+			continue
+		}
+
+		// a silent interval ends the frame, frames of unknown function codes
+		// are only delimited by it
+		if errors.Is(err, serial.ErrTimeout) {
+			if frame, err := mbserver.NewRTUFrame(buf); err == nil {
+				s.observe(sn, frame)
+			} else {
+				s.logger.Debugf("sniffer %s: discarded % x", sn.config.Name, buf)
+			}
+			buf = buf[:0]
+		} else if len(buf) > 2*rtuMaxLength {
+			// no silent interval, resynchronize on the next byte
+			buf = buf[1:]
+		}
+	}
+}
+
+const rtuMaxLength = 256
+
+// expectsResponse report whether buf starts with the response of the pending request
+func (sn *sniffer) expectsResponse(buf []byte) bool {
+	return sn.pending != nil && len(buf) >= 2 &&
+		buf[0] == sn.pending.Address && buf[1]&0x7F == sn.pending.Function
+}
+
+// nextRTUFrame decode the frame at the start of buf, nil while incomplete
+func nextRTUFrame(buf []byte, response bool) (*mbserver.RTUFrame, int) {
+	for _, n := range rtuFrameLengths(buf, response) {
+		if n > len(buf) {
+			continue
+		}
+		if frame, err := mbserver.NewRTUFrame(buf[:n]); err == nil {
+			return frame, n
+		}
+	}
+	return nil, 0
+}
+
+// rtuFrameLengths possible lengths of the frame at the start of buf, the
+// expected kind first; none for function codes of unknown length
+func rtuFrameLengths(buf []byte, response bool) []int {
+	if len(buf) < 3 {
+		return nil
+	}
+	function := buf[1]
+	if function&0x80 != 0 {
+		return []int{5}
+	}
+
+	var request, reply int
+	switch function {
+	case 1, 2, 3, 4:
+		request, reply = 8, 5+int(buf[2])
+	case 5, 6:
+		return []int{8}
+	case 15, 16:
+		request, reply = 9, 8
+		if len(buf) > 6 {
+			request += int(buf[6])
+		}
+	default:
+		return nil
+	}
+	if response {
+		return []int{reply, request}
+	}
+	return []int{request, reply}
+}
+
+// observe pair request and response frames into transactions
+func (s *Forwarder) observe(sn *sniffer, frame *mbserver.RTUFrame) {
+	now := s.clock.Now()
+	if p := sn.pending; p != nil {
+		if frame.Address == p.Address && frame.Function&0x7F == p.Function {
+			s.emitTransaction(&sn.txObserver, p, frame, now.Sub(sn.pendingTime))
+			sn.pending = nil
+			return
+		}
+		s.emitTransaction(&sn.txObserver, p, nil, 0)
+		sn.pending = nil
+	}
+	if frame.Address == 0 {
+		// broadcasts are not answered
+		s.emitTransaction(&sn.txObserver, frame, nil, 0)
+		return
+	}
+	sn.pending, sn.pendingTime = frame, now
+}
+
+// serveEvents stream the messages of hub, e.g. the decoded transactions, to
+// a WebSocket client as text messages until it disconnects or the forwarder
+// stops
+func (s *Forwarder) serveEvents(conn *websocket.Conn, hub *wsHub) {
+	defer conn.Close()
+	ch, unsubscribe := hub.subscribe()
+	defer unsubscribe()
+
+	// the client only sends control messages, read them to notice the close
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-closed:
+			return
+		case msg := <-ch:
+			conn.SetWriteDeadline(time.Now().Add(10 * time.Second)) // wall-clock, like every connection deadline
+			if err := conn.WriteMessage(websocket.TextMessage, msg); err != nil {
+				return
+			}
+		}
+	}
+}
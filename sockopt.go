@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// SocketOptions TCP socket tuning, unset options keep the defaults
+type SocketOptions struct {
+	NoDelay    *bool `yaml:"no_delay"`    // TCP_NODELAY, disable Nagle's algorithm; Go enables it by default
+	SendBuffer int   `yaml:"send_buffer"` // SO_SNDBUF(bytes), 0 for the OS default
+	RecvBuffer int   `yaml:"recv_buffer"` // SO_RCVBUF(bytes), 0 for the OS default
+	Linger     *int  `yaml:"linger"`      // SO_LINGER(seconds), 0 to discard unsent data and reset on close
+	DSCP       *int  `yaml:"dscp"`        // DSCP of the sent packets, 0-63, e.g. 46 for expedited forwarding
+}
+
+func validateSocketOptions(o *SocketOptions) error {
+	if o.SendBuffer < 0 {
+		return fmt.Errorf("invalid send_buffer %d: must not be negative", o.SendBuffer)
+	}
+	if o.RecvBuffer < 0 {
+		return fmt.Errorf("invalid recv_buffer %d: must not be negative", o.RecvBuffer)
+	}
+	if o.Linger != nil && *o.Linger < 0 {
+		return fmt.Errorf("invalid linger %d: must not be negative", *o.Linger)
+	}
+	if o.DSCP != nil && (*o.DSCP < 0 || *o.DSCP > 63) {
+		return fmt.Errorf("invalid dscp %d: must be between 0-63", *o.DSCP)
+	}
+	return nil
+}
+
+// applySocketOptions set the options on conn; connections that are not TCP,
+// e.g. unix sockets, are left alone
+func applySocketOptions(conn net.Conn, o *SocketOptions) error {
+	if o == nil {
+		return nil
+	}
+	if c, ok := conn.(*tls.Conn); ok {
+		conn = c.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	if o.NoDelay != nil {
+		if err := tcp.SetNoDelay(*o.NoDelay); err != nil {
+			return fmt.Errorf("failed to set no_delay: %v", err)
+		}
+	}
+	if o.SendBuffer > 0 {
+		if err := tcp.SetWriteBuffer(o.SendBuffer); err != nil {
+			return fmt.Errorf("failed to set send_buffer: %v", err)
+		}
+	}
+	if o.RecvBuffer > 0 {
+		if err := tcp.SetReadBuffer(o.RecvBuffer); err != nil {
+			return fmt.Errorf("failed to set recv_buffer: %v", err)
+		}
+	}
+	if o.Linger != nil {
+		if err := tcp.SetLinger(*o.Linger); err != nil {
+			return fmt.Errorf("failed to set linger: %v", err)
+		}
+	}
+	if o.DSCP != nil {
+		if err := setDSCP(tcp, *o.DSCP); err != nil {
+			return fmt.Errorf("failed to set dscp: %v", err)
+		}
+	}
+	return nil
+}
+
+// setDSCP mark the packets of conn with dscp, in the upper six bits of the
+// IPv4 TOS or the IPv6 traffic class
+func setDSCP(conn *net.TCPConn, dscp int) error {
+	tos := dscp << 2
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		return ipv6.NewConn(conn).SetTrafficClass(tos)
+	}
+	return ipv4.NewConn(conn).SetTOS(tos)
+}
+
+// socketDialer apply the socket options to the connections of the wrapped
+// dialer
+type socketDialer struct {
+	Dialer
+	options *SocketOptions
+}
+
+// withSocketOptions wrap d to apply o, d itself when o is nil
+func withSocketOptions(d Dialer, o *SocketOptions) Dialer {
+	if o == nil {
+		return d
+	}
+	return socketDialer{Dialer: d, options: o}
+}
+
+// DialContext dial address and apply the socket options
+func (d socketDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.Dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if err := applySocketOptions(conn, d.options); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
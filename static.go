@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// staticRange range of a slave read once and cached indefinitely, e.g.
+// nameplate data that never changes
+type staticRange struct {
+	AddressRange
+	function uint8
+
+	mu   sync.Mutex // held while the range is read from the slave
+	data []byte     // nil until read, packed bits or big endian registers
+}
+
+// staticCache static ranges of a slave
+type staticCache struct {
+	ranges []*staticRange
+}
+
+func newStaticCache(ranges []AddressRange) *staticCache {
+	c := &staticCache{}
+	for _, r := range ranges {
+		c.ranges = append(c.ranges, &staticRange{AddressRange: r, function: pollFunctions[r.Type]})
+	}
+	return c
+}
+
+// size return the number of ranges read from the slave and of all ranges,
+// c may be nil
+func (c *staticCache) size() (cached, total int) {
+	if c == nil {
+		return 0, 0
+	}
+	for _, r := range c.ranges {
+		r.mu.Lock()
+		if r.data != nil {
+			cached++
+		}
+		r.mu.Unlock()
+	}
+	return cached, len(c.ranges)
+}
+
+// find return the static range containing a read, nil when none does
+func (c *staticCache) find(function uint8, address, quantity int) *staticRange {
+	if c == nil {
+		return nil
+	}
+	for _, r := range c.ranges {
+		if r.function == function && r.Address <= address && address+quantity <= r.Address+r.Quantity {
+			return r
+		}
+	}
+	return nil
+}
+
+// invalidate drop the data of the static ranges of function overlapping
+// quantity items at address, function 0 for every function and quantity 0
+// for every address, they are read again on next use; return the number of
+// ranges dropped
+func (c *staticCache) invalidate(function uint8, address, quantity int) int {
+	if c == nil {
+		return 0
+	}
+	dropped := 0
+	for _, r := range c.ranges {
+		r.mu.Lock()
+		if r.data != nil && (function == 0 || r.function == function) && overlaps(r.Address, r.Quantity, address, quantity) {
+			r.data = nil
+			dropped++
+		}
+		r.mu.Unlock()
+	}
+	return dropped
+}
+
+// readStatic answer a read from a static range, reading the whole range from
+// the slave on first use; failed reads are not cached
+func (s *Forwarder) readStatic(client *modbusClient, slaveID byte, r *staticRange, address, quantity int) ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.data == nil {
+		data, err := s.readDirect(client, slaveID, r.function, r.Address, r.Quantity)
+		if err != nil {
+			return nil, err
+		}
+		r.data = data
+		s.logger.Infof("cached static range of slave %d (%s, addr %d, count %d)", slaveID, r.Type, r.Address, r.Quantity)
+	}
+	results, ok := extractRange(r.function, r.data, address-r.Address, quantity)
+	if !ok {
+		return nil, fmt.Errorf("static range of slave %d (%s, addr %d): short response", slaveID, r.Type, r.Address)
+	}
+	return results, nil
+}
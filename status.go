@@ -0,0 +1,81 @@
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// slaveStatus connection status of one slave
+type slaveStatus struct {
+	SlaveID     int             `json:"slave_id"`
+	ConnType    string          `json:"conn_type"`
+	Target      string          `json:"target"`
+	State       string          `json:"state"` // "up", "down", "disabled" or "unknown" before the first transaction
+	LastError   string          `json:"last_error,omitempty"`
+	LastSuccess *time.Time      `json:"last_success,omitempty"`
+	Reconnects  uint64          `json:"reconnects"`
+	Requests    uint64          `json:"requests"`
+	Errors      uint64          `json:"errors"`
+	BusySeconds float64         `json:"busy_seconds"` // total time of the transactions, divided by requests the mean latency
+	QueueDepth  int             `json:"queue_depth"`
+	Malformed   malformedStatus `json:"malformed"` // malformed responses by kind
+
+	HealthScore float64 `json:"health_score"` // success rate, lowered by latency beyond the target, 0-1
+	SuccessRate float64 `json:"success_rate"` // moving average
+	LatencyEMA  float64 `json:"latency_ema_seconds"`
+}
+
+// forwarderStatus runtime status of the forwarder
+type forwarderStatus struct {
+	Version   string        `json:"version"`
+	StartTime time.Time     `json:"start_time"`
+	Uptime    float64       `json:"uptime_seconds"`
+	Slaves    []slaveStatus `json:"slaves"`
+}
+
+// status take a snapshot of the forwarder status, slaves sorted by ID
+func (s *Forwarder) status() forwarderStatus {
+	status := forwarderStatus{
+		Version:   versionString(),
+		StartTime: s.startTime,
+		Uptime:    s.clock.Now().Sub(s.startTime).Seconds(),
+	}
+
+	s.clientsMux.RLock()
+	for slaveID, client := range s.clients {
+		slave := slaveStatus{
+			SlaveID:     int(slaveID),
+			ConnType:    client.connType,
+			Target:      client.target(),
+			State:       "unknown",
+			Reconnects:  client.reconnects.Load(),
+			Requests:    client.requests.Load(),
+			Errors:      client.failures.Load(),
+			BusySeconds: time.Duration(client.busy.Load()).Seconds(),
+			QueueDepth:  int(client.queued.Load()),
+		}
+		slave.HealthScore, slave.SuccessRate, slave.LatencyEMA = client.health.snapshot()
+		slave.Malformed = client.malformed.snapshot()
+		client.mu.Lock()
+		if !client.lastConn.IsZero() {
+			lastConn := client.lastConn
+			slave.LastSuccess = &lastConn
+			slave.State = "up"
+		}
+		if client.lastError != nil {
+			slave.State = "down"
+			slave.LastError = client.lastError.Error()
+		}
+		client.mu.Unlock()
+		if client.disabled.Load() {
+			slave.State = "disabled"
+		}
+		status.Slaves = append(status.Slaves, slave)
+	}
+	s.clientsMux.RUnlock()
+
+	sort.Slice(status.Slaves, func(i, j int) bool {
+		return status.Slaves[i].SlaveID < status.Slaves[j].SlaveID
+	})
+	return status
+}
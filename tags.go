@@ -0,0 +1,631 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// scaled report whether the register value of the tag is scaled or
+// converted, its values are decimals then
+func (tag Tag) scaled() bool {
+	return tag.Scale != 1 || tag.Unit != tag.ConvertTo
+}
+
+// dataTypes registers of each numeric data type
+var dataTypes = map[string]int{
+	"uint16":  1,
+	"int16":   1,
+	"uint32":  2,
+	"int32":   2,
+	"float32": 2,
+	"uint64":  4,
+	"int64":   4,
+	"float64": 4,
+}
+
+// registers number of registers of the tag value
+func (tag Tag) registers() int {
+	if tag.DataType == "string" {
+		return tag.Length
+	}
+	return dataTypes[tag.DataType]
+}
+
+// value return the tag value of a register value, scaled and in the
+// convert_to unit
+func (tag Tag) value(raw float64) float64 {
+	return roundValue(convertUnit(raw*tag.Scale, tag.Unit, tag.ConvertTo))
+}
+
+// limits lowest and highest value of a numeric tag, in the convert_to unit
+func (tag Tag) limits() (float64, float64) {
+	var lo, hi float64
+	switch tag.DataType {
+	case "uint16":
+		lo, hi = 0, float64(tag.fieldMask())
+	case "int16":
+		lo, hi = math.MinInt16, math.MaxInt16
+	case "uint32":
+		lo, hi = 0, math.MaxUint32
+	case "int32":
+		lo, hi = math.MinInt32, math.MaxInt32
+	case "uint64":
+		lo, hi = 0, math.MaxUint64
+	case "int64":
+		lo, hi = math.MinInt64, math.MaxInt64
+	default:
+		// floats, limited to what float32 holds for both
+		lo, hi = -math.MaxFloat32, math.MaxFloat32
+	}
+	if tag.scaled() {
+		lo, hi = tag.value(lo), tag.value(hi)
+	}
+	return min(lo, hi), max(lo, hi)
+}
+
+// fieldMask mask of the bits of the tag value, after shifting them down
+func (tag Tag) fieldMask() uint16 {
+	if tag.Bit == nil {
+		return 0xFFFF
+	}
+	return uint16(1<<tag.Bits - 1)
+}
+
+// decode return the value of the tag from its register value: the enum name,
+// a bool for single bit tags, or the number in the convert_to unit
+func (tag Tag) decode(raw uint16) any {
+	if tag.Bit != nil {
+		raw = raw >> *tag.Bit & tag.fieldMask()
+	}
+	if name, ok := tag.Enum[int(raw)]; ok {
+		return name
+	}
+	if tag.Bit != nil && tag.Bits == 1 && len(tag.Enum) == 0 {
+		return raw == 1
+	}
+	if !tag.scaled() {
+		return int(raw)
+	}
+	return tag.value(float64(raw))
+}
+
+// decodeNumber return the value of a numeric tag from its register values,
+// integers unless the tag is scaled or a float
+func (tag Tag) decodeNumber(data []byte) (any, error) {
+	b := tag.ordered(slices.Clone(data))
+	var exact any
+	var v float64
+	switch tag.DataType {
+	case "uint16":
+		return tag.decode(binary.BigEndian.Uint16(b)), nil
+	case "int16":
+		i := int16(binary.BigEndian.Uint16(b))
+		exact, v = int(i), float64(i)
+	case "uint32":
+		u := binary.BigEndian.Uint32(b)
+		exact, v = int64(u), float64(u)
+	case "int32":
+		i := int32(binary.BigEndian.Uint32(b))
+		exact, v = int64(i), float64(i)
+	case "uint64":
+		u := binary.BigEndian.Uint64(b)
+		exact, v = u, float64(u)
+	case "int64":
+		i := int64(binary.BigEndian.Uint64(b))
+		exact, v = i, float64(i)
+	case "float32":
+		f := math.Float32frombits(binary.BigEndian.Uint32(b))
+		// the shortest decimal of the float32, without float64 noise
+		v, _ = strconv.ParseFloat(strconv.FormatFloat(float64(f), 'g', -1, 32), 64)
+		exact = v
+	case "float64":
+		v = math.Float64frombits(binary.BigEndian.Uint64(b))
+		exact = v
+	}
+	if math.IsNaN(v) || math.IsInf(v, 0) {
+		return nil, fmt.Errorf("invalid value %v", v)
+	}
+	if !tag.scaled() {
+		return exact, nil
+	}
+	return tag.value(v), nil
+}
+
+// encodeNumber parse the payload of a numeric tag, in the convert_to unit,
+// and return its register values
+func (tag Tag) encodeNumber(payload string) ([]byte, error) {
+	b := make([]byte, 2*tag.registers())
+	float := tag.DataType == "float32" || tag.DataType == "float64"
+	if float || tag.scaled() {
+		v, err := strconv.ParseFloat(payload, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return nil, fmt.Errorf("invalid value %q of tag %s", payload, tag.Name)
+		}
+		if tag.scaled() {
+			v = convertUnit(v, tag.ConvertTo, tag.Unit) / tag.Scale
+		}
+		switch tag.DataType {
+		case "float32":
+			if math.Abs(v) > math.MaxFloat32 {
+				return nil, fmt.Errorf("value %v is out of the float32 range", v)
+			}
+			binary.BigEndian.PutUint32(b, math.Float32bits(float32(v)))
+			return tag.ordered(b), nil
+		case "float64":
+			binary.BigEndian.PutUint64(b, math.Float64bits(v))
+			return tag.ordered(b), nil
+		}
+		// scaled integers, rounded to the register value
+		payload = strconv.FormatFloat(math.Round(v), 'f', -1, 64)
+	}
+
+	bits := 16 * tag.registers()
+	var raw uint64
+	var err error
+	if strings.HasPrefix(tag.DataType, "int") {
+		var v int64
+		v, err = strconv.ParseInt(payload, 0, bits)
+		raw = uint64(v)
+	} else {
+		raw, err = strconv.ParseUint(payload, 0, bits)
+	}
+	if errors.Is(err, strconv.ErrRange) {
+		return nil, fmt.Errorf("value %q of tag %s is out of the %s range", payload, tag.Name, tag.DataType)
+	} else if err != nil {
+		return nil, fmt.Errorf("invalid value %q of tag %s", payload, tag.Name)
+	}
+	for i := len(b) - 2; i >= 0; i -= 2 {
+		binary.BigEndian.PutUint16(b[i:], uint16(raw))
+		raw >>= 16
+	}
+	return tag.ordered(b), nil
+}
+
+// ordered return the register values b, high word first, in the word
+// order of the tag, or back
+func (tag Tag) ordered(b []byte) []byte {
+	if tag.WordOrder == "little" {
+		for i, j := 0, len(b)-2; i < j; i, j = i+2, j-2 {
+			b[i], b[i+1], b[j], b[j+1] = b[j], b[j+1], b[i], b[i+1]
+		}
+	}
+	return b
+}
+
+// encodeField parse the payload of a bit-field or enum tag: an enum name,
+// a number, or for single bit tags a coil state; return the unshifted bits
+func (tag Tag) encodeField(payload string) (uint16, error) {
+	for value, name := range tag.Enum {
+		if name == payload {
+			return uint16(value), nil
+		}
+	}
+	if tag.Bit != nil && tag.Bits == 1 && len(tag.Enum) == 0 {
+		on, err := parseCoil(payload)
+		if on {
+			return 1, err
+		}
+		return 0, err
+	}
+	v, err := strconv.ParseUint(payload, 0, 16)
+	if err != nil || uint16(v) > tag.fieldMask() {
+		return 0, fmt.Errorf("invalid value %q of tag %s", payload, tag.Name)
+	}
+	if _, ok := tag.Enum[int(v)]; len(tag.Enum) > 0 && !ok {
+		return 0, fmt.Errorf("invalid value %q of tag %s: not in enum", payload, tag.Name)
+	}
+	return uint16(v), nil
+}
+
+// encode return the register value of a tag value given in the convert_to
+// unit, negative values are 16-bit two's complement
+func (tag Tag) encode(value float64) (uint16, error) {
+	if tag.scaled() {
+		value = math.Round(convertUnit(value, tag.ConvertTo, tag.Unit) / tag.Scale)
+	}
+	if value < -0x8000 || value > 0xFFFF || value != math.Trunc(value) {
+		return 0, fmt.Errorf("value %v is out of the register range", value)
+	}
+	return uint16(int32(value)), nil
+}
+
+// decodeString return the string of the register values of a string tag
+func (tag Tag) decodeString(data []byte) string {
+	b := slices.Clone(data)
+	if tag.ByteOrder == "little" {
+		swapBytes(b)
+	}
+	if tag.Trim != "none" {
+		if i := bytes.IndexByte(b, 0); i >= 0 {
+			b = b[:i]
+		}
+	}
+	var value string
+	if tag.Encoding == "ascii" {
+		runes := make([]rune, len(b))
+		for i, c := range b {
+			runes[i] = rune(c)
+			if c > unicode.MaxASCII {
+				runes[i] = unicode.ReplacementChar
+			}
+		}
+		value = string(runes)
+	} else {
+		value = strings.ToValidUTF8(string(b), string(unicode.ReplacementChar))
+	}
+	if tag.Trim == "space" {
+		value = strings.TrimRight(value, " ")
+	}
+	return value
+}
+
+// encodeString return the register values of a string tag, padded with NUL
+func (tag Tag) encodeString(value string) ([]byte, error) {
+	if tag.Encoding == "ascii" {
+		for _, r := range value {
+			if r > unicode.MaxASCII {
+				return nil, fmt.Errorf("invalid value %q of tag %s: not ASCII", value, tag.Name)
+			}
+		}
+	}
+	b := make([]byte, 2*tag.Length)
+	if len(value) > len(b) {
+		return nil, fmt.Errorf("value %q of tag %s is longer than %d bytes", value, tag.Name, len(b))
+	}
+	copy(b, value)
+	if tag.ByteOrder == "little" {
+		swapBytes(b)
+	}
+	return b, nil
+}
+
+// swapBytes swap the bytes of each register
+func swapBytes(b []byte) {
+	for i := 0; i+1 < len(b); i += 2 {
+		b[i], b[i+1] = b[i+1], b[i]
+	}
+}
+
+// formatTagValue format a tag value as MQTT payload, bools as 1/0 like coils
+func formatTagValue(value any) string {
+	switch v := value.(type) {
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		if v {
+			return "1"
+		}
+		return "0"
+	}
+	return fmt.Sprint(value)
+}
+
+// readTag read the value of tag through the normal read path
+func (s *Forwarder) readTag(slaveID byte, tag Tag) (any, error) {
+	client, err := s.getClient(slaveID)
+	if err != nil {
+		return nil, err
+	}
+	function := pollFunctions[tag.Type]
+	results, err := s.read(client, slaveID, function, tag.Address, tag.registers())
+	if err != nil {
+		return nil, err
+	}
+	if function <= 2 {
+		return int(results[0] & 1), nil
+	}
+	if tag.DataType == "string" {
+		return tag.decodeString(results), nil
+	}
+	return tag.decodeNumber(results)
+}
+
+// tagValue current value of one tag with its quality, "good", "stale",
+// "bad" or "never-read" like the polled values
+type tagValue struct {
+	SlaveID   int        `json:"slave_id"`
+	Name      string     `json:"name"`
+	Type      string     `json:"type"`
+	Address   int        `json:"address"`
+	Value     any        `json:"value"` // null when the read failed
+	Unit      string     `json:"unit,omitempty"`
+	Quality   string     `json:"quality"`
+	Timestamp *time.Time `json:"timestamp,omitempty"` // time the value was read from the slave
+	Error     string     `json:"error,omitempty"`
+}
+
+// sampleTag read tag of slaveID with its quality: values answered from the
+// shadow store have the quality and time of their poll, values read from
+// the slave are good
+func (s *Forwarder) sampleTag(slaveID byte, tag Tag) tagValue {
+	v := tagValue{SlaveID: int(slaveID), Name: tag.Name, Type: tag.Type, Address: tag.Address, Unit: tag.ConvertTo, Quality: "good"}
+	now := s.clock.Now()
+	value, err := s.readTag(slaveID, tag)
+	updated, polled := now, false
+	if client, clientErr := s.getClient(slaveID); clientErr == nil && client.shadowReads && client.shadow != nil {
+		var quality string
+		if quality, updated, polled = client.shadow.sample(pollFunctions[tag.Type], tag.Address, tag.registers(), now); polled {
+			v.Quality = quality
+		} else {
+			updated = now
+		}
+	}
+	if err != nil {
+		v.Error = err.Error()
+		if !polled || v.Quality != "never-read" {
+			v.Quality = "bad"
+		}
+		return v
+	}
+	v.Value, v.Timestamp = value, &updated
+	return v
+}
+
+// tagValues read the tags of slaveID, or of all slaves when slaveID is
+// negative, sorted by slave ID
+func (s *Forwarder) tagValues(slaveID int) []tagValue {
+	values := []tagValue{}
+	for id, server := range s.config.Servers {
+		if slaveID >= 0 && int(id) != slaveID {
+			continue
+		}
+		for _, tag := range server.Tags {
+			values = append(values, s.sampleTag(id, tag))
+		}
+	}
+	sort.SliceStable(values, func(i, j int) bool {
+		return values[i].SlaveID < values[j].SlaveID
+	})
+	return values
+}
+
+// publishTagEvents send the values of all tags with their quality to the
+// WebSocket subscribers every interval until the forwarder stops, one JSON
+// text message per tag; nothing is read while nobody is subscribed
+func (s *Forwarder) publishTagEvents(interval time.Duration) {
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-s.clock.After(interval):
+		}
+		if s.tagEvents.idle() {
+			continue
+		}
+		for _, v := range s.tagValues(-1) {
+			msg, _ := json.Marshal(v)
+			s.tagEvents.publish(msg)
+		}
+	}
+}
+
+// handleTags GET /api/tags[?slave_id=N], current tag values in their
+// convert_to units
+func (s *Forwarder) handleTags(w http.ResponseWriter, r *http.Request) {
+	slaveID := -1
+	if param := r.URL.Query().Get("slave_id"); param != "" {
+		id, err := strconv.Atoi(param)
+		if err != nil || id < 0 || id > 255 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid slave_id %q", param)})
+			return
+		}
+		slaveID = id
+	}
+	writeJSON(w, http.StatusOK, s.tagValues(slaveID))
+}
+
+// handleTagWrite PUT /api/tags/{slave_id}/{name}, write the JSON body
+// {"value": V} to a tag like an MQTT command
+func (s *Forwarder) handleTagWrite(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("slave_id"))
+	server, ok := s.config.Servers[byte(id)]
+	if err != nil || id < 0 || id > 255 || !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown slave %q", r.PathValue("slave_id"))})
+		return
+	}
+	tag, ok := server.tag(r.PathValue("name"))
+	if !ok {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("unknown tag %s of slave %d", r.PathValue("name"), id)})
+		return
+	}
+	var body struct {
+		Value any `json:"value"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<16)).Decode(&body); err != nil || body.Value == nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": `invalid body: must be {"value": ...}`})
+		return
+	}
+
+	v := tagValue{SlaveID: id, Name: tag.Name, Type: tag.Type, Address: tag.Address, Unit: tag.ConvertTo}
+	v.Value, err = s.writeTag(byte(id), tag, formatTagValue(body.Value), adminClient(r))
+	var failed requestError
+	switch {
+	case errors.As(err, &failed):
+		writeJSON(w, http.StatusBadGateway, map[string]string{"error": err.Error()})
+	case err != nil:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+	default:
+		s.logger.Infof("tag %s of slave %d written through the admin API by %s", tag.Name, id, adminClient(r))
+		writeJSON(w, http.StatusOK, v)
+	}
+}
+
+// writeTag write payload to tag through the upstream request pipeline as
+// a request to unit from client, return the written value
+func (s *Forwarder) writeTag(unit byte, tag Tag, payload, client string) (any, error) {
+	switch {
+	case tag.Type == "coils":
+		on, err := parseCoil(payload)
+		if err != nil {
+			return nil, err
+		}
+		var value uint16
+		if on {
+			value = 0xFF00
+		}
+		_, err = s.request(unit, 5, client, uint16(tag.Address), value)
+		return on, err
+	case tag.Type != "holding":
+		return nil, fmt.Errorf("tag %s is read-only", tag.Name)
+	case tag.DataType == "string":
+		values, err := tag.encodeString(payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.writeRegisters(unit, client, tag.Address, values); err != nil {
+			return nil, err
+		}
+		return tag.decodeString(values), nil
+	case tag.DataType != "uint16":
+		values, err := tag.encodeNumber(payload)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.writeRegisters(unit, client, tag.Address, values); err != nil {
+			return nil, err
+		}
+		// the value actually written, after rounding to the registers
+		return tag.decodeNumber(values)
+	case tag.Bit != nil:
+		return s.writeBitField(unit, tag, payload, client)
+	case len(tag.Enum) > 0:
+		raw, err := tag.encodeField(payload)
+		if err != nil {
+			return nil, err
+		}
+		_, err = s.request(unit, 6, client, uint16(tag.Address), raw)
+		return tag.decode(raw), err
+	}
+
+	v, err := parseTagValue(tag, payload)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := tag.encode(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid register value %q: %v", payload, err)
+	}
+	if _, err := s.request(unit, 6, client, uint16(tag.Address), raw); err != nil {
+		return nil, err
+	}
+	if tag.scaled() {
+		// the value actually written, after rounding to the register
+		return tag.decode(raw), nil
+	}
+	return int64(v), nil
+}
+
+// writeBitField write payload to the bits of a bit-field tag, with a mask
+// write (FC 22) or by reading the register and writing it back with the
+// bits changed
+func (s *Forwarder) writeBitField(unit byte, tag Tag, payload, client string) (any, error) {
+	field, err := tag.encodeField(payload)
+	if err != nil {
+		return nil, err
+	}
+	mask, bits := tag.fieldMask()<<*tag.Bit, field<<*tag.Bit
+	address := uint16(tag.Address)
+
+	if tag.MaskWrite {
+		_, err = s.request(unit, 22, client, address, ^mask, bits)
+		return tag.decode(bits), err
+	}
+	// not atomic, a write of the other bits in between is lost
+	response, err := s.request(unit, 3, client, address, 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 3 {
+		return nil, fmt.Errorf("invalid read response")
+	}
+	current := binary.BigEndian.Uint16(response[1:])
+	_, err = s.request(unit, 6, client, address, current&^mask|bits)
+	return tag.decode(bits), err
+}
+
+// writeRegisters write the register values to address of unit, with a
+// single register write (FC 6) for one register, FC 16 otherwise
+func (s *Forwarder) writeRegisters(unit byte, client string, address int, values []byte) error {
+	if len(values) == 2 {
+		_, err := s.request(unit, 6, client, uint16(address), binary.BigEndian.Uint16(values))
+		return err
+	}
+	data := make([]byte, 5, 5+len(values))
+	binary.BigEndian.PutUint16(data, uint16(address))
+	binary.BigEndian.PutUint16(data[2:], uint16(len(values)/2))
+	data[4] = byte(len(values))
+	_, err := s.requestData(unit, 16, client, append(data, values...))
+	return err
+}
+
+// request send a request of function with the 16-bit words as data to unit
+// through the upstream request pipeline, return the response data
+func (s *Forwarder) request(unit, function uint8, client string, words ...uint16) ([]byte, error) {
+	data := make([]byte, 2*len(words))
+	for i, word := range words {
+		binary.BigEndian.PutUint16(data[2*i:], word)
+	}
+	return s.requestData(unit, function, client, data)
+}
+
+// requestData send a request of function with data to unit through the
+// upstream request pipeline, return the response data
+func (s *Forwarder) requestData(unit, function uint8, client string, data []byte) ([]byte, error) {
+	frame := &mbserver.TCPFrame{Device: unit, Function: function, Data: data}
+	response := s.handle(frame, client, nil)
+	if response == nil {
+		return nil, requestError("no response")
+	}
+	if response.GetFunction()&0x80 != 0 {
+		return nil, requestError("exception " + exceptionName(mbserver.Exception(response.GetData()[0])))
+	}
+	return response.GetData(), nil
+}
+
+// requestError request of a tag write answered with an exception or not at all
+type requestError string
+
+func (e requestError) Error() string {
+	return string(e)
+}
+
+// parseTagValue parse a register command payload, decimals are only
+// accepted for scaled tags
+func parseTagValue(tag Tag, payload string) (float64, error) {
+	if tag.scaled() {
+		v, err := strconv.ParseFloat(payload, 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0, fmt.Errorf("invalid value %q", payload)
+		}
+		return v, nil
+	}
+	v, err := strconv.ParseInt(payload, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid register value %q", payload)
+	}
+	return float64(v), nil
+}
+
+// parseCoil parse a coil command payload
+func parseCoil(payload string) (bool, error) {
+	switch strings.ToLower(payload) {
+	case "1", "true", "on":
+		return true, nil
+	case "0", "false", "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid coil value %q", payload)
+}
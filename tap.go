@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// tap transparent Modbus TCP proxy between one master and one device,
+// forwarding bytes unchanged while decoding the transactions
+type tap struct {
+	txObserver
+	config TapConfig
+}
+
+// tapRequest request waiting for its response
+type tapRequest struct {
+	frame *mbserver.RTUFrame
+	time  time.Time
+}
+
+// startTaps start listening for the masters of the configured taps
+func (s *Forwarder) startTaps() error {
+	for _, c := range s.config.Taps {
+		t := &tap{
+			txObserver: txObserver{kind: "tap", name: c.Name, mqttTopic: c.MQTTTopic},
+			config:     c,
+		}
+		if c.CaptureFile != "" {
+			capture, err := openCapture(c.CaptureFile)
+			if err != nil {
+				return fmt.Errorf("tap %s: %v", c.Name, err)
+			}
+			t.capture = capture
+		}
+
+		l, err := net.Listen("tcp", c.Listen)
+		if err != nil {
+			return fmt.Errorf("tap %s: failed to listen on %s: %v", c.Name, c.Listen, err)
+		}
+		if !s.trackListener(l, true) {
+			l.Close()
+			return net.ErrClosed
+		}
+		s.logger.Infof("tap %s listening on %s, forwarding to %s", c.Name, l.Addr(), c.Backend)
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer s.trackListener(l, false)
+			s.serveTap(t, l)
+			if t.capture != nil {
+				t.capture.close()
+			}
+		}()
+	}
+	return nil
+}
+
+// serveTap accept master connections until the listener is closed
+func (s *Forwarder) serveTap(t *tap, l net.Listener) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) && s.ctx.Err() == nil {
+				s.logger.Errorf("tap %s stopped: %v", t.name, err)
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.tapConn(t, conn)
+		}()
+	}
+}
+
+// tapConn connect the master connection to the device and copy both
+// directions, each master connection gets its own device connection
+func (s *Forwarder) tapConn(t *tap, conn net.Conn) {
+	if !s.trackConn(conn, true) {
+		conn.Close()
+		return
+	}
+	defer s.trackConn(conn, false)
+	defer conn.Close()
+
+	backend, err := s.dialer.DialContext(s.ctx, "tcp", t.config.Backend)
+	if err != nil {
+		s.logger.Warnf("tap %s: failed to connect to %s: %v", t.name, t.config.Backend, err)
+		return
+	}
+	defer backend.Close()
+	s.logger.Debugf("tap %s: connection from %s", t.name, conn.RemoteAddr())
+
+	var mu sync.Mutex
+	pending := make(map[uint16]tapRequest) // by transaction ID
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tapCopy(backend, conn, func(frame *mbserver.TCPFrame) {
+			mu.Lock()
+			defer mu.Unlock()
+			if p, ok := pending[frame.TransactionIdentifier]; ok {
+				s.emitTransaction(&t.txObserver, p.frame, nil, 0)
+			}
+			pending[frame.TransactionIdentifier] = tapRequest{frame: rtuFrame(frame), time: s.clock.Now()}
+		})
+		// the master is gone, unblock the device side
+		backend.Close()
+	}()
+	tapCopy(conn, backend, func(frame *mbserver.TCPFrame) {
+		mu.Lock()
+		defer mu.Unlock()
+		p, ok := pending[frame.TransactionIdentifier]
+		if !ok {
+			s.logger.Debugf("tap %s: response to unknown transaction %d", t.name, frame.TransactionIdentifier)
+			return
+		}
+		delete(pending, frame.TransactionIdentifier)
+		s.emitTransaction(&t.txObserver, p.frame, rtuFrame(frame), s.clock.Now().Sub(p.time))
+	})
+	conn.Close()
+	<-done
+
+	for _, p := range pending {
+		s.emitTransaction(&t.txObserver, p.frame, nil, 0)
+	}
+}
+
+// tapCopy copy src to dst unchanged, passing the complete MBAP frames seen
+// on the way to onFrame, until either side fails
+func tapCopy(dst io.Writer, src io.Reader, onFrame func(*mbserver.TCPFrame)) {
+	var pending []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if _, err := dst.Write(buf[:n]); err != nil {
+				return
+			}
+			pending = append(pending, buf[:n]...)
+			for len(pending) >= tcpHeaderSize {
+				length := int(binary.BigEndian.Uint16(pending[4:6]))
+				if length < 2 || length > tcpMaxLength-tcpHeaderSize+1 {
+					// out of sync, drop what was buffered
+					pending = pending[:0]
+					break
+				}
+				size := tcpHeaderSize - 1 + length
+				if len(pending) < size {
+					break
+				}
+				if frame, err := mbserver.NewTCPFrame(pending[:size]); err == nil {
+					onFrame(frame)
+				}
+				pending = pending[size:]
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// rtuFrame return a copy of the PDU and unit ID of a TCP frame
+func rtuFrame(frame *mbserver.TCPFrame) *mbserver.RTUFrame {
+	data := append([]byte(nil), frame.Data...)
+	return &mbserver.RTUFrame{Address: frame.Device, Function: frame.Function, Data: data}
+}
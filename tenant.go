@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessProfile routing, permissions and limits of the connections of a
+// TLS server name, a tenant or a listen address
+type accessProfile struct {
+	kind     string // "TLS profile", "tenant" or "listener"
+	name     string
+	units    map[byte]byte // upstream unit ID -> slaveID, nil for the default routing
+	readOnly bool
+
+	maxConnections int
+	limiter        *rateLimiter // request rate limit, nil for no limit
+
+	active    atomic.Int32  // open connections
+	rejected  atomic.Uint64 // connections rejected by max_connections
+	requests  atomic.Uint64 // requests answered
+	errors    atomic.Uint64 // exception responses
+	throttled atomic.Uint64 // requests rejected by the rate limit
+}
+
+// allow take one request from the rate limit, false when it is exceeded
+func (p *accessProfile) allow(now time.Time) bool {
+	if p.limiter == nil || p.limiter.allow(now) {
+		return true
+	}
+	p.throttled.Add(1)
+	return false
+}
+
+// count record an answered request, p may be nil
+func (p *accessProfile) count(exception bool) {
+	if p == nil {
+		return
+	}
+	p.requests.Add(1)
+	if exception {
+		p.errors.Add(1)
+	}
+}
+
+// admit enforce max_connections for a new connection
+func (p *accessProfile) admit(conn net.Conn, logger *Logger) bool {
+	if p.maxConnections > 0 && int(p.active.Load()) > p.maxConnections {
+		p.rejected.Add(1)
+		logger.Warnf("upstream connection from %s rejected, %s %s has %d connections", conn.RemoteAddr(), p.kind, p.name, p.maxConnections)
+		return false
+	}
+	return true
+}
+
+// rateLimiter token bucket
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate, burst int) *rateLimiter {
+	return &rateLimiter{rate: float64(rate), burst: float64(burst), tokens: float64(burst)}
+}
+
+// allow take one token if available
+func (l *rateLimiter) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.last.IsZero() {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	if l.tokens < 1 {
+		return false
+	}
+	l.tokens--
+	return true
+}
+
+// profileListener listener of a tenant or a listen address with its own
+// routing, its connections carry the profile
+type profileListener struct {
+	net.Listener
+	profile *accessProfile
+}
+
+// Accept wait for the next connection of the profile
+func (l *profileListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.profile.active.Add(1)
+	return &profileConn{Conn: conn, profile: l.profile}, nil
+}
+
+// profileConn upstream connection of a tenant or a listen address
+type profileConn struct {
+	net.Conn
+	profile   *accessProfile
+	closeOnce sync.Once
+}
+
+// Close close the connection
+func (c *profileConn) Close() error {
+	c.closeOnce.Do(func() { c.profile.active.Add(-1) })
+	return c.Conn.Close()
+}
+
+// listenTenants start the listeners of the configured tenants
+func (s *Forwarder) listenTenants() error {
+	for _, t := range s.config.Tenants {
+		tenant := &accessProfile{
+			kind:           "tenant",
+			name:           t.Name,
+			units:          t.Units,
+			readOnly:       t.ReadOnly,
+			maxConnections: t.MaxConnections,
+		}
+		if t.MaxRequestRate > 0 {
+			tenant.limiter = newRateLimiter(t.MaxRequestRate, t.RequestBurst)
+		}
+		s.tenants = append(s.tenants, tenant)
+
+		listenAddr := fmt.Sprintf("0.0.0.0:%d", t.ListenPort)
+		l, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			return fmt.Errorf("tenant %s: failed to listen on %s: %v", t.Name, listenAddr, err)
+		}
+		s.logger.Infof("modbus forwarder listening on %s (tenant %s)", listenAddr, t.Name)
+		s.serveListener(&profileListener{Listener: l, profile: tenant})
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/binary"
+	"slices"
+	"time"
+)
+
+// pduRange return the data type, address and quantity a request PDU
+// accesses, false for function codes without an address range
+func pduRange(pdu []byte) (typ string, address, quantity int, ok bool) {
+	if len(pdu) < 5 {
+		return "", 0, 0, false
+	}
+	address = int(binary.BigEndian.Uint16(pdu[1:]))
+	quantity = int(binary.BigEndian.Uint16(pdu[3:]))
+	switch pdu[0] {
+	case 1, 15:
+		typ = "coils"
+	case 2:
+		typ = "discrete"
+	case 3, 16:
+		typ = "holding"
+	case 4:
+		typ = "input"
+	case 5:
+		return "coils", address, 1, true
+	case 6, 22:
+		return "holding", address, 1, true
+	default:
+		return "", 0, 0, false
+	}
+	return typ, address, quantity, true
+}
+
+// timeoutRules response timeouts of address ranges, the first matching rule
+// applies
+type timeoutRules []TimeoutRule
+
+// timeout return the response timeout of the request pdu, def when no rule
+// matches
+func (r timeoutRules) timeout(pdu []byte, def time.Duration) time.Duration {
+	typ, address, quantity, ok := pduRange(pdu)
+	if !ok {
+		return def
+	}
+	for _, rule := range r {
+		if rule.Type == typ && address < rule.Address+rule.Quantity && rule.Address < address+quantity &&
+			(len(rule.Functions) == 0 || slices.Contains(rule.Functions, int(pdu[0]))) {
+			return time.Duration(rule.Timeout) * time.Millisecond
+		}
+	}
+	return def
+}
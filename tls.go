@@ -0,0 +1,107 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// tlsHandshakeTimeout time allowed for the TLS handshake of an upstream connection
+const tlsHandshakeTimeout = 10 * time.Second
+
+// loadCertPool load the CA certificates of a PEM file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read TLS client CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in TLS client CA %s", path)
+	}
+	return pool, nil
+}
+
+// listenTLS start listening for Modbus/TCP over TLS with the configured
+// certificates and SNI profiles
+func (s *Forwarder) listenTLS() (net.Listener, error) {
+	c := s.config.TLS
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	s.tlsProfiles = make(map[string]*accessProfile)
+	for _, p := range c.Profiles {
+		profile := &accessProfile{kind: "TLS profile", name: p.ServerName, readOnly: p.ReadOnly}
+		if len(p.Units) > 0 {
+			profile.units = p.Units
+		}
+		s.tlsProfiles[p.ServerName] = profile
+
+		// a profile certificate is presented to clients asking for its server name
+		if p.CertFile != "" {
+			cert, err := tls.LoadX509KeyPair(p.CertFile, p.KeyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load TLS certificate of profile %s: %v", p.ServerName, err)
+			}
+			config.Certificates = append([]tls.Certificate{cert}, config.Certificates...)
+		}
+	}
+
+	if c.ClientCAFile != "" {
+		pool, err := loadCertPool(c.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	listenAddr := fmt.Sprintf("0.0.0.0:%d", c.ListenPort)
+	l, err := tls.Listen("tcp", listenAddr, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", listenAddr, err)
+	}
+	return l, nil
+}
+
+// connProfile complete the TLS handshake of conn and select the profile of
+// the presented server name, or return the tenant of a tenant listener
+// connection; nil for plain connections and unknown names.
+// ok is false when the connection must be closed.
+func (s *Forwarder) connProfile(conn net.Conn) (profile *accessProfile, ok bool) {
+	if pc, isProfile := conn.(*profileConn); isProfile {
+		return pc.profile, pc.profile.admit(conn, s.logger)
+	}
+	tlsConn, isTLS := conn.(*tls.Conn)
+	if !isTLS {
+		return nil, true
+	}
+
+	// connection deadlines are wall-clock time
+	tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+	if err := tlsConn.Handshake(); err != nil {
+		s.logger.Warnf("TLS handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return nil, false
+	}
+	tlsConn.SetDeadline(time.Time{})
+
+	name := tlsConn.ConnectionState().ServerName
+	if profile, exists := s.tlsProfiles[name]; exists {
+		s.logger.Debugf("upstream connection from %s uses TLS profile %s", conn.RemoteAddr(), name)
+		return profile, true
+	}
+	if s.config.TLS.RequireProfile {
+		s.logger.Warnf("upstream connection from %s rejected, no TLS profile for server name %q", conn.RemoteAddr(), name)
+		return nil, false
+	}
+	return nil, true
+}
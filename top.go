@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// terminal control sequences of the top dashboard
+const (
+	ansiAltScreen  = "\x1b[?1049h\x1b[?25l" // switch to the alternate screen, hide the cursor
+	ansiMainScreen = "\x1b[?25h\x1b[?1049l" // show the cursor, back to the main screen
+	ansiHome       = "\x1b[H\x1b[2J"        // clear the screen
+	ansiBold       = "\x1b[1m"
+	ansiRed        = "\x1b[31m"
+	ansiGreen      = "\x1b[32m"
+	ansiYellow     = "\x1b[33m"
+	ansiReset      = "\x1b[0m"
+)
+
+// topSample one status poll of the top dashboard
+type topSample struct {
+	time   time.Time
+	status forwarderStatus
+}
+
+// fetchStatus GET /api/status of a running forwarder
+func fetchStatus(endpoint, token, user string) (forwarderStatus, error) {
+	var status forwarderStatus
+	resp, err := adminRequest("GET", endpoint, nil, token, user)
+	if err != nil {
+		return status, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return status, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return status, fmt.Errorf("invalid status response: %v", err)
+	}
+	return status, nil
+}
+
+// renderTop write one frame of the dashboard, rates are computed against
+// prev which is nil for the first frame
+func renderTop(w io.Writer, admin string, interval time.Duration, cur *topSample, prev *topSample, fetchErr error) {
+	var b strings.Builder
+	b.WriteString(ansiHome)
+	fmt.Fprintf(&b, "%s%s%s  up %s  %s  every %s  %s\n", ansiBold, cur.status.Version, ansiReset,
+		(time.Duration(cur.status.Uptime) * time.Second).String(), admin, interval, cur.time.Format("15:04:05"))
+	if fetchErr != nil {
+		fmt.Fprintf(&b, "%s%v%s\n", ansiRed, fetchErr, ansiReset)
+	} else {
+		b.WriteString("\n")
+	}
+
+	prevSlaves := make(map[int]slaveStatus)
+	var elapsed float64
+	if prev != nil {
+		for _, slave := range prev.status.Slaves {
+			prevSlaves[slave.SlaveID] = slave
+		}
+		elapsed = cur.time.Sub(prev.time).Seconds()
+	}
+
+	fmt.Fprintf(&b, "%s%5s  %-8s  %-21s  %6s  %7s  %7s  %8s  %9s  %7s  %6s  %5s  %s%s\n", ansiBold,
+		"SLAVE", "STATE", "TARGET", "HEALTH", "REQ/S", "ERR/S", "LATENCY", "REQUESTS", "ERRORS", "RECONN", "QUEUE", "LAST ERROR", ansiReset)
+	for _, slave := range cur.status.Slaves {
+		reqRate, errRate, latency := "-", "-", "-"
+		if p, ok := prevSlaves[slave.SlaveID]; ok && elapsed > 0 && slave.Requests >= p.Requests {
+			requests := slave.Requests - p.Requests
+			reqRate = fmt.Sprintf("%.1f", float64(requests)/elapsed)
+			errRate = fmt.Sprintf("%.1f", float64(slave.Errors-p.Errors)/elapsed)
+			if requests > 0 {
+				// mean latency of the transactions since the last frame
+				mean := time.Duration((slave.BusySeconds - p.BusySeconds) / float64(requests) * float64(time.Second))
+				latency = mean.Round(100 * time.Microsecond).String()
+			}
+		}
+		color := ""
+		switch slave.State {
+		case "up":
+			color = ansiGreen
+		case "down":
+			color = ansiRed
+		case "disabled":
+			color = ansiYellow
+		}
+		fmt.Fprintf(&b, "%5d  %s%-8s%s  %-21s  %6.3f  %7s  %7s  %8s  %9d  %7d  %6d  %5d  %s\n",
+			slave.SlaveID, color, slave.State, ansiReset, truncate(slave.Target, 21), slave.HealthScore, reqRate, errRate, latency,
+			slave.Requests, slave.Errors, slave.Reconnects, slave.QueueDepth, truncate(slave.LastError, 60))
+	}
+	b.WriteString("\nCtrl+C to quit\n")
+	io.WriteString(w, b.String())
+}
+
+// truncate shorten s to n characters
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n-1] + "~"
+}
+
+// runTop live dashboard of a running forwarder in the terminal, return the
+// exit code
+func runTop(args []string) int {
+	fs := flag.NewFlagSet("top", flag.ExitOnError)
+	admin := fs.String("admin", "http://127.0.0.1:8080", "admin API URL of the forwarder")
+	interval := fs.Duration("interval", time.Second, "refresh interval")
+	token := fs.String("token", os.Getenv("MBF_ADMIN_TOKEN"), "admin API bearer token, default $MBF_ADMIN_TOKEN")
+	user := fs.String("user", "", "admin API basic auth credentials as user:password")
+	fs.Parse(args)
+	if fs.NArg() > 0 || *interval <= 0 {
+		fs.Usage()
+		return 2
+	}
+	endpoint := strings.TrimSuffix(*admin, "/") + "/api/status"
+
+	// fail before taking over the screen when the forwarder is unreachable
+	status, err := fetchStatus(endpoint, *token, *user)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to get status: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	fmt.Print(ansiAltScreen)
+	defer fmt.Print(ansiMainScreen)
+
+	cur := &topSample{time: time.Now(), status: status}
+	var prev *topSample
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	for {
+		renderTop(os.Stdout, *admin, *interval, cur, prev, err)
+		select {
+		case <-ctx.Done():
+			return 0
+		case <-ticker.C:
+		}
+		status, err = fetchStatus(endpoint, *token, *user)
+		if err != nil {
+			// keep showing the last values with the error
+			continue
+		}
+		prev, cur = cur, &topSample{time: time.Now(), status: status}
+	}
+}
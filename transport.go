@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/goburrow/modbus"
+)
+
+const (
+	tcpHeaderSize  = 7
+	tcpMaxLength   = 260
+	tcpIdleTimeout = 60 * time.Second
+)
+
+// transport downstream transporter owning a connection
+type transport interface {
+	modbus.Transporter
+	Connect() error
+	Close() error
+}
+
+// tcpTransport modbus TCP transporter dialing through a Dialer
+type tcpTransport struct {
+	address     string
+	timeout     time.Duration
+	idleTimeout time.Duration
+	timeouts    timeoutRules // per range timeouts overriding timeout
+	dialer      Dialer
+	logger      *log.Logger
+	clock       Clock // time of the idle timeout
+
+	mu           sync.Mutex
+	conn         net.Conn
+	lastActivity time.Time
+}
+
+// newTCPTransport create TCP transporter for address
+func newTCPTransport(address string, timeout time.Duration, dialer Dialer, logger *log.Logger) *tcpTransport {
+	return &tcpTransport{
+		address:     address,
+		timeout:     timeout,
+		idleTimeout: tcpIdleTimeout,
+		dialer:      dialer,
+		logger:      logger,
+		clock:       systemClock{},
+	}
+}
+
+// Send send request ADU and read the response ADU
+func (t *tcpTransport) Send(aduRequest []byte) (aduResponse []byte, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err = t.connect(); err != nil {
+		return nil, err
+	}
+	t.lastActivity = t.clock.Now()
+
+	// connection deadlines are wall-clock time
+	var deadline time.Time
+	if len(aduRequest) > tcpHeaderSize {
+		if timeout := t.timeouts.timeout(aduRequest[tcpHeaderSize:], t.timeout); timeout > 0 {
+			deadline = time.Now().Add(timeout)
+		}
+	}
+	if err = t.conn.SetDeadline(deadline); err != nil {
+		t.close()
+		return nil, err
+	}
+
+	t.logf("modbus: sending % x", aduRequest)
+	if _, err = t.conn.Write(aduRequest); err != nil {
+		t.close()
+		return nil, err
+	}
+
+	var data [tcpMaxLength]byte
+	if _, err = io.ReadFull(t.conn, data[:tcpHeaderSize]); err != nil {
+		t.close()
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint16(data[4:]))
+	if length <= 0 || length > tcpMaxLength-tcpHeaderSize+1 {
+		// stream is out of sync, start over with a new connection
+		t.close()
+		return nil, fmt.Errorf("modbus: invalid length %d in response header", length)
+	}
+	length += tcpHeaderSize - 1
+	if _, err = io.ReadFull(t.conn, data[tcpHeaderSize:length]); err != nil {
+		t.close()
+		return nil, err
+	}
+	aduResponse = append([]byte(nil), data[:length]...)
+	t.logf("modbus: received % x", aduResponse)
+	return aduResponse, nil
+}
+
+// Connect establish the connection ahead of the first request
+func (t *tcpTransport) Connect() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.connect()
+}
+
+// Close close current connection
+func (t *tcpTransport) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.close()
+}
+
+// connect dial a new connection if not connected, caller must hold the mutex
+func (t *tcpTransport) connect() error {
+	if t.conn != nil {
+		return nil
+	}
+	ctx := context.Background()
+	if t.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.timeout)
+		defer cancel()
+	}
+	conn, err := t.dialer.DialContext(ctx, "tcp", t.address)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+	t.lastActivity = t.clock.Now()
+	if t.idleTimeout > 0 {
+		go t.closeIdle(conn)
+	}
+	return nil
+}
+
+// close close current connection, caller must hold the mutex
+func (t *tcpTransport) close() (err error) {
+	if t.conn != nil {
+		err = t.conn.Close()
+		t.conn = nil
+	}
+	return err
+}
+
+// closeIdle close conn once it has been idle for idleTimeout, returns when
+// conn is closed or replaced
+func (t *tcpTransport) closeIdle(conn net.Conn) {
+	wait := t.idleTimeout
+	for {
+		<-t.clock.After(wait)
+		t.mu.Lock()
+		if t.conn != conn {
+			t.mu.Unlock()
+			return
+		}
+		idle := t.clock.Now().Sub(t.lastActivity)
+		if idle >= t.idleTimeout {
+			t.logf("modbus: closing connection due to idle timeout: %v", idle)
+			t.close()
+			t.mu.Unlock()
+			return
+		}
+		t.mu.Unlock()
+		wait = t.idleTimeout - idle
+	}
+}
+
+func (t *tcpTransport) logf(format string, v ...any) {
+	if t.logger != nil {
+		t.logger.Printf(format, v...)
+	}
+}
+
+// queueTransport count the requests waiting for or in a downstream transaction
+type queueTransport struct {
+	transport
+	queued *atomic.Int32
+}
+
+// Send send request ADU and read the response ADU
+func (t *queueTransport) Send(aduRequest []byte) ([]byte, error) {
+	t.queued.Add(1)
+	defer t.queued.Add(-1)
+	return t.transport.Send(aduRequest)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"sync"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// unitRoutes map the upstream unit IDs of servers, their aliases and unit
+// IDs 0 and 255 when forwarded to a server, to the server slaveID
+func unitRoutes(config *Config) map[byte]byte {
+	units := make(map[byte]byte)
+	for slaveID, server := range config.Servers {
+		units[slaveID] = slaveID
+		for _, alias := range server.Aliases {
+			units[byte(alias)] = slaveID
+		}
+	}
+	if config.Unit0.Policy == "forward" {
+		units[0] = byte(config.Unit0.Target)
+	}
+	if config.Unit255.Policy == "forward" {
+		units[255] = byte(config.Unit255.Target)
+	}
+	return units
+}
+
+// isBroadcast report whether requests to unit are broadcast to all slaves
+func (s *Forwarder) isBroadcast(unit byte) bool {
+	return (unit == 0 && s.config.Unit0.Policy == "broadcast") ||
+		(unit == 255 && s.config.Unit255.Policy == "broadcast")
+}
+
+// broadcastQueueSize broadcasts waiting for the previous ones to reach the
+// slaves
+const broadcastQueueSize = 16
+
+// broadcastWrite broadcast write waiting for the slaves
+type broadcastWrite struct {
+	frame  mbserver.Framer
+	client string // upstream client of the broadcast
+}
+
+// broadcast queue a write request of client for every enabled slave, the
+// upstream master gets no response and does not wait for the slaves.
+// Broadcast reads are dropped.
+func (s *Forwarder) broadcast(frame mbserver.Framer, client string) {
+	function := frame.GetFunction()
+	if s.handlers[function] == nil || !isWriteFunction(function) {
+		s.logger.Warnf("dropped broadcast request with function %d, only writes can be broadcast", function)
+		return
+	}
+	s.broadcastOnce.Do(func() {
+		s.broadcasts = make(chan broadcastWrite, broadcastQueueSize)
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			for {
+				select {
+				case <-s.ctx.Done():
+					return
+				case b := <-s.broadcasts:
+					s.fanOut(b.frame, b.client)
+				}
+			}
+		}()
+	})
+	select {
+	case s.broadcasts <- broadcastWrite{frame: frame.Copy(), client: client}:
+	default:
+		s.logger.Warnf("dropped broadcast request with function %d, %d broadcasts are waiting", function, broadcastQueueSize)
+	}
+}
+
+// fanOut forward a broadcast write of client to every enabled slave at once,
+// the responses are discarded; broadcasts reach the slaves in order, the next
+// one starts when every slave has answered or failed. Each slave gets the
+// write like a unicast write, the whole broadcast is dropped when the write
+// schedule or the write rules of any slave reject it.
+func (s *Forwarder) fanOut(frame mbserver.Framer, client string) {
+	function := frame.GetFunction()
+	handler := s.handlers[function]
+	s.clientsMux.RLock()
+	slaveIDs := make([]byte, 0, len(s.clients))
+	for slaveID, c := range s.clients {
+		if !c.disabled.Load() && s.functionAllowed(slaveID, function) {
+			slaveIDs = append(slaveIDs, slaveID)
+		}
+	}
+	s.clientsMux.RUnlock()
+
+	routed := make([]mbserver.Framer, len(slaveIDs))
+	checked := make([]mbserver.Framer, len(slaveIDs))
+	for i, slaveID := range slaveIDs {
+		routed[i] = routeFrame(frame, slaveID)
+		exception := s.checkWriteSchedule(slaveID, client, routed[i])
+		if exception == nil {
+			checked[i], exception = s.checkRequest(routed[i], slaveID, client)
+		}
+		if exception != nil {
+			s.logger.Warnf("dropped broadcast request with function %d from %s, rejected for slave %d: %v", function, client, slaveID, exception)
+			return
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i, slaveID := range slaveIDs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, exception := s.forward(handler, routed[i], checked[i], slaveID, client); exception != &mbserver.Success {
+				s.logger.Warnf("broadcast to slave %d failed: %v", slaveID, exception)
+			}
+		}()
+	}
+	wg.Wait()
+}
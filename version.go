@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// build information, injected at build time with
+// -ldflags "-X main.version=... -X main.gitCommit=... -X main.buildDate=..."
+var (
+	version   string = "dev"
+	gitCommit string = ""
+	buildDate string = ""
+)
+
+// buildInfo return build information, falling back to the vcs stamp
+// embedded by the go toolchain when not injected at build time
+func buildInfo() (ver, commit, date string) {
+	ver, commit, date = version, gitCommit, buildDate
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if date == "" {
+					date = setting.Value
+				}
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return ver, commit, date
+}
+
+// versionString return one line version description
+func versionString() string {
+	ver, commit, date := buildInfo()
+	return fmt.Sprintf("mb-forwarder %s (commit %s, built %s, %s %s/%s)",
+		ver, commit, date, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
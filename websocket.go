@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// wsConn MBAP stream over a WebSocket connection, each binary message
+// carries one or more complete ADUs
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader // current message
+}
+
+// Read read from the current binary message, moving to the next at its end
+func (c *wsConn) Read(p []byte) (int, error) {
+	for {
+		if c.reader == nil {
+			typ, r, err := c.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if typ != websocket.BinaryMessage {
+				continue
+			}
+			c.reader = r
+		}
+		n, err := c.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			c.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write send p as one binary message
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SetDeadline set read and write deadlines
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// wsDialer Dialer connecting to a WebSocket URL, for slaves with conn_type ws
+type wsDialer struct {
+	dialer Dialer
+}
+
+// DialContext dial the WebSocket URL address
+func (d wsDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	dialer := websocket.Dialer{
+		NetDialContext: d.dialer.DialContext,
+		Subprotocols:   []string{"modbus"},
+	}
+	conn, _, err := dialer.DialContext(ctx, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{Conn: conn}, nil
+}
+
+// checkOrigin allow upgrades without an Origin header, sent by browsers
+// only, from the same origin and from ws_allowed_origins; pages of other
+// sites must not reach the slaves through the browser of an operator
+func (s *Forwarder) checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	for _, allowed := range s.config.WSAllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	s.logger.Warnf("WebSocket upgrade from %s rejected, origin %s is not allowed", r.RemoteAddr, origin)
+	return false
+}
+
+// wsProfile authenticate a WebSocket upgrade with ws_auth and return the
+// profile of its connection, nil for the default routing; ok is false when
+// the upgrade was answered with an error
+func (s *Forwarder) wsProfile(w http.ResponseWriter, r *http.Request) (profile *accessProfile, ok bool) {
+	profile = s.wsAccess
+	if !s.config.WSAuth {
+		return profile, true
+	}
+	auth := s.config.AdminAuth
+	id := authIdentity(auth, r)
+	if id == nil {
+		s.logger.Warnf("WebSocket upgrade from %s rejected, authentication required", r.RemoteAddr)
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"error": "authentication required"})
+		return nil, false
+	}
+	if !roleAllows(auth, id.role, capRead) {
+		s.logger.Warnf("WebSocket upgrade from %s denied to %s, role %s lacks %s", r.RemoteAddr, id.name, id.role, capRead)
+		writeJSON(w, http.StatusForbidden, map[string]string{"error": capRead + " access required"})
+		return nil, false
+	}
+	s.logger.Infof("WebSocket connection from %s authenticated as %s (%s)", r.RemoteAddr, id.name, id.role)
+	if !roleAllows(auth, id.role, capWrite) {
+		return s.wsReadOnly, true
+	}
+	return profile, true
+}
+
+// newWSProfiles create the profiles of the WebSocket connections: with
+// ws_units or ws_read_only, and the read-only one of ws_auth identities
+// without the write capability
+func (s *Forwarder) newWSProfiles() {
+	c := s.config
+	if len(c.WSUnits) > 0 || c.WSReadOnly {
+		s.wsAccess = &accessProfile{kind: "WebSocket listener", name: c.WSListen, readOnly: c.WSReadOnly}
+		if len(c.WSUnits) > 0 {
+			s.wsAccess.units = c.WSUnits
+		}
+	}
+	if c.WSAuth {
+		s.wsReadOnly = &accessProfile{kind: "WebSocket listener", name: c.WSListen + " (read only)", readOnly: true}
+		if len(c.WSUnits) > 0 {
+			s.wsReadOnly.units = c.WSUnits
+		}
+	}
+}
+
+// startWebSocket start accepting upstream MBAP over WebSocket when ws_listen is configured
+func (s *Forwarder) startWebSocket() error {
+	if s.config.WSListen == "" {
+		return nil
+	}
+	s.newWSProfiles()
+	for _, server := range s.config.Servers {
+		if len(server.Tags) > 0 {
+			s.tagEvents = newWSHub()
+			break
+		}
+	}
+
+	l, err := net.Listen("tcp", s.config.WSListen)
+	if err != nil {
+		return fmt.Errorf("failed to listen on WebSocket address %s: %v", s.config.WSListen, err)
+	}
+	s.ws = &http.Server{
+		Handler:           s.wsHandler(),
+		ReadHeaderTimeout: 5 * time.Second,
+		ErrorLog:          s.logger.stdLogger(LevelWarn),
+	}
+	s.logger.Infof("modbus forwarder listening on ws://%s%s", l.Addr(), s.config.WSPath)
+	if s.tagEvents != nil {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.publishTagEvents(time.Duration(s.config.WSValuesInterval) * time.Millisecond)
+		}()
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.ws.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.logger.Errorf("WebSocket listener stopped: %v", err)
+			s.fail(fmt.Errorf("WebSocket listener: %v", err))
+			s.cancel()
+		}
+	}()
+	return nil
+}
+
+// wsHandler handler of the WebSocket endpoints of ws_listen
+func (s *Forwarder) wsHandler() http.Handler {
+	upgrader := websocket.Upgrader{
+		Subprotocols: []string{"modbus"},
+		CheckOrigin:  s.checkOrigin,
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+s.config.WSPath, func(w http.ResponseWriter, r *http.Request) {
+		profile, ok := s.wsProfile(w, r)
+		if !ok {
+			return
+		}
+		if !s.addWorker() {
+			http.Error(w, "forwarder is stopping", http.StatusServiceUnavailable)
+			return
+		}
+		defer s.wg.Done()
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			s.logger.Warnf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+			return
+		}
+		var conn net.Conn = &wsConn{Conn: ws}
+		if profile != nil {
+			profile.active.Add(1)
+			conn = &profileConn{Conn: conn, profile: profile}
+		}
+		s.serveConn(conn)
+	})
+
+	if s.tagEvents != nil {
+		mux.HandleFunc("GET "+s.config.WSValuesPath, func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := s.wsProfile(w, r); !ok {
+				return
+			}
+			if !s.addWorker() {
+				http.Error(w, "forwarder is stopping", http.StatusServiceUnavailable)
+				return
+			}
+			defer s.wg.Done()
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				s.logger.Warnf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+				return
+			}
+			s.serveEvents(conn, s.tagEvents)
+		})
+	}
+
+	if s.sniffs != nil {
+		mux.HandleFunc("GET "+s.config.SniffPath, func(w http.ResponseWriter, r *http.Request) {
+			if _, ok := s.wsProfile(w, r); !ok {
+				return
+			}
+			if !s.addWorker() {
+				http.Error(w, "forwarder is stopping", http.StatusServiceUnavailable)
+				return
+			}
+			defer s.wg.Done()
+			conn, err := upgrader.Upgrade(w, r, nil)
+			if err != nil {
+				s.logger.Warnf("WebSocket upgrade from %s failed: %v", r.RemoteAddr, err)
+				return
+			}
+			s.serveEvents(conn, s.sniffs)
+		})
+	}
+	return mux
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"time"
+)
+
+// writeAuditEntry one write of coils or holding registers in the write
+// audit file, a change history of the setpoints of a slave
+type writeAuditEntry struct {
+	Time     string `json:"time"`
+	Slave    byte   `json:"slave"`
+	Function uint8  `json:"function"`
+	Type     string `json:"type"` // "coils" or "holding"
+	Address  int    `json:"address"`
+	Before   []int  `json:"before,omitempty"` // polled or read before the write, missing when unknown
+	Written  []int  `json:"written"`
+	After    []int  `json:"after,omitempty"`    // read back with verify_writes
+	Mismatch bool   `json:"mismatch,omitempty"` // the values read back differ from the written ones
+}
+
+// auditValues unpack quantity coils or holding registers
+func auditValues(function uint8, data []byte, quantity int) []int {
+	if data == nil {
+		return nil
+	}
+	values := make([]int, 0, quantity)
+	for i := 0; i < quantity; i++ {
+		if function == 1 {
+			if i/8 >= len(data) {
+				break
+			}
+			values = append(values, int(data[i/8]>>(i%8)&1))
+		} else {
+			if 2*i+1 >= len(data) {
+				break
+			}
+			values = append(values, int(data[2*i])<<8|int(data[2*i+1]))
+		}
+	}
+	return values
+}
+
+// beforeWrite values of the coils (function 1) or holding registers
+// (function 3) about to be written, for the write audit file: the polled
+// values, or with verify_writes read from the slave; nil when unknown
+func (s *Forwarder) beforeWrite(client *modbusClient, slaveID byte, function uint8, address, quantity int) []byte {
+	if client.writeAudit == nil {
+		return nil
+	}
+	if client.shadow != nil {
+		if data, err := client.shadow.read(function, address, quantity); err == nil {
+			return data
+		}
+	}
+	if !client.verifyWrites {
+		return nil
+	}
+	data, err := s.readDirect(client, slaveID, function, address, quantity)
+	if err != nil {
+		s.logger.Debugf("failed to read slave %d before write (function %d, addr %d, count %d): %v", slaveID, function, address, quantity, err)
+		return nil
+	}
+	return data
+}
+
+// afterWrite read a successful write back with verify_writes and record it
+// in the write audit file
+func (s *Forwarder) afterWrite(client *modbusClient, slaveID byte, write uint8, function uint8, address, quantity int, before, data []byte) {
+	if !client.verifyWrites && client.writeAudit == nil {
+		return
+	}
+	written := auditValues(function, data, quantity)
+	var after []int
+	mismatch := false
+	if client.verifyWrites {
+		results, err := s.readDirect(client, slaveID, function, address, quantity)
+		if err != nil {
+			s.logger.Warnf("failed to verify write to slave %d (function %d, addr %d, count %d): %v", slaveID, write, address, quantity, err)
+		} else {
+			after = auditValues(function, results, quantity)
+			if mismatch = !slices.Equal(after, written); mismatch {
+				s.logger.Warnf("write to slave %d not verified (function %d, addr %d, count %d): wrote %v, read back %v", slaveID, write, address, quantity, written, after)
+			}
+		}
+	}
+	if client.writeAudit == nil {
+		return
+	}
+
+	typ := "holding"
+	if function == 1 {
+		typ = "coils"
+	}
+	msg, err := json.Marshal(writeAuditEntry{
+		Time:     s.clock.Now().UTC().Format(time.RFC3339Nano),
+		Slave:    slaveID,
+		Function: write,
+		Type:     typ,
+		Address:  address,
+		Before:   auditValues(function, before, quantity),
+		Written:  written,
+		After:    after,
+		Mismatch: mismatch,
+	})
+	if err != nil {
+		return
+	}
+	if err := client.writeAudit.write(msg); err != nil {
+		s.logger.Errorf("write audit: %v", err)
+	}
+}
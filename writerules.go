@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// checkWriteValues check the values of a single or multiple register write
+// (FC 6/16/23) against the write rules of the slave, return the request data
+// with clamped values, nil when unchanged
+func (s *Forwarder) checkWriteValues(slaveID byte, client string, frame mbserver.Framer) ([]byte, *mbserver.Exception) {
+	function := frame.GetFunction()
+	if function != 6 && function != 16 && function != 23 {
+		return nil, nil
+	}
+	s.clientsMux.RLock()
+	c := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	if c == nil || len(c.writeRules) == 0 {
+		return nil, nil
+	}
+
+	data := frame.GetData()
+	var address, quantity int
+	var values []byte // register values of data
+	switch {
+	case function == 6 && len(data) >= 4:
+		address, quantity, values = int(binary.BigEndian.Uint16(data)), 1, data[2:4]
+	case function == 16 && len(data) >= 5:
+		address, quantity, values = int(binary.BigEndian.Uint16(data)), int(binary.BigEndian.Uint16(data[2:])), data[5:]
+	case function == 23 && len(data) >= 9:
+		address, quantity, values = int(binary.BigEndian.Uint16(data[4:])), int(binary.BigEndian.Uint16(data[6:])), data[9:]
+	default:
+		// malformed, rejected by the handler
+		return nil, nil
+	}
+
+	var clamped []byte
+	for i := 0; i < quantity && i*2+1 < len(values); i++ {
+		register := address + i
+		for _, rule := range c.writeRules {
+			if register < rule.Address || register >= rule.Address+rule.Quantity {
+				continue
+			}
+			raw := binary.BigEndian.Uint16(values[i*2:])
+			value := int(raw)
+			if rule.Signed {
+				value = int(int16(raw))
+			}
+			if rule.valid(value) {
+				continue
+			}
+			if !rule.Clamp {
+				s.logger.Warnf("write from %s to slave %d register %d value %d violates the write rules, rejected",
+					client, slaveID, register, value)
+				s.writeDenied(slaveID, client, function, data, "write_rules")
+				return nil, &mbserver.IllegalDataValue
+			}
+			if clamped == nil {
+				clamped = slices.Clone(data)
+			}
+			limit := rule.clamp(value)
+			s.logger.Warnf("write from %s to slave %d register %d value %d clamped to %d", client, slaveID, register, value, limit)
+			offset := len(data) - len(values) + i*2
+			binary.BigEndian.PutUint16(clamped[offset:], uint16(limit))
+		}
+	}
+	return clamped, nil
+}
+
+// checkMaskWrite check the result of a mask write (FC 22) of address against
+// the write rules of the slave, reading the current value from the slave;
+// results breaking a rule are rejected, never clamped
+func (s *Forwarder) checkMaskWrite(client *modbusClient, slaveID byte, address int, andMask, orMask uint16) *mbserver.Exception {
+	var rules []WriteRule
+	for _, rule := range client.writeRules {
+		if address >= rule.Address && address < rule.Address+rule.Quantity {
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil
+	}
+	current, err := s.readOnce(client, slaveID, 3, address, 1)
+	if err == nil && len(current) < 2 {
+		err = fmt.Errorf("invalid read response")
+	}
+	if err != nil {
+		s.logger.Errorf("failed to read register %d of slave %d before the mask write: %v", address, slaveID, err)
+		return errorException(err)
+	}
+
+	raw := binary.BigEndian.Uint16(current)&andMask | orMask&^andMask
+	for _, rule := range rules {
+		value := int(raw)
+		if rule.Signed {
+			value = int(int16(raw))
+		}
+		if !rule.valid(value) {
+			s.logger.Warnf("mask write to slave %d register %d results in value %d, violates the write rules, rejected",
+				slaveID, address, value)
+			s.emitHook(hookEvent{Event: hookWriteDenied, Slave: slaveID, Function: 22, Address: &address, Quantity: 1, Reason: "write_rules"})
+			return &mbserver.IllegalDataValue
+		}
+	}
+	return nil
+}
+
+// valid report whether value satisfies the rule
+func (r WriteRule) valid(value int) bool {
+	if len(r.Values) > 0 {
+		return slices.Contains(r.Values, value)
+	}
+	return (r.Min == nil || value >= *r.Min) && (r.Max == nil || value <= *r.Max)
+}
+
+// clamp return value limited to the rule min and max
+func (r WriteRule) clamp(value int) int {
+	if r.Min != nil && value < *r.Min {
+		return *r.Min
+	}
+	if r.Max != nil && value > *r.Max {
+		return *r.Max
+	}
+	return value
+}
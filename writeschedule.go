@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/tbrandon/mbserver"
+)
+
+// cronField allowed values of one cron field, bit n is value n
+type cronField uint64
+
+// cronExpr cron-style expression matching minutes:
+// minute hour day-of-month month day-of-week
+type cronExpr struct {
+	minute, hour, day, month, weekday cronField
+	anyDay, anyWeekday                bool // field is *, for the cron day matching rule
+}
+
+// cron field bounds and value names
+var (
+	cronMonths   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parse a cron expression with five fields, each a list of *,
+// values or ranges with optional steps, e.g. "*/15 6-21 * * mon-fri"
+func parseCron(expr string) (cronExpr, error) {
+	var c cronExpr
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return c, fmt.Errorf("invalid cron expression %q: must have 5 fields", expr)
+	}
+	var err error
+	if c.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return c, fmt.Errorf("invalid cron expression %q: minute: %v", expr, err)
+	}
+	if c.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return c, fmt.Errorf("invalid cron expression %q: hour: %v", expr, err)
+	}
+	if c.day, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return c, fmt.Errorf("invalid cron expression %q: day of month: %v", expr, err)
+	}
+	if c.month, err = parseCronField(fields[3], 1, 12, cronMonths); err != nil {
+		return c, fmt.Errorf("invalid cron expression %q: month: %v", expr, err)
+	}
+	// 7 is sunday as well
+	if c.weekday, err = parseCronField(fields[4], 0, 7, cronWeekdays); err != nil {
+		return c, fmt.Errorf("invalid cron expression %q: day of week: %v", expr, err)
+	}
+	if c.weekday&(1<<7) != 0 {
+		c.weekday |= 1
+	}
+	c.anyDay = strings.HasPrefix(fields[2], "*")
+	c.anyWeekday = strings.HasPrefix(fields[4], "*")
+	return c, nil
+}
+
+// parseCronField parse a comma separated list of *, values and ranges, with
+// optional /step, between min and max
+func parseCronField(field string, min, max int, names []string) (cronField, error) {
+	var f cronField
+	for _, part := range strings.Split(field, ",") {
+		rng, stepText, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepText); err != nil || step < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepText)
+			}
+		}
+		lo, hi := min, max
+		if rng != "*" {
+			first, last, isRange := strings.Cut(rng, "-")
+			var err error
+			if lo, err = cronValue(first, min, max, names); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = cronValue(last, min, max, names); err != nil {
+					return 0, err
+				}
+				if hi == 0 && max == 7 {
+					// sunday ending a day of week range, e.g. "fri-sun"
+					hi = 7
+				}
+			} else if hasStep {
+				// "a/n" is a to max every n
+				hi = max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			f |= 1 << v
+		}
+	}
+	return f, nil
+}
+
+// cronValue parse a number or a name of names, between min and max
+func cronValue(text string, min, max int, names []string) (int, error) {
+	for i, name := range names {
+		if name != "" && strings.EqualFold(text, name) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(text)
+	if err != nil || v < min || v > max {
+		return 0, fmt.Errorf("invalid value %q, must be between %d-%d", text, min, max)
+	}
+	return v, nil
+}
+
+// matches report whether t falls in a minute matched by the expression, when
+// both day fields are restricted either may match, like cron
+func (c cronExpr) matches(t time.Time) bool {
+	if c.minute&(1<<t.Minute()) == 0 || c.hour&(1<<t.Hour()) == 0 || c.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	day := c.day&(1<<t.Day()) != 0
+	weekday := c.weekday&(1<<int(t.Weekday())) != 0
+	if c.anyDay || c.anyWeekday {
+		return day && weekday
+	}
+	return day || weekday
+}
+
+// writeSchedule times writes to one slave are allowed
+type writeSchedule struct {
+	allow     []cronExpr
+	location  *time.Location
+	exception *mbserver.Exception
+	audit     *captureFile // denied writes, nil when disabled
+}
+
+// writeDeniedEntry write rejected outside the write schedule in the audit file
+type writeDeniedEntry struct {
+	Time     string `json:"time"`
+	Slave    byte   `json:"slave"`
+	Client   string `json:"client"`
+	Function uint8  `json:"function"`
+	Address  int    `json:"address"`
+	Quantity int    `json:"quantity"`
+	Data     string `json:"data"` // request data, hex
+	Result   string `json:"result"`
+}
+
+func newWriteSchedule(config *WriteSchedule) (*writeSchedule, error) {
+	w := &writeSchedule{
+		allow:     config.Windows,
+		location:  config.Location,
+		exception: exceptionNames[config.Exception],
+	}
+	if config.AuditFile != "" {
+		audit, err := openCapture(config.AuditFile)
+		if err != nil {
+			return nil, err
+		}
+		w.audit = audit
+	}
+	return w, nil
+}
+
+// allowed report whether writes are allowed at t
+func (w *writeSchedule) allowed(t time.Time) bool {
+	t = t.In(w.location)
+	for _, c := range w.allow {
+		if c.matches(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWriteSchedule reject writes of client to a slave outside its write
+// schedule and record them in the audit file
+func (s *Forwarder) checkWriteSchedule(slaveID byte, client string, frame mbserver.Framer) *mbserver.Exception {
+	function := frame.GetFunction()
+	if !isWriteFunction(function) {
+		return nil
+	}
+	s.clientsMux.RLock()
+	c := s.clients[slaveID]
+	s.clientsMux.RUnlock()
+	if c == nil || c.schedule == nil {
+		return nil
+	}
+	now := s.clock.Now()
+	if c.schedule.allowed(now) {
+		return nil
+	}
+
+	_, address, quantity, _ := pduRange(append([]byte{function}, frame.GetData()...))
+	s.logger.Warnf("write from %s to slave %d (function %d, addr %d, count %d) is outside the write schedule, rejected",
+		client, slaveID, function, address, quantity)
+	s.writeDenied(slaveID, client, function, frame.GetData(), "write_schedule")
+	if c.schedule.audit != nil {
+		msg, err := json.Marshal(writeDeniedEntry{
+			Time:     now.UTC().Format(time.RFC3339Nano),
+			Slave:    slaveID,
+			Client:   client,
+			Function: function,
+			Address:  address,
+			Quantity: quantity,
+			Data:     hex.EncodeToString(frame.GetData()),
+			Result:   exceptionName(*c.schedule.exception),
+		})
+		if err == nil {
+			if err := c.schedule.audit.write(msg); err != nil {
+				s.logger.Errorf("write schedule audit: %v", err)
+			}
+		}
+	}
+	return c.schedule.exception
+}